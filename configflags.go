@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// configFlags holds the -watch-dir and -rule flags, which set up simple
+// cases without a config file
+type configFlags struct {
+	watchDirs []string
+	rules     []map[string]any
+}
+
+// addConfigFlags adds -watch-dir and -rule to a flag set
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{}
+	fs.Func("watch-dir", "Watch this directory too (repeatable, added to $"+fwatch.WatchDirEnv+")", func(dir string) error {
+		f.watchDirs = append(f.watchDirs, dir)
+		return nil
+	})
+	fs.Func("rule", "Move files with these extensions to a directory, as \".pdf,.docx=/path\" (repeatable, added to $"+fwatch.RulesEnv+")", func(value string) error {
+		rule, err := parseRuleFlag(value)
+		if err != nil {
+			return err
+		}
+		f.rules = append(f.rules, rule)
+		return nil
+	})
+	return f
+}
+
+// parseRuleFlag turns "EXT,EXT=DESTINATION" into a move rule
+func parseRuleFlag(value string) (map[string]any, error) {
+	exts, dest, ok := strings.Cut(value, "=")
+	if !ok || exts == "" || dest == "" {
+		return nil, fmt.Errorf("want extensions=destination, such as .pdf,.docx=/home/user/Documents")
+	}
+	var extensions []string
+	for _, ext := range strings.Split(exts, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			extensions = append(extensions, ext)
+		}
+	}
+	return map[string]any{"extensions": extensions, "destination": dest}, nil
+}
+
+// apply makes the flags take effect. Like -profile they go through the
+// environment, so configs reloaded later, and a sandboxed fwatch, have
+// them too; what the environment has already isn't added again.
+func (f *configFlags) apply() error {
+	if len(f.watchDirs) > 0 {
+		dirs := filepath.SplitList(os.Getenv(fwatch.WatchDirEnv))
+		for _, dir := range f.watchDirs {
+			if !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+		os.Setenv(fwatch.WatchDirEnv, strings.Join(dirs, string(os.PathListSeparator)))
+	}
+	if len(f.rules) > 0 {
+		var rules []json.RawMessage
+		if env := os.Getenv(fwatch.RulesEnv); env != "" {
+			if err := json.Unmarshal([]byte(env), &rules); err != nil {
+				return fmt.Errorf("parsing %s: %w", fwatch.RulesEnv, err)
+			}
+		}
+		for _, rule := range f.rules {
+			data, err := json.Marshal(rule)
+			if err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(rules, func(r json.RawMessage) bool { return string(r) == string(data) }) {
+				rules = append(rules, data)
+			}
+		}
+		data, err := json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		os.Setenv(fwatch.RulesEnv, string(data))
+	}
+	return nil
+}
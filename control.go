@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// controlShutdownTimeout bounds how long in-flight control requests may
+// delay shutdown
+const controlShutdownTimeout = 2 * time.Second
+
+// defaultControlSocket returns where the control socket is created unless
+// -control-socket says otherwise: in XDG_RUNTIME_DIR if set, or a per-user
+// directory in the temporary directory
+func defaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "fwatch.sock")
+	}
+	return filepath.Join(controlTempDir(), "fwatch.sock")
+}
+
+// controlTempDir is the directory of the control socket in the temporary
+// directory, which others could squat a socket name in
+func controlTempDir() string {
+	return filepath.Join(os.TempDir(), "fwatch-"+strconv.Itoa(os.Getuid()))
+}
+
+// controlStatus is the response to GET /status
+type controlStatus struct {
+	Version string `json:"version"`
+	PID     int    `json:"pid"`
+	Config  string `json:"config"`
+	Profile string `json:"profile,omitempty"`
+
+	// ConfigSHA256 is the digest of the config file and the files it
+	// includes as last loaded, and ConfigStale whether they have changed
+	// since, e.g. because a reload failed
+	ConfigSHA256 string       `json:"config_sha256"`
+	ConfigStale  bool         `json:"config_stale"`
+	Stats        fwatch.Stats `json:"stats"`
+}
+
+// loadedConfigDigest is the SHA-256 of the config file as last loaded
+var loadedConfigDigest atomic.Value
+
+// rememberConfig records the digest of the config that was loaded
+func rememberConfig(path string, config *fwatch.Config) {
+	digest, _ := configDigest(path, config.IncludedFiles())
+	loadedConfigDigest.Store(digest)
+}
+
+// configDigest returns the hex SHA-256 of the config file followed by the
+// files it includes
+func configDigest(path string, included []string) (string, error) {
+	h := sha256.New()
+	for _, file := range append([]string{path}, included...) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// controlRequest is the body of the POST endpoints that act on watches
+type controlRequest struct {
+	// Watches names the watch directories to act on; empty means all
+	Watches []string `json:"watches"`
+}
+
+// controlResponse is the body of every POST response
+type controlResponse struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Queued int    `json:"queued,omitempty"` // files queued by a rescan
+}
+
+// listenControl creates the control socket at path. A socket left behind
+// by a previous instance is replaced, but one that still accepts
+// connections belongs to a running instance and is left alone, and
+// anything else at path is refused rather than removed.
+func listenControl(path string) (net.Listener, error) {
+	// Another user could have created the directory first to put their
+	// own socket in it
+	if dir := filepath.Dir(path); dir == controlTempDir() {
+		if err := os.Mkdir(dir, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("creating control socket directory: %w", err)
+		}
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		if err := checkOwned(dir, info, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkControlSocket(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another instance", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale control socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// Anyone who can connect can pause fwatch or queue files
+	return listenPrivate(path)
+}
+
+// checkControlSocket returns an error unless path is a socket of the
+// current user, one matching fs.ErrNotExist if there is nothing there
+func checkControlSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+	return checkOwned(path, info, false)
+}
+
+// controlHandler answers control requests for engine. reload reloads the
+// config file.
+func controlHandler(configPath string, engine *fwatch.Engine, reload func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		loaded, _ := loadedConfigDigest.Load().(string)
+		current, _ := configDigest(configPath, engine.Config().IncludedFiles())
+		writeJSON(w, http.StatusOK, controlStatus{
+			Version:      version,
+			PID:          os.Getpid(),
+			Config:       configPath,
+			Profile:      engine.Config().Profile,
+			ConfigSHA256: loaded,
+			ConfigStale:  current != loaded,
+			Stats:        engine.Stats(),
+		})
+	})
+	mux.HandleFunc("POST /pause", watchHandler(func(req controlRequest) (int, error) {
+		return 0, engine.Pause(req.Watches...)
+	}))
+	mux.HandleFunc("POST /resume", watchHandler(func(req controlRequest) (int, error) {
+		return 0, engine.Resume(req.Watches...)
+	}))
+	mux.HandleFunc("POST /rescan", watchHandler(func(req controlRequest) (int, error) {
+		return engine.Rescan(req.Watches...)
+	}))
+	mux.HandleFunc("POST /reload", watchHandler(func(controlRequest) (int, error) {
+		slog.Info("Reloading config on control request", "config", configPath)
+		return 0, reload()
+	}))
+	return mux
+}
+
+// serveControl serves handler on the control socket listener until ctx is
+// cancelled
+func serveControl(ctx context.Context, listener net.Listener, handler http.Handler) {
+	slog.Info("Listening for control requests", "socket", listener.Addr().String())
+	if err := serveHTTP(ctx, listener, handler); err != nil {
+		slog.Error("Control socket failed", "socket", listener.Addr().String(), "error", err)
+	}
+}
+
+// serveHTTP serves handler on listener until ctx is cancelled, giving
+// requests under way controlShutdownTimeout to finish
+func serveHTTP(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), controlShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// watchHandler adapts an action on watches to an HTTP handler
+func watchHandler(action func(controlRequest) (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req controlRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, controlResponse{Error: "invalid request: " + err.Error()})
+				return
+			}
+		}
+		queued, err := action(req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, controlResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, controlResponse{OK: true, Queued: queued})
+	}
+}
+
+// writeJSON sends v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,98 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// socketDir returns a directory short enough for unix socket paths
+func socketDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestListenControl(t *testing.T) {
+	path := filepath.Join(socketDir(t), "fwatch.sock")
+	listener, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		t.Errorf("socket created with mode %o, want it closed to other users", perm)
+	}
+	if err := checkControlSocket(path); err != nil {
+		t.Errorf("checkControlSocket = %v", err)
+	}
+
+	// A socket that still answers belongs to a running instance
+	if _, err := listenControl(path); err == nil {
+		t.Error("listenControl took over a socket in use")
+	}
+
+	// One left behind is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenControl(path)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenControlRefusesOtherFiles(t *testing.T) {
+	path := filepath.Join(socketDir(t), "fwatch.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenControl(path); err == nil {
+		t.Error("listenControl accepted a regular file at the socket path")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file at the socket path removed: %v", err)
+	}
+	if err := checkControlSocket(path); err == nil {
+		t.Error("checkControlSocket accepted a regular file")
+	}
+}
+
+func TestListenControlTempDir(t *testing.T) {
+	t.Setenv("TMPDIR", socketDir(t))
+	t.Setenv("XDG_RUNTIME_DIR", "")
+
+	listener, err := listenControl(defaultControlSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	info, err := os.Lstat(controlTempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Errorf("socket directory has mode %o, want 700", perm)
+	}
+
+	// A directory others can write to could hold anyone's socket
+	os.Chmod(controlTempDir(), 0o777)
+	if _, err := listenControl(defaultControlSocket()); err == nil {
+		t.Error("listenControl used a directory open to other users")
+	}
+	os.RemoveAll(controlTempDir())
+	os.Symlink(t.TempDir(), controlTempDir())
+	if _, err := listenControl(defaultControlSocket()); err == nil {
+		t.Error("listenControl followed a symlink for its directory")
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenPrivate creates a unix socket at path that only the current user
+// can connect to. The socket is created with those permissions rather
+// than changed afterwards, which would leave a moment open to others.
+func listenPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0o077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+// checkOwned returns an error unless info belongs to the current user and,
+// with private set, is closed to everyone else
+func checkOwned(path string, info os.FileInfo, private bool) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user", path)
+	}
+	if private && info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s is accessible to other users", path)
+	}
+	return nil
+}
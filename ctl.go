@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// ctlTimeout bounds a single control request
+const ctlTimeout = 10 * time.Second
+
+// ctlCommands lists the commands "fwatch ctl" understands and whether they
+// take watch directories as arguments
+var ctlCommands = map[string]bool{
+	"status": false,
+	"stats":  false,
+	"pause":  true,
+	"resume": true,
+	"rescan": true,
+	"reload": false,
+}
+
+// runCtl implements "fwatch ctl": it sends a command to a running
+// instance over its control socket and returns the exit code
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket(), "Path to the control socket of the running instance")
+	asJSON := fs.Bool("json", false, "Print the raw JSON response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: fwatch ctl [flags] <command> [watch dir...]
+
+Control a running fwatch instance.
+
+Commands:
+  status           Show watches, queue and whether they are paused
+  stats            Show processing counters
+  pause [dir...]   Stop processing files in the given watches, or all
+  resume [dir...]  Process held files and continue watching
+  rescan [dir...]  Queue every file already in the given watches, or all
+  reload           Reload the configuration file
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	command, dirs := fs.Arg(0), fs.Args()[1:]
+	takesDirs, ok := ctlCommands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", command)
+		return 2
+	}
+	if !takesDirs && len(dirs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s takes no arguments\n", command)
+		return 2
+	}
+
+	client := controlClient(*socket)
+	var resp *http.Response
+	var err error
+	if command == "status" || command == "stats" {
+		resp, err = client.Get("http://fwatch/status")
+	} else {
+		// Watches are matched by their cleaned absolute path
+		req := controlRequest{}
+		for _, dir := range dirs {
+			if abs, err := filepath.Abs(dir); err == nil {
+				dir = abs
+			}
+			req.Watches = append(req.Watches, dir)
+		}
+		body, _ := json.Marshal(req)
+		resp, err = client.Post("http://fwatch/"+command, "application/json", bytes.NewReader(body))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v (is fwatch running?)\n", *socket, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *socket, err)
+		return 1
+	}
+	if *asJSON {
+		os.Stdout.Write(data)
+		if resp.StatusCode != http.StatusOK {
+			return 1
+		}
+		return 0
+	}
+
+	if command == "status" || command == "stats" {
+		var status controlStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid response: %v\n", *socket, err)
+			return 1
+		}
+		if command == "status" {
+			printStatus(&status)
+		} else {
+			printStats(&status)
+		}
+		return 0
+	}
+
+	var result controlResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid response: %v\n", *socket, err)
+		return 1
+	}
+	if !result.OK {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", command, result.Error)
+		return 1
+	}
+	if command == "rescan" {
+		fmt.Printf("Queued %d file(s)\n", result.Queued)
+	}
+	return 0
+}
+
+// runStatus implements "fwatch status", a shorthand for "fwatch ctl status"
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket(), "Path to the control socket of the running instance")
+	asJSON := fs.Bool("json", false, "Print the raw JSON response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: fwatch status [flags]
+
+Show the uptime, config, watches, queue, per-rule counts and latest errors
+of a running fwatch instance.
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	return runCtl([]string{"-socket", *socket, fmt.Sprintf("-json=%t", *asJSON), "status"})
+}
+
+// controlClient returns an HTTP client talking to the control socket
+func controlClient(socket string) *http.Client {
+	return &http.Client{
+		Timeout: ctlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				// Don't tell an impostor what to do, or believe its answers
+				if err := checkControlSocket(socket); err != nil {
+					return nil, err
+				}
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// printStatus prints the instance and its watches
+func printStatus(status *controlStatus) {
+	stats := &status.Stats
+	fmt.Printf("fwatch %s (PID %d), running for %s\n", status.Version, status.PID, time.Since(stats.Started).Round(time.Second))
+	config := status.Config
+	if status.ConfigSHA256 != "" {
+		config += fmt.Sprintf(" (sha256 %.12s)", status.ConfigSHA256)
+	}
+	if status.Profile != "" {
+		config += ", profile " + status.Profile
+	}
+	if status.ConfigStale {
+		config += ", changed on disk since it was loaded"
+	}
+	fmt.Printf("Config: %s\n", config)
+	queued := fmt.Sprint(stats.QueueDepth)
+	if stats.Spilled > 0 {
+		queued += fmt.Sprintf(" (+%d on disk)", stats.Spilled)
+	}
+	fmt.Printf("Queue: %d settling, %s queued, %d waiting for schedule, %d waiting to stop changing\n\n",
+		stats.Settling, queued, stats.Deferred, stats.Idle)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "WATCH\tBACKEND\tSTATE")
+	for _, watch := range stats.Watches {
+		state := "active"
+		if watch.Paused {
+			state = fmt.Sprintf("paused (%d held)", watch.Held)
+		}
+		if watch.Polled > 0 {
+			state += fmt.Sprintf(", %d directories polled past the watch limit", watch.Polled)
+		}
+		if watch.Health == fwatch.HealthDown {
+			state = fmt.Sprintf("down for %s, retrying in %s: %s", time.Since(watch.DownSince).Round(time.Second),
+				max(time.Until(watch.NextRetry), 0).Round(time.Second), watch.Error)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", watch.Path, watch.Backend, state)
+	}
+	w.Flush()
+
+	if len(stats.Rules) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RULE\tSUCCEEDED\tSKIPPED\tFAILED\tLAST")
+		for _, rule := range stats.Rules {
+			last := "never"
+			if !rule.Last.IsZero() {
+				last = time.Since(rule.Last).Round(time.Second).String() + " ago"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", rule.Name, rule.Succeeded, rule.Skipped, rule.Failed, last)
+		}
+		w.Flush()
+	}
+
+	if len(stats.Errors) > 0 {
+		fmt.Println("\nRecent errors:")
+		for _, e := range stats.Errors {
+			fmt.Printf("  %s  %s (rule %s, attempt %d): %s\n", e.Time.Format(time.DateTime), e.File, e.Rule, e.Attempt, e.Error)
+		}
+	}
+}
+
+// printStats prints the processing counters
+func printStats(status *controlStatus) {
+	stats := &status.Stats
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, row := range []struct {
+		name  string
+		value int64
+	}{
+		{"Debounced", stats.Debounced},
+		{"Enqueued", stats.Enqueued},
+		{"Coalesced", stats.Coalesced},
+		{"Processed", stats.Processed},
+		{"Succeeded", stats.Succeeded},
+		{"Skipped", stats.Skipped},
+		{"Failed", stats.Failed},
+		{"Settling", int64(stats.Settling)},
+		{"Queued", int64(stats.QueueDepth)},
+		{"Queued on disk", int64(stats.Spilled)},
+		{"Deferred", int64(stats.Deferred)},
+		{"Idle", int64(stats.Idle)},
+	} {
+		fmt.Fprintf(w, "%s\t%d\n", row.name, row.value)
+	}
+	w.Flush()
+}
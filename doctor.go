@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runDoctor implements "fwatch doctor": it probes whether the system is
+// ready for the configuration, prints every finding with what to do about
+// it and returns the exit code
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	quiet := fs.Bool("quiet", false, "Only print problems")
+	profile := profileFlag(fs)
+	overrides := addConfigFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch doctor [-config path] [-profile names] [-quiet]\n\nCheck that the watches, destinations and system limits are ready for a configuration.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	selectProfile(*profile)
+	if err := overrides.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		return 1
+	}
+
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	errors, warnings := 0, 0
+	for _, d := range config.Doctor() {
+		switch d.Severity {
+		case fwatch.SeverityError:
+			errors++
+		case fwatch.SeverityWarning:
+			warnings++
+		case fwatch.SeverityOK:
+			if *quiet {
+				continue
+			}
+		}
+		fmt.Println(d)
+	}
+
+	fmt.Printf("%d error(s), %d warning(s)\n", errors, warnings)
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// selfCheck logs the problems "fwatch doctor" would report, so they show
+// at startup rather than with the first file they break
+func selfCheck(config *fwatch.Config) {
+	for _, d := range config.Doctor() {
+		switch d.Severity {
+		case fwatch.SeverityError:
+			slog.Error("Self-check found a problem", "subject", d.Subject, "problem", d.Message, "fix", d.Fix)
+		case fwatch.SeverityWarning:
+			slog.Warn("Self-check found a problem", "subject", d.Subject, "problem", d.Message, "fix", d.Fix)
+		}
+	}
+}
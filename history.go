@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runHistory implements "fwatch history": it prints processed files from
+// the history database, optionally filtered, and returns the exit code
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	since := fs.String("since", "", "Only show files processed within this duration (e.g. 24h, 7d)")
+	rule := fs.String("rule", "", "Only show files matched by this rule")
+	failed := fs.Bool("failed", false, "Only show files that failed to process")
+	limit := fs.Int("limit", 0, "Show at most this many of the newest entries (0 for all)")
+	asJSON := fs.Bool("json", false, "Print one JSON record per line")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch history [flags] [name...]\n\nShow where files went. Names filter by a case-insensitive substring of the\nsource or destination path.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	if config.HistoryDB == "" {
+		fmt.Fprintf(os.Stderr, "%s: history is not enabled (set history_db)\n", *configPath)
+		return 1
+	}
+
+	filter := fwatch.HistoryFilter{Rule: *rule, Failed: *failed}
+	if *since != "" {
+		d, err := fwatch.ParseDuration(*since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -since: %v\n", err)
+			return 2
+		}
+		filter.Since = time.Now().Add(-time.Duration(d))
+	}
+
+	history, err := fwatch.OpenHistory(config.HistoryDB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.HistoryDB, err)
+		return 1
+	}
+
+	records, err := history.Query(filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.HistoryDB, err)
+		return 1
+	}
+	records = filterByName(records, fs.Args())
+	if *limit > 0 && len(records) > *limit {
+		records = records[len(records)-*limit:]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, rec := range records {
+			enc.Encode(rec)
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSTATUS\tRULE\tSOURCE\tRESULT")
+	for _, rec := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", rec.Time.Local().Format(time.DateTime), rec.Status, rec.Rule, rec.Source, describeOutcome(&rec))
+	}
+	w.Flush()
+	return 0
+}
+
+// filterByName keeps records whose source or destination contains one of
+// names, ignoring case. With no names every record is kept.
+func filterByName(records []fwatch.HistoryRecord, names []string) []fwatch.HistoryRecord {
+	if len(names) == 0 {
+		return records
+	}
+	var kept []fwatch.HistoryRecord
+	for _, rec := range records {
+		source, dest := strings.ToLower(rec.Source), strings.ToLower(rec.Destination)
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if strings.Contains(source, name) || strings.Contains(dest, name) {
+				kept = append(kept, rec)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// describeOutcome summarizes where a file went or why it didn't
+func describeOutcome(rec *fwatch.HistoryRecord) string {
+	switch {
+	case rec.Quarantined != "":
+		return "quarantined: " + rec.Quarantined
+	case rec.Error != "":
+		return rec.Error
+	case rec.Reason != "":
+		return rec.Reason
+	case rec.Destination != "":
+		return "→ " + rec.Destination
+	default:
+		return rec.Action
+	}
+}
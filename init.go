@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// initPreset is a group of file types "fwatch init" offers to sort into a
+// directory of their own
+type initPreset struct {
+	name       string
+	extensions []string
+	dir        string // destination, relative to the destination root
+}
+
+// initPresets are the rules "fwatch init" offers, in the order asked
+var initPresets = []initPreset{
+	{"images", []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".svg"}, "Pictures"},
+	{"documents", []string{".pdf", ".doc", ".docx", ".odt", ".rtf", ".txt", ".xls", ".xlsx", ".ods", ".ppt", ".pptx", ".odp", ".epub"}, "Documents"},
+	{"archives", []string{".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar"}, "Archives"},
+	{"videos", []string{".mp4", ".mkv", ".mov", ".avi", ".webm", ".m4v"}, "Videos"},
+}
+
+// runInit implements "fwatch init": it writes a starter configuration from
+// presets, asking for anything not given by flags when run in a terminal,
+// validates it and returns the exit code
+func runInit(args []string) int {
+	home, _ := os.UserHomeDir()
+
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path of the configuration file to write")
+	watchDir := fs.String("watch", "", "Directory to watch (default ~/Downloads)")
+	presets := fs.String("presets", "", "Comma-separated presets to include, \"all\" or \"none\" (default: ask, or all)")
+	destRoot := fs.String("dest-root", home, "Directory the preset destinations are created in")
+	force := fs.Bool("force", false, "Overwrite an existing configuration file")
+	fs.Usage = func() {
+		names := make([]string, len(initPresets))
+		for i, preset := range initPresets {
+			names[i] = preset.name
+		}
+		fmt.Fprintf(fs.Output(), "Usage: fwatch init [flags]\n\nWrite a starter configuration. Questions are asked for anything not given\nby flags when run in a terminal. Presets: %s.\n\n", strings.Join(names, ", "))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if ext := filepath.Ext(*configPath); ext != ".yaml" && ext != ".yml" {
+		fmt.Fprintf(os.Stderr, "%s: init writes YAML, use a .yaml or .yml path\n", *configPath)
+		return 2
+	}
+	if _, err := os.Stat(*configPath); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use -force to overwrite it\n", *configPath)
+		return 1
+	}
+
+	// Only ask when someone can answer
+	var in *bufio.Reader
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		in = bufio.NewReader(os.Stdin)
+	}
+
+	if *watchDir == "" {
+		*watchDir = filepath.Join(home, "Downloads")
+		if in != nil {
+			*watchDir = ask(in, "Directory to watch", *watchDir)
+		}
+	}
+	watch, err := filepath.Abs(expandHome(*watchDir, home))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *watchDir, err)
+		return 1
+	}
+	root := expandHome(*destRoot, home)
+	if _, err := os.Stat(watch); os.IsNotExist(err) && (in == nil || askYesNo(in, watch+" doesn't exist, create it?", true)) {
+		if err := os.MkdirAll(watch, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", watch, err)
+			return 1
+		}
+		fmt.Printf("Created %s\n", watch)
+	}
+
+	var chosen []initPreset
+	switch {
+	case *presets == "all" || (*presets == "" && in == nil):
+		chosen = initPresets
+	case *presets == "none":
+	case *presets != "":
+		for _, name := range strings.Split(*presets, ",") {
+			i := slices.IndexFunc(initPresets, func(p initPreset) bool { return p.name == strings.TrimSpace(name) })
+			if i == -1 {
+				fmt.Fprintf(os.Stderr, "Unknown preset %q\n", name)
+				return 2
+			}
+			chosen = append(chosen, initPresets[i])
+		}
+	default:
+		for _, preset := range initPresets {
+			question := fmt.Sprintf("Move %s (%s) to %s?", preset.name, strings.Join(preset.extensions[:3], ", ")+", ...", filepath.Join(root, preset.dir))
+			if askYesNo(in, question, true) {
+				chosen = append(chosen, preset)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*configPath), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	if err := os.WriteFile(*configPath, []byte(starterConfig(watch, root, chosen)), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	fmt.Printf("Wrote %s with %d rule(s)\n", *configPath, len(chosen))
+
+	// Check the result like "fwatch validate" would
+	config, err := fwatch.LoadConfigStrict(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	status := 0
+	for _, problem := range config.Check() {
+		fmt.Printf("%s: %s\n", *configPath, problem)
+		if problem.Severity == fwatch.SeverityError {
+			status = 1
+		}
+	}
+	if status == 0 {
+		fmt.Printf("Preview what it would do with \"fwatch test -all %s\", then start fwatch.\n", watch)
+	}
+	return status
+}
+
+// starterConfig returns the YAML for a configuration watching watch and
+// sorting files by the given presets into directories below root
+func starterConfig(watch, root string, presets []initPreset) string {
+	var b strings.Builder
+	b.WriteString("# fwatch configuration, generated by \"fwatch init\"\n")
+	b.WriteString("# See the README for all options; check changes with \"fwatch validate\"\n\n")
+	fmt.Fprintf(&b, "watches:\n  - path: %s\n\n", strconv.Quote(watch))
+	b.WriteString("# Create destination directories when they don't exist\ncreate_dirs: true\n\n")
+
+	if len(presets) == 0 {
+		b.WriteString("# Rules are evaluated in order; the first rule matching a file wins\nrules: []\n")
+		return b.String()
+	}
+	b.WriteString("# Rules are evaluated in order; the first rule matching a file wins\nrules:\n")
+	for _, preset := range presets {
+		quoted := make([]string, len(preset.extensions))
+		for i, ext := range preset.extensions {
+			quoted[i] = strconv.Quote(ext)
+		}
+		fmt.Fprintf(&b, "  - name: %s\n", strconv.Quote(preset.name))
+		fmt.Fprintf(&b, "    extensions: [%s]\n", strings.Join(quoted, ", "))
+		fmt.Fprintf(&b, "    destination: %s\n", strconv.Quote(filepath.Join(root, preset.dir)))
+	}
+	return b.String()
+}
+
+// ask prints a question and returns the answer, or def if it is empty
+func ask(in *bufio.Reader, question, def string) string {
+	fmt.Printf("%s [%s]: ", question, def)
+	line, _ := in.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+// askYesNo asks a yes/no question until it gets an answer it understands
+func askYesNo(in *bufio.Reader, question string, def bool) bool {
+	hint := "Y/n"
+	if !def {
+		hint = "y/N"
+	}
+	for {
+		fmt.Printf("%s [%s] ", question, hint)
+		line, err := in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			return def
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+		if err != nil {
+			return def
+		}
+	}
+}
+
+// expandHome replaces a leading ~ in path with the home directory
+func expandHome(path, home string) string {
+	if path == "~" {
+		return home
+	}
+	if rest, ok := strings.CutPrefix(path, "~"+string(filepath.Separator)); ok {
+		return filepath.Join(home, rest)
+	}
+	return path
+}
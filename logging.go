@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// setupLogging installs the default slog logger according to the log flags.
+// The returned closer must be called on exit to flush the log file, if any.
+func setupLogging(format, level, file string, maxSize fwatch.ByteSize, maxBackups int) (io.Closer, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	var out io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if file != "" {
+		rf, err := fwatch.OpenRotatingFile(file, int64(maxSize), maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = rf, rf
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return closer, nil
+}
+
+// fatal logs an error and exits, replacing log.Fatalf for slog
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,57 +1,96 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
-	"time"
+	"syscall"
 
-	"github.com/fsnotify/fsnotify"
-	"gopkg.in/yaml.v3"
+	"github.com/polarn/fwatch/pkg/fwatch"
 )
 
 // version is set via ldflags during build
 var version = "dev"
 
-// Config represents the application configuration
-type Config struct {
-	WatchDir   string `yaml:"watch_dir"`
-	Rules      []Rule `yaml:"rules"`
-	CreateDirs bool   `yaml:"create_dirs"`
-}
-
-// Rule represents a file routing rule
-type Rule struct {
-	Extensions  []string `yaml:"extensions"`
-	Destination string   `yaml:"destination"`
-}
+// configNames are the configuration file names looked for in the default
+// location, in order of preference
+var configNames = []string{"config.yaml", "config.yml", "config.json", "config.toml"}
 
 // getDefaultConfigPath returns the default configuration file path
-// using XDG_CONFIG_HOME or falling back to ~/.config
+// using XDG_CONFIG_HOME or falling back to ~/.config. The first existing
+// file of configNames is used, or config.yaml if there is none.
 func getDefaultConfigPath() string {
+	dir := ""
+
 	// Check XDG_CONFIG_HOME first
 	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
-		return filepath.Join(configHome, "fwatch", "config.yaml")
+		dir = filepath.Join(configHome, "fwatch")
+	} else if home := os.Getenv("HOME"); home != "" {
+		// Fall back to ~/.config
+		dir = filepath.Join(home, ".config", "fwatch")
 	}
+	// Last resort: current directory
 
-	// Fall back to ~/.config
-	if home := os.Getenv("HOME"); home != "" {
-		return filepath.Join(home, ".config", "fwatch", "config.yaml")
+	for _, name := range configNames {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
 	}
-
-	// Last resort: current directory
-	return "config.yaml"
+	return filepath.Join(dir, configNames[0])
 }
 
 func main() {
+	// Subcommands take their own flags; anything else runs the watcher
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "undo":
+			os.Exit(runUndo(os.Args[2:]))
+		case "test":
+			os.Exit(runTest(os.Args[2:]))
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "run-once":
+			os.Exit(runRunOnce(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		}
+	}
+
 	defaultConfigPath := getDefaultConfigPath()
 	configPath := flag.String("config", defaultConfigPath, "Path to configuration file")
 	showVersion := flag.Bool("version", false, "Show version information")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logFile := flag.String("log-file", "", "Write logs to this file instead of stderr")
+	logMaxSize := flag.String("log-max-size", "10MB", "Rotate the log file when it exceeds this size (0 disables rotation)")
+	logMaxBackups := flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+	pidFile := flag.String("pid-file", "", "Write the process ID to this file while running")
+	controlSocket := flag.String("control-socket", defaultControlSocket(), "Serve the control API for \"fwatch ctl\" on this unix socket (empty to disable)")
+	uiAddr := flag.String("ui-addr", "", "Serve a web dashboard and the control API on this address, e.g. 127.0.0.1:8080; an address other machines can reach needs -ui-token-file")
+	uiTokenFile := flag.String("ui-token-file", "", "Require the token in this file for every dashboard request, as ?token= when opening the page or an Authorization: Bearer header")
+	sandboxed := flag.Bool("sandbox", false, "Confine fwatch to the paths in its config with Landlock and seccomp (Linux only)")
+	profile := profileFlag(flag.CommandLine)
+	overrides := addConfigFlags(flag.CommandLine)
 	flag.Parse()
+	selectProfile(*profile)
+	if err := overrides.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		os.Exit(2)
+	}
 
 	// Show version and exit if requested
 	if *showVersion {
@@ -59,201 +98,121 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Load configuration
-	config, err := loadConfig(*configPath)
+	// Read before entering the sandbox, which may leave the file out
+	token, err := uiToken(*uiAddr, *uiTokenFile)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-
-	// Validate watch directory
-	if _, err := os.Stat(config.WatchDir); os.IsNotExist(err) {
-		log.Fatalf("Watch directory does not exist: %s", config.WatchDir)
-	}
-
-	// Create destination directories if needed
-	if config.CreateDirs {
-		for _, rule := range config.Rules {
-			if err := os.MkdirAll(rule.Destination, 0755); err != nil {
-				log.Printf("Warning: Failed to create directory %s: %v", rule.Destination, err)
-			}
-		}
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		os.Exit(2)
 	}
 
-	// Start watching
-	log.Printf("fwatch started - watching: %s", config.WatchDir)
-	if err := watchDirectory(config); err != nil {
-		log.Fatalf("Failed to watch directory: %v", err)
-	}
-}
-
-func loadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	// Set up logging
+	maxSize, err := fwatch.ParseByteSize(*logMaxSize)
 	if err != nil {
-		return nil, fmt.Errorf("reading config file: %w", err)
+		fmt.Fprintf(os.Stderr, "Invalid -log-max-size: %v\n", err)
+		os.Exit(2)
 	}
-
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("parsing config file: %w", err)
-	}
-
-	return &config, nil
-}
-
-func watchDirectory(config *Config) error {
-	watcher, err := fsnotify.NewWatcher()
+	logCloser, err := setupLogging(*logFormat, *logLevel, *logFile, maxSize, *logMaxBackups)
 	if err != nil {
-		return fmt.Errorf("creating watcher: %w", err)
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		os.Exit(2)
 	}
-	defer watcher.Close()
+	defer logCloser.Close()
 
-	// Add watch directory
-	if err := watcher.Add(config.WatchDir); err != nil {
-		return fmt.Errorf("adding watch directory: %w", err)
-	}
-
-	log.Printf("Watching directory: %s", config.WatchDir)
-
-	// Map extensions to destinations for quick lookup
-	extMap := buildExtensionMap(config.Rules)
-
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return fmt.Errorf("watcher events channel closed")
-			}
-
-			// Only process create and write events
-			if event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Write == fsnotify.Write {
-				// Small delay to ensure file is fully written
-				time.Sleep(100 * time.Millisecond)
-				processFile(event.Name, extMap)
-			}
-
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return fmt.Errorf("watcher errors channel closed")
-			}
-			log.Printf("Watcher error: %v", err)
+	// Load configuration
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fatal("Failed to load config", "config", *configPath, "error", err)
+	}
+	if *sandboxed {
+		files := sandboxFiles{
+			logFile:       *logFile,
+			logBackups:    maxSize > 0 && *logMaxBackups > 0,
+			pidFile:       *pidFile,
+			controlSocket: *controlSocket,
 		}
-	}
-}
-
-func buildExtensionMap(rules []Rule) map[string]string {
-	extMap := make(map[string]string)
-	for _, rule := range rules {
-		for _, ext := range rule.Extensions {
-			// Normalize extension to lowercase
-			extMap[strings.ToLower(ext)] = rule.Destination
+		if err := sandbox(*configPath, config, files); err != nil {
+			fatal("Failed to enter sandbox", "error", err)
 		}
 	}
-	return extMap
-}
+	rememberConfig(*configPath, config)
 
-func processFile(filePath string, extMap map[string]string) {
-	// Skip if file doesn't exist (might have been moved already)
-	info, err := os.Stat(filePath)
+	engine, err := fwatch.New(*config)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("Error stating file %s: %v", filePath, err)
-		}
-		return
+		fatal("Invalid config", "config", *configPath, "error", err)
 	}
 
-	// Skip directories
-	if info.IsDir() {
-		return
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			fatal("Failed to write PID file", "pid_file", *pidFile, "error", err)
+		}
 	}
 
-	// Get file extension
-	ext := strings.ToLower(filepath.Ext(filePath))
-	if ext == "" {
-		return
+	// Stop cleanly on SIGINT/SIGTERM, finishing the files being processed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	// Reload requests arrive from config file changes, SIGHUP and the
+	// control socket
+	reloads, watchIncludes := watchConfig(*configPath)
+	watchIncludes(engine.Config().IncludePaths())
+	reload := func() error {
+		err := reloadConfig(*configPath, engine)
+		watchIncludes(engine.Config().IncludePaths())
+		return err
+	}
+	go reloadOnChange(ctx, reloads, reload)
+	go pauseOnSignal(ctx, engine)
+
+	// The control socket and dashboard are a convenience; fwatch works
+	// without them
+	control := controlHandler(*configPath, engine, reload)
+	if *controlSocket != "" {
+		if listener, err := controlListener(*controlSocket); err != nil {
+			slog.Warn("Control socket disabled", "socket", *controlSocket, "error", err)
+		} else if listener != nil {
+			go serveControl(ctx, listener, control)
+		}
 	}
-
-	// Check if we have a rule for this extension
-	destination, exists := extMap[ext]
-	if !exists {
-		return
+	if *uiAddr != "" {
+		go serveUI(ctx, *uiAddr, token, control)
 	}
 
-	// Build destination path
-	fileName := filepath.Base(filePath)
-	destPath := filepath.Join(destination, fileName)
+	go func() {
+		select {
+		case <-engine.Ready():
+			notifySystemd("READY=1")
+		case <-ctx.Done():
+			return
+		}
+		<-ctx.Done()
+		notifySystemd("STOPPING=1")
+	}()
 
-	// Check if destination file already exists
-	if _, err := os.Stat(destPath); err == nil {
-		// File exists, add timestamp to make it unique
-		timestamp := time.Now().Format("20060102-150405")
-		nameWithoutExt := strings.TrimSuffix(fileName, ext)
-		destPath = filepath.Join(destination, fmt.Sprintf("%s-%s%s", nameWithoutExt, timestamp, ext))
-		log.Printf("Destination file exists, using: %s", filepath.Base(destPath))
+	// Start watching
+	selfCheck(engine.Config())
+	slog.Info("fwatch started", "version", version, "watches", len(engine.Config().Watches), "profile", engine.Config().Profile, "pid", os.Getpid())
+	err = engine.Run(ctx)
+	stop()
+
+	if *pidFile != "" {
+		if err := removePIDFile(*pidFile); err != nil {
+			slog.Warn("Failed to remove PID file", "pid_file", *pidFile, "error", err)
+		}
 	}
-
-	// Move the file
-	if err := moveFile(filePath, destPath); err != nil {
-		log.Printf("Error moving file %s to %s: %v", filePath, destPath, err)
-		return
+	if err != nil {
+		fatal("Failed to watch directory", "error", err)
 	}
-
-	log.Printf("Moved: %s → %s", fileName, destination)
+	slog.Info("fwatch stopped")
 }
 
-// moveFile moves a file from src to dst, handling cross-device moves
-func moveFile(src, dst string) error {
-	// Try rename first (fastest method)
-	err := os.Rename(src, dst)
-	if err == nil {
-		return nil
-	}
-
-	// Check if it's a cross-device link error
-	// If so, fall back to copy + delete
-	if strings.Contains(err.Error(), "invalid cross-device link") {
-		return copyAndDelete(src, dst)
-	}
-
-	// For other errors, return them
-	return err
+// profileFlag adds the -profile flag to a flag set
+func profileFlag(fs *flag.FlagSet) *string {
+	return fs.String("profile", "", "Use these config profiles, separated by commas (default $"+fwatch.ProfileEnv+", then the config's profile)")
 }
 
-// copyAndDelete copies a file and then deletes the source
-func copyAndDelete(src, dst string) error {
-	// Open source file
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("opening source file: %w", err)
+// selectProfile makes the -profile flag take effect. It goes through the
+// environment, so configs reloaded later use the same profiles.
+func selectProfile(profile string) {
+	if profile != "" {
+		os.Setenv(fwatch.ProfileEnv, profile)
 	}
-	defer srcFile.Close()
-
-	// Get source file info for permissions
-	srcInfo, err := srcFile.Stat()
-	if err != nil {
-		return fmt.Errorf("getting source file info: %w", err)
-	}
-
-	// Create destination file
-	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, srcInfo.Mode())
-	if err != nil {
-		return fmt.Errorf("creating destination file: %w", err)
-	}
-	defer dstFile.Close()
-
-	// Copy the content
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("copying file content: %w", err)
-	}
-
-	// Ensure data is written to disk
-	if err := dstFile.Sync(); err != nil {
-		return fmt.Errorf("syncing destination file: %w", err)
-	}
-
-	// Remove the source file
-	if err := os.Remove(src); err != nil {
-		return fmt.Errorf("removing source file: %w", err)
-	}
-
-	return nil
 }
@@ -0,0 +1,340 @@
+package fwatch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats
+const (
+	ArchiveZip    = "zip"
+	ArchiveTarGz  = "tar.gz"
+	ArchiveTarZst = "tar.zst"
+	ArchiveZst    = "zst"
+)
+
+// archiveFormats lists the valid archive formats
+var archiveFormats = []string{ArchiveZip, ArchiveTarGz, ArchiveTarZst, ArchiveZst}
+
+// ArchiveAction configures the archive action, which compresses matched
+// files into an archive in the rule's destination
+type ArchiveAction struct {
+	// Format is "zip" (default), "tar.gz", "tar.zst" or "zst" (the file
+	// compressed on its own)
+	Format string `yaml:"format"`
+
+	// Name is a template for the archive name without the format's
+	// extension (default "{{.Name}}")
+	Name string `yaml:"name"`
+
+	// Append adds files to an existing archive of the same name instead of
+	// applying the conflict policy, e.g. for a daily archive named
+	// "downloads-{{.Date}}"
+	Append bool `yaml:"append"`
+
+	// RemoveSource deletes the file once it has been archived
+	RemoveSource bool `yaml:"remove_source"`
+}
+
+// validate checks the archive settings
+func (a *ArchiveAction) validate() error {
+	if a.Format != "" && !slices.Contains(archiveFormats, a.Format) {
+		return fmt.Errorf("unknown archive format %q (want one of %v)", a.Format, archiveFormats)
+	}
+	if a.Append && a.Format == ArchiveZst {
+		return fmt.Errorf("archive format zst holds a single file and can't be appended to; use tar.zst")
+	}
+	return nil
+}
+
+// archiveFile adds a matched file to the archive configured by the rule and
+// returns the archive's path, or an empty path and the reason if the file
+// was skipped by the conflict policy
+func archiveFile(filePath string, rule *Rule) (archivePath, skipReason string, err error) {
+	action := rule.Archive
+	if action == nil {
+		action = &ArchiveAction{}
+	}
+	format := cmp.Or(action.Format, ArchiveZip)
+	archivePath, err = archivePathFor(filePath, rule)
+	if err != nil {
+		return "", "", err
+	}
+
+	if rule.Rotate != "" {
+		if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+			return "", "", fmt.Errorf("creating destination directory: %w", err)
+		}
+	}
+
+	if action.Append {
+		var existing string
+		if _, err := os.Stat(archivePath); err == nil {
+			existing = archivePath
+		}
+		if err := writeArchive(archivePath, existing, format, filePath, true); err != nil {
+			return "", "", err
+		}
+	} else {
+		resolved, reason, err := placeResolved(filePath, archivePath, rule.conflictPolicy(), rule.conflictSuffix(), func(path string, replace bool) error {
+			return writeArchive(path, "", format, filePath, replace)
+		})
+		if resolved == "" || err != nil {
+			return "", reason, err
+		}
+		archivePath = resolved
+	}
+	if action.RemoveSource {
+		if err := os.Remove(filePath); err != nil {
+			return archivePath, "", fmt.Errorf("removing source file: %w", err)
+		}
+	}
+	return archivePath, "", nil
+}
+
+// archivePathFor returns the archive a file goes into before any conflict
+// is resolved, rendering the rule's name template
+func archivePathFor(filePath string, rule *Rule) (string, error) {
+	name, format := "{{.Name}}", ArchiveZip
+	if rule.Archive != nil {
+		name = cmp.Or(rule.Archive.Name, name)
+		format = cmp.Or(rule.Archive.Format, format)
+	}
+	base, err := renderTemplate(name, newTemplateData(filePath, rule))
+	if err != nil {
+		return "", err
+	}
+	if base == "" || strings.ContainsRune(base, filepath.Separator) {
+		return "", fmt.Errorf("invalid archive name %q", base)
+	}
+	return filepath.Join(rule.Destination, periodDir(rule.Rotate, time.Now()), base+"."+format), nil
+}
+
+// writeArchive writes an archive at path containing the entries of the
+// existing archive, if any, followed by the file. The archive is built in
+// a temporary file and renamed into place, so a failure never leaves a
+// truncated archive behind. A file at path is only replaced if replace is
+// set.
+func writeArchive(path, existing, format, filePath string, replace bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fwatch-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	switch format {
+	case ArchiveZip:
+		err = writeZip(tmp, existing, filePath)
+	case ArchiveZst:
+		err = compressZst(tmp, filePath)
+	default:
+		err = writeTar(tmp, existing, format, filePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return moveOptions{noReplace: !replace}.rename(tmp.Name(), path)
+}
+
+// writeZip writes a zip archive to w
+func writeZip(w io.Writer, existing, filePath string) error {
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+
+	if existing != "" {
+		zr, err := zip.OpenReader(existing)
+		if err != nil {
+			return fmt.Errorf("reading existing archive: %w", err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if err := zw.Copy(f); err != nil {
+				return fmt.Errorf("copying existing archive: %w", err)
+			}
+			names[f.Name] = true
+		}
+	}
+
+	src, info, err := openSource(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = uniqueEntryName(info.Name(), names)
+	header.Method = zip.Deflate
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, src); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeTar writes a compressed tar archive to w
+func writeTar(w io.Writer, existing, format, filePath string) error {
+	cw, err := newCompressor(w, format)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	names := make(map[string]bool)
+
+	if existing != "" {
+		if err := copyTarEntries(tw, existing, format, names); err != nil {
+			return fmt.Errorf("copying existing archive: %w", err)
+		}
+	}
+
+	src, info, err := openSource(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = uniqueEntryName(info.Name(), names)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, src); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// copyTarEntries copies every entry of an existing compressed tar archive
+// to tw, recording their names
+func copyTarEntries(tw *tar.Writer, path, format string, names map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dr, err := newDecompressor(f, format)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+		names[header.Name] = true
+	}
+}
+
+// compressZst writes the file compressed with zstd to w
+func compressZst(w io.Writer, filePath string) error {
+	src, _, err := openSource(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// newCompressor returns a writer compressing to w in the tar format's
+// compression
+func newCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	if format == ArchiveTarZst {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// newDecompressor returns a reader decompressing r in the tar format's
+// compression
+func newDecompressor(r io.Reader, format string) (io.ReadCloser, error) {
+	if format == ArchiveTarZst {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// openSource opens a file to be archived
+func openSource(filePath string) (*os.File, os.FileInfo, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening source file: %w", err)
+	}
+	info, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return nil, nil, fmt.Errorf("getting source file info: %w", err)
+	}
+	return src, info, nil
+}
+
+// uniqueEntryName returns name, or "name (N).ext" if the archive already
+// has an entry called name
+func uniqueEntryName(name string, names map[string]bool) string {
+	if !names[name] {
+		return name
+	}
+	stem, ext := splitExt(name)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if !names[candidate] {
+			return candidate
+		}
+	}
+}
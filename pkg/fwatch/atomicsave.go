@@ -0,0 +1,161 @@
+package fwatch
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// saveSettleDelay is how recently a file must have been written for name~
+// to be taken for Vim's backup of it, and how long until such a backup is
+// looked at again
+const saveSettleDelay = 5 * time.Second
+
+// saveTemp describes the temporary files a program writes while saving a
+// file, to rename over it once it is complete
+type saveTemp struct {
+	// final returns the name the temporary file stands in for, which is
+	// "" if it can't be told, and whether name is such a file
+	final func(name string) (string, bool)
+
+	// temps returns the names of the temporary files that would be
+	// written while saving name, or nil if they can't be told
+	temps func(name string) []string
+
+	// saving reports whether the temporary file at path is still part of
+	// a save of final. It is set for names real files can have too; other
+	// temporary files always are.
+	saving func(path, final string) bool
+}
+
+// saveTemps are the atomic-save patterns of common editors and sync
+// clients
+var saveTemps = []saveTemp{
+	{
+		// Vim checks that it may create files in the directory with one
+		// named 4913, or 4913 plus a multiple of 123 if that exists, and
+		// with writebackup keeps the old file as name~ while it writes
+		final: func(name string) (string, bool) {
+			if n, err := strconv.Atoi(name); err == nil && name[0] != '0' && n >= 4913 && (n-4913)%123 == 0 {
+				return "", true
+			}
+			if final, ok := strings.CutSuffix(name, "~"); ok && final != "" {
+				return final, true
+			}
+			return "", false
+		},
+		// Both are removed again as soon as Vim is done with them, so one
+		// that stays is a real file: the probe right away, name~ once name
+		// is no longer being written
+		saving: func(path, final string) bool {
+			if _, err := os.Lstat(path); err != nil {
+				return true
+			}
+			if final == "" {
+				return false
+			}
+			info, err := os.Lstat(final)
+			return err == nil && time.Since(info.ModTime()) < saveSettleDelay
+		},
+	},
+	{
+		// VS Code writes name.vsctmp and renames it over name
+		final: func(name string) (string, bool) {
+			final, ok := strings.CutSuffix(name, ".vsctmp")
+			return final, ok && final != ""
+		},
+		temps: func(name string) []string { return []string{name + ".vsctmp"} },
+	},
+	{
+		// Syncthing downloads into .syncthing.name.tmp, or
+		// ~syncthing~name.tmp on Windows
+		final: func(name string) (string, bool) {
+			for _, prefix := range []string{".syncthing.", "~syncthing~"} {
+				if rest, ok := strings.CutPrefix(name, prefix); ok {
+					final, ok := strings.CutSuffix(rest, ".tmp")
+					return final, ok && final != ""
+				}
+			}
+			return "", false
+		},
+		temps: func(name string) []string {
+			return []string{".syncthing." + name + ".tmp", "~syncthing~" + name + ".tmp"}
+		},
+	},
+}
+
+// handlesAtomicSaves reports whether saves through temporary files are
+// recognized, which they are unless atomic_saves is false
+func (c *Config) handlesAtomicSaves() bool {
+	return c.AtomicSaves == nil || *c.AtomicSaves
+}
+
+// savedFile reports whether path is a temporary file written while saving
+// another, and returns the path of that file if it can be told. transient is
+// set for a name real files can have too, which is only taken for a
+// temporary file while the save is under way.
+func savedFile(path string) (final string, temp, transient bool) {
+	name := filepath.Base(path)
+	for _, t := range saveTemps {
+		final, ok := t.final(name)
+		if !ok {
+			continue
+		}
+		if final != "" {
+			final = filepath.Join(filepath.Dir(path), final)
+		}
+		if t.saving != nil && !t.saving(path, final) {
+			return "", false, false
+		}
+		return final, true, t.saving != nil
+	}
+	return "", false, false
+}
+
+// beingSaved reports whether a temporary file exists that will be renamed
+// over path once a save is complete
+func beingSaved(path string) bool {
+	dir, name := filepath.Split(path)
+	for _, temp := range saveTemps {
+		if temp.temps == nil {
+			continue
+		}
+		for _, tempName := range temp.temps(name) {
+			if _, err := os.Lstat(filepath.Join(dir, tempName)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// settledEvent translates an event for the temporary file of a save into
+// one for the file saved: an event for the temporary file itself is
+// dropped while it is written, and once it is renamed or removed the saved
+// file is looked at, since not every backend reports the rename for the
+// new name. Events for names real files can have too are only dropped once
+// the file is gone; processFile looks at the file again after the
+// debounce. Other events are returned as they are.
+func (c *Config) settledEvent(event Event) (Event, bool) {
+	if !c.handlesAtomicSaves() {
+		return event, true
+	}
+	final, ok, transient := savedFile(event.Path)
+	if !ok {
+		return event, true
+	}
+	if transient {
+		if _, err := os.Lstat(event.Path); err == nil {
+			return event, true
+		}
+	}
+	if final == "" || !(event.Op.Has(OpRename) || event.Op.Has(OpRemove)) {
+		return event, false
+	}
+	if _, err := os.Lstat(final); err != nil {
+		return event, false
+	}
+	return Event{Path: final, Op: OpCreate}, true
+}
@@ -0,0 +1,289 @@
+package fwatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSavedFile(t *testing.T) {
+	const (
+		gone    = iota // the temporary file is gone again
+		alone          // it is there, the file saved isn't
+		writing        // it is there and the file saved was just written
+		written        // it is there and the file saved was written long ago
+	)
+	tests := []struct {
+		name      string
+		state     int
+		final     string
+		temp      bool
+		transient bool
+	}{
+		{"4913", gone, "", true, true},
+		{"5036", gone, "", true, true},
+		{"5036", alone, "", false, false},
+		{"4914", gone, "", false, false},
+		{"04913", gone, "", false, false},
+		{"notes.txt~", gone, "notes.txt", true, true},
+		{"notes.txt~", writing, "notes.txt", true, true},
+		{"notes.txt~", written, "", false, false},
+		{"notes.txt~", alone, "", false, false},
+		{"~", alone, "", false, false},
+		{"report.docx.vsctmp", alone, "report.docx", true, false},
+		{".vsctmp", alone, "", false, false},
+		{".syncthing.photo.jpg.tmp", alone, "photo.jpg", true, false},
+		{"~syncthing~photo.jpg.tmp", gone, "photo.jpg", true, false},
+		{".syncthing..tmp", alone, "", false, false},
+		{"photo.jpg", alone, "", false, false},
+		{"backup.tmp", alone, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.state != gone {
+				write(tt.name, "data")(t, dir)
+			}
+			if tt.state == writing || tt.state == written {
+				saved, _ := strings.CutSuffix(tt.name, "~")
+				write(saved, "data")(t, dir)
+				if tt.state == written {
+					old := time.Now().Add(-time.Hour)
+					if err := os.Chtimes(filepath.Join(dir, saved), old, old); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			final, temp, transient := savedFile(filepath.Join(dir, tt.name))
+			want := ""
+			if tt.final != "" {
+				want = filepath.Join(dir, tt.final)
+			}
+			if final != want || temp != tt.temp || transient != tt.transient {
+				t.Errorf("savedFile(%q) = %q, %t, %t; want %q, %t, %t", tt.name, final, temp, transient, want, tt.temp, tt.transient)
+			}
+		})
+	}
+}
+
+// saveStep is a filesystem operation of a save and the events a backend
+// reports for it
+type saveStep struct {
+	do     func(t *testing.T, dir string)
+	events []Event
+}
+
+func write(name, data string) func(t *testing.T, dir string) {
+	return func(t *testing.T, dir string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func rename(from, to string) func(t *testing.T, dir string) {
+	return func(t *testing.T, dir string) {
+		if err := os.Rename(filepath.Join(dir, from), filepath.Join(dir, to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func remove(name string) func(t *testing.T, dir string) {
+	return func(t *testing.T, dir string) {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAtomicSaves(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // a file that is there before the save
+		steps    []saveStep
+		want     string // the file processed once the events settled
+	}{
+		{
+			name:     "vim",
+			existing: "notes.txt",
+			steps: []saveStep{
+				{write("4913", ""), []Event{{"4913", OpCreate}, {"4913", OpChmod}}},
+				{remove("4913"), []Event{{"4913", OpRemove}}},
+				{rename("notes.txt", "notes.txt~"), []Event{{"notes.txt", OpRename}, {"notes.txt~", OpCreate}}},
+				{write("notes.txt", "new"), []Event{{"notes.txt", OpCreate}, {"notes.txt", OpWrite}, {"notes.txt", OpChmod}}},
+				{remove("notes.txt~"), []Event{{"notes.txt~", OpRemove}}},
+			},
+			want: "notes.txt",
+		},
+		{
+			name: "real file named like vim's probe",
+			steps: []saveStep{
+				{write("5036", "data"), []Event{{"5036", OpCreate}, {"5036", OpWrite}}},
+			},
+			want: "5036",
+		},
+		{
+			name: "real file named like vim's backup",
+			steps: []saveStep{
+				{write("notes.txt~", "data"), []Event{{"notes.txt~", OpCreate}, {"notes.txt~", OpWrite}}},
+			},
+			want: "notes.txt~",
+		},
+		{
+			name: "vscode",
+			steps: []saveStep{
+				{write("report.md.vsctmp", "draft"), []Event{{"report.md.vsctmp", OpCreate}, {"report.md.vsctmp", OpWrite}}},
+				{rename("report.md.vsctmp", "report.md"), []Event{{"report.md.vsctmp", OpRename}, {"report.md", OpCreate}}},
+			},
+			want: "report.md",
+		},
+		{
+			name: "vscode without an event for the new name",
+			steps: []saveStep{
+				{write("report.md.vsctmp", "draft"), []Event{{"report.md.vsctmp", OpCreate}, {"report.md.vsctmp", OpWrite}}},
+				{rename("report.md.vsctmp", "report.md"), []Event{{"report.md.vsctmp", OpRename}}},
+			},
+			want: "report.md",
+		},
+		{
+			name: "syncthing",
+			steps: []saveStep{
+				{write(".syncthing.photo.jpg.tmp", "part"), []Event{{".syncthing.photo.jpg.tmp", OpCreate}, {".syncthing.photo.jpg.tmp", OpWrite}}},
+				{write(".syncthing.photo.jpg.tmp", "complete"), []Event{{".syncthing.photo.jpg.tmp", OpWrite}, {".syncthing.photo.jpg.tmp", OpChmod}}},
+				{rename(".syncthing.photo.jpg.tmp", "photo.jpg"), []Event{{".syncthing.photo.jpg.tmp", OpRename}, {"photo.jpg", OpCreate}}},
+			},
+			want: "photo.jpg",
+		},
+		{
+			name: "syncthing on windows",
+			steps: []saveStep{
+				{write("~syncthing~photo.jpg.tmp", "complete"), []Event{{"~syncthing~photo.jpg.tmp", OpCreate}, {"~syncthing~photo.jpg.tmp", OpWrite}}},
+				{rename("~syncthing~photo.jpg.tmp", "photo.jpg"), []Event{{"~syncthing~photo.jpg.tmp", OpRename}}},
+			},
+			want: "photo.jpg",
+		},
+		{
+			name: "abandoned download",
+			steps: []saveStep{
+				{write(".syncthing.photo.jpg.tmp", "part"), []Event{{".syncthing.photo.jpg.tmp", OpCreate}}},
+				{remove(".syncthing.photo.jpg.tmp"), []Event{{".syncthing.photo.jpg.tmp", OpRemove}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.existing != "" {
+				write(tt.existing, "old")(t, dir)
+			}
+			dest := t.TempDir()
+			e, err := New(Config{Watches: []Watch{{Path: dir}}, Rules: []Rule{{Regex: ".", Destination: dest}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.tracer = noop.NewTracerProvider().Tracer(tracerName)
+			config := e.config.Load()
+
+			var queued []string
+			for _, step := range tt.steps {
+				step.do(t, dir)
+				for _, event := range step.events {
+					event.Path = filepath.Join(dir, event.Path)
+					event, ok := config.settledEvent(event)
+					if ok && e.wantsEvent(event) {
+						if name := filepath.Base(event.Path); !slices.Contains(queued, name) {
+							queued = append(queued, name)
+						}
+					}
+				}
+			}
+
+			// The events are debounced, so the files are looked at once the
+			// save is over
+			for _, name := range queued {
+				e.processFile(filepath.Join(dir, name), jobTiming{})
+			}
+			var want []string
+			if tt.want != "" {
+				want = []string{tt.want}
+			}
+			if moved := movedNames(t, dest); !slices.Equal(moved, want) {
+				t.Errorf("processed %q (queued %q), want %q", moved, queued, want)
+			}
+		})
+	}
+}
+
+func TestSettledEventDisabled(t *testing.T) {
+	disabled := false
+	config := &Config{AtomicSaves: &disabled}
+	event := Event{Path: "/watch/report.md.vsctmp", Op: OpCreate}
+	if got, ok := config.settledEvent(event); !ok || got != event {
+		t.Errorf("settledEvent = %v, %t; want the event unchanged", got, ok)
+	}
+}
+
+func TestRunOnceLeavesSaves(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	for _, name := range []string{"report.md.vsctmp", "report.md", "5036", "other.txt"} {
+		write(name, "data")(t, dir)
+	}
+	e, err := New(Config{Watches: []Watch{{Path: dir}}, Rules: []Rule{{Regex: ".", Destination: dest}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if moved := movedNames(t, dest); !slices.Equal(moved, []string{"5036", "other.txt"}) {
+		t.Errorf("moved %q, want only 5036 and other.txt", moved)
+	}
+}
+
+func TestVimBackupWhileSaving(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	write("notes.txt", "new")(t, dir)
+	write("notes.txt~", "old")(t, dir)
+	e, err := New(Config{Watches: []Watch{{Path: dir}}, Rules: []Rule{{Regex: "~$", Destination: dest}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.tracer = noop.NewTracerProvider().Tracer(tracerName)
+
+	// Kept with backup set, name~ is a real file once the save is over
+	backup := filepath.Join(dir, "notes.txt~")
+	e.processFile(backup, jobTiming{})
+	if moved := movedNames(t, dest); len(moved) != 0 {
+		t.Fatalf("moved %q while notes.txt was being written", moved)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "notes.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	e.processFile(backup, jobTiming{})
+	if moved := movedNames(t, dest); !slices.Equal(moved, []string{"notes.txt~"}) {
+		t.Errorf("moved %q after the save, want notes.txt~", moved)
+	}
+}
+
+// movedNames lists the files in dest
+func movedNames(t *testing.T, dest string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
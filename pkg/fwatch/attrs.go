@@ -0,0 +1,48 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// appleQuarantineXattr is the extended attribute macOS sets on downloaded
+// files so Gatekeeper checks them when they are first opened
+const appleQuarantineXattr = "com.apple.quarantine"
+
+// What to do with the quarantine attribute of routed files
+const (
+	QuarantineXattrPreserve = "preserve"
+	QuarantineXattrStrip    = "strip"
+)
+
+// preserveAttributes copies the permissions, ownership, extended
+// attributes and timestamps of src, described by info, to dst after a
+// copy. Ownership is only changed where the process is permitted to.
+func preserveAttributes(src, dst string, info os.FileInfo) error {
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			// Unprivileged users can often still set a group they belong to
+			if err := os.Lchown(dst, -1, gid); err != nil && !errors.Is(err, os.ErrPermission) {
+				return fmt.Errorf("setting owner: %w", err)
+			}
+			slog.Debug("Could not preserve file owner", "file", src, "dest_path", dst, "uid", uid)
+		}
+	}
+
+	// Set the mode after chown, which may clear setuid and setgid bits
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return fmt.Errorf("setting permissions: %w", err)
+	}
+
+	if err := copyXattrs(src, dst); err != nil {
+		return fmt.Errorf("copying extended attributes: %w", err)
+	}
+
+	// Timestamps go last, as the other changes may touch them
+	if err := os.Chtimes(dst, fileAtime(info), info.ModTime()); err != nil {
+		return fmt.Errorf("setting timestamps: %w", err)
+	}
+	return nil
+}
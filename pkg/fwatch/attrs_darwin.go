@@ -0,0 +1,20 @@
+package fwatch
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNoXattr is returned when a file has no extended attribute of a name
+const errNoXattr = unix.ENOATTR
+
+// fileAtime returns the last access time of the file described by info
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
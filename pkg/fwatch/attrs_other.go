@@ -0,0 +1,34 @@
+//go:build !linux && !darwin
+
+package fwatch
+
+import (
+	"os"
+	"time"
+)
+
+// fileOwner is not supported on this platform
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// copyXattrs is not supported on this platform
+func copyXattrs(src, dst string) error {
+	return nil
+}
+
+// copyXattr is not supported on this platform
+func copyXattr(src, dst, name string) error {
+	return nil
+}
+
+// removeXattr is not supported on this platform
+func removeXattr(path, name string) error {
+	return nil
+}
+
+// fileAtime returns the modification time, as access times aren't read on
+// this platform
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
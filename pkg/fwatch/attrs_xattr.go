@@ -0,0 +1,109 @@
+//go:build linux || darwin
+
+package fwatch
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileOwner returns the user and group owning the file described by info
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// copyXattrs copies the extended attributes of src to dst. On Linux this
+// includes POSIX ACLs, which are stored as system.posix_acl_* attributes.
+// Attributes dst's filesystem or the process's privileges don't allow are
+// skipped.
+func copyXattrs(src, dst string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value, 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes set on path
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name on path
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// copyXattr copies the extended attribute name from src to dst, if src
+// has it and dst's filesystem supports it
+func copyXattr(src, dst, name string) error {
+	value, err := getXattr(src, name)
+	if errors.Is(err, errNoXattr) || errors.Is(err, unix.ENOTSUP) || (err == nil && value == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := unix.Lsetxattr(dst, name, value, 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+		return err
+	}
+	return nil
+}
+
+// removeXattr removes the extended attribute name from path, if set
+func removeXattr(path, name string) error {
+	err := unix.Lremovexattr(path, name)
+	if errors.Is(err, errNoXattr) || errors.Is(err, unix.ENOTSUP) {
+		return nil
+	}
+	return err
+}
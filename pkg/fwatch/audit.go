@@ -0,0 +1,134 @@
+package fwatch
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Defaults for the audit log's rotation
+const (
+	defaultAuditMaxSize    = ByteSize(100 << 20)
+	defaultAuditMaxBackups = 10
+)
+
+// AuditOptions configures the audit log, a JSON line per processed file
+// that is written independently of the log
+type AuditOptions struct {
+	// Path is the file records are appended to
+	Path string `yaml:"path"`
+
+	// MaxSize rotates the file to Path.1, Path.2, ... once it grows
+	// past this size; 100MB if unset
+	MaxSize ByteSize `yaml:"max_size"`
+
+	// MaxBackups is how many rotated files are kept; 10 if unset
+	MaxBackups int `yaml:"max_backups"`
+}
+
+// validate checks the audit log settings
+func (a *AuditOptions) validate() error {
+	if a == nil {
+		return nil
+	}
+	if a.Path == "" {
+		return fmt.Errorf("audit.path is required")
+	}
+	if a.MaxSize < 0 {
+		return fmt.Errorf("audit.max_size must not be negative")
+	}
+	if a.MaxBackups < 0 {
+		return fmt.Errorf("audit.max_backups must not be negative")
+	}
+	return nil
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	Size        int64     `json:"size"`
+	Rule        string    `json:"rule"`
+	Action      string    `json:"action"`
+	Status      Status    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Dest        string    `json:"dest,omitempty"`
+	Checksum    string    `json:"sha256,omitempty"`
+	Duplicate   string    `json:"duplicate,omitempty"`
+	Quarantined string    `json:"quarantined,omitempty"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	Step        int       `json:"step,omitempty"`
+	DurationMs  int64     `json:"duration_ms"`
+}
+
+// newAuditRecord describes a result for the audit log
+func newAuditRecord(r Result) auditRecord {
+	record := auditRecord{
+		Time: r.Time, Source: r.Path, Size: r.Size, Rule: r.Rule, Action: r.Action,
+		Status: r.Status, Reason: r.Reason, Dest: r.DestPath, Checksum: r.Checksum,
+		Duplicate: r.Duplicate, Quarantined: r.Quarantined, Encrypted: r.Encrypted,
+		Attempt: r.Attempt, Step: r.Step, DurationMs: r.Duration.Milliseconds(),
+	}
+	if r.Err != nil {
+		record.Error = r.Err.Error()
+	}
+	return record
+}
+
+// auditWriter appends results to the audit log, reopening it when a
+// reloaded config changes its settings
+type auditWriter struct {
+	mu   sync.Mutex
+	opts AuditOptions
+	file *RotatingFile
+}
+
+// record appends a result to the audit log opts configures, if any. Each
+// record is written at once, so rotation never splits a line.
+func (w *auditWriter) record(opts *AuditOptions, r Result) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if opts == nil || *opts != w.opts {
+		w.closeLocked()
+	}
+	if opts == nil {
+		return
+	}
+	if w.file == nil {
+		file, err := OpenRotatingFile(opts.Path, int64(cmp.Or(opts.MaxSize, defaultAuditMaxSize)), cmp.Or(opts.MaxBackups, defaultAuditMaxBackups))
+		if err != nil {
+			slog.Error("Failed to open audit log", "audit", opts.Path, "file", r.Path, "error", err)
+			return
+		}
+		w.opts, w.file = *opts, file
+	}
+
+	line, err := json.Marshal(newAuditRecord(r))
+	if err != nil {
+		slog.Error("Failed to encode audit record", "file", r.Path, "error", err)
+		return
+	}
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write audit log", "audit", opts.Path, "file", r.Path, "error", err)
+	}
+}
+
+// close closes the audit log
+func (w *auditWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeLocked()
+}
+
+func (w *auditWriter) closeLocked() {
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.opts, w.file = AuditOptions{}, nil
+}
@@ -0,0 +1,149 @@
+package fwatch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// kafkaClient publishes to Kafka. Connections to the brokers are made as
+// messages are written.
+type kafkaClient struct {
+	writer *kafka.Writer
+}
+
+// dialKafka sets up a writer for the publisher's brokers. Messages are
+// keyed by the source path, so events for one file keep their order.
+func dialKafka(p *Publisher) (brokerClient, error) {
+	transport := &kafka.Transport{DialTimeout: p.timeout()}
+	if p.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	if p.Username != "" {
+		transport.SASL = plain.Mechanism{Username: p.Username, Password: p.Password}
+	}
+	return &kafkaClient{writer: &kafka.Writer{
+		Addr:         kafka.TCP(p.brokers()...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: p.timeout(),
+		MaxAttempts:  1,
+		Transport:    transport,
+	}}, nil
+}
+
+func (c *kafkaClient) publish(ctx context.Context, p *Publisher, key, payload []byte) error {
+	return c.writer.WriteMessages(ctx, kafka.Message{Topic: p.Topic, Key: key, Value: payload})
+}
+
+func (c *kafkaClient) close() error {
+	return c.writer.Close()
+}
+
+// natsClient publishes to a NATS server
+type natsClient struct {
+	conn *nats.Conn
+}
+
+// dialNATS connects to the publisher's servers, trying each in turn
+func dialNATS(p *Publisher) (brokerClient, error) {
+	scheme := "nats"
+	if p.TLS {
+		scheme = "tls"
+	}
+	urls := make([]string, 0, len(p.Brokers))
+	for _, broker := range p.brokers() {
+		urls = append(urls, scheme+"://"+broker)
+	}
+	opts := []nats.Option{nats.Name("fwatch"), nats.Timeout(p.timeout())}
+	if p.Username != "" {
+		opts = append(opts, nats.UserInfo(p.Username, p.Password))
+	}
+	conn, err := nats.Connect(strings.Join(urls, ","), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsClient{conn: conn}, nil
+}
+
+// publish sends the message and flushes, so a message the server never got
+// is reported rather than lost in the buffer
+func (c *natsClient) publish(ctx context.Context, p *Publisher, key, payload []byte) error {
+	if err := c.conn.Publish(p.Topic, payload); err != nil {
+		return err
+	}
+	return c.conn.FlushWithContext(ctx)
+}
+
+func (c *natsClient) close() error {
+	c.conn.Close()
+	return nil
+}
+
+// mqttClient publishes to an MQTT broker
+type mqttClient struct {
+	client mqtt.Client
+}
+
+// dialMQTT connects to the publisher's brokers
+func dialMQTT(p *Publisher) (brokerClient, error) {
+	host, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		SetClientID(fmt.Sprintf("fwatch-%s-%d", host, os.Getpid())).
+		SetConnectTimeout(p.timeout()).
+		SetWriteTimeout(p.timeout()).
+		SetAutoReconnect(true).
+		SetCleanSession(true)
+	scheme := "tcp"
+	if p.TLS {
+		scheme = "ssl"
+		opts.SetTLSConfig(&tls.Config{})
+	}
+	for _, broker := range p.brokers() {
+		opts.AddBroker(scheme + "://" + broker)
+	}
+	if p.Username != "" {
+		opts.SetUsername(p.Username).SetPassword(p.Password)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(p.timeout()) {
+		client.Disconnect(0)
+		return nil, fmt.Errorf("timed out connecting to %v", p.Brokers)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return &mqttClient{client: client}, nil
+}
+
+// publish sends the message with the publisher's QoS, waiting for the
+// broker's acknowledgement above 0
+func (c *mqttClient) publish(ctx context.Context, p *Publisher, key, payload []byte) error {
+	qos := defaultMQTTQoS
+	if p.QoS != nil {
+		qos = *p.QoS
+	}
+	token := c.client.Publish(p.Topic, byte(qos), false, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the broker to acknowledge: %w", ctx.Err())
+	}
+}
+
+func (c *mqttClient) close() error {
+	c.client.Disconnect(250)
+	return nil
+}
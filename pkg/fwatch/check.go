@@ -0,0 +1,162 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Severity classifies a Problem found by Config.Check
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Problem is an issue found while checking a configuration
+type Problem struct {
+	Severity Severity
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+}
+
+// LoadConfigStrict is like LoadConfig but rejects keys that don't
+// correspond to any configuration field, catching typos such as
+// "destiantion"
+func LoadConfigStrict(path string) (*Config, error) {
+	return loadConfig(path, true)
+}
+
+// Check runs Validate plus deeper checks against the filesystem and
+// across rules, returning every problem found rather than stopping at the
+// first. Errors make the configuration unusable or certainly wrong;
+// warnings point at likely mistakes.
+func (c *Config) Check() []Problem {
+	var problems []Problem
+	add := func(severity Severity, format string, args ...any) {
+		problems = append(problems, Problem{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if err := c.Validate(); err != nil {
+		add(SeverityError, "%v", err)
+	}
+
+	for _, path := range c.includePaths {
+		if files, err := includeFiles(path); err == nil && len(files) == 0 {
+			add(SeverityWarning, "include %s has no rule files", path)
+		}
+	}
+
+	if c.keepsSources() && c.HistoryDB == "" {
+		add(SeverityWarning, "read_only_sources without history_db processes the files again after a restart")
+	}
+	for _, watch := range c.Watches {
+		if info, err := os.Stat(watch.Path); err == nil && !info.IsDir() && !info.Mode().IsRegular() {
+			add(SeverityError, "watch %s is neither a directory nor a file", watch.Path)
+		}
+	}
+
+	// An extension claimed by an unconditional rule can never reach a
+	// later rule, unless the rule continues
+	claimed := make(map[string]string)
+	for _, rule := range orderedRules(c.Rules) {
+		seen := make(map[string]bool)
+		for _, ext := range rule.Extensions {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				add(SeverityWarning, "%s: extension %q has no leading dot and will never match", rule.Name, ext)
+			}
+			if seen[ext] {
+				add(SeverityWarning, "%s: extension %s listed more than once", rule.Name, ext)
+				continue
+			}
+			seen[ext] = true
+
+			if earlier, ok := claimed[ext]; ok {
+				add(SeverityError, "%s: extension %s is always matched by %s first", rule.Name, ext, earlier)
+			} else if !rule.hasConditions() && !rule.Continue {
+				claimed[ext] = rule.Name
+			}
+		}
+		if len(rule.Extensions) == 0 && len(rule.MimeTypes) == 0 && rule.Regex == "" && rule.Expr == "" && len(rule.MatchDirs) == 0 {
+			add(SeverityWarning, "%s: no extensions, mime_types, regex or expr, the rule never matches", rule.Name)
+		}
+
+		for _, action := range rule.actionRules() {
+			if action.Destination != "" && !isRemoteDestination(action.Destination) {
+				problems = append(problems, c.checkDestination(action)...)
+			}
+		}
+	}
+
+	return problems
+}
+
+// hasConditions reports whether the rule restricts matches beyond its
+// extension and MIME type lists. MIME types don't count: they widen a
+// rule's selection rather than narrowing it.
+func (r *Rule) hasConditions() bool {
+	return r.MinSize > 0 || r.MaxSize > 0 || r.MinAge > 0 || r.MaxAge > 0 || len(r.ExcludeDirs) > 0 || r.ContentMatches != "" || r.Regex != "" || r.Expr != ""
+}
+
+// checkDestination checks that a rule's destination exists (or will be
+// created), is writable and does not feed back into a watch
+func (c *Config) checkDestination(rule *Rule) []Problem {
+	var problems []Problem
+	add := func(severity Severity, format string, args ...any) {
+		problems = append(problems, Problem{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	dest := filepath.Clean(rule.Destination)
+	if watch := c.feedsBack(dest); watch != nil {
+		add(SeverityWarning, "%s: destination %s is watched by %s; files moved there are kept from being processed again only until fwatch restarts, consider exclude_dirs or a destination outside the watch",
+			rule.Name, dest, watch.Path)
+	} else {
+		for _, watch := range c.Watches {
+			if isWithin(dest, watch.Path) {
+				add(SeverityWarning, "%s: destination %s is inside watched directory %s", rule.Name, dest, watch.Path)
+			}
+		}
+	}
+
+	info, err := os.Stat(dest)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if !c.CreateDirs {
+			add(SeverityError, "%s: destination %s does not exist and create_dirs is off", rule.Name, dest)
+		}
+	case err != nil:
+		add(SeverityError, "%s: destination %s: %v", rule.Name, dest, err)
+	case !info.IsDir():
+		add(SeverityError, "%s: destination %s is not a directory", rule.Name, dest)
+	default:
+		if err := checkWritable(dest); err != nil {
+			add(SeverityError, "%s: destination %s is not writable: %v", rule.Name, dest, err)
+		}
+	}
+
+	return problems
+}
+
+// isWithin reports whether path lies strictly below dir
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkWritable verifies that files can be created in dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".fwatch-probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
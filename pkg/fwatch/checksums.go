@@ -0,0 +1,129 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Checksum files for Rule.Checksums
+const (
+	ChecksumsManifest = "sha256sums"
+	ChecksumsSidecar  = "sidecar"
+)
+
+// checksumModes lists the valid checksums values
+var checksumModes = []string{ChecksumsManifest, ChecksumsSidecar}
+
+const (
+	// manifestName is the file listing the checksums of a directory
+	manifestName = "SHA256SUMS"
+
+	// checksumSuffix is added to a file's name for its checksum sidecar
+	checksumSuffix = ".sha256"
+)
+
+// manifestMu serializes updates of manifests, so files arriving in the
+// same directory at once are all recorded
+var manifestMu sync.Mutex
+
+// validateChecksums checks a rule's checksums setting
+func (r *Rule) validateChecksums() error {
+	if r.Checksums == "" {
+		return nil
+	}
+	switch {
+	case !slices.Contains(checksumModes, r.Checksums):
+		return fmt.Errorf("unknown checksums value %q (want one of %v)", r.Checksums, checksumModes)
+	case r.Action != "" && r.Action != ActionMove && r.Action != ActionCopy && r.Action != ActionPipeline:
+		return fmt.Errorf("checksums is only supported for the move, copy and pipeline actions")
+	case r.Action != ActionPipeline && isRemoteDestination(r.Destination):
+		return fmt.Errorf("checksums needs a local destination")
+	}
+	return nil
+}
+
+// recordChecksum writes the SHA-256 of a file that arrived at destPath to
+// the manifest of its directory, or to its sidecar. replaced says the file
+// overwrote one of the same name, whose entry is then replaced.
+func recordChecksum(mode, destPath string, replaced bool) error {
+	sum, err := hashFile(destPath)
+	if err != nil {
+		return fmt.Errorf("hashing file for its checksum: %w", err)
+	}
+	name := filepath.Base(destPath)
+	line := checksumLine(sum, name)
+
+	if mode == ChecksumsSidecar {
+		return writeFileAtomic(destPath+checksumSuffix, []byte(line))
+	}
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	manifest := filepath.Join(filepath.Dir(destPath), manifestName)
+	if replaced {
+		data, err := os.ReadFile(manifest)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("reading %s: %w", manifest, err)
+		}
+		lines := strings.SplitAfter(string(data), "\n")
+		lines = slices.DeleteFunc(lines, func(l string) bool { return l == "" || checksumEntryName(l) == escapeChecksumName(name) })
+		return writeFileAtomic(manifest, []byte(strings.Join(lines, "")+line))
+	}
+
+	// A line is written at once with O_APPEND, so readers never see half
+	// of one and a crash loses at most the last
+	f, err := os.OpenFile(manifest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", manifest, err)
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", manifest, err)
+	}
+	return f.Close()
+}
+
+// checksumLine formats an entry the way sha256sum does, so the file can
+// be checked with "sha256sum -c"
+func checksumLine(sum, name string) string {
+	escaped := escapeChecksumName(name)
+	if escaped != name {
+		return `\` + sum + "  " + escaped + "\n"
+	}
+	return sum + "  " + name + "\n"
+}
+
+// escapeChecksumName escapes the backslashes and line breaks in a name the
+// way sha256sum does
+func escapeChecksumName(name string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(name)
+}
+
+// checksumEntryName returns the escaped name of a manifest line, in text
+// or binary mode
+func checksumEntryName(line string) string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, `\`), "\n")
+	if len(line) < 66 || (line[64:66] != "  " && line[64:66] != " *") {
+		return ""
+	}
+	return line[66:]
+}
+
+// writeFileAtomic replaces path with data through a temporary file, so it
+// is never seen half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), tempPrefix+filepath.Base(path))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
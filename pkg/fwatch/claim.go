@@ -0,0 +1,204 @@
+package fwatch
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// claimPrefix starts the names of the hidden lock files that instances
+	// sharing a watch directory claim files with
+	claimPrefix = ".fwatch-claim-"
+
+	// defaultClaimTTL is how long a claim lasts without being refreshed,
+	// after which another instance may take the file over
+	defaultClaimTTL = 10 * time.Minute
+)
+
+// claimTTL returns how long the watch's claims last
+func (w *Watch) claimTTL() time.Duration {
+	return cmp.Or(time.Duration(w.ClaimTTL), defaultClaimTTL)
+}
+
+// claim is a file this instance holds the lock file of
+type claim struct {
+	lock  string
+	owner string // what this instance wrote to the lock file
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// claimPath returns the lock file that claims path
+func claimPath(path string) string {
+	return filepath.Join(filepath.Dir(path), claimPrefix+filepath.Base(path))
+}
+
+// claimOwner identifies this instance in its lock files
+func claimOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s %d", cmp.Or(host, "unknown"), os.Getpid())
+}
+
+// claimFile claims path for this instance, if the watch it is in is shared
+// with others. It returns false if another instance holds the file, or it
+// couldn't be claimed; a nil claim means none was needed. A file held by
+// another instance is looked at again once its claim may have gone stale,
+// in case that instance stopped.
+func (e *Engine) claimFile(watch *Watch, path string) (*claim, bool) {
+	if watch == nil || !watch.Claim {
+		return nil, true
+	}
+	c, holder, err := tryClaim(path, watch.claimTTL())
+	switch {
+	case err != nil:
+		slog.Error("Failed to claim file", "file", path, "error", err)
+		return nil, false
+	case c == nil:
+		slog.Debug("File is claimed by another instance", "file", path, "holder", holder)
+		e.recheckLater(path, watch.claimTTL())
+		return nil, false
+	}
+	// The other instance may have finished with it just before
+	if _, err := os.Lstat(path); err != nil {
+		c.release()
+		return nil, false
+	}
+	return c, true
+}
+
+// tryClaim creates the lock file for path, taking over one that hasn't
+// been refreshed for ttl. If another instance holds the file, it returns a
+// nil claim and who holds it.
+func tryClaim(path string, ttl time.Duration) (*claim, string, error) {
+	lock := claimPath(path)
+	var holder string
+	for range 3 {
+		// O_EXCL is atomic on local filesystems and NFSv3 and later, so
+		// only one instance creates the lock
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			owner := fmt.Sprintf("%s %s\n", claimOwner(), time.Now().Format(time.RFC3339Nano))
+			_, err = f.WriteString(owner)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lock)
+				return nil, "", fmt.Errorf("writing %s: %w", lock, err)
+			}
+			c := &claim{lock: lock, owner: owner, stop: make(chan struct{}), done: make(chan struct{})}
+			go c.refresh(max(ttl/3, time.Millisecond))
+			return c, "", nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", fmt.Errorf("creating %s: %w", lock, err)
+		}
+
+		data, _ := os.ReadFile(lock)
+		holder = string(bytes.TrimSpace(data))
+		info, err := os.Stat(lock)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Released meanwhile
+			continue
+		case err != nil:
+			return nil, "", err
+		case time.Since(info.ModTime()) < ttl:
+			return nil, holder, nil
+		}
+		if !takeOverClaim(lock, ttl) {
+			return nil, holder, nil
+		}
+		slog.Warn("Taking over stale claim", "file", path, "holder", holder, "claim_ttl", ttl)
+	}
+	return nil, holder, nil
+}
+
+// takeOverClaim moves a stale lock file out of the way. Instances that saw
+// it stale at once race for it: whoever renames it wins, and one that
+// renamed a lock just made by the winner puts it back. If a third instance
+// created a lock in between, the winner's copy is left to go stale rather
+// than removed; the lock on the file is then the third's.
+func takeOverClaim(lock string, ttl time.Duration) bool {
+	removeStaleCopies(lock, ttl)
+	stale := fmt.Sprintf("%s%s%d", lock, staleSuffix, rand.Int64())
+	if err := os.Rename(lock, stale); err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	info, err := os.Stat(stale)
+	if err == nil && time.Since(info.ModTime()) < ttl {
+		if err := os.Link(stale, lock); err != nil {
+			slog.Warn("Failed to put back claim taken by mistake", "lock", lock, "error", err)
+			return false
+		}
+		os.Remove(stale)
+		return false
+	}
+	os.Remove(stale)
+	return true
+}
+
+// staleSuffix follows the lock file name in the names of lock files moved
+// aside by takeOverClaim
+const staleSuffix = ".stale-"
+
+// removeStaleCopies removes the copies of lock that takeOverClaim left
+// behind once they are stale themselves
+func removeStaleCopies(lock string, ttl time.Duration) {
+	// Not a glob, which the file's name could have patterns in
+	entries, _ := os.ReadDir(filepath.Dir(lock))
+	prefix := filepath.Base(lock) + staleSuffix
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) >= ttl {
+			os.Remove(filepath.Join(filepath.Dir(lock), entry.Name()))
+		}
+	}
+}
+
+// refresh keeps the claim from going stale while its file is being
+// processed
+func (c *claim) refresh(every time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(c.lock, now, now); err != nil {
+				slog.Warn("Failed to refresh claim", "lock", c.lock, "error", err)
+			}
+		}
+	}
+}
+
+// release removes the lock file, leaving the file to any instance, unless
+// another instance took it over meanwhile. It is a no-op on a nil claim.
+func (c *claim) release() {
+	if c == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	if data, err := os.ReadFile(c.lock); err == nil && string(data) != c.owner {
+		slog.Warn("Claim was taken over by another instance", "lock", c.lock, "holder", string(bytes.TrimSpace(data)))
+		return
+	}
+	if err := os.Remove(c.lock); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Failed to release claim", "lock", c.lock, "error", err)
+	}
+}
@@ -0,0 +1,132 @@
+package fwatch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ageClaim makes the lock file of path look last refreshed age ago
+func ageClaim(t *testing.T, path string, age time.Duration) {
+	t.Helper()
+	old := time.Now().Add(-age)
+	if err := os.Chtimes(claimPath(path), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTryClaim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, path, "data")
+
+	c, holder, err := tryClaim(path, time.Minute)
+	if err != nil || c == nil {
+		t.Fatalf("tryClaim = %v, %q, %v; want a claim", c, holder, err)
+	}
+	data, err := os.ReadFile(claimPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != c.owner || !strings.HasPrefix(c.owner, claimOwner()+" ") {
+		t.Errorf("lock file holds %q, want this instance", data)
+	}
+
+	// Held by this claim until released
+	other, holder, err := tryClaim(path, time.Minute)
+	if err != nil || other != nil {
+		t.Fatalf("second tryClaim = %v, %v; want the file held", other, err)
+	}
+	if holder != strings.TrimSpace(c.owner) {
+		t.Errorf("holder = %q, want %q", holder, strings.TrimSpace(c.owner))
+	}
+
+	c.release()
+	if _, err := os.Lstat(claimPath(path)); !os.IsNotExist(err) {
+		t.Errorf("lock file still there after release: %v", err)
+	}
+	again, _, err := tryClaim(path, time.Minute)
+	if err != nil || again == nil {
+		t.Fatalf("tryClaim after release = %v, %v; want a claim", again, err)
+	}
+	again.release()
+}
+
+func TestTryClaimRefreshes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	c, _, err := tryClaim(path, 30*time.Millisecond)
+	if err != nil || c == nil {
+		t.Fatalf("tryClaim = %v, %v", c, err)
+	}
+	defer c.release()
+
+	// Refreshed claims never go stale
+	time.Sleep(100 * time.Millisecond)
+	if other, _, err := tryClaim(path, 30*time.Millisecond); err != nil || other != nil {
+		t.Errorf("tryClaim = %v, %v; want a claim being refreshed held", other, err)
+	}
+}
+
+func TestTryClaimTakesOverStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.pdf")
+	writeFile(t, claimPath(path), "other-host 1234 2024-05-01T00:00:00Z\n")
+	ageClaim(t, path, time.Hour)
+
+	c, _, err := tryClaim(path, time.Minute)
+	if err != nil || c == nil {
+		t.Fatalf("tryClaim = %v, %v; want the stale claim taken over", c, err)
+	}
+	if data, _ := os.ReadFile(claimPath(path)); string(data) != c.owner {
+		t.Errorf("lock file holds %q, want this instance", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files beside the lock, want none left behind", len(entries)-1)
+	}
+	c.release()
+}
+
+func TestReleaseAfterTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	c, _, err := tryClaim(path, time.Hour)
+	if err != nil || c == nil {
+		t.Fatalf("tryClaim = %v, %v", c, err)
+	}
+
+	// Another instance took the file over while this one was stalled
+	taken := "other-host 1234 2024-05-01T00:00:00Z\n"
+	if err := os.WriteFile(claimPath(path), []byte(taken), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.release()
+	if data, _ := os.ReadFile(claimPath(path)); string(data) != taken {
+		t.Errorf("release removed the other instance's lock, now %q", data)
+	}
+}
+
+func TestTakeOverClaimPutsBackFresh(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report [1].pdf")
+	owner := "other-host 1234 2024-05-01T00:00:00Z\n"
+	writeFile(t, claimPath(path), owner)
+
+	// A lock another instance just made is put back, not taken
+	if takeOverClaim(claimPath(path), time.Minute) {
+		t.Error("takeOverClaim took a fresh lock")
+	}
+	if data, _ := os.ReadFile(claimPath(path)); string(data) != owner {
+		t.Errorf("lock file holds %q after putting it back", data)
+	}
+
+	// Copies left behind are removed once stale
+	leftover := claimPath(path) + staleSuffix + "42"
+	writeFile(t, leftover, owner)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(leftover, old, old)
+	takeOverClaim(claimPath(path), time.Minute)
+	if _, err := os.Lstat(leftover); !os.IsNotExist(err) {
+		t.Errorf("stale copy not removed: %v", err)
+	}
+}
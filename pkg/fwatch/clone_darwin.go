@@ -0,0 +1,22 @@
+package fwatch
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile replaces dst with an APFS clone of src. clonefile only creates
+// new files, so the clone is made beside dst and renamed over it; dst stays
+// open on the empty file it replaced.
+func cloneFile(dst, src *os.File) error {
+	clone := dst.Name() + "-clone"
+	if err := unix.Fclonefileat(int(src.Fd()), unix.AT_FDCWD, clone, 0); err != nil {
+		return err
+	}
+	if err := os.Rename(clone, dst.Name()); err != nil {
+		os.Remove(clone)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package fwatch
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst a reflink of src with FICLONE, which Btrfs, XFS and
+// other copy-on-write filesystems support within one filesystem
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package fwatch
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is not supported on this platform
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
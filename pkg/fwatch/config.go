@@ -0,0 +1,890 @@
+package fwatch
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Config represents the application configuration
+type Config struct {
+	// WatchDir is shorthand for a single entry in Watches
+	WatchDir   string  `yaml:"watch_dir"`
+	Watches    []Watch `yaml:"watches"`
+	Rules      []Rule  `yaml:"rules"`
+	CreateDirs bool    `yaml:"create_dirs"`
+
+	// Profiles are named sets of watches and rules, added to the ones
+	// above when Profile selects them, so one file can serve several
+	// machines. Profile is a comma-separated list of names; ProfileEnv
+	// overrides it when a file is loaded.
+	Profiles map[string]Profile `yaml:"profiles"`
+	Profile  string             `yaml:"profile"`
+
+	profileApplied bool // the selected profiles were added
+
+	// Include names files whose rules are added after the ones above, so
+	// packs of rules can be shared between machines: files, directories
+	// of them or glob patterns, relative to the config file. They are read
+	// by LoadConfig.
+	Include []string `yaml:"include"`
+
+	includePaths []string // include entries as absolute paths
+	included     []string // files rules were loaded from
+
+	// Workers is the number of files processed concurrently and QueueSize
+	// the number of pending files buffered before events are held back
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+
+	// QueueDir keeps pending files beyond QueueSize in a journal in this
+	// directory instead of holding back events, and saves the files still
+	// pending at shutdown there to process them after the next start
+	QueueDir string `yaml:"queue_dir"`
+
+	// Debounce is how long a file must go without events before it is
+	// processed, so bursts of writes are handled once
+	Debounce Duration `yaml:"debounce"`
+
+	// Backend selects how directories are watched: "fsnotify" (default)
+	// uses OS notifications, "poll" rescans every PollInterval for
+	// filesystems that don't deliver them, and "fsevents" uses macOS
+	// FSEvents, which scales to very large directories
+	Backend      string   `yaml:"backend"`
+	PollInterval Duration `yaml:"poll_interval"`
+
+	// WatchdogInterval is how often watch directories are checked for
+	// having gone away, for example with the drive or network mount they
+	// are on; lost watches are re-established once they are back
+	WatchdogInterval Duration `yaml:"watchdog_interval"`
+
+	// Ignore lists glob patterns for file names that are never processed,
+	// in addition to defaultIgnorePatterns unless IgnoreDefaults is false
+	Ignore         []string `yaml:"ignore"`
+	IgnoreDefaults *bool    `yaml:"ignore_defaults"`
+
+	// AtomicSaves recognizes the temporary files editors and sync clients
+	// save through, processing the file saved once they are renamed over
+	// it instead (default true)
+	AtomicSaves *bool `yaml:"atomic_saves"`
+
+	// ExcludeDirs lists glob patterns for directory names that recursive
+	// watches skip, such as "node_modules" or ".git"
+	ExcludeDirs []string `yaml:"exclude_dirs"`
+
+	// OnWatchLimit is what happens to subdirectories of recursive watches
+	// once the backend hits the system limit on watches (fs.inotify.max_user_watches
+	// on Linux): "skip" (default) leaves them unwatched, "poll" polls them
+	OnWatchLimit string `yaml:"on_watch_limit"`
+
+	// Symlinks is how symbolic links in watch directories are handled:
+	// "move-as-link" (default), "follow" or "ignore"
+	Symlinks string `yaml:"symlinks"`
+
+	// ReadOnlySources makes fwatch leave the files of every watch in place,
+	// e.g. on a read-only mount: moves copy them, nothing deletes them,
+	// and each file is processed once, remembered in HistoryDB if set
+	ReadOnlySources bool `yaml:"read_only_sources"`
+
+	// QuarantineDir receives files that failed processing QuarantineAfter
+	// times in a row (default: once retries are exhausted), either moved
+	// there or, with QuarantineMode "symlink", linked from there
+	QuarantineDir   string `yaml:"quarantine_dir"`
+	QuarantineAfter int    `yaml:"quarantine_after"`
+	QuarantineMode  string `yaml:"quarantine_mode"`
+
+	// Retry is the default retry policy for rules that don't set their own
+	Retry *RetryPolicy `yaml:"retry"`
+
+	// Scan checks files before the action of rules that don't set their
+	// own, sending those it rejects to QuarantineDir
+	Scan *ScanOptions `yaml:"scan"`
+
+	// MinFreeSpace is the space moves and copies must leave free at their
+	// destination; OnLowSpace is what happens to a file that would go
+	// below it: "wait" (default) until there is room, "skip" it or "fail"
+	MinFreeSpace ByteSize `yaml:"min_free_space"`
+	OnLowSpace   string   `yaml:"on_low_space"`
+
+	// RateLimit throttles processing and cross-device copies
+	RateLimit *RateLimit `yaml:"rate_limit"`
+
+	// MaxFilesPerMinute holds files once rules have acted on this many in
+	// a minute, so a runaway producer can't keep fwatch busy unattended
+	MaxFilesPerMinute int `yaml:"max_files_per_minute"`
+
+	// MaxFileSize keeps rules from acting on larger files; OnMaxFileSize
+	// is what happens to them: "skip" (default) or "quarantine"
+	MaxFileSize   ByteSize `yaml:"max_file_size"`
+	OnMaxFileSize string   `yaml:"on_max_file_size"`
+
+	// MaxDepth limits recursive watches to this many levels of
+	// subdirectories below the watch directory
+	MaxDepth int `yaml:"max_depth"`
+
+	// Notify is the default desktop notification mode for rules
+	Notify NotifyMode `yaml:"notify"`
+
+	// Webhooks are HTTP endpoints notified about processed files
+	Webhooks []Webhook `yaml:"webhooks"`
+
+	// Publish sends messages about processed files to Kafka, NATS or MQTT
+	Publish []Publisher `yaml:"publish"`
+
+	// Email sends notifications about failed files by SMTP
+	Email *EmailOptions `yaml:"email"`
+
+	// Tracing exports OpenTelemetry traces of file processing
+	Tracing *TracingOptions `yaml:"tracing"`
+
+	// HistoryDB is the path of the database recording processed files
+	HistoryDB string `yaml:"history_db"`
+
+	// Audit writes a JSON line per processed file to a rotated file of
+	// its own
+	Audit *AuditOptions `yaml:"audit"`
+
+	// HashIndex is the path of a database of content hashes of stored
+	// files, used to detect duplicates quickly
+	HashIndex string `yaml:"hash_index"`
+
+	// Retention rules periodically clean up old files
+	Retention []RetentionRule `yaml:"retention"`
+
+	// Trash configures where files deleted in trash mode go when the
+	// system trash can't take them
+	Trash *TrashOptions `yaml:"trash"`
+}
+
+// Watch is a directory monitored for new files
+type Watch struct {
+	// Path is a directory, or a single file whose changes are processed,
+	// e.g. copied to a timestamped snapshot
+	Path string `yaml:"path"`
+
+	// Backend overrides the global backend for this directory
+	Backend string `yaml:"backend"`
+
+	// Ignore lists glob patterns ignored in this directory only
+	Ignore []string `yaml:"ignore"`
+
+	// Symlinks overrides the global symlink policy for this directory
+	Symlinks string `yaml:"symlinks"`
+
+	// ReadOnlySources leaves the files of this watch in place, like the
+	// global option
+	ReadOnlySources bool `yaml:"read_only_sources"`
+
+	// Recursive also watches all subdirectories, except those matching
+	// ExcludeDirs here or in the global configuration
+	Recursive   bool     `yaml:"recursive"`
+	ExcludeDirs []string `yaml:"exclude_dirs"`
+
+	// MaxDepth overrides the global limit on how many levels of
+	// subdirectories a recursive watch covers
+	MaxDepth int `yaml:"max_depth"`
+
+	// OnWatchLimit overrides the global watch limit policy for this directory
+	OnWatchLimit string `yaml:"on_watch_limit"`
+
+	// DropFolders treats each directory created in the watch directory as
+	// a delivery: once nothing in it has changed for DropSettle (default
+	// 30s), a rule with match_dirs moves it whole, or its files are
+	// processed and the emptied directory is removed
+	DropFolders bool     `yaml:"drop_folders"`
+	DropSettle  Duration `yaml:"drop_settle"`
+
+	// Claim makes instances sharing the directory, for example over NFS,
+	// take a lock file next to each file before processing it, so only one
+	// of them does. A claim not refreshed for ClaimTTL (default 10m) is
+	// taken over.
+	Claim    bool     `yaml:"claim"`
+	ClaimTTL Duration `yaml:"claim_ttl"`
+
+	// file is set when Path named a file as the config was loaded
+	file bool
+}
+
+// dir returns the directory that is watched for the watch: Path itself, or
+// the directory of a watched file
+func (w *Watch) dir() string {
+	if w.file {
+		return filepath.Dir(w.Path)
+	}
+	return w.Path
+}
+
+// Rule actions
+const (
+	ActionMove    = "move"
+	ActionCopy    = "copy"
+	ActionExec    = "exec"
+	ActionArchive = "archive"
+	ActionDelete  = "delete"
+
+	// ActionPipeline runs a rule's steps in order; it is implied by steps
+	ActionPipeline = "pipeline"
+
+	// ActionChecksum hashes the file; it is only valid as a pipeline step
+	ActionChecksum = "checksum"
+)
+
+// Rule represents a file routing rule
+type Rule struct {
+	// Name identifies the rule in logs; defaults to "rule N"
+	Name string `yaml:"name"`
+
+	// Rules are evaluated by descending Priority, then in the order they
+	// are listed, and the first match wins. Continue lets a matched file
+	// go on to the next matching rule as well.
+	Priority int  `yaml:"priority"`
+	Continue bool `yaml:"continue"`
+
+	// A file is selected by the rule if it has one of the extensions or
+	// its sniffed content has one of the MIME types ("image/png", "image/*")
+	Extensions  []string `yaml:"extensions"`
+	MimeTypes   []string `yaml:"mime_types"`
+	Destination string   `yaml:"destination"`
+
+	// MatchDirs makes the rule move drop folders whose name matches one of
+	// these patterns, instead of matching files
+	MatchDirs []string `yaml:"match_dirs"`
+
+	// ExcludeDirs keeps the rule from matching files below subdirectories
+	// of a recursive watch whose name matches one of these patterns
+	ExcludeDirs []string `yaml:"exclude_dirs"`
+
+	// Action is what to do with a matched file: "move" (default), "copy",
+	// "exec", "archive", "delete" or "pipeline"
+	Action  string         `yaml:"action"`
+	Exec    *ExecAction    `yaml:"exec"`
+	Archive *ArchiveAction `yaml:"archive"`
+
+	// Steps are the actions of a pipeline, run in order on the file
+	Steps []Step `yaml:"steps"`
+
+	// Post is run after the action succeeded and OnError after it failed
+	// for good, to start processing elsewhere
+	Post    *Hook `yaml:"post"`
+	OnError *Hook `yaml:"on_error"`
+
+	// Filename renames and cleans up the name of moved, copied and uploaded
+	// files
+	Filename *FilenameOptions `yaml:"filename"`
+
+	// OnConflict is what to do when the destination file already exists:
+	// "rename" (default), "overwrite", "skip", "numbered" or "hash-compare"
+	OnConflict string `yaml:"on_conflict"`
+
+	// Rotate sorts files into a directory per "daily", "weekly" or
+	// "monthly" period below the destination, created as each one starts
+	Rotate string `yaml:"rotate"`
+
+	// ConflictSuffix is the Go time layout appended to the names of files
+	// renamed on conflict (default "-20060102-150405"); files that would
+	// still clash get a counter too
+	ConflictSuffix string `yaml:"conflict_suffix"`
+
+	// VerifyChecksum checks that cross-device copies match the source
+	// before the source is deleted
+	VerifyChecksum bool `yaml:"verify_checksum"`
+
+	// Verify checks moved and copied files at the destination, putting
+	// back those that fail
+	Verify *VerifyOptions `yaml:"verify"`
+
+	// Hardlink makes the copy action hard link the file when the
+	// destination is on the same filesystem, and copy it otherwise
+	Hardlink bool `yaml:"hardlink"`
+
+	// Encrypt encrypts moved and copied files with age, adding .age to
+	// their names
+	Encrypt *EncryptOptions `yaml:"encrypt"`
+
+	// FastCopy clones files copied across directories where the filesystem
+	// supports it, and otherwise leaves the copy to the kernel
+	FastCopy bool `yaml:"fast_copy"`
+
+	// Upload configures uploads to a remote destination
+	Upload *UploadOptions `yaml:"upload"`
+
+	// Duplicates is what to do with a file identical to one already in the
+	// destination or hash index: "skip", "hardlink" or "delete"
+	Duplicates string `yaml:"duplicates"`
+
+	// DeleteMode is how the delete action and duplicates: delete remove a
+	// file: "permanent" (default) or "trash"
+	DeleteMode string `yaml:"delete_mode"`
+
+	// PreserveAttributes keeps timestamps, ownership and extended
+	// attributes when a cross-device move falls back to copying
+	PreserveAttributes bool `yaml:"preserve_attributes"`
+
+	// QuarantineXattr is what happens to the macOS com.apple.quarantine
+	// attribute of moved and copied files: "preserve" (default) keeps it,
+	// even across devices, and "strip" removes it
+	QuarantineXattr string `yaml:"quarantine_xattr"`
+
+	// MinFreeSpace and OnLowSpace override the global free space guard
+	MinFreeSpace ByteSize `yaml:"min_free_space"`
+	OnLowSpace   string   `yaml:"on_low_space"`
+
+	// MaxFilesPerMinute, MaxFileSize and OnMaxFileSize limit this rule
+	// like the global options, which apply as well
+	MaxFilesPerMinute int      `yaml:"max_files_per_minute"`
+	MaxFileSize       ByteSize `yaml:"max_file_size"`
+	OnMaxFileSize     string   `yaml:"on_max_file_size"`
+
+	// Chown and Chmod set the owner ("user", "user:group" or ":group") and
+	// the mode of moved and copied files
+	Chown string    `yaml:"chown"`
+	Chmod *FileMode `yaml:"chmod"`
+
+	// Checksums records the SHA-256 of moved and copied files in a
+	// SHA256SUMS file in their directory ("sha256sums") or next to each in
+	// a .sha256 file ("sidecar")
+	Checksums string `yaml:"checksums"`
+
+	// Retry overrides the global retry policy for this rule
+	Retry *RetryPolicy `yaml:"retry"`
+
+	// Scan overrides the global scan for this rule
+	Scan *ScanOptions `yaml:"scan"`
+
+	// Notify controls desktop notifications for this rule's results
+	Notify NotifyMode `yaml:"notify"`
+
+	// Schedule limits when the action runs; files matched outside it wait
+	// until it opens
+	Schedule *Schedule `yaml:"schedule"`
+
+	// WaitUntilIdle holds a matched file until it hasn't changed for this
+	// long, for producers that write over minutes or hours; MaxWait gives
+	// up and processes it anyway once it has waited that long
+	WaitUntilIdle Duration `yaml:"wait_until_idle"`
+	MaxWait       Duration `yaml:"max_wait"`
+
+	// Optional conditions, all of which must hold for the rule to match
+	MinSize ByteSize `yaml:"min_size"`
+	MaxSize ByteSize `yaml:"max_size"`
+	MinAge  Duration `yaml:"min_age"`
+	MaxAge  Duration `yaml:"max_age"`
+
+	// Regex is a regular expression the file name must match. The text of
+	// its named groups is available to templates as .Match.
+	Regex string `yaml:"regex"`
+
+	// Expr is a CEL expression the file must satisfy, over its path, name,
+	// ext, dir, dirs, size, mtime, age and mime
+	Expr string `yaml:"expr"`
+
+	// ContentMatches is a regular expression the file's text must match,
+	// searched in its first ContentBytes (default 64KB), or in the text
+	// of a PDF
+	ContentMatches string   `yaml:"content_matches"`
+	ContentBytes   ByteSize `yaml:"content_bytes"`
+}
+
+// LoadConfig reads and parses a configuration file in YAML, JSON or TOML,
+// chosen by its extension, adds the rules of the files it includes and
+// expands environment variable references in string values. The result
+// is normalized but not validated; see Config.Validate. A path of "-"
+// reads standard input, and the watches and rules of FWATCH_WATCH_DIR
+// and FWATCH_RULES are added, which make a missing file an empty one.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, false)
+}
+
+// loadConfig reads, decodes and normalizes a configuration file
+func loadConfig(path string, strict bool) (*Config, error) {
+	data, err := readConfigData(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file the environment stands in for is empty in any format
+	format := configFormat(path)
+	if data == nil {
+		format = FormatYAML
+	}
+	config, err := decodeConfig(data, format, strict)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	if err := config.loadIncludes(filepath.Dir(path), strict); err != nil {
+		return nil, err
+	}
+	if err := config.applyEnv(strict); err != nil {
+		return nil, err
+	}
+	if profile := os.Getenv(ProfileEnv); profile != "" {
+		config.Profile = profile
+	}
+	config.normalize()
+	return config, nil
+}
+
+// normalize folds WatchDir into Watches, cleans paths and names unnamed
+// rules. It is safe to call more than once.
+func (c *Config) normalize() {
+	c.Watches = slices.Clone(c.Watches)
+	c.Rules = slices.Clone(c.Rules)
+	c.applyProfiles()
+	for i := range c.Watches {
+		c.Watches[i].Path = filepath.Clean(c.Watches[i].Path)
+	}
+	if c.WatchDir != "" {
+		dir := filepath.Clean(c.WatchDir)
+		if !slices.ContainsFunc(c.Watches, func(w Watch) bool { return w.Path == dir }) {
+			c.Watches = append([]Watch{{Path: dir}}, c.Watches...)
+		}
+	}
+	for i := range c.Watches {
+		info, err := os.Stat(c.Watches[i].Path)
+		c.Watches[i].file = err == nil && info.Mode().IsRegular()
+	}
+
+	if c.QuarantineDir != "" {
+		c.QuarantineDir = filepath.Clean(c.QuarantineDir)
+	}
+	if c.HistoryDB != "" {
+		c.HistoryDB = filepath.Clean(c.HistoryDB)
+	}
+	if c.Audit != nil && c.Audit.Path != "" {
+		c.Audit.Path = filepath.Clean(c.Audit.Path)
+	}
+	if c.QueueDir != "" {
+		c.QueueDir = filepath.Clean(c.QueueDir)
+	}
+	if c.HashIndex != "" {
+		c.HashIndex = filepath.Clean(c.HashIndex)
+	}
+	if c.Trash != nil && c.Trash.Dir != "" {
+		trash := *c.Trash
+		trash.Dir = filepath.Clean(trash.Dir)
+		c.Trash = &trash
+	}
+
+	for i := range c.Rules {
+		if c.Rules[i].Name == "" {
+			c.Rules[i].Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(c.Rules[i].Steps) > 0 && c.Rules[i].Action == "" {
+			c.Rules[i].Action = ActionPipeline
+		}
+	}
+
+	c.Retention = slices.Clone(c.Retention)
+	for i := range c.Retention {
+		r := &c.Retention[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("retention %d", i+1)
+		}
+		r.Paths = slices.Clone(r.Paths)
+		for j := range r.Paths {
+			r.Paths[j] = filepath.Clean(r.Paths[j])
+		}
+	}
+}
+
+// Validate checks that the configuration can be used for watching
+func (c *Config) Validate() error {
+	if err := c.validateProfiles(); err != nil {
+		return err
+	}
+	if len(c.Watches) == 0 {
+		return fmt.Errorf("no watch directory configured (set watch_dir or watches)")
+	}
+	for i, watch := range c.Watches {
+		switch backend := c.backendFor(&watch); backend {
+		case BackendFsnotify, BackendPoll:
+		case BackendFSEvents:
+			if !fseventsSupported {
+				return fmt.Errorf("watch %s: the fsevents backend is only available on macOS, in builds with cgo", watch.Path)
+			}
+		default:
+			return fmt.Errorf("watch %s: unknown backend %q", watch.Path, backend)
+		}
+		if watch.Symlinks != "" && !slices.Contains(symlinkPolicies, watch.Symlinks) {
+			return fmt.Errorf("watch %s: unknown symlinks policy %q", watch.Path, watch.Symlinks)
+		}
+		if watch.DropFolders && watch.Recursive {
+			return fmt.Errorf("watch %s: drop_folders can't be combined with recursive", watch.Path)
+		}
+		if watch.DropFolders && c.readOnly(&watch) {
+			return fmt.Errorf("watch %s: drop folders are removed once processed, which read_only_sources doesn't allow", watch.Path)
+		}
+		if watch.Claim && c.readOnly(&watch) {
+			return fmt.Errorf("watch %s: claim writes lock files, which read_only_sources doesn't allow", watch.Path)
+		}
+		if watch.file && (watch.Recursive || watch.DropFolders) {
+			return fmt.Errorf("watch %s: a watched file can't be recursive or have drop folders", watch.Path)
+		}
+		if watch.DropSettle < 0 {
+			return fmt.Errorf("watch %s: drop_settle must not be negative", watch.Path)
+		}
+		if watch.ClaimTTL < 0 {
+			return fmt.Errorf("watch %s: claim_ttl must not be negative", watch.Path)
+		}
+		if watch.MaxDepth < 0 || watch.MaxDepth > 0 && !watch.Recursive {
+			return fmt.Errorf("watch %s: max_depth must be positive and needs recursive", watch.Path)
+		}
+		if watch.OnWatchLimit != "" && !slices.Contains(watchLimitPolicies, watch.OnWatchLimit) {
+			return fmt.Errorf("watch %s: unknown on_watch_limit policy %q", watch.Path, watch.OnWatchLimit)
+		}
+		if _, err := os.Stat(watch.Path); os.IsNotExist(err) {
+			return fmt.Errorf("watch directory does not exist: %s", watch.Path)
+		}
+		if slices.IndexFunc(c.Watches[:i], func(w Watch) bool { return w.Path == watch.Path }) != -1 {
+			return fmt.Errorf("watch directory listed more than once: %s", watch.Path)
+		}
+	}
+
+	for _, pattern := range c.ignorePatterns(nil) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range c.ExcludeDirs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude_dirs pattern %q: %w", pattern, err)
+		}
+	}
+	if c.Symlinks != "" && !slices.Contains(symlinkPolicies, c.Symlinks) {
+		return fmt.Errorf("unknown symlinks policy %q", c.Symlinks)
+	}
+	if c.OnWatchLimit != "" && !slices.Contains(watchLimitPolicies, c.OnWatchLimit) {
+		return fmt.Errorf("unknown on_watch_limit policy %q", c.OnWatchLimit)
+	}
+	for _, watch := range c.Watches {
+		for _, pattern := range watch.Ignore {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("watch %s: invalid ignore pattern %q: %w", watch.Path, pattern, err)
+			}
+		}
+		for _, pattern := range watch.ExcludeDirs {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("watch %s: invalid exclude_dirs pattern %q: %w", watch.Path, pattern, err)
+			}
+		}
+		// Each directory must belong to a single watch
+		for _, other := range c.Watches {
+			if other.Recursive && isWithin(watch.Path, other.Path) {
+				return fmt.Errorf("watch %s is inside recursive watch %s", watch.Path, other.Path)
+			}
+			if watch.file && !other.file && other.Path == watch.dir() {
+				return fmt.Errorf("watch %s is a file in watch %s, whose rules see it already", watch.Path, other.Path)
+			}
+		}
+	}
+
+	if c.QuarantineDir != "" {
+		if c.QuarantineMode != "" && c.QuarantineMode != QuarantineMove && c.QuarantineMode != QuarantineSymlink {
+			return fmt.Errorf("unknown quarantine_mode %q", c.QuarantineMode)
+		}
+		if c.QuarantineAfter < 0 {
+			return fmt.Errorf("quarantine_after must not be negative")
+		}
+		if c.watchFor(filepath.Join(c.QuarantineDir, "x")) != nil {
+			return fmt.Errorf("quarantine_dir must not be a watched directory: %s", c.QuarantineDir)
+		}
+	}
+
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+	if err := validLowSpace(c.OnLowSpace); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := validateLimits(c.MaxFilesPerMinute, c.MaxFileSize, c.OnMaxFileSize); err != nil {
+		return err
+	}
+	if c.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative")
+	}
+
+	if c.HistoryDB != "" && c.watchFor(c.HistoryDB) != nil {
+		return fmt.Errorf("history_db must not be in a watched directory: %s", c.HistoryDB)
+	}
+	if err := c.Audit.validate(); err != nil {
+		return err
+	}
+	if c.Audit != nil && c.watchFor(c.Audit.Path) != nil {
+		return fmt.Errorf("audit.path must not be in a watched directory: %s", c.Audit.Path)
+	}
+	if c.QueueDir != "" && c.watchFor(filepath.Join(c.QueueDir, spillJournal)) != nil {
+		return fmt.Errorf("queue_dir must not be in a watched directory: %s", c.QueueDir)
+	}
+	if c.HashIndex != "" && c.watchFor(c.HashIndex) != nil {
+		return fmt.Errorf("hash_index must not be in a watched directory: %s", c.HashIndex)
+	}
+	if err := c.Trash.validate(); err != nil {
+		return err
+	}
+	if c.Trash != nil && c.Trash.Dir != "" && c.watchFor(filepath.Join(c.Trash.Dir, "x")) != nil {
+		return fmt.Errorf("trash.dir must not be a watched directory: %s", c.Trash.Dir)
+	}
+
+	if err := c.Email.validate(); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	for i, hook := range c.Webhooks {
+		if err := hook.validate(); err != nil {
+			return fmt.Errorf("webhook %d: %w", i+1, err)
+		}
+	}
+	for i, p := range c.Publish {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("publish %d: %w", i+1, err)
+		}
+	}
+
+	if err := c.Scan.validate(); err != nil {
+		return err
+	}
+	for i, rule := range c.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if c.scanFor(&rule) != nil && c.QuarantineDir == "" {
+			return fmt.Errorf("rule %d: scan needs quarantine_dir for the files it rejects", i+1)
+		}
+		if c.maxFileSize(&rule) > 0 && c.onMaxFileSize(&rule) == MaxFileSizeQuarantine && c.QuarantineDir == "" {
+			return fmt.Errorf("rule %d: on_max_file_size quarantine needs quarantine_dir", i+1)
+		}
+	}
+
+	for i, rule := range c.Retention {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("retention %d: %w", i+1, err)
+		}
+		if rule.Action == RetentionArchive && c.watchFor(filepath.Join(rule.Destination, "x")) != nil {
+			return fmt.Errorf("retention %d: destination must not be a watched directory: %s", i+1, rule.Destination)
+		}
+	}
+
+	return nil
+}
+
+// validate checks a single rule's settings
+func (r *Rule) validate() error {
+	switch r.Action {
+	case "", ActionMove, ActionCopy:
+		if r.Destination == "" {
+			return fmt.Errorf("destination is required")
+		}
+		if isRemoteDestination(r.Destination) {
+			var err error
+			switch {
+			case isObjectStoreURL(r.Destination):
+				err = validateObjectStoreURL(r.Destination)
+			case isSFTPURL(r.Destination):
+				err = validateSFTPURL(r.Destination)
+			default:
+				err = fmt.Errorf("unsupported destination URL %q", r.Destination)
+			}
+			if err != nil {
+				return err
+			}
+			if r.Duplicates != "" {
+				return fmt.Errorf("duplicates is not supported for remote destinations")
+			}
+		}
+	case ActionExec:
+		if r.Exec == nil || len(r.Exec.Command) == 0 {
+			return fmt.Errorf("exec action requires exec.command")
+		}
+	case ActionArchive:
+		if r.Destination == "" {
+			return fmt.Errorf("destination is required")
+		}
+		if isRemoteDestination(r.Destination) {
+			return fmt.Errorf("the archive action needs a local destination")
+		}
+		if r.Archive != nil {
+			if err := r.Archive.validate(); err != nil {
+				return err
+			}
+		}
+	case ActionDelete:
+		if r.Destination != "" {
+			return fmt.Errorf("the delete action takes no destination")
+		}
+	case ActionPipeline:
+		if err := r.validateSteps(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if len(r.Steps) > 0 && r.Action != ActionPipeline {
+		return fmt.Errorf("steps can't be combined with the %s action", r.Action)
+	}
+	for _, pattern := range r.ExcludeDirs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude_dirs pattern %q: %w", pattern, err)
+		}
+	}
+	if r.Filename != nil && (r.Action == ActionExec || r.Action == ActionArchive || r.Action == ActionDelete) {
+		return fmt.Errorf("filename is only supported for the move, copy and pipeline actions")
+	}
+	if r.Regex != "" {
+		if _, err := cachedRegexp(r.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	if r.Expr != "" {
+		if _, err := cachedProgram(r.Expr); err != nil {
+			return fmt.Errorf("invalid expr: %w", err)
+		}
+	}
+	if err := r.Filename.validate(r.sampleTemplateData()); err != nil {
+		return err
+	}
+	if r.Filename != nil && r.Filename.ContentHash && r.Action != ActionPipeline && isRemoteDestination(r.Destination) {
+		return fmt.Errorf("filename.content_hash needs a local destination")
+	}
+	if r.OnConflict != "" && !slices.Contains(conflictPolicies, r.OnConflict) {
+		return fmt.Errorf("unknown on_conflict policy %q", r.OnConflict)
+	}
+	if strings.ContainsAny(r.ConflictSuffix, `/\`) {
+		return fmt.Errorf("conflict_suffix must not contain path separators")
+	}
+	if err := validDuplicates(r.Duplicates); err != nil {
+		return err
+	}
+	if r.Duplicates != "" && r.Action != "" && r.Action != ActionMove {
+		return fmt.Errorf("duplicates is only supported for the move action")
+	}
+	if err := validDeleteMode(r.DeleteMode); err != nil {
+		return err
+	}
+	if r.DeleteMode != "" && r.Action != ActionDelete && r.Action != ActionPipeline && r.Duplicates != DuplicateDelete {
+		return fmt.Errorf("delete_mode only applies to the delete action and duplicates: delete")
+	}
+	if r.QuarantineXattr != "" && r.QuarantineXattr != QuarantineXattrPreserve && r.QuarantineXattr != QuarantineXattrStrip {
+		return fmt.Errorf("unknown quarantine_xattr value %q", r.QuarantineXattr)
+	}
+	if err := r.validateMatchDirs(); err != nil {
+		return err
+	}
+	if r.Rotate != "" && !slices.Contains(rotatePeriods, r.Rotate) {
+		return fmt.Errorf("unknown rotate period %q (want daily, weekly or monthly)", r.Rotate)
+	}
+	if err := validLowSpace(r.OnLowSpace); err != nil {
+		return err
+	}
+	if err := validateLimits(r.MaxFilesPerMinute, r.MaxFileSize, r.OnMaxFileSize); err != nil {
+		return err
+	}
+	if err := r.Encrypt.validate(); err != nil {
+		return err
+	}
+	if err := r.Verify.validate(); err != nil {
+		return err
+	}
+	if r.Verify != nil {
+		switch {
+		case r.Action != "" && r.Action != ActionMove && r.Action != ActionCopy || isRemoteDestination(r.Destination):
+			return fmt.Errorf("verify is only supported for moves and copies to local destinations")
+		case r.Encrypt != nil || len(r.MatchDirs) > 0:
+			return fmt.Errorf("verify can't be combined with encrypt or match_dirs")
+		}
+	}
+	if r.Encrypt != nil {
+		switch {
+		case r.Action != "" && r.Action != ActionMove && r.Action != ActionCopy || isRemoteDestination(r.Destination):
+			return fmt.Errorf("encrypt is only supported for moves and copies to local destinations")
+		case r.Hardlink || r.Duplicates != "" || len(r.MatchDirs) > 0:
+			return fmt.Errorf("encrypt can't be combined with hardlink, duplicates or match_dirs")
+		}
+	}
+	if err := r.validatePermissions(); err != nil {
+		return err
+	}
+	if err := r.validateChecksums(); err != nil {
+		return err
+	}
+	if err := r.validateContent(); err != nil {
+		return err
+	}
+	if err := r.validateIdle(); err != nil {
+		return err
+	}
+	if r.Hardlink && (r.Action != ActionCopy || isRemoteDestination(r.Destination)) {
+		return fmt.Errorf("hardlink is only supported for the copy action to a local destination")
+	}
+	if r.Action == ActionCopy && r.Upload != nil && r.Upload.DeleteSource {
+		return fmt.Errorf("upload.delete_source can't be used with the copy action")
+	}
+	if r.Continue && !r.keepsSource() {
+		return fmt.Errorf("continue needs an action that leaves the file in place: copy, exec, archive without remove_source, or an upload without delete_source")
+	}
+	if err := r.Upload.validate(); err != nil {
+		return err
+	}
+	if err := r.Scan.validate(); err != nil {
+		return err
+	}
+	if err := r.Post.validate(); err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	if err := r.OnError.validate(); err != nil {
+		return fmt.Errorf("on_error: %w", err)
+	}
+	return r.Retry.validate()
+}
+
+// keepsSource reports whether the rule's action leaves the matched file
+// where it is
+func (r *Rule) keepsSource() bool {
+	switch r.Action {
+	case ActionCopy, ActionExec, ActionChecksum:
+		return true
+	case ActionArchive:
+		return r.Archive == nil || !r.Archive.RemoveSource
+	case ActionPipeline:
+		for i := range r.Steps {
+			if !r.stepRule(&r.Steps[i]).keepsSource() {
+				return false
+			}
+		}
+		return true
+	default:
+		return isRemoteDestination(r.Destination) && (r.Upload == nil || !r.Upload.DeleteSource)
+	}
+}
+
+// backendFor returns the name of the backend used to watch a directory
+func (c *Config) backendFor(watch *Watch) string {
+	return cmp.Or(watch.Backend, c.Backend, BackendFsnotify)
+}
+
+// createDestinations creates the rule destination directories if the
+// configuration asks for it
+func createDestinations(config *Config) {
+	if !config.CreateDirs {
+		return
+	}
+	for i := range config.Rules {
+		for _, rule := range config.Rules[i].actionRules() {
+			if rule.Destination == "" || isRemoteDestination(rule.Destination) {
+				continue
+			}
+			if err := os.MkdirAll(rule.Destination, 0755); err != nil {
+				slog.Warn("Failed to create directory", "dir", rule.Destination, "error", err)
+			}
+		}
+	}
+}
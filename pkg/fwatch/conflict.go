@@ -0,0 +1,291 @@
+package fwatch
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Conflict policies for when a file with the same name already exists at
+// the destination
+const (
+	ConflictRename      = "rename"
+	ConflictOverwrite   = "overwrite"
+	ConflictSkip        = "skip"
+	ConflictNumbered    = "numbered"
+	ConflictHashCompare = "hash-compare"
+)
+
+// conflictPolicies lists the valid on_conflict values
+var conflictPolicies = []string{ConflictRename, ConflictOverwrite, ConflictSkip, ConflictNumbered, ConflictHashCompare}
+
+// identicalReason is the reason given when hash-compare finds the file is
+// already at its destination
+const identicalReason = "identical file already at destination"
+
+// defaultConflictSuffix is the time layout appended to renamed files when
+// the rule does not set conflict_suffix
+const defaultConflictSuffix = "-20060102-150405"
+
+// conflictPolicy returns the rule's on_conflict policy. Content hash names
+// only clash for identical files, so those are compared by default.
+func (r *Rule) conflictPolicy() string {
+	if r.OnConflict == "" && r.Filename != nil && r.Filename.ContentHash {
+		return ConflictHashCompare
+	}
+	return cmp.Or(r.OnConflict, ConflictRename)
+}
+
+// conflictSuffix returns the time layout appended to the files the rule
+// renames
+func (r *Rule) conflictSuffix() string {
+	return cmp.Or(r.ConflictSuffix, defaultConflictSuffix)
+}
+
+// resolveConflict decides where srcPath should be written given that
+// destPath is the preferred target. It returns the path to use, or an
+// empty path if the file should be skipped, along with a short reason for
+// logging when the target was changed or skipped. suffix is the time
+// layout renamed files get. The path is only free when checked; use
+// placeResolved to put a file there without replacing one that another
+// move put there since.
+func resolveConflict(srcPath, destPath, policy, suffix string) (string, string, error) {
+	if _, err := os.Lstat(destPath); errors.Is(err, os.ErrNotExist) {
+		return destPath, "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("checking destination: %w", err)
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		return destPath, "overwriting existing file", nil
+
+	case ConflictSkip:
+		return "", "destination file exists", nil
+
+	case ConflictNumbered:
+		path, err := numberedPath(destPath)
+		return path, "destination file exists, numbering", err
+
+	case ConflictHashCompare:
+		same, err := sameContents(srcPath, destPath)
+		if err != nil {
+			return "", "", fmt.Errorf("comparing with destination: %w", err)
+		}
+		if same {
+			return "", identicalReason, nil
+		}
+		path, err := renamedPath(destPath, suffix)
+		return path, "destination file differs, renaming", err
+
+	default:
+		path, err := renamedPath(destPath, suffix)
+		return path, "destination file exists, renaming", err
+	}
+}
+
+// maxPlaceAttempts bounds how often placeResolved resolves a conflict
+// again because other files keep taking the names it chose
+const maxPlaceAttempts = 100
+
+// placeResolved resolves the conflict policy for destPath and calls place
+// with the path chosen. Unless replace is set, place must put the file
+// there without replacing anything, with renameNoReplace or a hard link,
+// and fail with an error matching fs.ErrExist if another file got there
+// first; the conflict is then resolved again. This claims each name
+// atomically, where checking that it is free and then moving there could
+// replace a file put there in between, and nothing appears at the name
+// until the file is complete. It returns the path used, or "" if the file
+// was skipped, and the reason the target was changed or skipped.
+func placeResolved(srcPath, destPath, policy, suffix string, place func(path string, replace bool) error) (string, string, error) {
+	for range maxPlaceAttempts {
+		path, reason, err := resolveConflict(srcPath, destPath, policy, suffix)
+		if err != nil {
+			return "", "", fmt.Errorf("resolving destination conflict: %w", err)
+		}
+		if path == "" {
+			return "", reason, nil
+		}
+		replace := policy == ConflictOverwrite && reason != ""
+		if err := place(path, replace); replace || !errors.Is(err, fs.ErrExist) {
+			return path, reason, err
+		}
+		slog.Debug("Destination was taken while placing file, resolving again", "file", srcPath, "dest_path", path)
+	}
+	return "", "", fmt.Errorf("resolving destination conflict: %s kept being taken", destPath)
+}
+
+// resolveRemoteConflict is resolveConflict for a remote destination that
+// is known to already have a file at key. exists checks other keys;
+// identical compares contents for hash-compare and may be nil if the
+// remote can't tell, in which case the file is renamed.
+func resolveRemoteConflict(key, policy, suffix string, exists func(string) (bool, error), identical func() (bool, error)) (string, string, error) {
+	switch policy {
+	case ConflictOverwrite:
+		return key, "overwriting existing file", nil
+
+	case ConflictSkip:
+		return "", "destination file exists", nil
+
+	case ConflictNumbered:
+		stem, ext := splitExt(key)
+		candidate, err := freeName(func(n int) string { return fmt.Sprintf("%s (%d)%s", stem, n, ext) }, exists)
+		return candidate, "destination file exists, numbering", err
+
+	case ConflictHashCompare:
+		if identical == nil {
+			break
+		}
+		same, err := identical()
+		if err != nil {
+			return "", "", fmt.Errorf("comparing with destination: %w", err)
+		}
+		if same {
+			return "", identicalReason, nil
+		}
+		candidate, err := freeName(renamedNames(key, suffix), exists)
+		return candidate, "destination file differs, renaming", err
+	}
+	candidate, err := freeName(renamedNames(key, suffix), exists)
+	return candidate, "destination file exists, renaming", err
+}
+
+// splitExt splits a file name into stem and extension, preserving case
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext), ext
+}
+
+// renamedNames returns the names a file renamed at path may take: the
+// current time in the suffix layout appended to the stem, e.g.
+// "report-20240102-150405.pdf", then "report-20240102-150405-2.pdf" and so
+// on for files that conflict within the same second
+func renamedNames(path, suffix string) func(int) string {
+	stem, ext := splitExt(path)
+	stem += time.Now().Format(suffix)
+	return func(n int) string {
+		if n == 1 {
+			return stem + ext
+		}
+		return fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+}
+
+// renamedPath returns the first free name renamedNames gives for path
+func renamedPath(path, suffix string) (string, error) {
+	return freePath(renamedNames(path, suffix))
+}
+
+// numberedPath returns the first free path of the form "file (N).ext"
+func numberedPath(path string) (string, error) {
+	stem, ext := splitExt(path)
+	return freePath(func(n int) string { return fmt.Sprintf("%s (%d)%s", stem, n, ext) })
+}
+
+// freePath returns the first of the names that is free
+func freePath(name func(int) string) (string, error) {
+	return freeName(name, func(path string) (bool, error) {
+		_, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// freeName returns the first of the names that exists reports as free
+func freeName(name func(int) string, exists func(string) (bool, error)) (string, error) {
+	for n := 1; ; n++ {
+		candidate := name(n)
+		taken, err := exists(candidate)
+		if err != nil {
+			return "", fmt.Errorf("checking destination: %w", err)
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+}
+
+// linkReplacing hard links target at path, replacing what is there
+func linkReplacing(target, path string) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf("%s%d", tempPrefix, rand.Int64()))
+	if err := os.Link(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// renameByLinking is renameNoReplace for filesystems without a rename
+// that doesn't replace: new is hard linked to old, which fails if new
+// exists, before old is removed. Where hard links aren't supported either,
+// new is checked to be free before renaming, which leaves a moment for
+// another file to take it.
+func renameByLinking(old, new string) error {
+	err := os.Link(old, new)
+	if err == nil {
+		return os.Remove(old)
+	}
+	if errors.Is(err, fs.ErrExist) || isCrossDevice(err) {
+		return err
+	}
+	if _, err := os.Lstat(new); err == nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(old, new)
+}
+
+// sameContents reports whether two files have identical contents
+func sameContents(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	hashA, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return hashA == hashB, nil
+}
+
+// hashFile returns the hex-encoded SHA-256 digest of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
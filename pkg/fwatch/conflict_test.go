@@ -0,0 +1,189 @@
+package fwatch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	tests := []struct {
+		policy   string
+		existing string // contents of the file at the destination
+		want     string // the path chosen, "" to skip, "*" for a new name
+		reason   string
+	}{
+		{ConflictRename, "", "report.pdf", ""},
+		{ConflictRename, "other", "*", "destination file exists, renaming"},
+		{ConflictOverwrite, "other", "report.pdf", "overwriting existing file"},
+		{ConflictSkip, "other", "", "destination file exists"},
+		{ConflictNumbered, "other", "report (1).pdf", "destination file exists, numbering"},
+		{ConflictHashCompare, "data", "", identicalReason},
+		{ConflictHashCompare, "other", "*", "destination file differs, renaming"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.existing, func(t *testing.T) {
+			src, dest := filepath.Join(t.TempDir(), "report.pdf"), filepath.Join(t.TempDir(), "report.pdf")
+			writeFile(t, src, "data")
+			if tt.existing != "" {
+				writeFile(t, dest, tt.existing)
+			}
+
+			path, reason, err := resolveConflict(src, dest, tt.policy, defaultConflictSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == "*":
+				if path == dest || !strings.HasPrefix(filepath.Base(path), "report-") || filepath.Ext(path) != ".pdf" {
+					t.Errorf("path = %q, want a renamed report-*.pdf", path)
+				}
+			case tt.want == "":
+				if path != "" {
+					t.Errorf("path = %q, want the file skipped", path)
+				}
+			case path != filepath.Join(filepath.Dir(dest), tt.want):
+				t.Errorf("path = %q, want %s", path, tt.want)
+			}
+			if reason != tt.reason {
+				t.Errorf("reason = %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestPlaceResolvedConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "report.pdf")
+	writeFile(t, dest, "other")
+
+	// Moves racing for the same name each end up under one of their own,
+	// without replacing another's file
+	const moves = 20
+	paths := make([]string, moves)
+	var wg sync.WaitGroup
+	for i := range moves {
+		wg.Go(func() {
+			src := filepath.Join(t.TempDir(), "report.pdf")
+			writeFile(t, src, strconv.Itoa(i))
+			path, _, err := placeResolved(src, dest, ConflictNumbered, defaultConflictSuffix, func(path string, replace bool) error {
+				return moveFile(src, path, moveOptions{noReplace: !replace})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = path
+		})
+	}
+	wg.Wait()
+
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != strconv.Itoa(i) {
+			t.Errorf("%s holds move %s's file, want move %d's", path, data, i)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != moves+1 {
+		t.Errorf("%d files in the destination, want %d", len(entries), moves+1)
+	}
+}
+
+func TestPlaceResolvedOverwrite(t *testing.T) {
+	src, dest := filepath.Join(t.TempDir(), "report.pdf"), filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, src, "data")
+	writeFile(t, dest, "other")
+
+	path, reason, err := placeResolved(src, dest, ConflictOverwrite, defaultConflictSuffix, func(path string, replace bool) error {
+		if !replace {
+			t.Error("overwrite placed without replacing")
+		}
+		return moveFile(src, path, moveOptions{noReplace: !replace})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != dest || reason != "overwriting existing file" {
+		t.Errorf("placed at %q (%q), want %q overwritten", path, reason, dest)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "data" {
+		t.Errorf("destination holds %q, want the moved file", data)
+	}
+}
+
+func TestPlaceResolvedGivesUp(t *testing.T) {
+	src, dest := filepath.Join(t.TempDir(), "report.pdf"), filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, src, "data")
+
+	attempts := 0
+	_, _, err := placeResolved(src, dest, ConflictRename, defaultConflictSuffix, func(string, bool) error {
+		attempts++
+		return fs.ErrExist
+	})
+	if err == nil {
+		t.Fatal("placeResolved succeeded with every name taken")
+	}
+	if attempts != maxPlaceAttempts {
+		t.Errorf("%d attempts, want %d", attempts, maxPlaceAttempts)
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	writeFile(t, src, "data")
+	writeFile(t, dest, "other")
+
+	if err := renameNoReplace(src, dest); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("renameNoReplace over a file = %v, want fs.ErrExist", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "other" {
+		t.Errorf("destination replaced with %q", data)
+	}
+
+	free := filepath.Join(dir, "c")
+	if err := renameNoReplace(src, free); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there after renaming: %v", err)
+	}
+	if data, _ := os.ReadFile(free); string(data) != "data" {
+		t.Errorf("renamed file holds %q", data)
+	}
+}
+
+func TestRenameByLinking(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	writeFile(t, src, "data")
+	writeFile(t, dest, "other")
+
+	if err := renameByLinking(src, dest); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("renameByLinking over a file = %v, want fs.ErrExist", err)
+	}
+	if err := renameByLinking(src, filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there after renaming: %v", err)
+	}
+}
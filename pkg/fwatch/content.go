@@ -0,0 +1,254 @@
+package fwatch
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultContentBytes is how much text content_matches searches when
+	// the rule does not set content_bytes
+	defaultContentBytes = 64 << 10
+
+	// maxPDFScan is how much of a PDF is read to find its text, which may
+	// be anywhere in the file
+	maxPDFScan = 32 << 20
+
+	// pdfWordGap is the kerning in a TJ array taken to separate words
+	pdfWordGap = 200
+)
+
+// regexps caches compiled content_matches and regex expressions by pattern
+var regexps sync.Map
+
+// cachedRegexp returns the compiled expression of a content_matches or
+// regex
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexps.Store(pattern, re)
+	return re, nil
+}
+
+// validateContent checks a rule's content_matches and content_bytes
+func (r *Rule) validateContent() error {
+	if r.ContentMatches == "" {
+		if r.ContentBytes != 0 {
+			return fmt.Errorf("content_bytes needs content_matches")
+		}
+		return nil
+	}
+	if _, err := cachedRegexp(r.ContentMatches); err != nil {
+		return fmt.Errorf("invalid content_matches: %w", err)
+	}
+	if r.ContentBytes < 0 {
+		return fmt.Errorf("content_bytes must not be negative")
+	}
+	return nil
+}
+
+// matchesContent reports whether the text of the file matches the rule's
+// content_matches, if it has one. Files that aren't text or a PDF with
+// text in it never match.
+func (r *Rule) matchesContent(c *candidate) bool {
+	if r.ContentMatches == "" {
+		return true
+	}
+	re, err := cachedRegexp(r.ContentMatches)
+	if err != nil {
+		return false
+	}
+	limit := int(r.ContentBytes)
+	if limit == 0 {
+		limit = defaultContentBytes
+	}
+	return re.Match(c.text(limit))
+}
+
+// text returns up to limit bytes of the file's text: the start of a text
+// file, or the text extracted from a PDF
+func (c *candidate) text(limit int) []byte {
+	if text, ok := c.texts[limit]; ok {
+		return text
+	}
+	if c.texts == nil {
+		c.texts = make(map[int][]byte)
+	}
+	text, err := readText(c.path, limit)
+	if err != nil {
+		slog.Warn("Failed to read file for content matching", "file", c.path, "error", err)
+	}
+	c.texts[limit] = text
+	return text
+}
+
+// readText reads up to limit bytes of the text of a file
+func readText(path string, limit int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 5)
+	n, _ := io.ReadFull(f, head)
+	if string(head[:n]) == "%PDF-" {
+		data, err := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(head), f), maxPDFScan))
+		if err != nil {
+			return nil, err
+		}
+		return pdfText(data, limit), nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(head[:n]), f), int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	// NUL bytes don't occur in text, whatever its encoding but UTF-16
+	if bytes.IndexByte(data, 0) != -1 {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// pdfText extracts up to limit bytes of text from the content streams of
+// a PDF, decompressing those that use the Flate filter. Only text shown
+// with literal strings is found; documents that are scanned images, or
+// whose fonts use custom encodings, have no text to match.
+func pdfText(data []byte, limit int) []byte {
+	var text bytes.Buffer
+	for len(data) > 0 && text.Len() < limit {
+		start := bytes.Index(data, []byte("stream"))
+		if start == -1 {
+			break
+		}
+		body := data[start+len("stream"):]
+		body = bytes.TrimPrefix(bytes.TrimPrefix(body, []byte("\r")), []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end == -1 {
+			break
+		}
+		stream := body[:end]
+		data = body[end+len("endstream"):]
+
+		if r, err := zlib.NewReader(bytes.NewReader(stream)); err == nil {
+			inflated, _ := io.ReadAll(io.LimitReader(r, maxPDFScan))
+			r.Close()
+			stream = inflated
+		}
+		// Images, fonts and other binary streams hold no text
+		if bytes.IndexByte(stream, 0) == -1 {
+			pdfStreamText(&text, stream)
+		}
+	}
+	if text.Len() > limit {
+		return text.Bytes()[:limit]
+	}
+	return text.Bytes()
+}
+
+// pdfStreamText appends the literal strings shown by the text operators of
+// a content stream. The pieces of a TJ array, split for kerning, are joined
+// unless moved apart as far as a space, and each text object ends a line.
+func pdfStreamText(text *bytes.Buffer, stream []byte) {
+	start := text.Len()
+	array := false
+	for i := 0; i < len(stream); i++ {
+		switch c := stream[i]; {
+		case c == '(':
+			s, n := pdfLiteral(stream[i:])
+			text.WriteString(s)
+			i += n - 1
+		case c == '[':
+			array = true
+		case array && (c == '-' || c == '.' || c >= '0' && c <= '9'):
+			n := 1
+			for i+n < len(stream) && (stream[i+n] == '.' || stream[i+n] >= '0' && stream[i+n] <= '9') {
+				n++
+			}
+			// Offsets are in thousandths of the font size, with words
+			// usually set a third of it apart
+			if offset, err := strconv.ParseFloat(string(stream[i:i+n]), 64); err == nil && offset < -pdfWordGap {
+				text.WriteByte(' ')
+			}
+			i += n - 1
+		case c == ']':
+			array = false
+			text.WriteByte(' ')
+		case c == 'T':
+			if i+1 < len(stream) && stream[i+1] == 'j' {
+				text.WriteByte(' ')
+			}
+		case c == 'E':
+			if i+1 < len(stream) && stream[i+1] == 'T' && text.Len() > start {
+				text.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// pdfLiteral decodes the PDF literal string at the start of b, returning
+// it and the number of bytes it took up
+func pdfLiteral(b []byte) (string, int) {
+	var s strings.Builder
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; c {
+		case '(':
+			if depth > 0 {
+				s.WriteByte(c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s.String(), i + 1
+			}
+			s.WriteByte(c)
+		case '\\':
+			if i+1 >= len(b) {
+				return s.String(), len(b)
+			}
+			i++
+			switch e := b[i]; e {
+			case 'n':
+				s.WriteByte('\n')
+			case 'r':
+				s.WriteByte('\r')
+			case 't':
+				s.WriteByte('\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// A line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v, n := 0, 0
+					for n < 3 && i+n < len(b) && b[i+n] >= '0' && b[i+n] <= '7' {
+						v = v*8 + int(b[i+n]-'0')
+						n++
+					}
+					s.WriteByte(byte(v))
+					i += n - 1
+				} else {
+					s.WriteByte(e)
+				}
+			}
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String(), len(b)
+}
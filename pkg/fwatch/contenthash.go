@@ -0,0 +1,93 @@
+package fwatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHashDirs is how many directory levels content hash names fan out
+// into, enough for millions of files with a few hundred per directory
+const defaultHashDirs = 2
+
+// hashDirs returns how many directory levels content hash names fan out into
+func (f *FilenameOptions) hashDirs() int {
+	if f.HashDirs != nil {
+		return *f.HashDirs
+	}
+	return defaultHashDirs
+}
+
+// contentHashName returns the content-addressed name of a file relative to
+// the destination, such as ab/cd/abcd….pdf
+func (f *FilenameOptions) contentHashName(filePath string) (string, error) {
+	sum, err := hashFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("hashing file for its content hash name: %w", err)
+	}
+	parts := make([]string, 0, f.hashDirs()+1)
+	for i := range f.hashDirs() {
+		parts = append(parts, sum[2*i:2*i+2])
+	}
+	parts = append(parts, sum+strings.ToLower(filepath.Ext(filePath)))
+	return filepath.Join(parts...), nil
+}
+
+// sidecarMu serializes updates of sidecar files, so two files with the same
+// content arriving at once both get recorded
+var sidecarMu sync.Mutex
+
+// sidecar lists the names a content-addressed file arrived under
+type sidecar struct {
+	SHA256 string         `json:"sha256"`
+	Names  []sidecarEntry `json:"names"`
+}
+
+// sidecarEntry is one arrival of a content-addressed file
+type sidecarEntry struct {
+	Name   string    `json:"name"`
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+// sidecarPath returns the path of the sidecar file of a stored file
+func sidecarPath(stored string) string {
+	return stored + ".json"
+}
+
+// recordOriginalName adds the name filePath arrived under to the sidecar
+// of the content-addressed file stored at stored
+func recordOriginalName(stored, filePath string) error {
+	sidecarMu.Lock()
+	defer sidecarMu.Unlock()
+
+	path := sidecarPath(stored)
+	var s sidecar
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("reading sidecar %s: %w", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("reading sidecar: %w", err)
+	}
+	// A duplicate left in the watch is skipped again on every event
+	if slices.ContainsFunc(s.Names, func(e sidecarEntry) bool { return e.Source == filePath }) {
+		return nil
+	}
+	s.SHA256 = strings.TrimSuffix(filepath.Base(stored), filepath.Ext(stored))
+	s.Names = append(s.Names, sidecarEntry{Name: filepath.Base(filePath), Source: filePath, Time: time.Now().UTC()})
+
+	data, err = json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
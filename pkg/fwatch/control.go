@@ -0,0 +1,363 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotRunning is returned by control methods that need a running engine
+var ErrNotRunning = errors.New("engine is not running")
+
+// Stats is a snapshot of a running engine's state and activity
+type Stats struct {
+	Started    time.Time     `json:"started"`
+	Watches    []WatchStatus `json:"watches"`
+	QueueDepth int           `json:"queue_depth"` // files waiting for a worker
+	Spilled    int           `json:"spilled"`     // files waiting in the queue_dir journal
+	Settling   int           `json:"settling"`    // files waiting for events to stop
+	Deferred   int           `json:"deferred"`    // files waiting for a rule's schedule
+	Idle       int           `json:"idle"`        // files waiting for a rule's wait_until_idle
+
+	Debounced int64 `json:"debounced"` // events merged while their file was settling
+	Enqueued  int64 `json:"enqueued"`  // paths added to the queue
+	Coalesced int64 `json:"coalesced"` // events merged into an already queued path
+	Processed int64 `json:"processed"` // files looked at by a worker
+	Succeeded int64 `json:"succeeded"` // results with StatusSuccess
+	Skipped   int64 `json:"skipped"`   // results with StatusSkipped
+	Failed    int64 `json:"failed"`    // results with StatusFailed
+
+	Rules  []RuleStats    `json:"rules"`  // per rule, in config order
+	Errors []ErrorStatus  `json:"errors"` // the latest failures, newest first
+	Recent []RecentResult `json:"recent"` // the latest results, newest first
+}
+
+// RuleStats counts the results of one rule in Stats
+type RuleStats struct {
+	Name      string    `json:"name"`
+	Succeeded int64     `json:"succeeded"`
+	Skipped   int64     `json:"skipped"`
+	Failed    int64     `json:"failed"`
+	Last      time.Time `json:"last,omitzero"` // when it last handled a file
+}
+
+// ErrorStatus is a failed attempt in Stats
+type ErrorStatus struct {
+	Time    time.Time `json:"time"`
+	File    string    `json:"file"`
+	Rule    string    `json:"rule"`
+	Error   string    `json:"error"`
+	Attempt int       `json:"attempt"`
+}
+
+// recentErrors is how many of the latest failures Stats reports
+const recentErrors = 10
+
+// RecentResult is a file a rule handled, in Stats
+type RecentResult struct {
+	Time     time.Time `json:"time"`
+	File     string    `json:"file"`
+	Rule     string    `json:"rule"`
+	Action   string    `json:"action"`
+	Status   Status    `json:"status"`
+	DestPath string    `json:"dest_path,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// recentResults is how many of the latest results Stats reports
+const recentResults = 20
+
+// WatchStatus describes a watched directory in Stats
+type WatchStatus struct {
+	Path    string `json:"path"`
+	Backend string `json:"backend"`
+	Paused  bool   `json:"paused"`
+	Held    int    `json:"held"`             // files collected while paused
+	Polled  int    `json:"polled,omitempty"` // subdirectories polled past the watch limit
+
+	// Health is "ok", or "down" while the directory is gone and the
+	// watchdog tries to re-establish the watch; Error says why it is down
+	Health    string    `json:"health"`
+	Error     string    `json:"error,omitempty"`
+	DownSince time.Time `json:"down_since,omitzero"`
+	NextRetry time.Time `json:"next_retry,omitzero"`
+}
+
+// resultCounts counts results by status, overall and per rule, and keeps
+// the latest results and failures
+type resultCounts struct {
+	succeeded, skipped, failed atomic.Int64
+
+	mu     sync.Mutex
+	rules  map[string]*RuleStats
+	errors []ErrorStatus  // oldest first
+	recent []RecentResult // oldest first
+}
+
+func (c *resultCounts) add(r Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rules == nil {
+		c.rules = make(map[string]*RuleStats)
+	}
+	rule := c.rules[r.Rule]
+	if rule == nil {
+		rule = &RuleStats{Name: r.Rule}
+		c.rules[r.Rule] = rule
+	}
+	rule.Last = r.Time
+	if len(c.recent) == recentResults {
+		c.recent = slices.Delete(c.recent, 0, 1)
+	}
+	c.recent = append(c.recent, RecentResult{Time: r.Time, File: r.Path, Rule: r.Rule, Action: r.Action,
+		Status: r.Status, DestPath: redactDestination(r.DestPath), Reason: r.Reason})
+
+	switch r.Status {
+	case StatusSuccess:
+		c.succeeded.Add(1)
+		rule.Succeeded++
+	case StatusSkipped:
+		c.skipped.Add(1)
+		rule.Skipped++
+	case StatusFailed:
+		c.failed.Add(1)
+		rule.Failed++
+		if len(c.errors) == recentErrors {
+			c.errors = slices.Delete(c.errors, 0, 1)
+		}
+		c.errors = append(c.errors, ErrorStatus{Time: r.Time, File: r.Path, Rule: r.Rule, Error: r.Err.Error(), Attempt: r.Attempt})
+	}
+}
+
+// snapshot returns the counts of the configured rules, in order, and the
+// latest failures and results, newest first
+func (c *resultCounts) snapshot(rules []Rule) ([]RuleStats, []ErrorStatus, []RecentResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make([]RuleStats, 0, len(rules))
+	for _, rule := range rules {
+		if counted := c.rules[rule.Name]; counted != nil {
+			stats = append(stats, *counted)
+		} else {
+			stats = append(stats, RuleStats{Name: rule.Name})
+		}
+	}
+	errors := append(make([]ErrorStatus, 0, len(c.errors)), c.errors...)
+	slices.Reverse(errors)
+	recent := append(make([]RecentResult, 0, len(c.recent)), c.recent...)
+	slices.Reverse(recent)
+	return stats, errors, recent
+}
+
+// Stats returns a snapshot of the engine's watches, queue and counters
+func (e *Engine) Stats() Stats {
+	config := e.config.Load()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stats := Stats{
+		Started:   e.started,
+		Deferred:  len(e.deferred),
+		Idle:      len(e.idle),
+		Succeeded: e.counts.succeeded.Load(),
+		Skipped:   e.counts.skipped.Load(),
+		Failed:    e.counts.failed.Load(),
+	}
+	stats.Rules, stats.Errors, stats.Recent = e.counts.snapshot(config.Rules)
+	if e.pool != nil {
+		stats.QueueDepth = len(e.pool.queue)
+		stats.Spilled = e.pool.spilled()
+		stats.Settling = e.pool.debounce.waiting()
+		stats.Debounced = e.pool.stats.Debounced.Load()
+		stats.Enqueued = e.pool.stats.Enqueued.Load()
+		stats.Coalesced = e.pool.stats.Coalesced.Load()
+		stats.Processed = e.pool.stats.Processed.Load()
+	}
+	for _, watch := range config.Watches {
+		held, paused := e.paused[watch.Path]
+		status := WatchStatus{
+			Path:    watch.Path,
+			Backend: config.backendFor(&watch),
+			Paused:  paused,
+			Held:    len(held),
+			Health:  HealthOK,
+		}
+		if e.watcher != nil {
+			status.Polled = e.watcher.polled(watch.Path)
+		}
+		if h := e.health[watch.Path]; h != nil && h.down() {
+			status.Health, status.Error = HealthDown, h.err.Error()
+			status.DownSince, status.NextRetry = h.since, h.next
+		}
+		stats.Watches = append(stats.Watches, status)
+	}
+	return stats
+}
+
+// Pause stops processing files in the given watch directories, or in all
+// of them if none are given. Events keep being collected and the files are
+// processed once the directory is resumed.
+func (e *Engine) Pause(paths ...string) error {
+	paths, err := e.resolveWatches(paths)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, path := range paths {
+		if _, ok := e.paused[path]; !ok {
+			e.paused[path] = make(map[string]struct{})
+			slog.Info("Paused watch directory", "watch_dir", path)
+		}
+	}
+	return nil
+}
+
+// Resume restarts processing in the given watch directories, or in all of
+// them if none are given, and queues the files collected while paused
+func (e *Engine) Resume(paths ...string) error {
+	paths, err := e.resolveWatches(paths)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	pool := e.pool
+	var resumed []string
+	for _, path := range paths {
+		held, ok := e.paused[path]
+		if !ok {
+			continue
+		}
+		delete(e.paused, path)
+		for file := range held {
+			resumed = append(resumed, file)
+		}
+		slog.Info("Resumed watch directory", "watch_dir", path, "held", len(held))
+	}
+	e.mu.Unlock()
+
+	if pool != nil {
+		// Enqueueing blocks while the queue is full
+		go func() {
+			for _, file := range resumed {
+				pool.enqueue(file)
+			}
+		}()
+	}
+	return nil
+}
+
+// holdIfPaused records path for later if its watch directory is paused,
+// reporting whether it was held
+func (e *Engine) holdIfPaused(config *Config, path string) bool {
+	watch := config.watchFor(path)
+	if watch == nil {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	held, ok := e.paused[watch.Path]
+	if ok {
+		held[path] = struct{}{}
+	}
+	return ok
+}
+
+// Rescan queues every file currently in the given watch directories, or in
+// all of them if none are given, as if it had just been created. Recursive
+// watches are walked, skipping excluded directories. It returns the number
+// of files queued.
+func (e *Engine) Rescan(paths ...string) (int, error) {
+	paths, err := e.resolveWatches(paths)
+	if err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	pool := e.pool
+	e.mu.Unlock()
+	if pool == nil {
+		return 0, ErrNotRunning
+	}
+
+	config := e.config.Load()
+	var files []string
+	for _, path := range paths {
+		found, err := config.watchedFiles(path)
+		if err != nil {
+			return 0, err
+		}
+		slog.Info("Rescanning watch directory", "watch_dir", path, "files", len(found))
+		files = append(files, found...)
+	}
+
+	go func() {
+		for _, file := range files {
+			pool.enqueue(file)
+		}
+	}()
+	return len(files), nil
+}
+
+// watchedFiles lists the files in a watch directory, walking a recursive
+// watch without its excluded directories. Drop folders are listed instead
+// of the files in them.
+func (c *Config) watchedFiles(path string) ([]string, error) {
+	if watch := c.watchAt(path); watch != nil && watch.file {
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil
+		}
+		return []string{path}, nil
+	}
+	watch := c.watchFor(filepath.Join(path, "x"))
+	exclude := c.excludePatterns(watch)
+	var files []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case !d.IsDir():
+			files = append(files, p)
+		case p != path && watch.DropFolders && filepath.Dir(p) == path:
+			// Drop folders wait to settle and are processed whole
+			files = append(files, p)
+			return filepath.SkipDir
+		case p != path && (!watch.Recursive || isIgnored(p, exclude) || tooDeep(path, p, c.maxDepth(watch))):
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning %s: %w", path, err)
+	}
+	return files, nil
+}
+
+// resolveWatches resolves the watch directories named by a control request,
+// defaulting to all of them
+func (e *Engine) resolveWatches(paths []string) ([]string, error) {
+	all := watchPaths(e.config.Load())
+	if len(paths) == 0 {
+		return all, nil
+	}
+	resolved := make([]string, 0, len(paths))
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if !slices.Contains(all, path) {
+			return nil, fmt.Errorf("not a watch directory: %s", path)
+		}
+		resolved = append(resolved, path)
+	}
+	return resolved, nil
+}
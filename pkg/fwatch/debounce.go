@@ -0,0 +1,84 @@
+package fwatch
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultDebounce is how long a path must go without events before it is
+// queued, when the config does not set debounce
+const defaultDebounce = 250 * time.Millisecond
+
+// debouncer delays each path until no new event has arrived for it for a
+// quiet period, so a burst of events, such as the many writes of a large
+// download, leads to a single processing attempt
+type debouncer struct {
+	delay time.Duration
+	fire  func(path string)
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+	stopped bool
+}
+
+// newDebouncer returns a debouncer calling fire for each path once it has
+// been quiet for delay
+func newDebouncer(delay time.Duration, fire func(path string)) *debouncer {
+	if delay <= 0 {
+		delay = defaultDebounce
+	}
+	return &debouncer{delay: delay, fire: fire, pending: make(map[string]*time.Timer)}
+}
+
+// add records an event for path, restarting its quiet period. It reports
+// whether the event was merged into one already waiting.
+func (d *debouncer) add(path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return false
+	}
+
+	if timer, ok := d.pending[path]; ok && timer.Reset(d.delay) {
+		return true
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		// A later event may have replaced this timer after it fired
+		current := d.pending[path] == timer
+		if current {
+			delete(d.pending, path)
+		}
+		stopped := d.stopped
+		d.mu.Unlock()
+		if current && !stopped {
+			d.fire(path)
+		}
+	})
+	d.pending[path] = timer
+	return false
+}
+
+// waiting returns the number of paths in their quiet period
+func (d *debouncer) waiting() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// stop cancels all pending paths and returns them; later events are
+// dropped
+func (d *debouncer) stop() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	paths := make([]string, 0, len(d.pending))
+	for path, timer := range d.pending {
+		timer.Stop()
+		delete(d.pending, path)
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,111 @@
+package fwatch
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firedPaths collects the paths a debouncer fires
+type firedPaths struct {
+	mu    sync.Mutex
+	paths []string
+	fired chan struct{}
+}
+
+func newFiredPaths() *firedPaths {
+	return &firedPaths{fired: make(chan struct{}, 100)}
+}
+
+func (f *firedPaths) fire(path string) {
+	f.mu.Lock()
+	f.paths = append(f.paths, path)
+	f.mu.Unlock()
+	f.fired <- struct{}{}
+}
+
+func (f *firedPaths) get() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.paths)
+}
+
+func TestDebouncerMergesBursts(t *testing.T) {
+	fired := newFiredPaths()
+	d := newDebouncer(50*time.Millisecond, fired.fire)
+
+	if d.add("/watch/a") {
+		t.Error("first event merged")
+	}
+	for range 5 {
+		time.Sleep(10 * time.Millisecond)
+		if !d.add("/watch/a") {
+			t.Error("event during the quiet period not merged")
+		}
+	}
+	d.add("/watch/b")
+	if n := d.waiting(); n != 2 {
+		t.Errorf("waiting = %d, want 2", n)
+	}
+
+	for range 2 {
+		select {
+		case <-fired.fired:
+		case <-time.After(time.Second):
+			t.Fatal("paths not fired")
+		}
+	}
+	got := fired.get()
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"/watch/a", "/watch/b"}) {
+		t.Errorf("fired %q, want each path once", got)
+	}
+	if n := d.waiting(); n != 0 {
+		t.Errorf("waiting = %d after firing, want 0", n)
+	}
+}
+
+func TestDebouncerRestartsQuietPeriod(t *testing.T) {
+	fired := newFiredPaths()
+	d := newDebouncer(60*time.Millisecond, fired.fire)
+	start := time.Now()
+	d.add("/watch/a")
+	time.Sleep(40 * time.Millisecond)
+	d.add("/watch/a")
+
+	select {
+	case <-fired.fired:
+	case <-time.After(time.Second):
+		t.Fatal("path not fired")
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("fired after %s, want only once quiet for the delay after the last event", waited)
+	}
+}
+
+func TestDebouncerStop(t *testing.T) {
+	fired := newFiredPaths()
+	d := newDebouncer(20*time.Millisecond, fired.fire)
+	d.add("/watch/a")
+	d.add("/watch/b")
+
+	pending := d.stop()
+	slices.Sort(pending)
+	if !slices.Equal(pending, []string{"/watch/a", "/watch/b"}) {
+		t.Errorf("stop returned %q, want both paths", pending)
+	}
+	if d.add("/watch/c") {
+		t.Error("event after stop merged")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := fired.get(); len(got) != 0 {
+		t.Errorf("fired %q after stop", got)
+	}
+}
+
+func TestDebouncerDefaultDelay(t *testing.T) {
+	if d := newDebouncer(0, func(string) {}); d.delay != defaultDebounce {
+		t.Errorf("delay = %s, want %s", d.delay, defaultDebounce)
+	}
+}
@@ -0,0 +1,259 @@
+package fwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Duplicate handling modes for a file identical to one already stored
+const (
+	DuplicateSkip     = "skip"
+	DuplicateHardlink = "hardlink"
+	DuplicateDelete   = "delete"
+)
+
+// duplicateModes lists the valid duplicates values
+var duplicateModes = []string{DuplicateSkip, DuplicateHardlink, DuplicateDelete}
+
+// hashBucket maps SHA-256 digests to the path of a file with that content
+const hashBucket = "sha256"
+
+// hashIndex is a persistent map from content hash to a stored file, used
+// to find duplicates without rehashing destinations. Entries are checked
+// against the file before use, so stale ones are harmless. The database
+// stays open while the engine runs.
+type hashIndex struct {
+	mu   sync.Mutex
+	path string
+	db   *bolt.DB
+}
+
+// open returns the index at path, opening it on first use and again if
+// hash_index changed with a reload
+func (x *hashIndex) open(path string) (*bolt.DB, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.db != nil && x.path == path {
+		return x.db, nil
+	}
+	if x.db != nil {
+		x.db.Close()
+		x.db = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: historyOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(hashBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	x.db, x.path = db, path
+	return db, nil
+}
+
+// close closes the index, if it is open
+func (x *hashIndex) close() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.db != nil {
+		x.db.Close()
+		x.db = nil
+	}
+}
+
+// add records that path has the content hash sum
+func (x *hashIndex) add(indexPath, sum, path string) error {
+	db, err := x.open(indexPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(hashBucket)).Put([]byte(sum), []byte(path))
+	})
+}
+
+// lookup returns the indexed path for sum, if any
+func (x *hashIndex) lookup(indexPath, sum string) (string, error) {
+	db, err := x.open(indexPath)
+	if err != nil {
+		return "", err
+	}
+	var path string
+	err = db.View(func(tx *bolt.Tx) error {
+		path = string(tx.Bucket([]byte(hashBucket)).Get([]byte(sum)))
+		return nil
+	})
+	return path, err
+}
+
+// findDuplicate looks for a stored file identical to the one at filePath:
+// first in the hash index, if configured, then among same-sized files in
+// the rule's destination. It returns the duplicate's path, or "" if there
+// is none, and the file's hash.
+func (e *Engine) findDuplicate(config *Config, rule *Rule, filePath string, info os.FileInfo) (string, string, error) {
+	sum, err := hashFile(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("hashing file: %w", err)
+	}
+
+	if config.HashIndex != "" {
+		indexed, err := e.hashes.lookup(config.HashIndex, sum)
+		if err != nil {
+			slog.Warn("Failed to read hash index", "hash_index", config.HashIndex, "error", err)
+		} else if indexed != "" && indexed != filePath && isCopyOf(indexed, info, sum) {
+			return indexed, sum, nil
+		}
+	}
+
+	entries, err := os.ReadDir(rule.Destination)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", sum, nil
+		}
+		return "", "", fmt.Errorf("reading destination: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		candidate := filepath.Join(rule.Destination, entry.Name())
+		if candidate == filePath {
+			continue
+		}
+		if isCopyOf(candidate, info, "") {
+			other, err := hashFile(candidate)
+			if err != nil {
+				continue
+			}
+			if config.HashIndex != "" {
+				e.hashes.add(config.HashIndex, other, candidate)
+			}
+			if other == sum {
+				return candidate, sum, nil
+			}
+		}
+	}
+	return "", sum, nil
+}
+
+// isCopyOf reports whether path is a regular file of the same size as
+// info and, if sum is given, with that content hash
+func isCopyOf(path string, info os.FileInfo, sum string) bool {
+	other, err := os.Stat(path)
+	if err != nil || !other.Mode().IsRegular() || other.Size() != info.Size() || os.SameFile(other, info) {
+		return false
+	}
+	if sum == "" {
+		return true
+	}
+	otherSum, err := hashFile(path)
+	return err == nil && otherSum == sum
+}
+
+// moveOrDedupe moves a matched file like moveToDestination, unless the
+// rule handles duplicates and an identical file is already stored. Then
+// the file is skipped, deleted, or replaced by a hard link at its
+// destination. duplicate is the path of the identical file, if found.
+func (e *Engine) moveOrDedupe(ctx context.Context, config *Config, rule *Rule, filePath string, info os.FileInfo, limits *limiter) (destPath, skipReason, duplicate string, err error) {
+	if rule.Duplicates == "" {
+		destPath, skipReason, err = moveToDestination(ctx, filePath, rule, info, limits)
+		return destPath, skipReason, "", err
+	}
+
+	duplicate, _, err = e.findDuplicate(config, rule, filePath, info)
+	if err != nil {
+		return "", "", "", err
+	}
+	if duplicate == "" {
+		destPath, skipReason, err = moveToDestination(ctx, filePath, rule, info, limits)
+		return destPath, skipReason, "", err
+	}
+
+	switch rule.Duplicates {
+	case DuplicateSkip:
+		return "", "duplicate of " + duplicate, duplicate, nil
+
+	case DuplicateDelete:
+		if _, err := deleteFile(config.Trash, filePath, rule.DeleteMode); err != nil {
+			return "", "", duplicate, fmt.Errorf("removing duplicate: %w", err)
+		}
+		return duplicate, "", duplicate, nil
+
+	default:
+		name, err := rule.destName(filePath)
+		if err != nil {
+			return "", "", duplicate, err
+		}
+		destPath = filepath.Join(rule.Destination, name)
+		if duplicate == destPath {
+			// Already stored under this name
+			if _, err := deleteFile(config.Trash, filePath, rule.DeleteMode); err != nil {
+				return "", "", duplicate, fmt.Errorf("removing duplicate: %w", err)
+			}
+			return duplicate, "", duplicate, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return "", "", duplicate, fmt.Errorf("creating destination directory: %w", err)
+		}
+		resolved, reason, err := placeResolved(filePath, destPath, rule.conflictPolicy(), rule.conflictSuffix(), func(path string, replace bool) error {
+			if replace {
+				return linkReplacing(duplicate, path)
+			}
+			return os.Link(duplicate, path)
+		})
+		if err == nil && resolved == "" {
+			return "", reason, duplicate, nil
+		}
+		if err != nil {
+			// Different filesystem or no hard link support; store a copy
+			slog.Debug("Could not hard link duplicate, moving instead", "file", filePath, "duplicate", duplicate, "error", err)
+			destPath, skipReason, err = moveToDestination(ctx, filePath, rule, info, limits)
+			return destPath, skipReason, "", err
+		}
+		if err := os.Remove(filePath); err != nil {
+			return resolved, "", duplicate, fmt.Errorf("removing duplicate: %w", err)
+		}
+		if rule.Checksums != "" {
+			if err := recordChecksum(rule.Checksums, resolved, false); err != nil {
+				return resolved, "", duplicate, err
+			}
+		}
+		return resolved, "", duplicate, nil
+	}
+}
+
+// indexMoved adds a moved file to the hash index
+func (e *Engine) indexMoved(config *Config, result *Result) {
+	if config.HashIndex == "" || result.Checksum == "" || result.DestPath == "" {
+		return
+	}
+	if err := e.hashes.add(config.HashIndex, result.Checksum, result.DestPath); err != nil {
+		slog.Warn("Failed to update hash index", "hash_index", config.HashIndex, "error", err)
+	}
+}
+
+// validDuplicates checks a rule's duplicates mode
+func validDuplicates(mode string) error {
+	if mode != "" && !slices.Contains(duplicateModes, mode) {
+		return fmt.Errorf("unknown duplicates mode %q (want one of %v)", mode, duplicateModes)
+	}
+	return nil
+}
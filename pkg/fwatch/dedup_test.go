@@ -0,0 +1,65 @@
+package fwatch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashIndex(t *testing.T) {
+	dir := t.TempDir()
+	var x hashIndex
+	defer x.close()
+
+	first := filepath.Join(dir, "first", "hashes.db")
+	if err := x.add(first, "abc", "/archive/photo.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := x.lookup(first, "abc"); err != nil || path != "/archive/photo.jpg" {
+		t.Errorf("lookup = %q, %v; want /archive/photo.jpg", path, err)
+	}
+	if path, err := x.lookup(first, "def"); err != nil || path != "" {
+		t.Errorf("lookup of an unknown hash = %q, %v; want none", path, err)
+	}
+
+	// A reload pointing hash_index elsewhere switches databases
+	second := filepath.Join(dir, "second.db")
+	if path, err := x.lookup(second, "abc"); err != nil || path != "" {
+		t.Errorf("lookup in the new index = %q, %v; want none", path, err)
+	}
+	if path, err := x.lookup(first, "abc"); err != nil || path != "/archive/photo.jpg" {
+		t.Errorf("lookup after going back = %q, %v; want /archive/photo.jpg", path, err)
+	}
+
+	x.close()
+	if path, err := x.lookup(first, "abc"); err != nil || path != "/archive/photo.jpg" {
+		t.Errorf("lookup after reopening = %q, %v; want /archive/photo.jpg", path, err)
+	}
+}
+
+func TestHardlinkDuplicateAlreadyStored(t *testing.T) {
+	e, dir := newTestEngine(t)
+	dest := t.TempDir()
+	stored := filepath.Join(dest, "photo.jpg")
+	writeFile(t, stored, "same")
+	path := filepath.Join(dir, "photo.jpg")
+	writeFile(t, path, "same")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := &Rule{Destination: dest, Duplicates: DuplicateHardlink}
+	got, _, duplicate, err := e.moveOrDedupe(t.Context(), e.config.Load(), rule, path, info, nil)
+	if err != nil || got != stored || duplicate != stored {
+		t.Fatalf("moveOrDedupe = %q, %q, %v; want the stored copy", got, duplicate, err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("incoming file left in the watch: %v", err)
+	}
+	if data, err := os.ReadFile(stored); err != nil || string(data) != "same" {
+		t.Errorf("stored copy = %q, %v", data, err)
+	}
+}
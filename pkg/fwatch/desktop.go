@@ -0,0 +1,141 @@
+package fwatch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// desktopNotifyTimeout bounds how long a notification command may run
+const desktopNotifyTimeout = 10 * time.Second
+
+// NotifyMode selects which results produce a desktop notification. In
+// YAML it is written as true, false or "errors_only".
+type NotifyMode string
+
+const (
+	NotifyOff    NotifyMode = "off"
+	NotifyAll    NotifyMode = "all"
+	NotifyErrors NotifyMode = "errors_only"
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (m *NotifyMode) UnmarshalYAML(value *yaml.Node) error {
+	switch strings.ToLower(value.Value) {
+	case "true", "yes", "on", "all":
+		*m = NotifyAll
+	case "false", "no", "off":
+		*m = NotifyOff
+	case "errors_only", "errors":
+		*m = NotifyErrors
+	default:
+		return fmt.Errorf("invalid notify value %q (want true, false or errors_only)", value.Value)
+	}
+	return nil
+}
+
+// notifyMode returns the desktop notification mode for a rule, falling
+// back to the global setting
+func (c *Config) notifyMode(rule *Rule) NotifyMode {
+	if rule.Notify != "" {
+		return rule.Notify
+	}
+	if c.Notify != "" {
+		return c.Notify
+	}
+	return NotifyOff
+}
+
+// notifyDesktop shows a desktop notification for a result if the mode asks
+// for it. Failed attempts that will be retried are not reported. The
+// notification is sent in the background so processing is not delayed.
+func notifyDesktop(mode NotifyMode, r Result) {
+	if r.RetryIn > 0 {
+		return
+	}
+	failed := r.Status == StatusFailed
+	if mode == NotifyOff || mode == "" || (mode == NotifyErrors && !failed) {
+		return
+	}
+
+	name := filepath.Base(r.Path)
+	var title, body string
+	switch {
+	case failed:
+		title = "fwatch: failed to process " + name
+		body = r.Err.Error()
+	case r.Status == StatusSkipped:
+		title = "fwatch: skipped " + name
+		body = r.Reason
+	case r.DestPath != "":
+		title = "fwatch: moved " + name
+		body = "→ " + r.DestPath
+	default:
+		title = "fwatch: processed " + name
+		body = fmt.Sprintf("%s (%s)", r.Rule, r.Action)
+	}
+
+	go func() {
+		if err := sendDesktopNotification(title, body, failed); err != nil {
+			slog.Warn("Failed to send desktop notification", "file", r.Path, "error", err)
+		}
+	}()
+}
+
+// sendDesktopNotification shows a notification with the platform's native
+// tool: notify-send on Linux and BSD, osascript on macOS and a PowerShell
+// toast on Windows
+func sendDesktopNotification(title, body string, urgent bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), desktopNotifyTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	case "windows":
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript(title, body))
+	default:
+		urgency := "normal"
+		if urgent {
+			urgency = "critical"
+		}
+		cmd = exec.CommandContext(ctx, "notify-send", "--app-name=fwatch", "--urgency="+urgency, title, body)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string literal
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// windowsToastScript returns a PowerShell script that shows a toast
+// notification using the built-in Windows Runtime APIs
+func windowsToastScript(title, body string) string {
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+	return `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode(` + quote(title) + `)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode(` + quote(body) + `)) > $null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('fwatch').Show($toast)`
+}
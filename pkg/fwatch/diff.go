@@ -0,0 +1,249 @@
+package fwatch
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// diffConfig describes the differences between two configs in a
+// human-readable form, one entry per change
+func diffConfig(old, new *Config) []string {
+	var changes []string
+
+	oldPaths, newPaths := watchPaths(old), watchPaths(new)
+	for _, path := range newPaths {
+		if !slices.Contains(oldPaths, path) {
+			changes = append(changes, fmt.Sprintf("watch added: %s", path))
+		}
+	}
+	for _, watch := range old.Watches {
+		if !slices.Contains(newPaths, watch.Path) {
+			changes = append(changes, fmt.Sprintf("watch removed: %s", watch.Path))
+		} else if i := slices.Index(newPaths, watch.Path); !reflect.DeepEqual(watch, new.Watches[i]) {
+			changes = append(changes, fmt.Sprintf("watch changed: %s", watch.Path))
+		}
+	}
+	if !slices.Equal(old.ignorePatterns(nil), new.ignorePatterns(nil)) {
+		changes = append(changes, fmt.Sprintf("ignore: %v → %v", old.ignorePatterns(nil), new.ignorePatterns(nil)))
+	}
+	if old.handlesAtomicSaves() != new.handlesAtomicSaves() {
+		changes = append(changes, fmt.Sprintf("atomic_saves: %t → %t", old.handlesAtomicSaves(), new.handlesAtomicSaves()))
+	}
+	if !slices.Equal(old.ExcludeDirs, new.ExcludeDirs) {
+		changes = append(changes, fmt.Sprintf("exclude_dirs: %v → %v", old.ExcludeDirs, new.ExcludeDirs))
+	}
+	if old.OnWatchLimit != new.OnWatchLimit {
+		changes = append(changes, fmt.Sprintf("on_watch_limit: %q → %q", old.OnWatchLimit, new.OnWatchLimit))
+	}
+	if old.Symlinks != new.Symlinks {
+		changes = append(changes, fmt.Sprintf("symlinks: %q → %q", old.Symlinks, new.Symlinks))
+	}
+	if old.ReadOnlySources != new.ReadOnlySources {
+		changes = append(changes, fmt.Sprintf("read_only_sources: %t → %t", old.ReadOnlySources, new.ReadOnlySources))
+	}
+	if !slices.Equal(old.included, new.included) {
+		changes = append(changes, fmt.Sprintf("include: %v → %v", old.included, new.included))
+	}
+	if old.Profile != new.Profile {
+		changes = append(changes, fmt.Sprintf("profile: %q → %q", old.Profile, new.Profile))
+	}
+	if old.Backend != new.Backend {
+		changes = append(changes, fmt.Sprintf("backend: %q → %q", old.Backend, new.Backend))
+	}
+	if old.Workers != new.Workers {
+		changes = append(changes, fmt.Sprintf("workers: %d → %d", old.Workers, new.Workers))
+	}
+	if old.QueueSize != new.QueueSize {
+		changes = append(changes, fmt.Sprintf("queue_size: %d → %d", old.QueueSize, new.QueueSize))
+	}
+	if old.QueueDir != new.QueueDir {
+		changes = append(changes, fmt.Sprintf("queue_dir: %q → %q", old.QueueDir, new.QueueDir))
+	}
+	if old.QuarantineDir != new.QuarantineDir {
+		changes = append(changes, fmt.Sprintf("quarantine_dir: %q → %q", old.QuarantineDir, new.QuarantineDir))
+	}
+	if old.MinFreeSpace != new.MinFreeSpace || old.OnLowSpace != new.OnLowSpace {
+		changes = append(changes, fmt.Sprintf("min_free_space: %s %q → %s %q", old.MinFreeSpace, old.OnLowSpace, new.MinFreeSpace, new.OnLowSpace))
+	}
+	if old.MaxFilesPerMinute != new.MaxFilesPerMinute {
+		changes = append(changes, fmt.Sprintf("max_files_per_minute: %d → %d", old.MaxFilesPerMinute, new.MaxFilesPerMinute))
+	}
+	if old.MaxFileSize != new.MaxFileSize || old.OnMaxFileSize != new.OnMaxFileSize {
+		changes = append(changes, fmt.Sprintf("max_file_size: %s %q → %s %q", old.MaxFileSize, old.OnMaxFileSize, new.MaxFileSize, new.OnMaxFileSize))
+	}
+	if old.MaxDepth != new.MaxDepth {
+		changes = append(changes, fmt.Sprintf("max_depth: %d → %d", old.MaxDepth, new.MaxDepth))
+	}
+	if old.CreateDirs != new.CreateDirs {
+		changes = append(changes, fmt.Sprintf("create_dirs: %t → %t", old.CreateDirs, new.CreateDirs))
+	}
+	if !reflect.DeepEqual(old.Retention, new.Retention) {
+		changes = append(changes, fmt.Sprintf("retention: %d → %d rule(s)", len(old.Retention), len(new.Retention)))
+	}
+	if !reflect.DeepEqual(old.Audit, new.Audit) {
+		changes = append(changes, "audit: changed")
+	}
+	if !reflect.DeepEqual(old.Trash, new.Trash) {
+		changes = append(changes, "trash: changed")
+	}
+	if !reflect.DeepEqual(old.Email, new.Email) {
+		changes = append(changes, "email: changed")
+	}
+	if !reflect.DeepEqual(old.Tracing, new.Tracing) {
+		changes = append(changes, "tracing: changed")
+	}
+	if !reflect.DeepEqual(old.Scan, new.Scan) {
+		changes = append(changes, "scan: changed")
+	}
+	if !reflect.DeepEqual(old.Webhooks, new.Webhooks) {
+		changes = append(changes, fmt.Sprintf("webhooks: %d → %d configured", len(old.Webhooks), len(new.Webhooks)))
+	}
+	if !reflect.DeepEqual(old.Publish, new.Publish) {
+		changes = append(changes, fmt.Sprintf("publish: %d → %d configured", len(old.Publish), len(new.Publish)))
+	}
+
+	for i := 0; i < max(len(old.Rules), len(new.Rules)); i++ {
+		switch {
+		case i >= len(old.Rules):
+			changes = append(changes, fmt.Sprintf("rule %d added: %s", i+1, describeRule(&new.Rules[i])))
+		case i >= len(new.Rules):
+			changes = append(changes, fmt.Sprintf("rule %d removed: %s", i+1, describeRule(&old.Rules[i])))
+		case !reflect.DeepEqual(old.Rules[i], new.Rules[i]):
+			changes = append(changes, fmt.Sprintf("rule %d changed from (%s) to (%s)", i+1, describeRule(&old.Rules[i]), describeRule(&new.Rules[i])))
+		}
+	}
+
+	return changes
+}
+
+// watchPaths returns the paths of all configured watches
+func watchPaths(config *Config) []string {
+	paths := make([]string, len(config.Watches))
+	for i, watch := range config.Watches {
+		paths[i] = watch.Path
+	}
+	return paths
+}
+
+// describeRule returns a short summary of a rule for log messages
+func describeRule(rule *Rule) string {
+	desc := fmt.Sprintf("%v → %s", rule.Extensions, redactDestination(rule.Destination))
+	if rule.Action == ActionExec && rule.Exec != nil {
+		desc = fmt.Sprintf("%v → exec %v", rule.Extensions, rule.Exec.Command)
+	}
+	if rule.Action == ActionPipeline {
+		var steps []string
+		for _, step := range rule.Steps {
+			steps = append(steps, step.Action)
+		}
+		desc = fmt.Sprintf("%v → pipeline %v", rule.Extensions, steps)
+	}
+	if rule.Action == ActionCopy {
+		desc = fmt.Sprintf("%v → copy %s", rule.Extensions, redactDestination(rule.Destination))
+	}
+	if rule.Action == ActionDelete {
+		desc = fmt.Sprintf("%v → delete", rule.Extensions)
+	}
+	if len(rule.MatchDirs) > 0 {
+		desc = fmt.Sprintf("dirs %v → %s", rule.MatchDirs, rule.Destination)
+	}
+	if rule.Action == ActionArchive {
+		desc = fmt.Sprintf("%v → archive %s", rule.Extensions, rule.Destination)
+		if rule.Archive != nil && rule.Archive.Format != "" {
+			desc += fmt.Sprintf(" format=%s", rule.Archive.Format)
+		}
+	}
+	if rule.DeleteMode != "" {
+		desc += " delete_mode=" + rule.DeleteMode
+	}
+	if rule.MinFreeSpace > 0 {
+		desc += " min_free_space=" + rule.MinFreeSpace.String()
+	}
+	if rule.MaxFilesPerMinute > 0 {
+		desc += fmt.Sprintf(" max_files_per_minute=%d", rule.MaxFilesPerMinute)
+	}
+	if rule.MaxFileSize > 0 {
+		desc += " max_file_size=" + rule.MaxFileSize.String()
+	}
+	if rule.Rotate != "" {
+		desc += " rotate=" + rule.Rotate
+	}
+	if rule.Verify != nil {
+		desc += " verify"
+	}
+	if rule.Encrypt != nil {
+		desc += " encrypt"
+	}
+	if rule.Chown != "" {
+		desc += " chown=" + rule.Chown
+	}
+	if rule.Chmod != nil {
+		desc += " chmod=" + rule.Chmod.String()
+	}
+	if rule.Checksums != "" {
+		desc += " checksums=" + rule.Checksums
+	}
+	if len(rule.MimeTypes) > 0 {
+		desc += fmt.Sprintf(" mime_types=%v", rule.MimeTypes)
+	}
+	if rule.MinSize > 0 {
+		desc += fmt.Sprintf(" min_size=%d", rule.MinSize)
+	}
+	if rule.MaxSize > 0 {
+		desc += fmt.Sprintf(" max_size=%d", rule.MaxSize)
+	}
+	if rule.MinAge > 0 {
+		desc += fmt.Sprintf(" min_age=%s", time.Duration(rule.MinAge))
+	}
+	if rule.MaxAge > 0 {
+		desc += fmt.Sprintf(" max_age=%s", time.Duration(rule.MaxAge))
+	}
+	if rule.Regex != "" {
+		desc += fmt.Sprintf(" regex=%q", rule.Regex)
+	}
+	if rule.Expr != "" {
+		desc += fmt.Sprintf(" expr=%q", rule.Expr)
+	}
+	if rule.ContentMatches != "" {
+		desc += fmt.Sprintf(" content_matches=%q", rule.ContentMatches)
+	}
+	if rule.ContentBytes > 0 {
+		desc += fmt.Sprintf(" content_bytes=%d", rule.ContentBytes)
+	}
+	if rule.WaitUntilIdle > 0 {
+		desc += fmt.Sprintf(" wait_until_idle=%s", time.Duration(rule.WaitUntilIdle))
+	}
+	if rule.MaxWait > 0 {
+		desc += fmt.Sprintf(" max_wait=%s", time.Duration(rule.MaxWait))
+	}
+	if rule.Schedule != nil {
+		desc += fmt.Sprintf(" schedule=%q", rule.Schedule)
+	}
+	if rule.Priority != 0 {
+		desc += fmt.Sprintf(" priority=%d", rule.Priority)
+	}
+	if rule.Continue {
+		desc += " continue"
+	}
+	if rule.Scan != nil {
+		desc += " scan"
+	}
+	if rule.Post != nil {
+		desc += " post"
+	}
+	if rule.OnError != nil {
+		desc += " on_error"
+	}
+	if rule.Filename != nil {
+		desc += " filename"
+		if rule.Filename.Template != "" {
+			desc += fmt.Sprintf("=%q", rule.Filename.Template)
+		}
+		if rule.Filename.ContentHash {
+			desc += "=content_hash"
+		}
+	}
+	return desc
+}
@@ -0,0 +1,22 @@
+// Package fwatch is the watching and routing engine behind the fwatch
+// command. It monitors directories and moves, or otherwise acts on, new
+// files according to an ordered list of rules.
+//
+// A minimal embedding looks like this:
+//
+//	engine, err := fwatch.New(fwatch.Config{
+//		WatchDir: "/home/user/Downloads",
+//		Rules: []fwatch.Rule{
+//			{Extensions: []string{".pdf"}, Destination: "/home/user/Documents"},
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	engine.OnResult(func(r fwatch.Result) {
+//		fmt.Println(r.Path, r.Status, r.DestPath)
+//	})
+//	return engine.Run(ctx)
+//
+// The engine logs through the default log/slog logger.
+package fwatch
@@ -0,0 +1,264 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+)
+
+// SeverityOK marks a probe of Config.Doctor that passed
+const SeverityOK Severity = "ok"
+
+// Diagnosis is the outcome of a probe run by Config.Doctor
+type Diagnosis struct {
+	Severity Severity // SeverityOK if the probe passed
+	Subject  string   // What was probed, such as "watch /home/user/Downloads"
+	Message  string
+	Fix      string // What to do about a problem
+}
+
+func (d Diagnosis) String() string {
+	s := fmt.Sprintf("%s: %s: %s", d.Severity, d.Subject, d.Message)
+	if d.Fix != "" {
+		s += "; " + d.Fix
+	}
+	return s
+}
+
+// Doctor probes the system fwatch is about to run on with the config:
+// that the watches can be read and files removed from them, that the
+// destinations and state directories can be written, which moves have to
+// copy across filesystems, and whether recursive watches fit the system's
+// watch limit. Unlike Check it reports what passed too, and a fix for
+// every problem.
+func (c *Config) Doctor() []Diagnosis {
+	var report []Diagnosis
+	add := func(severity Severity, subject, fix, format string, args ...any) {
+		report = append(report, Diagnosis{Severity: severity, Subject: subject, Message: fmt.Sprintf(format, args...), Fix: fix})
+	}
+	as := runningAs()
+
+	for i := range c.Watches {
+		watch := &c.Watches[i]
+		subject := "watch " + watch.Path
+		info, err := os.Stat(watch.Path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			add(SeverityError, subject, "create it, or mount the drive it is on", "does not exist")
+			continue
+		case err != nil:
+			add(SeverityError, subject, fmt.Sprintf("give %s access to it", as), "%v", err)
+			continue
+		case !info.IsDir():
+			if f, err := os.Open(watch.Path); err != nil {
+				add(SeverityError, subject, fmt.Sprintf("give %s read permission on it", as), "can't be read: %v", err)
+			} else {
+				f.Close()
+				add(SeverityOK, subject, "", "file is readable")
+			}
+			continue
+		}
+		if err := checkReadable(watch.Path); err != nil {
+			add(SeverityError, subject, fmt.Sprintf("give %s read and execute permission on it", as), "can't be listed: %v", err)
+			continue
+		}
+		if c.readOnly(watch) {
+			add(SeverityOK, subject, "", "is readable")
+		} else if err := checkWritable(watch.Path); err != nil {
+			add(SeverityError, subject, fmt.Sprintf("give %s write permission on it, or set read_only_sources", as),
+				"files can't be moved or removed from it: %v", err)
+		} else {
+			add(SeverityOK, subject, "", "is readable and writable")
+		}
+	}
+
+	// Each destination is probed once, even if several rules share it
+	var dests []string
+	moved := make(map[string]bool)
+	for i := range c.Rules {
+		for _, rule := range c.Rules[i].actionRules() {
+			if rule.Destination == "" || isRemoteDestination(rule.Destination) {
+				continue
+			}
+			dest := filepath.Clean(rule.Destination)
+			if !slices.Contains(dests, dest) {
+				dests = append(dests, dest)
+			}
+			if !rule.keepsSource() {
+				moved[dest] = true
+			}
+		}
+	}
+	for _, dest := range dests {
+		c.probeDir(&report, "destination "+dest, dest, c.CreateDirs, as)
+	}
+
+	// A move between filesystems is a copy and a delete: slower, and the
+	// destination needs room for the whole file while it is copied
+	for _, dest := range dests {
+		if _, err := os.Stat(dest); !moved[dest] || err != nil {
+			continue
+		}
+		for _, watch := range c.Watches {
+			if c.readOnly(&watch) {
+				continue
+			}
+			if _, err := os.Stat(watch.Path); err != nil {
+				continue
+			}
+			subject := fmt.Sprintf("moves from %s to %s", watch.Path, dest)
+			if sameFilesystem(watch.Path, dest) {
+				add(SeverityOK, subject, "", "are renames on the same filesystem")
+			} else {
+				add(SeverityWarning, subject, "keep both on one filesystem for instant moves, or consider fast_copy and verify_checksum on the rule",
+					"cross filesystems, so each file is copied and then deleted, which takes time and needs free space for the whole file")
+			}
+		}
+	}
+
+	for _, state := range []struct{ name, dir string }{
+		{"quarantine_dir", c.QuarantineDir},
+		{"queue_dir", c.QueueDir},
+		{"history_db", dirOf(c.HistoryDB)},
+		{"hash_index", dirOf(c.HashIndex)},
+		{"audit", dirOf(c.auditPath())},
+		{"trash.dir", c.trashDir()},
+	} {
+		if state.dir != "" {
+			c.probeDir(&report, state.name+" "+state.dir, state.dir, true, as)
+		}
+	}
+
+	c.probeWatchLimit(add)
+	return report
+}
+
+// probeDir adds to the report whether files can be created in dir, or, if
+// it doesn't exist yet and fwatch creates it, in the directory it would be
+// created in
+func (c *Config) probeDir(report *[]Diagnosis, subject, dir string, created bool, as string) {
+	add := func(severity Severity, fix, format string, args ...any) {
+		*report = append(*report, Diagnosis{Severity: severity, Subject: subject, Message: fmt.Sprintf(format, args...), Fix: fix})
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !created:
+		add(SeverityError, "create it, or set create_dirs: true", "does not exist")
+	case errors.Is(err, os.ErrNotExist):
+		parent := existingParent(dir)
+		if err := checkWritable(parent); err != nil {
+			add(SeverityError, fmt.Sprintf("create it, or give %s write permission on %s", as, parent),
+				"does not exist and can't be created in %s: %v", parent, err)
+		} else {
+			add(SeverityOK, "", "does not exist yet and can be created")
+		}
+	case err != nil:
+		add(SeverityError, fmt.Sprintf("give %s access to it", as), "%v", err)
+	case !info.IsDir():
+		add(SeverityError, "point the setting at a directory", "is not a directory")
+	default:
+		if err := checkWritable(dir); err != nil {
+			add(SeverityError, fmt.Sprintf("give %s write permission on it", as), "is not writable: %v", err)
+		} else {
+			add(SeverityOK, "", "is writable")
+		}
+	}
+}
+
+// probeWatchLimit reports how many of the system's watches the recursive
+// watches need
+func (c *Config) probeWatchLimit(add func(severity Severity, subject, fix, format string, args ...any)) {
+	required := 0
+	onLimit := WatchLimitPoll
+	for i := range c.Watches {
+		watch := &c.Watches[i]
+		if c.backendFor(watch) != BackendFsnotify || watch.file {
+			continue
+		}
+		if !watch.Recursive {
+			required++
+			continue
+		}
+		tree := &watchTree{root: watch.Path, exclude: c.excludePatterns(watch), depth: c.maxDepth(watch)}
+		required += countDirs(tree)
+		if c.onWatchLimit(watch) == WatchLimitSkip {
+			onLimit = WatchLimitSkip
+		}
+	}
+	limit, advice := watchLimitAdvice(required)
+	if required == 0 || limit == 0 {
+		return
+	}
+
+	subject := "watch limit"
+	switch {
+	case required > limit && onLimit == WatchLimitSkip:
+		add(SeverityError, subject, advice+", or set on_watch_limit: poll", "%d directories to watch, but the limit is %d; the rest would be skipped", required, limit)
+	case required > limit:
+		add(SeverityWarning, subject, advice, "%d directories to watch, but the limit is %d; the rest are polled", required, limit)
+	case required > limit*3/4:
+		add(SeverityWarning, subject, advice, "%d directories to watch use most of the limit of %d, which other programs share", required, limit)
+	default:
+		add(SeverityOK, subject, "", "%d directories to watch, within the limit of %d", required, limit)
+	}
+}
+
+// checkReadable verifies that the entries of dir can be listed
+func checkReadable(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// existingParent returns the nearest directory above path that exists
+func existingParent(path string) string {
+	for {
+		parent := filepath.Dir(path)
+		if _, err := os.Stat(parent); err == nil || parent == path {
+			return parent
+		}
+		path = parent
+	}
+}
+
+// dirOf returns the directory of a file setting, or "" if it is unset
+func dirOf(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// auditPath returns the audit log's path, or ""
+func (c *Config) auditPath() string {
+	if c.Audit == nil {
+		return ""
+	}
+	return c.Audit.Path
+}
+
+// trashDir returns trash.dir, or ""
+func (c *Config) trashDir() string {
+	if c.Trash == nil {
+		return ""
+	}
+	return c.Trash.Dir
+}
+
+// runningAs names the user fwatch runs as, for advice on permissions
+func runningAs() string {
+	if u, err := user.Current(); err == nil {
+		return "user " + u.Username
+	}
+	return "the user fwatch runs as"
+}
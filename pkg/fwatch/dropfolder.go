@@ -0,0 +1,354 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	// defaultDropSettle is how long nothing in a drop folder must change
+	// before it is processed, when the watch does not set drop_settle
+	defaultDropSettle = 30 * time.Second
+
+	// dropFolderTick is how often drop folders are looked at
+	dropFolderTick = 2 * time.Second
+
+	// dropFolderDrain is how long a processed drop folder is kept track of
+	// to remove it once its files are gone
+	dropFolderDrain = 10 * time.Minute
+)
+
+// dropFolder is a directory created in a drop folder watch that is waiting
+// to settle, or whose files are being processed
+type dropFolder struct {
+	state     treeState
+	changed   time.Time // when something in it last changed
+	pending   bool      // to be processed once settled
+	settled   bool      // queued for processing
+	processed bool      // its files were queued, remove it once they are gone
+}
+
+// treeState summarizes a directory tree to notice whether anything in it
+// changed
+type treeState struct {
+	files   int
+	size    int64
+	modTime time.Time
+}
+
+// dropSettle returns how long a drop folder must stay unchanged
+func (w *Watch) dropSettle() time.Duration {
+	return cmp.Or(time.Duration(w.DropSettle), defaultDropSettle)
+}
+
+// isDropFolder reports whether path is a directory directly inside a drop
+// folder watch
+func (c *Config) isDropFolder(path string) (*Watch, bool) {
+	watch := c.watchFor(path)
+	return watch, watch != nil && watch.DropFolders && filepath.Dir(path) == watch.Path
+}
+
+// matchDirs reports whether the rule moves directories named name
+func (r *Rule) matchDirs(name string) bool {
+	return slices.ContainsFunc(r.MatchDirs, func(pattern string) bool {
+		ok, _ := filepath.Match(pattern, name)
+		return ok
+	})
+}
+
+// matchDirRule returns the first rule in evaluation order that moves a
+// drop folder whole, or nil if its files are to be processed instead
+func matchDirRule(rules []Rule, dir string) *Rule {
+	for _, rule := range orderedRules(rules) {
+		if rule.matchDirs(filepath.Base(dir)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// validateMatchDirs checks a rule that moves directories
+func (r *Rule) validateMatchDirs() error {
+	if len(r.MatchDirs) == 0 {
+		return nil
+	}
+	for _, pattern := range r.MatchDirs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid match_dirs pattern %q: %w", pattern, err)
+		}
+	}
+	switch {
+	case r.Action != "" && r.Action != ActionMove:
+		return fmt.Errorf("match_dirs is only supported for the move action")
+	case isRemoteDestination(r.Destination):
+		return fmt.Errorf("match_dirs needs a local destination")
+	case len(r.Extensions) > 0 || len(r.MimeTypes) > 0 || r.ContentMatches != "" || r.Regex != "" || r.Expr != "":
+		return fmt.Errorf("match_dirs can't be combined with extensions, mime_types, regex, expr or content_matches, a rule moves either directories or files")
+	case r.Filename != nil || r.Duplicates != "" || r.Chown != "" || r.Chmod != nil || r.Checksums != "" || r.Continue:
+		return fmt.Errorf("match_dirs can't be combined with filename, duplicates, chown, chmod, checksums or continue")
+	case r.OnConflict == ConflictOverwrite || r.OnConflict == ConflictHashCompare:
+		return fmt.Errorf("on_conflict %s is not supported for directories", r.OnConflict)
+	}
+	return nil
+}
+
+// trackDropFolder waits for a drop folder to settle. It reports whether
+// the folder has settled and should be processed now.
+func (e *Engine) trackDropFolder(watch *Watch, dir string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	d := e.drops[dir]
+	switch {
+	case d == nil:
+		slog.Debug("Waiting for drop folder to settle", "dir", dir, "settle", watch.dropSettle())
+		e.drops[dir] = &dropFolder{changed: time.Now(), pending: true, state: treeState{files: -1}}
+	case d.settled:
+		d.settled, d.processed, d.changed = false, true, time.Now()
+		return true
+	default:
+		// Changed or retried, look again once it has settled
+		d.pending = true
+	}
+	return false
+}
+
+// runDropFolders looks at drop folders every dropFolderTick until ctx is
+// done, queueing those that have settled and removing processed ones once
+// they are empty
+func (e *Engine) runDropFolders(ctx context.Context) {
+	ticker := time.NewTicker(dropFolderTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		e.mu.Lock()
+		dirs := make([]string, 0, len(e.drops))
+		for dir, d := range e.drops {
+			if !d.settled {
+				dirs = append(dirs, dir)
+			}
+		}
+		pool := e.pool
+		e.mu.Unlock()
+
+		config := e.config.Load()
+		for _, dir := range dirs {
+			watch, ok := config.isDropFolder(dir)
+			state, err := scanTree(dir)
+			now := time.Now()
+
+			e.mu.Lock()
+			d := e.drops[dir]
+			switch {
+			case d == nil || d.settled:
+			case !ok || errors.Is(err, os.ErrNotExist):
+				// Moved away, removed, or no longer a drop folder watch
+				delete(e.drops, dir)
+			case err != nil:
+				slog.Warn("Failed to scan drop folder", "dir", dir, "error", err)
+			case d.processed && state.files == 0:
+				delete(e.drops, dir)
+				e.mu.Unlock()
+				removeEmptyDirs(dir)
+				slog.Info("Removed processed drop folder", "dir", dir)
+				continue
+			case state != d.state:
+				// Files going away are being processed; anything else
+				// means the folder is still being written to
+				if !d.processed || state.files >= d.state.files {
+					d.changed, d.pending = now, true
+				}
+				d.state = state
+			case d.pending && state.files > 0 && now.Sub(d.changed) >= watch.dropSettle():
+				d.settled, d.pending = true, false
+				if pool != nil {
+					go pool.enqueue(dir)
+				}
+			case !d.pending && d.processed && now.Sub(d.changed) >= dropFolderDrain:
+				// Left with files no rule wanted, or still being retried
+				delete(e.drops, dir)
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+// processDropFolder handles a settled drop folder: a rule with match_dirs
+// moves it whole, otherwise every file in it is queued
+func (e *Engine) processDropFolder(ctx context.Context, config *Config, dir string, info os.FileInfo) {
+	if rule := matchDirRule(config.Rules, dir); rule != nil {
+		e.mu.Lock()
+		limits := e.limits
+		e.mu.Unlock()
+		if !limits.waitFile() {
+			return
+		}
+		claim, ok := e.claimFile(config.watchFor(dir), dir)
+		if !ok {
+			return
+		}
+		defer claim.release()
+		e.applyRule(ctx, config, rule, dir, info, limits)
+		return
+	}
+
+	var files []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	slog.Info("Processing drop folder", "dir", dir, "files", len(files))
+
+	e.mu.Lock()
+	pool := e.pool
+	e.mu.Unlock()
+	if pool != nil {
+		go func() {
+			for _, file := range files {
+				pool.enqueue(file)
+			}
+		}()
+	}
+}
+
+// scanTree returns the number, total size and latest modification time of
+// the files in a directory tree
+func scanTree(dir string) (treeState, error) {
+	var state treeState
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The tree itself being gone is reported, anything below is
+			// caught by the next scan
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(state.modTime) {
+			state.modTime = info.ModTime()
+		}
+		if !d.IsDir() {
+			state.files++
+			state.size += info.Size()
+		}
+		return nil
+	})
+	return state, err
+}
+
+// removeEmptyDirs removes dir and the directories below it, deepest first,
+// leaving any that still hold something
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for _, path := range slices.Backward(dirs) {
+		os.Remove(path)
+	}
+}
+
+// moveDir moves a drop folder into the rule's destination, applying the
+// rule's conflict policy to its name. Across filesystems the tree is copied
+// to a hidden temporary directory and renamed into place, so nothing
+// watching the destination sees a partial folder, and only then removed.
+func moveDir(ctx context.Context, config *Config, rule *Rule, dir string, limits *limiter) (destPath, skipReason string, err error) {
+	policy := rule.conflictPolicy()
+	parent := filepath.Join(rule.Destination, periodDir(rule.Rotate, time.Now()))
+	if rule.Rotate != "" {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", "", fmt.Errorf("creating destination directory: %w", err)
+		}
+	}
+	dest := filepath.Join(parent, filepath.Base(dir))
+	resolved, reason, err := placeResolved(dir, dest, policy, rule.conflictSuffix(), func(path string, replace bool) error {
+		return moveOptions{noReplace: !replace}.rename(dir, path)
+	})
+	if err == nil || !isCrossDevice(err) {
+		return resolved, reason, err
+	}
+
+	state, err := scanTree(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkFreeSpace(config, rule, dir, rule.Destination, state.size); err != nil {
+		return "", "", err
+	}
+
+	tmp := filepath.Join(rule.Destination, fmt.Sprintf("%s%d", tempPrefix, rand.Int64()))
+	if err := copyTree(ctx, dir, tmp, rule, limits); err != nil {
+		os.RemoveAll(tmp)
+		return "", "", err
+	}
+	resolved, reason, err = placeResolved(dir, dest, policy, rule.conflictSuffix(), func(path string, replace bool) error {
+		return moveOptions{noReplace: !replace}.rename(tmp, path)
+	})
+	if err != nil || resolved == "" {
+		os.RemoveAll(tmp)
+		if err != nil {
+			return "", "", fmt.Errorf("renaming directory into place: %w", err)
+		}
+		return "", reason, nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return resolved, "", fmt.Errorf("removing source directory: %w", err)
+	}
+	return resolved, "", nil
+}
+
+// copyTree copies the directory tree at src to dst
+func copyTree(ctx context.Context, src, dst string, rule *Rule, limits *limiter) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&os.ModeSymlink != 0:
+			// Links keep their target, relative ones still point into the tree
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return moveFile(path, target, moveOptions{
+				verifyChecksum:     rule.VerifyChecksum,
+				preserveAttributes: rule.PreserveAttributes,
+				keepSource:         true,
+				fastCopy:           rule.FastCopy,
+				limits:             limits,
+				ctx:                ctx,
+			})
+		}
+	})
+}
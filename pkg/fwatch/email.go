@@ -0,0 +1,347 @@
+package fwatch
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the connection to the SMTP server is secured
+const (
+	EmailTLSStartTLS = "starttls"
+	EmailTLSImplicit = "implicit"
+	EmailTLSNone     = "none"
+)
+
+// emailTLSModes lists the valid email tls values
+var emailTLSModes = []string{EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone}
+
+const (
+	defaultEmailTimeout = 30 * time.Second
+	defaultEmailRetries = 3
+
+	// emailDigestMax is how many results a digest describes in full; the
+	// rest are only counted
+	emailDigestMax = 100
+)
+
+// EmailOptions configures email notifications about failed files. With an
+// Interval, results are collected and sent as one digest per interval;
+// otherwise each is mailed at once.
+type EmailOptions struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	TLS      string   `yaml:"tls"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Events   []string `yaml:"events"`
+	Interval Duration `yaml:"interval"`
+	Timeout  Duration `yaml:"timeout"`
+}
+
+// validate checks the email settings
+func (o *EmailOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("invalid port %d", o.Port)
+	}
+	if o.TLS != "" && !slices.Contains(emailTLSModes, o.TLS) {
+		return fmt.Errorf("unknown tls mode %q (want one of %v)", o.TLS, emailTLSModes)
+	}
+	if o.Username != "" && o.TLS == EmailTLSNone && !isLocalHost(o.Host) {
+		return fmt.Errorf("authentication needs tls, except to localhost")
+	}
+	if _, err := mail.ParseAddress(o.From); err != nil {
+		return fmt.Errorf("invalid from address %q: %w", o.From, err)
+	}
+	if len(o.To) == 0 {
+		return fmt.Errorf("to needs at least one recipient")
+	}
+	for _, to := range o.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid to address %q: %w", to, err)
+		}
+	}
+	for _, event := range o.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("unknown event %q (want one of %v)", event, webhookEvents)
+		}
+	}
+	if o.Interval < 0 || o.Timeout < 0 {
+		return fmt.Errorf("interval and timeout must not be negative")
+	}
+	return nil
+}
+
+// wants reports whether results of an event type are mailed. By default
+// only failures that won't be retried are.
+func (o *EmailOptions) wants(event string) bool {
+	if len(o.Events) == 0 {
+		return event == EventFailed || event == EventQuarantined
+	}
+	return slices.Contains(o.Events, event)
+}
+
+// address returns the host:port of the SMTP server
+func (o *EmailOptions) address() string {
+	port := o.Port
+	if port == 0 {
+		port = 587
+		switch o.TLS {
+		case EmailTLSImplicit:
+			port = 465
+		case EmailTLSNone:
+			port = 25
+		}
+	}
+	return net.JoinHostPort(o.Host, strconv.Itoa(port))
+}
+
+// isLocalHost reports whether host is the local machine, where net/smtp
+// allows authentication without TLS
+func isLocalHost(host string) bool {
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+// mailer sends email notifications in the background, batching results
+// into digests when the configuration asks for it
+type mailer struct {
+	mu      sync.Mutex
+	pending []Result    // results waiting for the next digest
+	dropped int         // results beyond emailDigestMax in the next digest
+	since   time.Time   // when the first pending result arrived
+	timer   *time.Timer // sends the pending digest
+	opts    *EmailOptions
+	wg      sync.WaitGroup
+}
+
+// add queues a result for mailing if the options subscribe to its event
+func (m *mailer) add(opts *EmailOptions, r Result) {
+	if opts == nil || !opts.wants(resultEvent(r)) {
+		return
+	}
+
+	if opts.Interval <= 0 {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.deliver(opts, []Result{r}, 0, r.Time)
+		}()
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opts = opts
+	if len(m.pending) == 0 && m.dropped == 0 {
+		m.since = r.Time
+		m.timer = time.AfterFunc(time.Duration(opts.Interval), m.flush)
+	}
+	if len(m.pending) < emailDigestMax {
+		m.pending = append(m.pending, r)
+	} else {
+		m.dropped++
+	}
+}
+
+// flush sends the pending digest, if any
+func (m *mailer) flush() {
+	m.mu.Lock()
+	results, dropped, since, opts := m.pending, m.dropped, m.since, m.opts
+	m.pending, m.dropped = nil, 0
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if len(results) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	defer m.wg.Done()
+	m.deliver(opts, results, dropped, since)
+}
+
+// shutdown sends the pending digest and waits up to timeout for messages
+// being sent
+func (m *mailer) shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		m.flush()
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Abandoning pending email notifications")
+	}
+}
+
+// deliver sends a message about results, retrying a few times
+func (m *mailer) deliver(opts *EmailOptions, results []Result, dropped int, since time.Time) {
+	msg := composeEmail(opts, results, dropped, since)
+	policy := &RetryPolicy{MaxAttempts: defaultEmailRetries}
+	for attempt := 1; ; attempt++ {
+		err := sendEmail(opts, msg)
+		if err == nil {
+			slog.Debug("Sent email notification", "to", opts.To, "results", len(results)+dropped)
+			return
+		}
+		if attempt >= policy.maxAttempts() {
+			slog.Error("Failed to send email notification", "host", opts.Host, "to", opts.To, "attempt", attempt, "error", err)
+			return
+		}
+		delay := policy.delay(attempt)
+		slog.Warn("Failed to send email notification, will retry", "host", opts.Host, "attempt", attempt, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// composeEmail builds the message describing results
+func composeEmail(opts *EmailOptions, results []Result, dropped int, since time.Time) []byte {
+	host, _ := os.Hostname()
+	total := len(results) + dropped
+
+	failed := 0
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			failed++
+		}
+	}
+	subject := fmt.Sprintf("fwatch on %s: %s %s", host, filepath.Base(results[0].Path), resultEvent(results[0]))
+	switch {
+	case total > 1 && failed == len(results):
+		subject = fmt.Sprintf("fwatch on %s: %d files failed", host, total)
+	case total > 1:
+		subject = fmt.Sprintf("fwatch on %s: %d files reported", host, total)
+	}
+
+	var body strings.Builder
+	if opts.Interval > 0 {
+		fmt.Fprintf(&body, "fwatch on %s reported %d file(s) between %s and %s.\n\n",
+			host, total, since.Format(time.DateTime), time.Now().Format(time.DateTime))
+	}
+	for _, r := range results {
+		fmt.Fprintf(&body, "%s  %s\n", r.Time.Format(time.DateTime), r.Path)
+		fmt.Fprintf(&body, "  rule: %s, action: %s", r.Rule, r.Action)
+		if r.Destination != "" {
+			fmt.Fprintf(&body, ", destination: %s", r.Destination)
+		}
+		body.WriteString("\n")
+		switch event := resultEvent(r); {
+		case r.Err != nil:
+			fmt.Fprintf(&body, "  error: %v (attempt %d)\n", r.Err, r.Attempt)
+			if event == EventQuarantined {
+				fmt.Fprintf(&body, "  quarantined: %s\n", r.Quarantined)
+			} else if event == EventRetry {
+				fmt.Fprintf(&body, "  retrying in %s\n", r.RetryIn)
+			}
+		case r.Reason != "":
+			fmt.Fprintf(&body, "  skipped: %s\n", r.Reason)
+		case r.DestPath != "":
+			fmt.Fprintf(&body, "  moved to: %s\n", r.DestPath)
+		}
+		body.WriteString("\n")
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&body, "and %d more, see the log for details.\n", dropped)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", opts.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(opts.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	msg.WriteString("Auto-Submitted: auto-generated\r\n\r\n")
+	w := quotedprintable.NewWriter(&msg)
+	w.Write([]byte(strings.ReplaceAll(body.String(), "\n", "\r\n")))
+	w.Close()
+	return msg.Bytes()
+}
+
+// sendEmail sends msg to the configured recipients
+func sendEmail(opts *EmailOptions, msg []byte) error {
+	timeout := cmp.Or(time.Duration(opts.Timeout), defaultEmailTimeout)
+	tlsConfig := &tls.Config{ServerName: opts.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	if opts.TLS == EmailTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.address(), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", opts.address())
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, opts.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cmp.Or(opts.TLS, EmailTLSStartTLS) == EmailTLSStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starting TLS: %w", err)
+		}
+	}
+	if opts.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", opts.Username, opts.Password, opts.Host)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(opts.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range opts.To {
+		addr, _ := mail.ParseAddress(to)
+		if err := client.Rcpt(addr.Address); err != nil {
+			return fmt.Errorf("recipient %s: %w", addr.Address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,158 @@
+package fwatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// encryptedExt is appended to the names of files encrypted with age
+const encryptedExt = ".age"
+
+// EncryptOptions encrypts files with age on their way to the destination,
+// so only the holders of the recipients' private keys can read them there
+type EncryptOptions struct {
+	// Recipients are age public keys ("age1...") or SSH public keys
+	// ("ssh-ed25519 ...", "ssh-rsa ...")
+	Recipients []string `yaml:"recipients"`
+
+	// RecipientsFile names a file with a recipient per line, as taken by
+	// age -R; it is read for every file, so keys can be changed without a
+	// reload
+	RecipientsFile string `yaml:"recipients_file"`
+}
+
+// validate checks the encryption settings and their recipients
+func (o *EncryptOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if len(o.Recipients) == 0 && o.RecipientsFile == "" {
+		return fmt.Errorf("encrypt needs recipients or a recipients_file")
+	}
+	_, err := o.recipients()
+	return err
+}
+
+// recipients parses the recipients the files are encrypted to
+func (o *EncryptOptions) recipients() ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range o.Recipients {
+		recipient, err := parseRecipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: invalid recipient: %w", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if o.RecipientsFile != "" {
+		data, err := os.ReadFile(o.RecipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %w", err)
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			recipient, err := parseRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("encrypt: %s line %d: %w", o.RecipientsFile, i+1, err)
+			}
+			recipients = append(recipients, recipient)
+		}
+		if len(recipients) == 0 {
+			return nil, fmt.Errorf("encrypt: no recipients in %s", o.RecipientsFile)
+		}
+	}
+	return recipients, nil
+}
+
+// parseRecipient parses an age or SSH public key
+func parseRecipient(key string) (age.Recipient, error) {
+	switch {
+	case strings.HasPrefix(key, "ssh-"):
+		return agessh.ParseRecipient(key)
+	case strings.HasPrefix(key, "age1pq1"):
+		return age.ParseHybridRecipient(key)
+	}
+	return age.ParseX25519Recipient(key)
+}
+
+// encryptFile writes src encrypted to dst, removing src afterwards unless
+// keepSource is set. Like a copy, the encrypted file is written to a
+// hidden temporary file beside dst and renamed into place once it is
+// complete and synced, so the plaintext is only removed once its
+// encryption is safely stored. A file at dst is only replaced if replace
+// is set.
+func encryptFile(ctx context.Context, src, dst string, opts *EncryptOptions, keepSource, replace bool, limits *limiter) (err error) {
+	release := limits.acquireCopy()
+	defer release()
+
+	_, span := startSpan(ctx, "fwatch.encrypt")
+	defer func() { endSpan(span, err) }()
+
+	recipients, err := opts.recipients()
+	if err != nil {
+		return err
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("opening source file: %w", err)
+	}
+	defer srcFile.Close()
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("getting source file info: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(dst), tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("creating destination file: %w", err)
+	}
+	tmp := tmpFile.Name()
+	defer os.Remove(tmp) // fails harmlessly once renamed
+	defer tmpFile.Close()
+	if err := tmpFile.Chmod(srcInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("setting destination permissions: %w", err)
+	}
+
+	w, err := age.Encrypt(tmpFile, recipients...)
+	if err != nil {
+		return fmt.Errorf("encrypting file: %w", err)
+	}
+	written, err := io.Copy(w, limits.reader(srcFile))
+	span.SetAttributes(attribute.Int64("fwatch.bytes", written))
+	if err != nil {
+		return fmt.Errorf("encrypting file: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("encrypting file: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("syncing destination file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing destination file: %w", err)
+	}
+	if err := (moveOptions{noReplace: !replace}).rename(tmp, dst); err != nil {
+		return fmt.Errorf("renaming destination file into place: %w", err)
+	}
+
+	if keepSource {
+		return nil
+	}
+	// Windows refuses to remove a file that is still open
+	srcFile.Close()
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("removing source file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,943 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Status is the outcome of processing a matched file
+type Status string
+
+const (
+	StatusSuccess Status = "success"
+	StatusSkipped Status = "skipped"
+	StatusFailed  Status = "failed"
+)
+
+// Result describes what happened to a file that matched a rule
+type Result struct {
+	Time        time.Time     // When processing started
+	Path        string        // Source path of the file
+	Size        int64         // File size in bytes when matched
+	Rule        string        // Name of the matching rule
+	Action      string        // Action performed
+	Destination string        // The rule's destination directory, if any
+	DestPath    string        // Final path of the file, if it was moved
+	Checksum    string        // SHA-256 of the moved file, if history, the hash index, publishers or the audit log are enabled
+	Duplicate   string        // Path of an identical stored file, if one was found
+	Encrypted   bool          // DestPath is the file encrypted with age
+	Quarantined string        // Path in the quarantine directory, if the file was quarantined
+	Attempt     int           // Which attempt this was, starting at 1
+	Step        int           // The pipeline step that failed or was skipped, starting at 1
+	RetryIn     time.Duration // Delay before the file is looked at again, if scheduled
+	Status      Status        // Outcome of the action
+	Reason      string        // Why the file was skipped
+	Duration    time.Duration // Time spent on the action
+	Err         error         // Set when Status is StatusFailed
+}
+
+// lockedRecheckDelay is how long to wait before looking again at a file
+// that another process has locked
+const lockedRecheckDelay = 5 * time.Second
+
+// Engine watches directories and routes new files according to a Config.
+// It is safe for concurrent use; the config can be changed while running.
+type Engine struct {
+	config atomic.Pointer[Config]
+
+	mu       sync.Mutex
+	watcher  *multiWatcher // set while Run is active
+	pool     *workerPool   // set while Run is active
+	limits   *limiter      // set while Run is active, nil without rate_limit
+	tracer   trace.Tracer  // set while Run is active
+	handlers []func(Result)
+	running  bool
+	ready    chan struct{}
+
+	failures  failureTracker
+	unscanned failureTracker // times each file couldn't be scanned
+	perMinute fileCounts
+	webhooks  *webhookSender
+	mailer    mailer
+	brokers   publisherSet
+	history   *historyWriter
+	audit     auditWriter
+	kept      keptSources
+	undone    undoneFiles
+	hashes    hashIndex
+	buckets   bucketCache
+	sftp      sftpPool
+
+	deferred map[string]time.Time           // files waiting for a schedule, guarded by mu
+	ageing   map[string]time.Time           // files waiting to be old enough for min_age, guarded by mu
+	paused   map[string]map[string]struct{} // paused watch → files held, guarded by mu
+	applied  map[string][]string            // rules applied to a file so far, guarded by mu
+	health   map[string]*watchHealth        // watch directory → watchdog state, guarded by mu
+	drops    map[string]*dropFolder         // drop folders waiting or being processed, guarded by mu
+	idle     map[string]*idleFile           // files waiting to stop changing, guarded by mu
+	placed   map[string]placedFile          // files rules put into watched directories, guarded by mu
+	started  time.Time                      // when Run started, guarded by mu
+	counts   resultCounts
+}
+
+// New creates an Engine for the given configuration, which is normalized
+// and validated first
+func New(config Config) (*Engine, error) {
+	config.normalize()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	e := &Engine{ready: make(chan struct{}), webhooks: newWebhookSender(), history: newHistoryWriter(),
+		deferred: make(map[string]time.Time), ageing: make(map[string]time.Time), paused: make(map[string]map[string]struct{}),
+		applied: make(map[string][]string), health: make(map[string]*watchHealth),
+		drops: make(map[string]*dropFolder), idle: make(map[string]*idleFile),
+		placed: make(map[string]placedFile)}
+	e.config.Store(&config)
+	return e, nil
+}
+
+// Config returns the configuration currently in effect. It must not be
+// modified.
+func (e *Engine) Config() *Config {
+	return e.config.Load()
+}
+
+// OnResult registers fn to be called with the result of every processed
+// file. Calls happen on worker goroutines, so fn must be safe for
+// concurrent use and should return quickly.
+func (e *Engine) OnResult(fn func(Result)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, fn)
+}
+
+// Results returns a channel that receives the result of every processed
+// file. Results are dropped rather than blocking processing when the
+// channel's buffer is full.
+func (e *Engine) Results(buffer int) <-chan Result {
+	ch := make(chan Result, buffer)
+	e.OnResult(func(r Result) {
+		select {
+		case ch <- r:
+		default:
+		}
+	})
+	return ch
+}
+
+// Ready returns a channel that is closed once Run has registered all
+// watches and started processing
+func (e *Engine) Ready() <-chan struct{} {
+	return e.ready
+}
+
+// SetConfig replaces the configuration. Watches are added, removed or
+// moved between backends as needed; files being processed finish with the
+// old configuration and queued files are kept. On error the current
+// configuration stays in effect.
+func (e *Engine) SetConfig(config Config) error {
+	config.normalize()
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := e.config.Load()
+	if e.watcher != nil {
+		if err := e.applyWatches(current, &config); err != nil {
+			return err
+		}
+		createDestinations(&config)
+	}
+
+	if config.Workers != current.Workers || config.QueueSize != current.QueueSize || config.QueueDir != current.QueueDir || config.Debounce != current.Debounce {
+		slog.Warn("Changes to workers, queue_size, queue_dir and debounce take effect after a restart")
+	}
+	if config.PollInterval != current.PollInterval {
+		slog.Warn("Changes to poll_interval take effect after a restart")
+	}
+	if !reflect.DeepEqual(config.RateLimit, current.RateLimit) {
+		slog.Warn("Changes to rate_limit take effect after a restart")
+	}
+	if !reflect.DeepEqual(config.Tracing, current.Tracing) {
+		slog.Warn("Changes to tracing take effect after a restart")
+	}
+
+	changes := diffConfig(current, &config)
+	if len(changes) == 0 {
+		slog.Info("Config reloaded, no changes")
+	}
+	for _, change := range changes {
+		slog.Info("Config reloaded", "change", change)
+	}
+
+	e.config.Store(&config)
+	return nil
+}
+
+// AddRule appends a rule to the current configuration
+func (e *Engine) AddRule(rule Rule) error {
+	config := *e.config.Load()
+	config.Rules = append(slices.Clone(config.Rules), rule)
+	return e.SetConfig(config)
+}
+
+// applyWatches re-registers watch directories that were added, removed or
+// moved to another backend. Callers must hold e.mu.
+func (e *Engine) applyWatches(current, next *Config) error {
+	// Add new directories before removing old ones so a failure leaves
+	// the current watches in place
+	oldPaths, newPaths := watchPaths(current), watchPaths(next)
+	var added []string
+	for _, watch := range next.Watches {
+		// Lost watches are added by the watchdog once they are back
+		if h := e.health[watch.Path]; h != nil && h.down() {
+			continue
+		}
+		if err := addWatch(e.watcher, next, &watch); err != nil {
+			for _, p := range added {
+				e.watcher.Remove(p)
+			}
+			return fmt.Errorf("adding watch directory %s: %w", watch.Path, err)
+		}
+		if !slices.Contains(oldPaths, watch.Path) {
+			added = append(added, watch.Path)
+		}
+	}
+	for _, path := range added {
+		dir, _ := os.Stat(next.watchAt(path).dir())
+		e.watchEstablished(path, dir)
+	}
+	for _, path := range oldPaths {
+		if slices.Contains(newPaths, path) {
+			continue
+		}
+		delete(e.health, path)
+		if err := e.watcher.Remove(path); err != nil {
+			slog.Warn("Failed to remove old watch directory", "watch_dir", path, "error", err)
+		}
+	}
+	return nil
+}
+
+// addWatch registers a watch's directory, or its file, with watcher
+func addWatch(watcher *multiWatcher, config *Config, watch *Watch) error {
+	if watch.file {
+		return watcher.AddFile(watch.Path, config.backendFor(watch))
+	}
+	return watcher.Add(watch.Path, config.backendFor(watch), watch.Recursive, config.excludePatterns(watch), config.maxDepth(watch), config.onWatchLimit(watch))
+}
+
+// closeOutputs sends the notifications still pending for the last files and
+// closes history, the hash index and the connections to remote destinations
+func (e *Engine) closeOutputs() {
+	e.sftp.close()
+	e.buckets.close()
+	e.history.close()
+	e.hashes.close()
+	e.audit.close()
+	e.brokers.shutdown(webhookShutdownTimeout)
+	e.mailer.shutdown(webhookShutdownTimeout)
+	e.webhooks.shutdown(webhookShutdownTimeout)
+}
+
+// Run watches the configured directories and processes file events until
+// ctx is cancelled or the watcher fails. Files being processed when ctx is
+// cancelled are finished before Run returns. Run may only be called once.
+func (e *Engine) Run(ctx context.Context) error {
+	e.mu.Lock()
+	if e.running {
+		e.mu.Unlock()
+		return errors.New("engine is already running")
+	}
+	e.running = true
+
+	config := e.config.Load()
+	watcher := newMultiWatcher(time.Duration(config.PollInterval))
+	defer watcher.Close()
+
+	createDestinations(config)
+
+	// Add watch directories
+	for _, watch := range config.Watches {
+		if err := addWatch(watcher, config, &watch); err != nil {
+			e.mu.Unlock()
+			return fmt.Errorf("adding watch directory %s: %w", watch.Path, err)
+		}
+		dir, _ := os.Stat(watch.dir())
+		e.watchEstablished(watch.Path, dir)
+		if watch.file {
+			slog.Info("Watching file", "watch_file", watch.Path, "backend", config.backendFor(&watch))
+			continue
+		}
+		slog.Info("Watching directory", "watch_dir", watch.Path, "backend", config.backendFor(&watch), "recursive", watch.Recursive)
+	}
+	e.watcher = watcher
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		e.watcher = nil
+		e.mu.Unlock()
+	}()
+
+	// Deferred before the pool so deliveries for the last files are sent
+	defer e.closeOutputs()
+
+	provider, shutdownTracing, err := newTracerProvider(ctx, config.Tracing)
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Failed to export remaining traces", "error", err)
+		}
+	}()
+
+	spill, err := openSpillQueue(config.QueueDir)
+	if err != nil {
+		return fmt.Errorf("opening queue_dir: %w", err)
+	}
+	pool := newWorkerPool(ctx, config.Workers, config.QueueSize, time.Duration(config.Debounce), spill, e.processFile)
+	defer pool.wait()
+
+	e.mu.Lock()
+	e.pool = pool
+	e.tracer = provider.Tracer(tracerName)
+	e.limits = newLimiter(ctx, config.RateLimit)
+	e.started = time.Now()
+	e.mu.Unlock()
+
+	close(e.ready)
+
+	retentionDone := make(chan struct{})
+	go func() {
+		defer close(retentionDone)
+		e.runRetention(ctx)
+	}()
+	defer func() { <-retentionDone }()
+
+	watchdogDone := make(chan struct{})
+	go func() {
+		defer close(watchdogDone)
+		e.runWatchdog(ctx)
+	}()
+	defer func() { <-watchdogDone }()
+
+	dropsDone := make(chan struct{})
+	go func() {
+		defer close(dropsDone)
+		e.runDropFolders(ctx)
+	}()
+	defer func() { <-dropsDone }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down, waiting for files in progress")
+			return nil
+
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return fmt.Errorf("watcher events channel closed")
+			}
+			if path, cause := lostWatch(e.config.Load(), &event, nil); path != "" {
+				e.watchLost(path, cause)
+				continue
+			}
+
+			event, ok = e.config.Load().settledEvent(event)
+			if ok && e.wantsEvent(event) && !e.holdIfPaused(e.config.Load(), event.Path) {
+				pool.submit(event.Path)
+			}
+
+		case err, ok := <-watcher.Errors():
+			if !ok {
+				return fmt.Errorf("watcher errors channel closed")
+			}
+			if path, cause := lostWatch(e.config.Load(), nil, err); path != "" {
+				e.watchLost(path, cause)
+				continue
+			}
+			slog.Error("Watcher error", "error", err)
+		}
+	}
+}
+
+// wantsEvent reports whether an event should have its file processed.
+// Files are looked at when they are created, written or moved into a
+// watch, which all platforms report as a create, and when their attributes
+// change, since archivers and copy tools often set permissions and times
+// only after writing. A rename is reported for the old name, so the file
+// is gone from there unless another took its place.
+func (e *Engine) wantsEvent(event Event) bool {
+	switch {
+	case event.Op.Has(OpCreate) || event.Op.Has(OpWrite) || event.Op.Has(OpChmod):
+		return true
+	case event.Op.Has(OpRename):
+		if _, err := os.Lstat(event.Path); err == nil {
+			return true
+		}
+		e.forget(event.Path)
+	case event.Op.Has(OpRemove):
+		e.forget(event.Path)
+	}
+	return false
+}
+
+// forget drops what is remembered about a file that is gone
+func (e *Engine) forget(path string) {
+	e.failures.reset(path)
+	e.unscanned.reset(path)
+	e.clearApplied(path)
+	e.kept.forget(path)
+	e.mu.Lock()
+	e.dropIdle(path)
+	delete(e.placed, path)
+	e.mu.Unlock()
+}
+
+// processFile matches a file against the current rules and performs the
+// matching rule's action. timing tells how long the file waited, for its
+// trace.
+func (e *Engine) processFile(filePath string, timing jobTiming) {
+	config := e.config.Load()
+	start := time.Now()
+
+	// Skip temporary and partial files before touching them
+	watch := config.watchFor(filePath)
+	if isIgnored(filePath, config.ignorePatterns(watch)) {
+		slog.Debug("Ignoring file", "file", filePath)
+		return
+	}
+
+	// Saves through a temporary file are processed once it is renamed
+	// over the file saved
+	if config.handlesAtomicSaves() {
+		if _, ok, transient := savedFile(filePath); ok {
+			slog.Debug("Ignoring temporary file of a save", "file", filePath)
+			if _, err := os.Lstat(filePath); transient && err == nil {
+				e.recheckLater(filePath, saveSettleDelay)
+			}
+			return
+		}
+		if beingSaved(filePath) {
+			slog.Debug("Leaving file that is being saved", "file", filePath)
+			return
+		}
+	}
+
+	// Leave files in paused directories for when they are resumed; retries
+	// and rescans can still queue them
+	if e.holdIfPaused(config, filePath) {
+		slog.Debug("Holding file in paused directory", "file", filePath)
+		return
+	}
+
+	// Skip if file doesn't exist (might have been moved already)
+	info, ignored, err := config.statFile(watch, filePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to stat file", "file", filePath, "error", err)
+		} else {
+			e.failures.reset(filePath)
+		}
+		return
+	}
+	if ignored {
+		slog.Debug("Ignoring symlink", "file", filePath)
+		return
+	}
+
+	// A destination inside a watch would otherwise see every file again
+	if e.isPlaced(filePath, info) {
+		slog.Debug("Ignoring file a rule put here", "file", filePath)
+		return
+	}
+
+	// Files of read-only watches stay where they are, but are only
+	// processed once
+	readOnly := config.readOnly(watch)
+	if readOnly && !info.IsDir() && e.kept.has(config.HistoryDB, filePath, info) {
+		slog.Debug("Leaving file of read-only watch that was processed", "file", filePath)
+		return
+	}
+
+	// The trace starts with the first event, so it shows the time spent
+	// settling and queued before the file was looked at
+	e.mu.Lock()
+	tracer := e.tracer
+	limits := e.limits
+	e.mu.Unlock()
+	ctx, span := tracer.Start(context.Background(), "fwatch.process",
+		trace.WithTimestamp(cmp.Or(timing.event, timing.queued, start)),
+		trace.WithAttributes(attribute.String("file.path", filePath), attribute.Int64("file.size", info.Size())))
+	defer span.End()
+	if watch != nil {
+		span.SetAttributes(attribute.String("fwatch.watch", watch.Path))
+	}
+	traceWaits(ctx, timing, start)
+
+	// Directories are only processed as drop folders, once settled
+	if info.IsDir() {
+		if _, ok := config.isDropFolder(filePath); ok && e.trackDropFolder(watch, filePath) {
+			e.processDropFolder(ctx, config, filePath, info)
+		}
+		return
+	}
+
+	// Leave files that undo put back where they are
+	if config.HistoryDB != "" && e.undone.has(config.HistoryDB, filePath, info) {
+		slog.Debug("Leaving file restored by undo", "file", filePath)
+		return
+	}
+
+	// Find the rules that apply to this file
+	_, matchSpan := startSpan(ctx, "fwatch.match")
+	c := newCandidate(filePath, info, watch)
+	rules := matchRules(config.Rules, c)
+	matchSpan.SetAttributes(attribute.Int("fwatch.rules", len(rules)))
+	matchSpan.End()
+	if len(rules) == 0 {
+		if at := oldEnoughAt(config.Rules, c); !at.IsZero() {
+			e.recheckWhenOld(filePath, at)
+			return
+		}
+		slog.Debug("No rule matches file", "file", filePath)
+		return
+	}
+
+	if !e.waitRateLimit(ctx, limits) {
+		return
+	}
+
+	// Instances sharing the watch directory process each file once
+	claim, ok := e.claimFile(watch, filePath)
+	if !ok {
+		return
+	}
+	defer claim.release()
+
+	// Rules with continue set leave the file for the next one. When a
+	// later rule is retried or deferred, those already applied are skipped.
+	for _, rule := range rules {
+		if len(rules) > 1 && e.isApplied(filePath, rule.Name) {
+			continue
+		}
+		if readOnly {
+			rule = rule.keepingSource()
+		}
+		proceed, pending := e.applyRule(ctx, config, rule, filePath, info, limits)
+		if !proceed {
+			if !pending {
+				e.clearApplied(filePath)
+			}
+			return
+		}
+		if len(rules) > 1 {
+			e.markApplied(filePath, rule.Name)
+		}
+	}
+	e.clearApplied(filePath)
+	if readOnly {
+		e.kept.add(config.HistoryDB, e.history, filePath, info)
+	}
+}
+
+// applyRule performs a rule's action on a file and reports the result. It
+// returns whether the file can go on to the next rule, and if not, whether
+// it will be looked at again because the rule is retried or waiting for
+// its schedule.
+func (e *Engine) applyRule(ctx context.Context, config *Config, rule *Rule, filePath string, info os.FileInfo, limits *limiter) (proceed, pending bool) {
+	// Hold the file until the rule's schedule allows its action
+	if rule.Schedule != nil && !rule.Schedule.Open(time.Now()) {
+		e.deferUntil(filePath, rule, rule.Schedule.Next(time.Now()))
+		return false, true
+	}
+	// and until a slow writer has left it alone for the rule's quiet period
+	if e.waitIdle(rule, filePath, info) {
+		return false, true
+	}
+	// and while the rule, or all rules together, have acted on as many
+	// files as max_files_per_minute allows
+	if wait, ok := e.perMinute.take(config, rule, time.Now()); !ok {
+		slog.Debug("Holding file for max_files_per_minute", "file", filePath, "rule", rule.Name, "wait", wait)
+		e.recheckLater(filePath, wait)
+		return false, true
+	}
+
+	result := Result{
+		Time:        time.Now(),
+		Path:        filePath,
+		Size:        info.Size(),
+		Rule:        rule.Name,
+		Action:      cmp.Or(rule.Action, ActionMove),
+		Destination: redactDestination(rule.Destination),
+	}
+
+	ctx, span := startSpan(ctx, "fwatch.rule", attribute.String("fwatch.rule", rule.Name),
+		attribute.String("fwatch.action", result.Action))
+	defer func() {
+		span.SetAttributes(attribute.String("fwatch.status", string(result.Status)))
+		if result.DestPath != "" {
+			span.SetAttributes(attribute.String("fwatch.dest_path", redactDestination(result.DestPath)))
+		}
+		if result.Reason != "" {
+			span.SetAttributes(attribute.String("fwatch.reason", result.Reason))
+		}
+		endSpan(span, result.Err)
+	}()
+
+	var err error
+	var started, scanGaveUp bool
+	if limit := config.maxFileSize(rule); limit > 0 && !info.IsDir() && ByteSize(info.Size()) > limit {
+		if config.onMaxFileSize(rule) == MaxFileSizeQuarantine {
+			err = fmt.Errorf("%w (%s)", errTooLarge, limit)
+		} else {
+			result.Reason = fmt.Sprintf("file is larger than max_file_size (%s)", limit)
+		}
+	}
+	scan := config.scanFor(rule)
+	if scan != nil && err == nil && result.Reason == "" {
+		scanCtx, scanSpan := startSpan(ctx, "fwatch.scan")
+		err = scanFile(scanCtx, scan, rule, filePath, info)
+		endSpan(scanSpan, err)
+		if !errors.Is(err, errScanFailed) {
+			e.unscanned.reset(filePath)
+		} else if n := e.unscanned.fail(filePath); n > scan.maxRetries() {
+			// The scanner stayed away too long; quarantine rather than
+			// wait for it forever
+			e.unscanned.reset(filePath)
+			err = fmt.Errorf("%w, giving up after %d attempts", err, n)
+			scanGaveUp = true
+		}
+	}
+	switch {
+	case err != nil || result.Reason != "":
+	case result.Action == ActionPipeline:
+		started, err = e.runPipeline(ctx, config, rule, filePath, info, limits, &result)
+	default:
+		result.DestPath, result.Reason, result.Duplicate, err = e.runAction(ctx, config, rule, filePath, info, limits)
+		result.Encrypted = rule.Encrypt != nil && result.DestPath != ""
+	}
+
+	result.Duration = time.Since(result.Time)
+	switch {
+	case isLocked(err) && !started:
+		// Still being written; look again later without counting a failure
+		result.Status, result.Reason = StatusSkipped, "file is locked by another process"
+		result.RetryIn = lockedRecheckDelay
+		e.recheckLater(filePath, lockedRecheckDelay)
+	case errors.Is(err, errScanFailed) && !scanGaveUp:
+		// Not the file's fault; it waits for the scanner
+		result.Status, result.Reason = StatusSkipped, err.Error()
+		result.RetryIn = scanRecheckDelay
+		e.recheckLater(filePath, scanRecheckDelay)
+	case errors.Is(err, errLowSpace) && !started && config.onLowSpace(rule) != LowSpaceFail:
+		// Not an attempt either, nothing was written
+		result.Status, result.Reason = StatusSkipped, err.Error()
+		if config.onLowSpace(rule) == LowSpaceWait {
+			result.RetryIn = lowSpaceRecheckDelay
+			e.recheckLater(filePath, lowSpaceRecheckDelay)
+		}
+	case err != nil:
+		result.Status, result.Err = StatusFailed, err
+	case result.Reason != "":
+		result.Status = StatusSkipped
+	default:
+		result.Status = StatusSuccess
+	}
+
+	if result.Status == StatusSuccess {
+		e.rememberPlaced(config, result.DestPath)
+	}
+
+	switch {
+	case result.Status == StatusFailed && (result.Action == ActionPipeline || errors.Is(err, errRejected) || errors.Is(err, errTooLarge) || scanGaveUp):
+		e.failPipeline(config, &result)
+	case result.Status == StatusFailed:
+		e.handleFailure(config, rule, &result)
+	default:
+		e.failures.reset(filePath)
+	}
+
+	// The checksum lets history answer whether a file has changed since,
+	// lets duplicates be found, and goes into published messages and the
+	// audit log
+	if (config.HistoryDB != "" || config.HashIndex != "" || len(config.Publish) > 0 || config.Audit != nil) && result.DestPath != "" && !isRemoteDestination(result.DestPath) && !info.IsDir() {
+		_, hashSpan := startSpan(ctx, "fwatch.checksum")
+		sum, err := hashFile(result.DestPath)
+		endSpan(hashSpan, err)
+		if err == nil {
+			result.Checksum = sum
+		} else {
+			slog.Warn("Failed to checksum moved file", "file", filePath, "dest_path", result.DestPath, "error", err)
+		}
+	}
+	if (result.Action == ActionMove || result.Action == ActionCopy) && result.Status == StatusSuccess && !info.IsDir() {
+		e.indexMoved(config, &result)
+	}
+
+	e.counts.add(result)
+	logResult(result)
+	e.runHooks(rule, result)
+	notifyDesktop(config.notifyMode(rule), result)
+	e.webhooks.send(config.Webhooks, result)
+	e.mailer.add(config.Email, result)
+	e.brokers.send(config.Publish, result)
+	e.history.record(config.HistoryDB, result)
+	e.audit.record(config.Audit, result)
+	e.emit(result)
+
+	// A skipped action leaves the file for the next rule, a locked file is
+	// looked at again whole
+	return result.Status == StatusSuccess || (result.Status == StatusSkipped && result.RetryIn == 0), result.RetryIn > 0
+}
+
+// runAction performs a rule's move, copy, exec, archive or delete action on
+// a file
+func (e *Engine) runAction(ctx context.Context, config *Config, rule *Rule, filePath string, info os.FileInfo, limits *limiter) (destPath, skipReason, duplicate string, err error) {
+	ctx, span := startSpan(ctx, "fwatch.action", attribute.String("fwatch.action", cmp.Or(rule.Action, ActionMove)))
+	defer func() { endSpan(span, err) }()
+
+	if len(rule.MatchDirs) > 0 {
+		destPath, skipReason, err = moveDir(ctx, config, rule, filePath, limits)
+		return destPath, skipReason, "", err
+	}
+
+	// Don't start writing a file the destination has no room for
+	if action := cmp.Or(rule.Action, ActionMove); action == ActionMove || action == ActionCopy || action == ActionArchive {
+		if err := checkFreeSpace(config, rule, filePath, rule.Destination, info.Size()); err != nil {
+			return "", "", "", err
+		}
+	}
+
+	switch cmp.Or(rule.Action, ActionMove) {
+	case ActionExec:
+		return "", "", "", runExec(rule, filePath)
+	case ActionArchive:
+		destPath, skipReason, err = archiveFile(filePath, rule)
+		return destPath, skipReason, "", err
+	case ActionDelete:
+		if config.readOnly(config.watchFor(filePath)) {
+			return "", "the watch has read_only_sources", "", nil
+		}
+		destPath, err = deleteFile(config.Trash, filePath, rule.DeleteMode)
+		return destPath, "", "", err
+	}
+	switch {
+	case isObjectStoreURL(rule.Destination):
+		destPath, skipReason, err = e.uploadToObjectStore(filePath, rule, limits)
+	case isSFTPURL(rule.Destination):
+		destPath, skipReason, err = e.uploadToSFTP(filePath, rule, limits)
+	case rule.Action == ActionCopy:
+		destPath, skipReason, err = copyToDestination(ctx, filePath, rule, info, limits)
+	default:
+		return e.moveOrDedupe(ctx, config, rule, filePath, info, limits)
+	}
+	return destPath, skipReason, "", err
+}
+
+// waitRateLimit waits until the rate limit lets another file be processed,
+// tracing the wait. It returns false if the engine is stopping.
+func (e *Engine) waitRateLimit(ctx context.Context, limits *limiter) bool {
+	if limits == nil {
+		return true
+	}
+	_, span := startSpan(ctx, "fwatch.rate_limit")
+	defer span.End()
+	return limits.waitFile()
+}
+
+// isApplied reports whether a rule has already been applied to a file
+// during the current pass through its matching rules
+func (e *Engine) isApplied(path, rule string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Contains(e.applied[path], rule)
+}
+
+// markApplied records that a rule has been applied to a file
+func (e *Engine) markApplied(path, rule string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.applied[path] = append(e.applied[path], rule)
+}
+
+// clearApplied forgets the rules applied to a file
+func (e *Engine) clearApplied(path string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.applied, path)
+}
+
+// handleFailure counts a failed attempt, then either schedules a retry
+// according to the rule's retry policy or, once the file has failed often
+// enough, moves it to quarantine
+func (e *Engine) handleFailure(config *Config, rule *Rule, result *Result) {
+	attempts := e.failures.fail(result.Path)
+	result.Attempt = attempts
+	policy := config.retryPolicy(rule)
+
+	// Without an explicit threshold, quarantine once retries are exhausted
+	threshold := config.QuarantineAfter
+	if threshold <= 0 {
+		threshold = policy.maxAttempts()
+	}
+
+	if config.QuarantineDir != "" && attempts >= threshold {
+		target, err := quarantine(config, *result, attempts)
+		if err != nil {
+			slog.Error("Failed to quarantine file", "file", result.Path, "rule", result.Rule, "error", err)
+		}
+		if target != "" {
+			result.Quarantined = target
+			e.failures.reset(result.Path)
+			return
+		}
+	}
+
+	if attempts >= policy.maxAttempts() {
+		e.failures.reset(result.Path)
+		return
+	}
+
+	result.RetryIn = policy.delay(attempts)
+	e.recheckLater(result.Path, result.RetryIn)
+}
+
+// deferUntil processes path again once the rule's schedule opens at the
+// given time. A file that is already waiting keeps its timer.
+func (e *Engine) deferUntil(path string, rule *Rule, at time.Time) {
+	if at.IsZero() {
+		slog.Warn("Schedule never opens, leaving file", "file", path, "rule", rule.Name, "schedule", rule.Schedule.String())
+		return
+	}
+
+	e.mu.Lock()
+	_, waiting := e.deferred[path]
+	pool := e.pool
+	if !waiting && pool != nil {
+		e.deferred[path] = at
+	}
+	e.mu.Unlock()
+
+	if waiting || pool == nil {
+		slog.Debug("File is waiting for schedule", "file", path, "rule", rule.Name)
+		return
+	}
+	slog.Info("Deferring file until schedule opens", "file", path, "rule", rule.Name,
+		"schedule", rule.Schedule.String(), "opens_at", at.Format(time.RFC3339))
+	time.AfterFunc(time.Until(at), func() {
+		e.mu.Lock()
+		delete(e.deferred, path)
+		e.mu.Unlock()
+		pool.enqueue(path)
+	})
+}
+
+// recheckWhenOld processes path again once it is old enough for a rule's
+// min_age. A file that is already waiting keeps its timer, and is looked at
+// again then if it changed meanwhile.
+func (e *Engine) recheckWhenOld(path string, at time.Time) {
+	e.mu.Lock()
+	_, waiting := e.ageing[path]
+	pool := e.pool
+	if !waiting && pool != nil {
+		e.ageing[path] = at
+	}
+	e.mu.Unlock()
+
+	if waiting || pool == nil {
+		return
+	}
+	slog.Debug("File is too new for min_age, waiting", "file", path, "old_enough_at", at.Format(time.RFC3339))
+	time.AfterFunc(time.Until(at), func() {
+		e.mu.Lock()
+		delete(e.ageing, path)
+		e.mu.Unlock()
+		pool.enqueue(path)
+	})
+}
+
+// recheckLater queues path for processing again after delay
+func (e *Engine) recheckLater(path string, delay time.Duration) {
+	e.mu.Lock()
+	pool := e.pool
+	e.mu.Unlock()
+	if pool != nil {
+		time.AfterFunc(delay, func() { pool.enqueue(path) })
+	}
+}
+
+// emit hands a result to all registered handlers
+func (e *Engine) emit(result Result) {
+	e.mu.Lock()
+	handlers := e.handlers
+	e.mu.Unlock()
+
+	for _, fn := range handlers {
+		fn(result)
+	}
+}
+
+// logResult writes a structured log record for a processed file
+func logResult(r Result) {
+	attrs := []any{
+		"file", r.Path, "rule", r.Rule, "action", r.Action,
+		"destination", r.Destination, "duration", r.Duration,
+	}
+
+	switch r.Status {
+	case StatusFailed:
+		attrs = append(attrs, "attempt", r.Attempt)
+		switch {
+		case r.RetryIn > 0:
+			slog.Warn("Failed to process file, will retry", append(attrs, "retry_in", r.RetryIn, "error", r.Err)...)
+		case r.Quarantined != "":
+			slog.Error("Failed to process file, quarantined", append(attrs, "quarantined", r.Quarantined, "error", r.Err)...)
+		default:
+			slog.Error("Failed to process file", append(attrs, "error", r.Err)...)
+		}
+	case StatusSkipped:
+		slog.Info("Skipping file", append(attrs, "reason", r.Reason)...)
+	default:
+		switch {
+		case r.Duplicate != "":
+			slog.Info("Deduplicated file", append(attrs, "dest_path", r.DestPath, "duplicate", r.Duplicate)...)
+		case r.Action == ActionMove:
+			slog.Info("Moved file", append(attrs, "dest_path", r.DestPath)...)
+		case r.Action == ActionCopy:
+			slog.Info("Copied file", append(attrs, "dest_path", r.DestPath)...)
+		case r.Action == ActionExec:
+			slog.Info("Command succeeded", attrs...)
+		case r.Action == ActionArchive:
+			slog.Info("Archived file", append(attrs, "dest_path", r.DestPath)...)
+		case r.Action == ActionDelete && r.DestPath != "":
+			slog.Info("Moved file to trash", append(attrs, "dest_path", r.DestPath)...)
+		case r.Action == ActionDelete:
+			slog.Info("Deleted file", attrs...)
+		case r.Action == ActionPipeline:
+			slog.Info("Pipeline finished", append(attrs, "dest_path", r.DestPath)...)
+		default:
+			slog.Info("Processed file", attrs...)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package fwatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestEngine returns an engine watching a new directory, with a rule
+// moving every file into another
+func newTestEngine(t *testing.T) (*Engine, string) {
+	t.Helper()
+	dir := t.TempDir()
+	e, err := New(Config{Watches: []Watch{{Path: dir}}, Rules: []Rule{{Regex: ".", Destination: t.TempDir()}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, dir
+}
+
+func TestWantsEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     Op
+		exists bool
+		want   bool
+		forget bool // whether what is remembered about the file is dropped
+	}{
+		{"create", OpCreate, true, true, false},
+		{"write", OpWrite, true, true, false},
+		{"chmod", OpChmod, true, true, false},
+		{"create and write", OpCreate | OpWrite, true, true, false},
+		{"renamed away", OpRename, false, false, true},
+		{"renamed away and replaced", OpRename, true, true, false},
+		{"remove", OpRemove, false, false, true},
+		{"none", 0, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, dir := newTestEngine(t)
+			path := filepath.Join(dir, "report.pdf")
+			if tt.exists {
+				if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e.failures.fail(path)
+
+			if got := e.wantsEvent(Event{Path: path, Op: tt.op}); got != tt.want {
+				t.Errorf("wantsEvent(%v) = %t, want %t", tt.op, got, tt.want)
+			}
+			// A file that was forgotten starts counting its failures again
+			if forgotten := e.failures.fail(path) == 1; forgotten != tt.forget {
+				t.Errorf("forgotten = %t, want %t", forgotten, tt.forget)
+			}
+		})
+	}
+}
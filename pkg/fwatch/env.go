@@ -0,0 +1,99 @@
+package fwatch
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envReference matches "${NAME}", "${NAME:-default}" and the "$${" escape
+var envReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces environment variable references in every string
+// field of the configuration, such as watch_dir and destination. A
+// reference to an unset variable without a default is an error, since
+// silently expanding it to nothing could send files to the wrong place.
+func expandEnv(config *Config) error {
+	return expandValue(reflect.ValueOf(config).Elem(), "")
+}
+
+// expandValue walks v, expanding strings in place. path names the value in
+// error messages using the YAML field names.
+func expandValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		expanded, err := expandString(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(expanded)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return expandValue(v.Elem(), path)
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			if err := expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(iter.Value())
+			if err := expandValue(elem, fmt.Sprintf("%s.%v", path, iter.Key())); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := expandValue(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandString replaces the environment variable references in s
+func expandString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envReference.FindStringSubmatch(ref)
+		if value, ok := os.LookupEnv(m[1]); ok && (value != "" || m[2] == "") {
+			return value
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return ""
+	})
+	return expanded, err
+}
@@ -0,0 +1,88 @@
+package fwatch
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// Environment variables that configure fwatch without a config file, as
+// in a container, or add to the config file
+const (
+	// WatchDirEnv lists directories to watch, separated like PATH
+	WatchDirEnv = "FWATCH_WATCH_DIR"
+
+	// RulesEnv is a JSON list of rules, added after the config's own
+	RulesEnv = "FWATCH_RULES"
+)
+
+// StdinConfig is the config path that reads the configuration from
+// standard input, in YAML or JSON
+const StdinConfig = "-"
+
+// readStdin reads standard input once, so a reload parses the same
+// configuration again
+var readStdin = sync.OnceValues(func() ([]byte, error) {
+	return io.ReadAll(os.Stdin)
+})
+
+// configuredByEnv reports whether the environment configures watches or
+// rules, so a config file isn't needed
+func configuredByEnv() bool {
+	return os.Getenv(WatchDirEnv) != "" || os.Getenv(RulesEnv) != ""
+}
+
+// readConfigData returns the configuration at path: standard input for
+// StdinConfig, and nothing for a missing file if the environment
+// configures fwatch
+func readConfigData(path string) ([]byte, error) {
+	if path == StdinConfig {
+		data, err := readStdin()
+		if err != nil {
+			return nil, fmt.Errorf("reading config from standard input: %w", err)
+		}
+		return data, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && configuredByEnv() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	return data, nil
+}
+
+// applyEnv adds the watches of FWATCH_WATCH_DIR and the rules of
+// FWATCH_RULES. A directory that is watched already, or a rule listed
+// twice, is only added once.
+func (c *Config) applyEnv(strict bool) error {
+	for _, dir := range filepath.SplitList(os.Getenv(WatchDirEnv)) {
+		if dir == "" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if !slices.ContainsFunc(c.Watches, func(w Watch) bool { return filepath.Clean(w.Path) == dir }) {
+			c.Watches = append(c.Watches, Watch{Path: dir})
+		}
+	}
+
+	data := os.Getenv(RulesEnv)
+	if data == "" {
+		return nil
+	}
+	var rules []Rule
+	if err := decodeDocument([]byte(data), FormatJSON, strict, &rules); err != nil {
+		return fmt.Errorf("parsing %s: %w", RulesEnv, err)
+	}
+	for _, rule := range rules {
+		if !slices.ContainsFunc(c.Rules, func(r Rule) bool { return reflect.DeepEqual(r, rule) }) {
+			c.Rules = append(c.Rules, rule)
+		}
+	}
+	return nil
+}
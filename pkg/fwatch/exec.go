@@ -0,0 +1,141 @@
+package fwatch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// defaultExecTimeout bounds how long an exec action may run when the rule
+// does not set its own timeout
+const defaultExecTimeout = 5 * time.Minute
+
+// ExecAction configures a command run for each matched file. Command,
+// Dir and Env values are templates, see templateData for the variables.
+type ExecAction struct {
+	Command []string          `yaml:"command"`
+	Timeout Duration          `yaml:"timeout"`
+	Dir     string            `yaml:"dir"`
+	Env     map[string]string `yaml:"env"`
+}
+
+// runExec runs the rule's command for a matched file, logging its output
+func runExec(rule *Rule, filePath string) error {
+	return execCommand(rule.Exec, newTemplateData(filePath, rule))
+}
+
+// execCommand renders and runs the command, streaming stdout and stderr
+// into the log line by line
+func execCommand(action *ExecAction, data templateData) error {
+	args, err := renderCommand(action, data)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(action.Timeout)
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	if action.Dir != "" {
+		dir, err := renderTemplate(action.Dir, data)
+		if err != nil {
+			return err
+		}
+		cmd.Dir = dir
+	}
+
+	// Inherit fwatch's environment and add the file variables plus any
+	// configured entries on top
+	cmd.Env = append(os.Environ(),
+		"FWATCH_PATH="+data.Path,
+		"FWATCH_NAME="+data.Name,
+		"FWATCH_DESTINATION="+data.Destination,
+	)
+	if data.Dest != "" {
+		cmd.Env = append(cmd.Env, "FWATCH_DEST="+data.Dest)
+	}
+	if data.Error != "" {
+		cmd.Env = append(cmd.Env, "FWATCH_ERROR="+data.Error)
+	}
+	for key, value := range action.Env {
+		rendered, err := renderTemplate(value, data)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, key+"="+rendered)
+	}
+
+	stdout := &logWriter{command: args[0], stream: "stdout"}
+	stderr := &logWriter{command: args[0], stream: "stderr"}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	// Give output pipes a moment to drain after the command exits or is
+	// killed, so orphaned children holding them open can't block us
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	stdout.flush()
+	stderr.flush()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("running command: %w", err)
+	}
+	return nil
+}
+
+// renderCommand expands the templates in the command's arguments
+func renderCommand(action *ExecAction, data templateData) ([]string, error) {
+	args := make([]string, len(action.Command))
+	for i, arg := range action.Command {
+		rendered, err := renderTemplate(arg, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = rendered
+	}
+	return args, nil
+}
+
+// logWriter is an io.Writer that logs each complete line written to it
+type logWriter struct {
+	command string
+	stream  string
+	buf     []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+		w.log(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any trailing output that did not end in a newline
+func (w *logWriter) flush() {
+	if len(w.buf) > 0 {
+		w.log(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *logWriter) log(line []byte) {
+	slog.Info("Command output", "command", w.command, "stream", w.stream, "line", string(line))
+}
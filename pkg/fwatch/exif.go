@@ -0,0 +1,385 @@
+package fwatch
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exifData is the photo and video metadata available to templates as
+// .Exif. It is only read from the file when a template uses it.
+type exifData struct {
+	DateTaken   time.Time // When the photo or video was taken, or the file's modification time without metadata
+	CameraMake  string    // Manufacturer of the camera or phone, empty if unknown
+	CameraModel string    // Model of the camera or phone, empty if unknown
+	Lens        string    // Lens model, empty if unknown
+}
+
+const (
+	// exifScanSize is how much of a file is searched for metadata that
+	// isn't found through the file's structure
+	exifScanSize = 1 << 20
+
+	// exifDateLayout is how EXIF writes dates, in local time
+	exifDateLayout = "2006:01:02 15:04:05"
+)
+
+// errNoMetadata means a file has no metadata fwatch can read
+var errNoMetadata = errors.New("no photo or video metadata found")
+
+// heifBrands are the ftyp brands of HEIF images, such as HEIC and AVIF;
+// other ISO media files are read as videos
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1", "avif", "avis"}
+
+// readExif returns the metadata of a photo or video. The date falls back to
+// the modification time, so templates always have one to sort by.
+func readExif(path string) exifData {
+	var meta exifData
+	f, err := os.Open(path)
+	if err == nil {
+		meta, err = parseMediaMetadata(f)
+		f.Close()
+	}
+	if err != nil {
+		slog.Debug("Could not read photo or video metadata", "file", path, "error", err)
+	}
+	if meta.DateTaken.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			meta.DateTaken = info.ModTime()
+		}
+	}
+	return meta
+}
+
+// parseMediaMetadata reads the metadata of a JPEG, a TIFF-based raw file
+// (DNG, CR2, NEF, ARW, ORF, RW2, PEF), a HEIF image or a MP4 or QuickTime
+// video
+func parseMediaMetadata(f io.ReaderAt) (exifData, error) {
+	var header [12]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		return exifData{}, errNoMetadata
+	}
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		return parseJPEG(f)
+	case isTIFFHeader(header[:4]):
+		data, err := readPrefix(f, exifScanSize)
+		if err != nil {
+			return exifData{}, err
+		}
+		return parseTIFF(data)
+	case string(header[4:8]) == "ftyp" && slices.Contains(heifBrands, string(header[8:12])):
+		// The Exif item is usually stored before the image data
+		data, err := readPrefix(f, exifScanSize)
+		if err != nil {
+			return exifData{}, err
+		}
+		if i := bytes.Index(data, []byte("Exif\x00\x00")); i >= 0 {
+			return parseTIFF(data[i+6:])
+		}
+		return exifData{}, errNoMetadata
+	case string(header[4:8]) == "ftyp":
+		return parseQuickTime(f)
+	}
+	return exifData{}, errNoMetadata
+}
+
+// readPrefix reads up to n bytes from the start of f
+func readPrefix(f io.ReaderAt, n int64) ([]byte, error) {
+	return io.ReadAll(io.NewSectionReader(f, 0, n))
+}
+
+// isTIFFHeader reports whether b starts TIFF data, including the variants
+// used by Olympus and Panasonic raw files
+func isTIFFHeader(b []byte) bool {
+	switch string(b[:4]) {
+	case "II*\x00", "MM\x00*", "IIRO", "IIRS", "MMOR", "IIU\x00":
+		return true
+	}
+	return false
+}
+
+// parseJPEG finds the EXIF segment of a JPEG file
+func parseJPEG(f io.ReaderAt) (exifData, error) {
+	var marker [4]byte
+	for off := int64(2); ; {
+		if _, err := f.ReadAt(marker[:], off); err != nil || marker[0] != 0xFF {
+			return exifData{}, errNoMetadata
+		}
+		// Start of scan: the image data follows, metadata comes before it
+		if marker[1] == 0xDA {
+			return exifData{}, errNoMetadata
+		}
+		size := int64(binary.BigEndian.Uint16(marker[2:]))
+		if marker[1] == 0xE1 && size > 8 {
+			segment := make([]byte, size-2)
+			if _, err := f.ReadAt(segment, off+4); err != nil {
+				return exifData{}, err
+			}
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return parseTIFF(segment[6:])
+			}
+		}
+		off += 2 + size
+	}
+}
+
+// parseTIFF reads the camera and date tags of TIFF-structured EXIF data
+func parseTIFF(data []byte) (exifData, error) {
+	if len(data) < 8 {
+		return exifData{}, errNoMetadata
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exifData{}, errNoMetadata
+	}
+
+	var meta exifData
+	tags := make(map[uint16]string)
+	var exifIFD uint32
+	readIFD := func(offset uint32) {
+		if int64(offset)+2 > int64(len(data)) {
+			return
+		}
+		count := int(order.Uint16(data[offset:]))
+		for i := range count {
+			entry := int(offset) + 2 + 12*i
+			if entry+12 > len(data) {
+				return
+			}
+			tag := order.Uint16(data[entry:])
+			typ := order.Uint16(data[entry+2:])
+			n := order.Uint32(data[entry+4:])
+			switch {
+			case tag == 0x8769 && typ == 4:
+				exifIFD = order.Uint32(data[entry+8:])
+			case typ == 2 && n <= 4:
+				tags[tag] = exifString(data[entry+8 : entry+8+int(n)])
+			case typ == 2:
+				start := int64(order.Uint32(data[entry+8:]))
+				if start+int64(n) <= int64(len(data)) {
+					tags[tag] = exifString(data[start : start+int64(n)])
+				}
+			}
+		}
+	}
+	readIFD(order.Uint32(data[4:]))
+	if exifIFD != 0 {
+		readIFD(exifIFD)
+	}
+
+	meta.CameraMake = tags[0x010F]
+	meta.CameraModel = tags[0x0110]
+	meta.Lens = tags[0xA434]
+	// DateTimeOriginal, then DateTimeDigitized, then the file's DateTime
+	for _, tag := range []uint16{0x9003, 0x9004, 0x0132} {
+		if date, err := parseExifDate(tags[tag], tags[0x9011]); err == nil {
+			meta.DateTaken = date
+			break
+		}
+	}
+	if meta == (exifData{}) {
+		return meta, errNoMetadata
+	}
+	return meta, nil
+}
+
+// exifString trims the NUL terminator and padding of an EXIF string
+func exifString(b []byte) string {
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+// parseExifDate parses an EXIF date, in the given UTC offset such as
+// "+02:00" if there is one and in local time otherwise
+func parseExifDate(date, offset string) (time.Time, error) {
+	if date == "" || strings.HasPrefix(date, "0000") {
+		return time.Time{}, errNoMetadata
+	}
+	if offset != "" {
+		if t, err := time.Parse(exifDateLayout+"-07:00", date+offset); err == nil {
+			return t, nil
+		}
+	}
+	return time.ParseInLocation(exifDateLayout, date, time.Local)
+}
+
+// quickTimeEpoch is where MP4 and QuickTime timestamps count from
+var quickTimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// parseQuickTime reads the creation time and the camera of a MP4 or
+// QuickTime video from its movie box, which may come after the media data
+func parseQuickTime(f io.ReaderAt) (exifData, error) {
+	var meta exifData
+	var keyed map[string]string
+	err := walkBoxes(f, 0, -1, func(typ string, off, size int64) error {
+		if typ != "moov" {
+			return nil
+		}
+		return walkBoxes(f, off, size, func(typ string, off, size int64) error {
+			switch typ {
+			case "mvhd":
+				var b [12]byte
+				if _, err := f.ReadAt(b[:], off); err != nil {
+					return err
+				}
+				var secs uint64
+				if b[0] == 1 {
+					secs = binary.BigEndian.Uint64(b[4:])
+				} else {
+					secs = uint64(binary.BigEndian.Uint32(b[4:]))
+				}
+				if secs > 0 {
+					meta.DateTaken = quickTimeEpoch.Add(time.Duration(secs) * time.Second).Local()
+				}
+			case "meta":
+				keyed = readQuickTimeKeys(f, off, size)
+			case "udta":
+				// Manufacturer and model strings some cameras write
+				walkBoxes(f, off, size, func(typ string, off, size int64) error {
+					if (typ == "\xa9mak" || typ == "\xa9mod") && size > 4 && size < 1024 {
+						b := make([]byte, size)
+						if _, err := f.ReadAt(b, off); err == nil {
+							value := exifString(b[4:min(4+int64(binary.BigEndian.Uint16(b)), size)])
+							if typ == "\xa9mak" {
+								meta.CameraMake = value
+							} else {
+								meta.CameraModel = value
+							}
+						}
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return exifData{}, err
+	}
+
+	// Phones record the camera, and the date with its time zone, as keys
+	meta.CameraMake = cmp.Or(keyed["com.apple.quicktime.make"], meta.CameraMake)
+	meta.CameraModel = cmp.Or(keyed["com.apple.quicktime.model"], meta.CameraModel)
+	if date := keyed["com.apple.quicktime.creationdate"]; date != "" {
+		for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339} {
+			if t, err := time.Parse(layout, date); err == nil {
+				meta.DateTaken = t
+				break
+			}
+		}
+	}
+	if meta == (exifData{}) {
+		return meta, errNoMetadata
+	}
+	return meta, nil
+}
+
+// readQuickTimeKeys reads the string values of a QuickTime metadata box,
+// which names its items in a keys box and stores them in an ilst box
+func readQuickTimeKeys(f io.ReaderAt, off, size int64) map[string]string {
+	var keys []string
+	values := make(map[string]string)
+	// An MP4 style meta box starts with a version and flags, a QuickTime
+	// one right away with its hdlr box
+	var head [8]byte
+	if _, err := f.ReadAt(head[:], off); err != nil || string(head[4:8]) != "hdlr" {
+		if size < 4 {
+			return values
+		}
+		off, size = off+4, size-4
+	}
+	walkBoxes(f, off, size, func(typ string, off, size int64) error {
+		if size > 1<<16 {
+			return nil
+		}
+		b := make([]byte, size)
+		if _, err := f.ReadAt(b, off); err != nil {
+			return nil
+		}
+		switch typ {
+		case "keys":
+			// Version and flags, the number of keys, then each key's size,
+			// namespace and name
+			for p := 8; p+8 <= len(b); {
+				n := int(binary.BigEndian.Uint32(b[p:]))
+				if n < 8 || p+n > len(b) {
+					break
+				}
+				keys = append(keys, string(b[p+8:p+n]))
+				p += n
+			}
+		case "ilst":
+			// Each item is named by the 1-based index of its key and holds
+			// a data box: size, "data", type, locale, value
+			for p := 0; p+8 <= len(b); {
+				n := int(binary.BigEndian.Uint32(b[p:]))
+				if n < 8 || p+n > len(b) {
+					break
+				}
+				index := int(binary.BigEndian.Uint32(b[p+4:]))
+				item := b[p+8 : p+n]
+				if index >= 1 && index <= len(keys) && len(item) >= 16 && string(item[4:8]) == "data" {
+					// A data box too small for its own header holds nothing
+					if dataSize := int(binary.BigEndian.Uint32(item)); dataSize >= 16 {
+						values[keys[index-1]] = exifString(item[16:min(dataSize, len(item))])
+					}
+				}
+				p += n
+			}
+		}
+		return nil
+	})
+	return values
+}
+
+// walkBoxes calls fn with the type, payload offset and payload size of each
+// ISO media box between off and off+size, or to the end of the file when
+// size is negative
+func walkBoxes(f io.ReaderAt, off, size int64, fn func(typ string, off, size int64) error) error {
+	end := off + size
+	for size < 0 || off+8 <= end {
+		var head [16]byte
+		if _, err := f.ReadAt(head[:8], off); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		boxSize, headSize := int64(binary.BigEndian.Uint32(head[:4])), int64(8)
+		switch boxSize {
+		case 0:
+			// The last box, up to the end of the file
+			if size >= 0 {
+				boxSize = end - off
+			} else {
+				boxSize = 1 << 62
+			}
+		case 1:
+			if _, err := f.ReadAt(head[8:16], off+8); err != nil {
+				return err
+			}
+			boxSize, headSize = int64(binary.BigEndian.Uint64(head[8:16])), 16
+		}
+		if boxSize < headSize || (size >= 0 && off+boxSize > end) {
+			return fmt.Errorf("invalid %q box at offset %d", head[4:8], off)
+		}
+		if err := fn(string(head[4:8]), off+headSize, boxSize-headSize); err != nil {
+			return err
+		}
+		off += boxSize
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package fwatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// box returns an ISO media box of the given type holding the payloads
+func box(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(b, typ...), payload...)
+}
+
+// u32 returns n as four big-endian bytes
+func u32(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// quickTimeMovie returns a video whose metadata box has keys and an ilst
+// box holding the items
+func quickTimeMovie(keys []string, items ...[]byte) []byte {
+	var keyBoxes [][]byte
+	for _, key := range keys {
+		keyBoxes = append(keyBoxes, append(append(u32(uint32(8+len(key))), "mdta"...), key...))
+	}
+	keysBox := box("keys", append(u32(0), u32(uint32(len(keys)))...), bytes.Join(keyBoxes, nil))
+	meta := box("meta", box("hdlr", make([]byte, 24)), keysBox, box("ilst", items...))
+	return append(box("ftyp", []byte("qt  "), u32(0)), box("moov", meta)...)
+}
+
+// dataItem returns an ilst item for the 1-based key index holding value,
+// with its data box claiming dataSize bytes
+func dataItem(index uint32, dataSize uint32, value string) []byte {
+	data := append(append(u32(dataSize), "data"...), append(u32(1), u32(0)...)...)
+	return box(string(u32(index)), append(data, value...))
+}
+
+func TestParseQuickTimeKeys(t *testing.T) {
+	keys := []string{"com.apple.quicktime.make", "com.apple.quicktime.model"}
+	movie := quickTimeMovie(keys, dataItem(1, 16+5, "Apple"), dataItem(2, 16+9, "iPhone 15"))
+	meta, err := parseMediaMetadata(bytes.NewReader(movie))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CameraMake != "Apple" || meta.CameraModel != "iPhone 15" {
+		t.Errorf("camera = %q %q, want Apple iPhone 15", meta.CameraMake, meta.CameraModel)
+	}
+}
+
+func TestParseQuickTimeMalformedIlst(t *testing.T) {
+	keys := []string{"com.apple.quicktime.make", "com.apple.quicktime.model"}
+	tests := []struct {
+		name  string
+		items [][]byte
+	}{
+		{"data box smaller than its header", [][]byte{dataItem(1, 10, "Apple")}},
+		{"data box of size zero", [][]byte{dataItem(1, 0, "Apple")}},
+		{"data box larger than the item", [][]byte{dataItem(1, 1<<20, "Apple")}},
+		{"index beyond the keys", [][]byte{dataItem(7, 16+5, "Apple")}},
+		{"index zero", [][]byte{dataItem(0, 16+5, "Apple")}},
+		{"item size beyond the box", [][]byte{append(u32(1<<16), u32(1)...)}},
+		{"item size below its header", [][]byte{append(u32(4), u32(1)...)}},
+		{"truncated item", [][]byte{u32(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := quickTimeMovie(keys, tt.items...)
+			// Only the lack of a panic matters; what is read is best effort
+			parseMediaMetadata(bytes.NewReader(movie))
+		})
+	}
+}
+
+func TestParseQuickTimeTinyMetaBox(t *testing.T) {
+	movie := append(box("ftyp", []byte("isom"), u32(0)), box("moov", box("meta", []byte{0, 0}))...)
+	if _, err := parseMediaMetadata(bytes.NewReader(movie)); err == nil {
+		t.Error("want an error for a movie without metadata")
+	}
+}
+
+func FuzzParseMediaMetadata(f *testing.F) {
+	keys := []string{"com.apple.quicktime.make", "com.apple.quicktime.creationdate"}
+	f.Add(quickTimeMovie(keys, dataItem(1, 16+5, "Apple"), dataItem(2, 16+24, "2024-01-05T10:00:00+0100")))
+	f.Add(quickTimeMovie(keys, dataItem(1, 10, "Apple")))
+	f.Add([]byte("\xff\xd8\xff\xe1\x00\x10Exif\x00\x00II*\x00\x08\x00\x00\x00"))
+	f.Add([]byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x0f\x00\x02\x00\x00\x00\x04Sony"))
+	f.Add(append(box("ftyp", []byte("heic"), u32(0)), "Exif\x00\x00II*\x00\x08\x00\x00\x00"...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseMediaMetadata(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,174 @@
+package fwatch
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Explanation describes what the engine would do with a file, as reported
+// by Config.Explain
+type Explanation struct {
+	Path    string `json:"path"`
+	Watch   string `json:"watch,omitempty"`   // Watch directory containing the file, if any
+	Ignored bool   `json:"ignored,omitempty"` // The name matches an ignore pattern, or it is an ignored symlink
+	Rule    string `json:"rule,omitempty"`    // Name of the matching rule, if any
+	Action  string `json:"action,omitempty"`
+
+	// DestPath is where the file would be moved, uploaded or archived,
+	// after the conflict policy is applied; Command is the rendered exec
+	// command
+	DestPath string   `json:"dest_path,omitempty"`
+	Command  []string `json:"command,omitempty"`
+
+	// Trash is set if the file would be deleted to the trash
+	Trash bool `json:"trash,omitempty"`
+
+	// Conflict says how an existing file at the destination would be
+	// handled; Skipped is set if the file would be left alone because of it
+	Conflict string `json:"conflict,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+
+	// OpensAt is set if the rule's schedule is closed now
+	OpensAt time.Time `json:"opens_at,omitzero"`
+
+	// Steps describes each step of a pipeline, up to the first one that
+	// would be skipped
+	Steps []*Explanation `json:"steps,omitempty"`
+
+	// Next describes the following rule applied to the file when this
+	// rule has continue set
+	Next *Explanation `json:"next,omitempty"`
+}
+
+// Explain reports which rule matches a file and what its action would do,
+// without doing it. Remote destinations are not contacted, so their
+// conflicts are not checked.
+func (c *Config) Explain(filePath string) (*Explanation, error) {
+	filePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	watch := c.watchFor(filePath)
+	info, ignored, err := c.statFile(watch, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", filePath)
+	}
+
+	x := &Explanation{Path: filePath}
+	if watch != nil {
+		x.Watch = watch.Path
+	}
+	if ignored || isIgnored(filePath, c.ignorePatterns(watch)) {
+		x.Ignored = true
+		return x, nil
+	}
+
+	rules := matchRules(c.Rules, newCandidate(filePath, info, watch))
+	if len(rules) == 0 {
+		return x, nil
+	}
+	current := x
+	for i, rule := range rules {
+		if i > 0 {
+			current.Next = &Explanation{Path: filePath, Watch: x.Watch}
+			current = current.Next
+		}
+		if err := explainRule(current, filePath, rule); err != nil {
+			return x, err
+		}
+		if err := explainSteps(current, filePath, rule); err != nil {
+			return x, err
+		}
+	}
+	return x, nil
+}
+
+// explainSteps fills in the steps of a pipeline rule, following the file
+// through the moves it would make
+func explainSteps(x *Explanation, filePath string, rule *Rule) error {
+	current := filePath
+	for i := range rule.Steps {
+		step := rule.stepRule(&rule.Steps[i])
+		sx := &Explanation{Path: current, Watch: x.Watch}
+		x.Steps = append(x.Steps, sx)
+		if step.Action == ActionChecksum {
+			sx.Rule, sx.Action = rule.Name, ActionChecksum
+			continue
+		}
+		if err := explainRule(sx, filePath, step); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if sx.Skipped {
+			break
+		}
+		if step.Action == ActionMove && !isRemoteDestination(step.Destination) {
+			current = sx.DestPath
+		}
+	}
+	return nil
+}
+
+// explainRule fills in what rule's action would do with the file. x.Path
+// is where the file would be by then, which a pipeline's moves change;
+// conflicts are checked against the file itself at filePath.
+func explainRule(x *Explanation, filePath string, rule *Rule) error {
+	x.Rule = rule.Name
+	x.Action = cmp.Or(rule.Action, ActionMove)
+	if rule.Schedule != nil && !rule.Schedule.Open(time.Now()) {
+		x.OpensAt = rule.Schedule.Next(time.Now())
+	}
+	if x.Action == ActionPipeline {
+		return nil
+	}
+
+	var target string
+	var err error
+	switch x.Action {
+	case ActionExec:
+		x.Command, err = renderCommand(rule.Exec, newTemplateData(x.Path, rule))
+		return err
+	case ActionDelete:
+		x.Trash = rule.DeleteMode == DeleteModeTrash
+		return nil
+	case ActionArchive:
+		if target, err = archivePathFor(x.Path, rule); err != nil {
+			return err
+		}
+		if rule.Archive != nil && rule.Archive.Append {
+			x.DestPath = target
+			return nil
+		}
+	default:
+		name, err := rule.destName(x.Path)
+		if err != nil {
+			return err
+		}
+		if isRemoteDestination(rule.Destination) {
+			// Keys are joined with a slash whatever the local separator
+			x.DestPath = redactDestination(rule.Destination)
+			if x.DestPath[len(x.DestPath)-1] != '/' {
+				x.DestPath += "/"
+			}
+			x.DestPath += name
+			return nil
+		}
+		target = filepath.Join(rule.Destination, name)
+	}
+
+	resolved, reason, err := resolveConflict(filePath, target, rule.conflictPolicy(), rule.conflictSuffix())
+	if err != nil {
+		return fmt.Errorf("resolving destination conflict: %w", err)
+	}
+	x.Conflict = reason
+	if resolved == "" {
+		x.DestPath, x.Skipped = target, true
+	} else {
+		x.DestPath = resolved
+	}
+	return nil
+}
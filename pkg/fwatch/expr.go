@@ -0,0 +1,129 @@
+package fwatch
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"cel.dev/cel-go/cel"
+)
+
+// exprCostLimit bounds the work an expression may do on a file, so a
+// costly one fails instead of stalling the workers
+const exprCostLimit = 100_000
+
+// exprEnv declares the variables expressions can use
+var exprEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("path", cel.StringType),
+		cel.Variable("name", cel.StringType),
+		cel.Variable("ext", cel.StringType),
+		cel.Variable("dir", cel.StringType),
+		cel.Variable("dirs", cel.ListType(cel.StringType)),
+		cel.Variable("size", cel.IntType),
+		cel.Variable("mtime", cel.TimestampType),
+		cel.Variable("age", cel.DurationType),
+		cel.Variable("mime", cel.StringType),
+	)
+})
+
+// exprPrograms caches compiled expressions by their text
+var exprPrograms sync.Map
+
+// sizeLiteral matches sizes with a unit, such as 100MB or 1.5GiB, which
+// expressions may use for numbers of bytes
+var sizeLiteral = regexp.MustCompile(`(\d+(?:\.\d+)?)(KiB|MiB|GiB|TiB|KB|MB|GB|TB)\b`)
+
+// expandSizes replaces the size literals outside the string literals of
+// an expression with their number of bytes
+func expandSizes(expr string) string {
+	var b strings.Builder
+	var quote byte
+	start := 0
+	flush := func(end int) {
+		part := expr[start:end]
+		b.WriteString(sizeLiteral.ReplaceAllStringFunc(part, func(literal string) string {
+			size, err := ParseByteSize(literal)
+			if err != nil {
+				return literal
+			}
+			return fmt.Sprint(int64(size))
+		}))
+		start = end
+	}
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case quote == 0 && (c == '"' || c == '\''):
+			flush(i)
+			quote = c
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			b.WriteString(expr[start : i+1])
+			start, quote = i+1, 0
+		}
+	}
+	if quote != 0 {
+		b.WriteString(expr[start:])
+	} else {
+		flush(len(expr))
+	}
+	return b.String()
+}
+
+// cachedProgram returns the compiled program of a rule's expr
+func cachedProgram(expr string) (cel.Program, error) {
+	if program, ok := exprPrograms.Load(expr); ok {
+		return program.(cel.Program), nil
+	}
+	env, err := exprEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expandSizes(expr))
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression gives %s, not a bool", ast.OutputType())
+	}
+	program, err := env.Program(ast, cel.CostLimit(exprCostLimit))
+	if err != nil {
+		return nil, err
+	}
+	exprPrograms.Store(expr, program)
+	return program, nil
+}
+
+// matchesExpr reports whether the file satisfies the rule's expr, if it
+// has one. The content type is only sniffed if the expression gets to
+// mime, and an expression that fails on a file doesn't match it.
+func (r *Rule) matchesExpr(c *candidate) bool {
+	if r.Expr == "" {
+		return true
+	}
+	program, err := cachedProgram(r.Expr)
+	if err != nil {
+		return false
+	}
+	out, _, err := program.Eval(map[string]any{
+		"path":  c.path,
+		"name":  filepath.Base(c.path),
+		"ext":   c.ext,
+		"dir":   filepath.Dir(c.path),
+		"dirs":  c.dirs,
+		"size":  c.info.Size(),
+		"mtime": c.info.ModTime(),
+		"age":   c.now.Sub(c.info.ModTime()),
+		"mime":  func() any { return c.contentType() },
+	})
+	if err != nil {
+		slog.Warn("Rule expression failed", "file", c.path, "rule", r.Name, "error", err)
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
@@ -0,0 +1,43 @@
+package fwatch
+
+import "testing"
+
+func TestExpandSizes(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"size > 100MB", "size > 104857600"},
+		{"size < 1.5GiB", "size < 1610612736"},
+		{"size >= 2KB && size < 1TB", "size >= 2048 && size < 1099511627776"},
+		{`name == "100MB"`, `name == "100MB"`},
+		{`name == '100MB' || size > 1KiB`, `name == '100MB' || size > 1024`},
+		{`name == "a \"5MB\" b" && size > 1KB`, `name == "a \"5MB\" b" && size > 1024`},
+		{`name.endsWith("'") && size > 1MB`, `name.endsWith("'") && size > 1048576`},
+		{`name == "5MB`, `name == "5MB`}, // unterminated, left to the compiler
+		{"size > 5MBs", "size > 5MBs"},
+		{"size > 100", "size > 100"},
+	}
+	for _, tt := range tests {
+		if got := expandSizes(tt.expr); got != tt.want {
+			t.Errorf("expandSizes(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCachedProgram(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"size > 1.5GiB && ext == '.iso'", true},
+		{`name.startsWith("IMG_") && age > duration("24h")`, true},
+		{"size + 1", false}, // not a bool
+		{"size >", false},
+		{"unknown == 1", false},
+	}
+	for _, tt := range tests {
+		if _, err := cachedProgram(tt.expr); (err == nil) != tt.valid {
+			t.Errorf("cachedProgram(%q) = %v, want valid %t", tt.expr, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package fwatch
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Non-ASCII handling for FilenameOptions.NonASCII
+const (
+	NonASCIIKeep          = "keep"
+	NonASCIITransliterate = "transliterate"
+	NonASCIIStrip         = "strip"
+)
+
+// illegalChars are the characters Windows and most SMB shares refuse in
+// file names, besides control characters
+const illegalChars = `<>:"/\|?*`
+
+// FilenameOptions changes the name a file gets at its destination. The
+// template is rendered first, then the transforms are applied in the order
+// of the fields.
+type FilenameOptions struct {
+	// Template is the new name, e.g. "{{.Date}}-{{.Stem}}{{.Ext}}", with
+	// the same variables as exec arguments. Slashes in it place the file
+	// in subdirectories of the destination.
+	Template string `yaml:"template"`
+
+	// NonASCII is "keep" (default), "transliterate" (é becomes e, ß ss,
+	// and what has no ASCII equivalent is dropped) or "strip"
+	NonASCII string `yaml:"non_ascii"`
+
+	// Lowercase lowercases the whole name, including the extension
+	Lowercase bool `yaml:"lowercase"`
+
+	// ReplaceSpaces replaces each run of whitespace with this string
+	ReplaceSpaces *string `yaml:"replace_spaces"`
+
+	// ReplaceIllegal replaces characters not allowed in Windows or SMB file
+	// names, and control characters, with this string
+	ReplaceIllegal *string `yaml:"replace_illegal"`
+
+	// MaxLength shortens the name to at most this many bytes, keeping the
+	// extension
+	MaxLength int `yaml:"max_length"`
+
+	// ContentHash names the file by the SHA-256 of its content, keeping
+	// its extension, below directories named by the first characters of
+	// the digest: ab/cd/abcd….pdf. Renaming transforms don't apply.
+	ContentHash bool `yaml:"content_hash"`
+
+	// HashDirs is how many levels of two-character directories a content
+	// hash name is stored below, 2 by default
+	HashDirs *int `yaml:"hash_dirs"`
+
+	// Sidecar keeps a JSON file next to each content-addressed file with
+	// the names it arrived under
+	Sidecar bool `yaml:"sidecar"`
+}
+
+// validate checks the filename settings
+func (f *FilenameOptions) validate(sample templateData) error {
+	if f == nil {
+		return nil
+	}
+	switch f.NonASCII {
+	case "", NonASCIIKeep, NonASCIITransliterate, NonASCIIStrip:
+	default:
+		return fmt.Errorf("unknown filename.non_ascii value %q", f.NonASCII)
+	}
+	if f.MaxLength < 0 {
+		return fmt.Errorf("filename.max_length can't be negative")
+	}
+	for _, replacement := range []*string{f.ReplaceSpaces, f.ReplaceIllegal} {
+		if replacement != nil && strings.ContainsAny(*replacement, illegalChars) {
+			return fmt.Errorf("filename replacement %q contains characters not allowed in file names", *replacement)
+		}
+	}
+	if f.Template != "" {
+		if _, err := renderTemplate(f.Template, sample); err != nil {
+			return fmt.Errorf("filename.template: %w", err)
+		}
+	}
+	if f.ContentHash && f.Template != "" {
+		return fmt.Errorf("filename.content_hash can't be combined with a template")
+	}
+	if (f.HashDirs != nil || f.Sidecar) && !f.ContentHash {
+		return fmt.Errorf("filename.hash_dirs and filename.sidecar need content_hash")
+	}
+	if f.HashDirs != nil && (*f.HashDirs < 0 || *f.HashDirs > 4) {
+		return fmt.Errorf("filename.hash_dirs must be between 0 and 4")
+	}
+	return nil
+}
+
+// Periods a rule's rotate option sorts files into
+const (
+	RotateDaily   = "daily"
+	RotateWeekly  = "weekly"
+	RotateMonthly = "monthly"
+)
+
+// rotatePeriods lists the valid rotate values
+var rotatePeriods = []string{RotateDaily, RotateWeekly, RotateMonthly}
+
+// periodDir returns the directory for the rotate period t falls in, such
+// as 2024-08-05, 2024-W32 or 2024-08, or "" without rotation
+func periodDir(rotate string, t time.Time) string {
+	switch rotate {
+	case RotateDaily:
+		return t.Format("2006-01-02")
+	case RotateWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case RotateMonthly:
+		return t.Format("2006-01")
+	}
+	return ""
+}
+
+// destName returns the name a file gets at the rule's destination, below
+// the directory of the current period if the rule rotates. A template
+// name has its directories separated by slashes.
+func (r *Rule) destName(filePath string) (string, error) {
+	name, err := r.fileName(filePath)
+	if err != nil || r.Rotate == "" {
+		return name, err
+	}
+	return path.Join(periodDir(r.Rotate, time.Now()), name), nil
+}
+
+// fileName returns the name the rule's filename options give a file
+func (r *Rule) fileName(filePath string) (string, error) {
+	name := filepath.Base(filePath)
+	f := r.Filename
+	if f == nil {
+		return name, nil
+	}
+	if f.ContentHash {
+		return f.contentHashName(filePath)
+	}
+
+	if f.Template != "" {
+		rendered, err := renderTemplate(f.Template, newTemplateData(filePath, r))
+		if err != nil {
+			return "", fmt.Errorf("filename template: %w", err)
+		}
+		name = rendered
+	}
+
+	// The transforms apply to each directory and the name on their own
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		part = f.transform(part)
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) {
+			if i < len(parts)-1 {
+				return "", fmt.Errorf("filename template gave %q, which is not a path below the destination", name)
+			}
+			return "", fmt.Errorf("%s has no usable name after the filename transforms", filePath)
+		}
+		parts[i] = part
+	}
+	return path.Join(parts...), nil
+}
+
+// transform applies the renaming transforms to one file or directory name
+func (f *FilenameOptions) transform(name string) string {
+	switch f.NonASCII {
+	case NonASCIITransliterate:
+		name = transliterate(name)
+	case NonASCIIStrip:
+		name = strings.Map(func(r rune) rune {
+			if r > unicode.MaxASCII {
+				return -1
+			}
+			return r
+		}, name)
+	}
+	if f.Lowercase {
+		name = strings.ToLower(name)
+	}
+	if f.ReplaceSpaces != nil {
+		name = strings.Join(strings.Fields(name), *f.ReplaceSpaces)
+	}
+	if f.ReplaceIllegal != nil {
+		var b strings.Builder
+		for _, r := range name {
+			if unicode.IsControl(r) || strings.ContainsRune(illegalChars, r) {
+				b.WriteString(*f.ReplaceIllegal)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+		name = b.String()
+	}
+	if f.MaxLength > 0 {
+		name = truncateName(name, f.MaxLength)
+	}
+
+	return strings.TrimSpace(name)
+}
+
+// transliterations are letters that don't decompose into an ASCII letter
+// and a combining mark
+var transliterations = map[rune]string{
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'Ø': "O", 'ø': "o",
+	'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d", 'Þ': "Th", 'þ': "th", 'Ð': "D", 'ð': "d",
+	'ı': "i", '‘': "'", '’': "'", '“': "'", '”': "'", '–': "-", '—': "-", '…': "...",
+}
+
+// transliterate replaces letters with their closest ASCII spelling, such as
+// é with e, and drops characters that have none
+func transliterate(s string) string {
+	// Decompose, so "é" becomes "e" and a combining accent that is dropped
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	s, _, _ = transform.String(t, s)
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r <= unicode.MaxASCII:
+			b.WriteRune(r)
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		}
+	}
+	return b.String()
+}
+
+// truncateName shortens name to at most max bytes, keeping its extension
+// when it fits and never splitting a UTF-8 sequence
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	stem, ext := splitExt(name)
+	if len(ext) >= max {
+		stem, ext = name, ""
+	}
+	// Cut before the rune the limit falls in, if it splits one
+	cut := max - len(ext)
+	start := cut
+	for start > 0 && cut-start < utf8.UTFMax-1 && !utf8.RuneStart(stem[start]) {
+		start--
+	}
+	if _, size := utf8.DecodeRuneInString(stem[start:]); start+size > cut {
+		cut = start
+	}
+	return stem[:cut] + ext
+}
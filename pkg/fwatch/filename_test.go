@@ -0,0 +1,76 @@
+package fwatch
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		want string
+	}{
+		{"report.pdf", 20, "report.pdf"},
+		{"annual report.pdf", 10, "annual.pdf"},
+		{"årsrapport.pdf", 6, "å.pdf"},
+		{"åå.pdf", 7, "å.pdf"},              // the limit falls inside the second å
+		{"日本語.txt", 8, "日.txt"},             // and inside 本
+		{"a.verylongextension", 5, "a.ver"}, // the extension doesn't fit
+		// Invalid bytes before the cut are kept
+		{"\xffbad\xfename.txt", 8, "\xffbad.txt"},
+		{"ab" + strings.Repeat("\x80", 4) + ".txt", 7, "ab\x80.txt"},
+	}
+	for _, tt := range tests {
+		got := truncateName(tt.name, tt.max)
+		if got != tt.want {
+			t.Errorf("truncateName(%q, %d) = %q, want %q", tt.name, tt.max, got, tt.want)
+		}
+		if len(got) > tt.max {
+			t.Errorf("truncateName(%q, %d) is %d bytes", tt.name, tt.max, len(got))
+		}
+		if utf8.ValidString(tt.name) && !utf8.ValidString(got) {
+			t.Errorf("truncateName(%q, %d) = %q split a rune", tt.name, tt.max, got)
+		}
+	}
+}
+
+func TestPeriodDir(t *testing.T) {
+	tests := []struct {
+		rotate string
+		at     time.Time
+		want   string
+	}{
+		{RotateDaily, time.Date(2024, 8, 5, 23, 59, 0, 0, time.UTC), "2024-08-05"},
+		{RotateWeekly, time.Date(2024, 8, 5, 0, 0, 0, 0, time.UTC), "2024-W32"},
+		{RotateWeekly, time.Date(2024, 8, 4, 23, 59, 0, 0, time.UTC), "2024-W31"}, // Sunday ends the week
+		{RotateWeekly, time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC), "2025-W01"},
+		{RotateWeekly, time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC), "2020-W53"},
+		{RotateMonthly, time.Date(2024, 8, 31, 0, 0, 0, 0, time.UTC), "2024-08"},
+		{"", time.Date(2024, 8, 5, 0, 0, 0, 0, time.UTC), ""},
+	}
+	for _, tt := range tests {
+		if got := periodDir(tt.rotate, tt.at); got != tt.want {
+			t.Errorf("periodDir(%q, %s) = %q, want %q", tt.rotate, tt.at.Format(time.DateOnly), got, tt.want)
+		}
+	}
+}
+
+func TestDestNameRotates(t *testing.T) {
+	// The month may turn while the test runs
+	rule := &Rule{Rotate: RotateMonthly}
+	before := path.Join(time.Now().Format("2006-01"), "report.pdf")
+	name, err := rule.destName("/watch/report.pdf")
+	after := path.Join(time.Now().Format("2006-01"), "report.pdf")
+	if err != nil || name != before && name != after {
+		t.Errorf("destName = %q, %v; want %q", name, err, after)
+	}
+
+	rule.Rotate = ""
+	if name, err := rule.destName("/watch/report.pdf"); err != nil || name != "report.pdf" {
+		t.Errorf("destName without rotate = %q, %v", name, err)
+	}
+}
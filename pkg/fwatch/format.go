@@ -0,0 +1,88 @@
+package fwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file formats, selected by file extension
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// configFormat returns the format of a configuration file from its
+// extension, defaulting to YAML
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+// lineNumber matches the position prefix of YAML decoding errors
+var lineNumber = regexp.MustCompile(`(?m)^(yaml: |\s*)line \d+: `)
+
+// decodeConfig parses configuration data in the given format. With strict
+// set, keys that don't correspond to any configuration field are rejected.
+func decodeConfig(data []byte, format string, strict bool) (*Config, error) {
+	var config Config
+	if err := decodeDocument(data, format, strict, &config); err != nil {
+		return nil, err
+	}
+	if err := expandEnv(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// decodeDocument parses data in the given format into out.
+//
+// JSON and TOML are converted to YAML first so that every format shares
+// the field names and custom value types of the YAML configuration.
+func decodeDocument(data []byte, format string, strict bool, out any) error {
+	converted := format != FormatYAML
+	if converted {
+		var doc any
+		switch format {
+		case FormatJSON:
+			if err := json.Unmarshal(data, &doc); err != nil {
+				return err
+			}
+		case FormatTOML:
+			var table map[string]any
+			if _, err := toml.Decode(string(data), &table); err != nil {
+				return err
+			}
+			doc = table
+		}
+		var err error
+		if data, err = yaml.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(strict)
+	if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		// Line numbers refer to the converted document, not the file
+		if converted {
+			return errors.New(lineNumber.ReplaceAllString(err.Error(), "$1"))
+		}
+		return err
+	}
+	return nil
+}
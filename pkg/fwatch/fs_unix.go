@@ -0,0 +1,25 @@
+//go:build !windows
+
+package fwatch
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isCrossDevice reports whether err is a rename failing because source
+// and destination are on different filesystems
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// isLocked reports whether err means another process holds the file open
+// exclusively. Unix systems don't have mandatory locks.
+func isLocked(err error) bool {
+	return false
+}
+
+// longPath returns path in a form the OS accepts regardless of length
+func longPath(path string) string {
+	return path
+}
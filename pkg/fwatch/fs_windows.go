@@ -0,0 +1,51 @@
+//go:build windows
+
+package fwatch
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Windows error codes not defined by package syscall
+const (
+	errorNotSameDevice    syscall.Errno = 17
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// maxPath is the length from which Win32 APIs need the \\?\ prefix; 248
+// rather than MAX_PATH (260) because directory creation stops earlier
+const maxPath = 248
+
+// isCrossDevice reports whether err is a rename failing because source
+// and destination are on different volumes
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
+
+// isLocked reports whether err means another process, typically the one
+// still writing the file, has it open without sharing
+func isLocked(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
+
+// longPath returns path with the \\?\ prefix if it is too long for the
+// classic Win32 limit. Package os does this for most calls, but only for
+// paths it considers safe to rewrite, so do it explicitly for moves.
+func longPath(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path: \\server\share\... becomes \\?\UNC\server\share\...
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
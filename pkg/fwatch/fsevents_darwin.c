@@ -0,0 +1,47 @@
+//go:build darwin && cgo
+
+#include "_cgo_export.h"
+#include "fsevents_darwin.h"
+
+// callback hands a batch of events to the watcher registered under the
+// stream's info id
+static void callback(ConstFSEventStreamRef stream, void *info, size_t numEvents, void *eventPaths,
+		const FSEventStreamEventFlags eventFlags[], const FSEventStreamEventId eventIds[]) {
+	fwatchFSEvents((uintptr_t)info, numEvents, (char **)eventPaths, (FSEventStreamEventFlags *)eventFlags);
+}
+
+dispatch_queue_t fwatchNewQueue(void) {
+	return dispatch_queue_create("fwatch.fsevents", DISPATCH_QUEUE_SERIAL);
+}
+
+// fwatchStartStream starts reporting file-level events below path on queue.
+// It returns NULL if the stream can't be created or started.
+FSEventStreamRef fwatchStartStream(const char *path, uintptr_t id, double latency, dispatch_queue_t queue) {
+	CFStringRef cfPath = CFStringCreateWithCString(NULL, path, kCFStringEncodingUTF8);
+	if (cfPath == NULL) {
+		return NULL;
+	}
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&cfPath, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamContext context = {0, (void *)id, NULL, NULL, NULL};
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, callback, &context, paths, kFSEventStreamEventIdSinceNow, latency,
+		kFSEventStreamCreateFlagFileEvents | kFSEventStreamCreateFlagNoDefer | kFSEventStreamCreateFlagWatchRoot);
+	CFRelease(paths);
+	CFRelease(cfPath);
+	if (stream == NULL) {
+		return NULL;
+	}
+
+	FSEventStreamSetDispatchQueue(stream, queue);
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		return NULL;
+	}
+	return stream;
+}
+
+void fwatchStopStream(FSEventStreamRef stream) {
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	FSEventStreamRelease(stream);
+}
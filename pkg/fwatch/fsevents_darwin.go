@@ -0,0 +1,345 @@
+//go:build darwin && cgo
+
+package fwatch
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include "fsevents_darwin.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// fseventsSupported reports whether the fsevents backend can be used
+const fseventsSupported = true
+
+// fseventsLatency is how many seconds FSEvents collects events before
+// delivering them in one batch
+const fseventsLatency = 0.1
+
+// FSEvents event flags, from FSEvents.h
+const (
+	fseventMustScanSubDirs  = 0x00000001
+	fseventRootChanged      = 0x00000020
+	fseventItemCreated      = 0x00000100
+	fseventItemRemoved      = 0x00000200
+	fseventItemInodeMetaMod = 0x00000400
+	fseventItemRenamed      = 0x00000800
+	fseventItemModified     = 0x00001000
+	fseventItemChangeOwner  = 0x00004000
+	fseventItemXattrMod     = 0x00008000
+)
+
+// fseventsWatchers maps the ids passed to FSEvents callbacks to their
+// watchers, so no Go pointer is handed to C
+var fseventsWatchers = struct {
+	sync.Mutex
+	next     uintptr
+	watchers map[uintptr]*fseventsWatcher
+}{watchers: make(map[uintptr]*fseventsWatcher)}
+
+// fseventsWatcher is a Watcher using macOS FSEvents. Unlike kqueue, which
+// fsnotify uses on macOS and which needs a file descriptor for every file,
+// FSEvents watches a whole directory tree with one stream, so it copes
+// with very large directories. A stream is started for each directory
+// added that isn't already below another stream's root; events are only
+// reported for files directly inside added directories.
+type fseventsWatcher struct {
+	id    uintptr
+	queue C.dispatch_queue_t
+
+	mu       sync.Mutex
+	dirs     map[string]bool
+	streams  map[string]*fseventsStream // by root
+	closed   bool
+	inflight sync.WaitGroup
+
+	done   chan struct{}
+	events chan Event
+	errors chan error
+}
+
+// fseventsStream is a running FSEvents stream
+type fseventsStream struct {
+	root string // directory as added
+	real string // root with symlinks resolved, as FSEvents reports paths
+	ref  C.FSEventStreamRef
+}
+
+// newFSEventsWatcher creates a watcher backed by FSEvents
+func newFSEventsWatcher() (*fseventsWatcher, error) {
+	w := &fseventsWatcher{
+		queue:   C.fwatchNewQueue(),
+		dirs:    make(map[string]bool),
+		streams: make(map[string]*fseventsStream),
+		done:    make(chan struct{}),
+		events:  make(chan Event),
+		errors:  make(chan error),
+	}
+	fseventsWatchers.Lock()
+	fseventsWatchers.next++
+	w.id = fseventsWatchers.next
+	fseventsWatchers.watchers[w.id] = w
+	fseventsWatchers.Unlock()
+	return w, nil
+}
+
+// Add reports events for files in path. Files already present do not
+// produce events, matching the fsnotify backend.
+func (w *fseventsWatcher) Add(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return fmt.Errorf("watcher is closed")
+	}
+	w.dirs[path] = true
+	if w.covered(path) {
+		return nil
+	}
+	stream, err := w.startStream(path)
+	if err != nil {
+		delete(w.dirs, path)
+		return err
+	}
+
+	// Streams for directories below path are now redundant
+	for root, other := range w.streams {
+		if isWithin(root, path) {
+			delete(w.streams, root)
+			go C.fwatchStopStream(other.ref)
+		}
+	}
+	w.streams[path] = stream
+	return nil
+}
+
+// Remove stops reporting events for files in path
+func (w *fseventsWatcher) Remove(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.dirs, path)
+	stream, ok := w.streams[path]
+	if !ok {
+		return nil
+	}
+	delete(w.streams, path)
+	// Stopping may wait for a running callback, which may be waiting for
+	// the lock, so it must not happen while holding it
+	go C.fwatchStopStream(stream.ref)
+
+	// Directories below it that are still watched need streams of their own
+	var below []string
+	for dir := range w.dirs {
+		if isWithin(dir, path) {
+			below = append(below, dir)
+		}
+	}
+	slices.Sort(below)
+	for _, dir := range below {
+		if w.covered(dir) {
+			continue
+		}
+		stream, err := w.startStream(dir)
+		if err != nil {
+			return err
+		}
+		w.streams[dir] = stream
+	}
+	return nil
+}
+
+func (w *fseventsWatcher) Events() <-chan Event { return w.events }
+func (w *fseventsWatcher) Errors() <-chan error { return w.errors }
+
+// Close stops all streams and closes the event channels
+func (w *fseventsWatcher) Close() error {
+	fseventsWatchers.Lock()
+	delete(fseventsWatchers.watchers, w.id)
+	fseventsWatchers.Unlock()
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	streams := w.streams
+	w.streams = nil
+	w.mu.Unlock()
+
+	close(w.done)
+	for _, stream := range streams {
+		C.fwatchStopStream(stream.ref)
+	}
+	w.inflight.Wait()
+	close(w.events)
+	close(w.errors)
+	return nil
+}
+
+// covered reports whether a running stream already reports events for
+// dir. Callers must hold w.mu.
+func (w *fseventsWatcher) covered(dir string) bool {
+	for root := range w.streams {
+		if dir == root || isWithin(dir, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// startStream starts a stream rooted at dir. Callers must hold w.mu.
+func (w *fseventsWatcher) startStream(dir string) (*fseventsStream, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	cPath := C.CString(resolved)
+	defer C.free(unsafe.Pointer(cPath))
+
+	ref := C.fwatchStartStream(cPath, C.uintptr_t(w.id), C.double(fseventsLatency), w.queue)
+	if ref == nil {
+		return nil, fmt.Errorf("starting FSEvents stream for %s failed", dir)
+	}
+	return &fseventsStream{root: dir, real: resolved, ref: ref}, nil
+}
+
+//export fwatchFSEvents
+func fwatchFSEvents(id C.uintptr_t, n C.size_t, paths **C.char, flags *C.FSEventStreamEventFlags) {
+	fseventsWatchers.Lock()
+	w := fseventsWatchers.watchers[uintptr(id)]
+	fseventsWatchers.Unlock()
+	if w == nil {
+		return
+	}
+
+	cPaths := unsafe.Slice(paths, int(n))
+	cFlags := unsafe.Slice(flags, int(n))
+	batch := make([]fsevent, len(cPaths))
+	for i := range cPaths {
+		batch[i] = fsevent{path: C.GoString(cPaths[i]), flags: uint32(cFlags[i])}
+	}
+	w.deliver(batch)
+}
+
+// fsevent is a single event as reported by FSEvents
+type fsevent struct {
+	path  string
+	flags uint32
+}
+
+// deliver converts a batch of FSEvents to Events and sends them
+func (w *fseventsWatcher) deliver(batch []fsevent) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.inflight.Add(1)
+	defer w.inflight.Done()
+
+	var events []Event
+	var errs []error
+	for _, ev := range batch {
+		path, ok := w.translate(ev.path)
+		if !ok {
+			continue
+		}
+		switch {
+		case ev.flags&fseventRootChanged != 0:
+			errs = append(errs, fmt.Errorf("watched directory %s was moved or removed", path))
+		case ev.flags&fseventMustScanSubDirs != 0:
+			// Events were dropped; report every file as possibly new
+			if w.dirs[path] {
+				events = append(events, scanEvents(path)...)
+			}
+		case w.dirs[filepath.Dir(path)]:
+			if op := fromFSEventsFlags(ev.flags); op != 0 {
+				events = append(events, Event{Path: path, Op: op})
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, event := range events {
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+	for _, err := range errs {
+		select {
+		case w.errors <- err:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// translate maps a path reported by FSEvents, which has symlinks resolved,
+// back to the watched path it is under. Callers must hold w.mu.
+func (w *fseventsWatcher) translate(path string) (string, bool) {
+	for _, stream := range w.streams {
+		if path == stream.real {
+			return stream.root, true
+		}
+		if isWithin(path, stream.real) {
+			rel, err := filepath.Rel(stream.real, path)
+			if err == nil {
+				return filepath.Join(stream.root, rel), true
+			}
+		}
+	}
+	return "", false
+}
+
+// scanEvents returns a create event for every file in dir
+func scanEvents(dir string) []Event {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var events []Event
+	for _, entry := range entries {
+		events = append(events, Event{Path: filepath.Join(dir, entry.Name()), Op: OpCreate})
+	}
+	return events
+}
+
+// fromFSEventsFlags converts FSEvents item flags to our operation bits.
+// FSEvents may merge several changes into one event, so more than one bit
+// can be set.
+func fromFSEventsFlags(flags uint32) Op {
+	var o Op
+	for _, m := range []struct {
+		from uint32
+		to   Op
+	}{
+		{fseventItemCreated, OpCreate},
+		{fseventItemModified, OpWrite},
+		{fseventItemRemoved, OpRemove},
+		{fseventItemRenamed, OpRename},
+		{fseventItemInodeMetaMod | fseventItemChangeOwner | fseventItemXattrMod, OpChmod},
+	} {
+		if flags&m.from != 0 {
+			o |= m.to
+		}
+	}
+	return o
+}
@@ -0,0 +1,12 @@
+#ifndef FWATCH_FSEVENTS_H
+#define FWATCH_FSEVENTS_H
+
+#include <stdlib.h>
+#include <CoreServices/CoreServices.h>
+#include <dispatch/dispatch.h>
+
+dispatch_queue_t fwatchNewQueue(void);
+FSEventStreamRef fwatchStartStream(const char *path, uintptr_t id, double latency, dispatch_queue_t queue);
+void fwatchStopStream(FSEventStreamRef stream);
+
+#endif
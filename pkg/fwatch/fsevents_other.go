@@ -0,0 +1,13 @@
+//go:build !darwin || !cgo
+
+package fwatch
+
+import "errors"
+
+// fseventsSupported reports whether the fsevents backend can be used
+const fseventsSupported = false
+
+// newFSEventsWatcher is not supported on this platform
+func newFSEventsWatcher() (Watcher, error) {
+	return nil, errors.New("the fsevents backend is only available on macOS, in builds with cgo")
+}
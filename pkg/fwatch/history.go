@@ -0,0 +1,294 @@
+package fwatch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// historyBucket holds one record per processed file, keyed by a
+	// big-endian sequence number so iteration is in processing order
+	historyBucket = "files"
+
+	// undoneBucket maps paths restored by undo to the file's size and
+	// modification time, so the engine leaves them alone
+	undoneBucket = "undone"
+
+	// historyOpenTimeout bounds how long to wait for another process
+	// holding the database lock
+	historyOpenTimeout = 10 * time.Second
+
+	historyQueueSize = 1000
+)
+
+// HistoryRecord is an entry in the history database describing one
+// processed file
+type HistoryRecord struct {
+	ID          uint64     `json:"id"`
+	Time        time.Time  `json:"time"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination,omitempty"`
+	Quarantined string     `json:"quarantined,omitempty"`
+	Rule        string     `json:"rule"`
+	Action      string     `json:"action"`
+	Status      Status     `json:"status"`
+	Size        int64      `json:"size"`
+	Checksum    string     `json:"checksum,omitempty"`
+	Duplicate   string     `json:"duplicate,omitempty"`
+	Encrypted   bool       `json:"encrypted,omitempty"`
+	Attempt     int        `json:"attempt,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Undone      *time.Time `json:"undone,omitempty"`
+}
+
+// newHistoryRecord converts a result into a history record
+func newHistoryRecord(r Result) HistoryRecord {
+	rec := HistoryRecord{
+		Time:        r.Time,
+		Source:      r.Path,
+		Destination: r.DestPath,
+		Quarantined: r.Quarantined,
+		Rule:        r.Rule,
+		Action:      r.Action,
+		Status:      r.Status,
+		Size:        r.Size,
+		Checksum:    r.Checksum,
+		Duplicate:   r.Duplicate,
+		Encrypted:   r.Encrypted,
+		Attempt:     r.Attempt,
+		Reason:      r.Reason,
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+	}
+	return rec
+}
+
+// HistoryFilter selects records from the history database. Zero fields
+// match everything.
+type HistoryFilter struct {
+	Since  time.Time // Only records at or after this time
+	Rule   string    // Only records for this rule
+	Failed bool      // Only failed records
+	Limit  int       // At most this many of the newest matching records
+}
+
+// matches reports whether rec passes the filter
+func (f *HistoryFilter) matches(rec *HistoryRecord) bool {
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if f.Rule != "" && rec.Rule != f.Rule {
+		return false
+	}
+	if f.Failed && rec.Status != StatusFailed {
+		return false
+	}
+	return true
+}
+
+// History is a handle on a history database. The database file is only
+// locked while an operation runs, so a running fwatch can keep recording.
+type History struct {
+	path string
+}
+
+// OpenHistory returns a handle on the existing history database at path
+func OpenHistory(path string) (*History, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("opening history database: %w", err)
+	}
+	return &History{path: path}, nil
+}
+
+// view runs fn in a read-only transaction
+func (h *History) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(h.path, 0o600, &bolt.Options{ReadOnly: true, Timeout: historyOpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction
+func (h *History) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(h.path, 0o600, &bolt.Options{Timeout: historyOpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// Query returns the records matching filter, oldest first
+func (h *History) Query(filter HistoryFilter) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+	err := h.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBucket))
+		if bucket == nil {
+			return nil
+		}
+		// Walk backwards so Limit keeps the newest records
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var rec HistoryRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("record %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			if !filter.matches(&rec) {
+				continue
+			}
+			records = append(records, rec)
+			if filter.Limit > 0 && len(records) >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, err
+}
+
+// historyEntry is a record waiting to be written to a database, or with
+// kept set, a file of a read-only watch that was processed
+type historyEntry struct {
+	path   string
+	record HistoryRecord
+	kept   string
+	stamp  fileStamp
+}
+
+// historyWriter appends records to the history database in the background.
+// The database is only opened while writing, so "fwatch history" can read
+// it while fwatch is running.
+type historyWriter struct {
+	queue chan historyEntry
+	once  sync.Once
+	done  chan struct{}
+}
+
+// newHistoryWriter creates a writer; its goroutine starts on first use
+func newHistoryWriter() *historyWriter {
+	return &historyWriter{queue: make(chan historyEntry, historyQueueSize), done: make(chan struct{})}
+}
+
+// record queues a result for the database at path. Records are dropped
+// with a warning if the writer falls behind.
+func (w *historyWriter) record(path string, r Result) {
+	if path == "" {
+		return
+	}
+	w.once.Do(func() { go w.run() })
+	select {
+	case w.queue <- historyEntry{path: path, record: newHistoryRecord(r)}:
+	default:
+		slog.Warn("History queue full, dropping record", "file", r.Path)
+	}
+}
+
+// keep queues a processed file of a read-only watch for the database at
+// path
+func (w *historyWriter) keep(path, file string, stamp fileStamp) {
+	if path == "" {
+		return
+	}
+	w.once.Do(func() { go w.run() })
+	select {
+	case w.queue <- historyEntry{path: path, kept: file, stamp: stamp}:
+	default:
+		slog.Warn("History queue full, dropping record", "file", file)
+	}
+}
+
+// run writes queued records, batching whatever has accumulated while the
+// previous batch was written
+func (w *historyWriter) run() {
+	defer close(w.done)
+	for entry := range w.queue {
+		batch := []historyEntry{entry}
+	drain:
+		for {
+			select {
+			case entry, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, entry)
+			default:
+				break drain
+			}
+		}
+
+		byPath := make(map[string][]historyEntry)
+		var paths []string
+		for _, entry := range batch {
+			if _, ok := byPath[entry.path]; !ok {
+				paths = append(paths, entry.path)
+			}
+			byPath[entry.path] = append(byPath[entry.path], entry)
+		}
+		for _, path := range paths {
+			if err := appendHistory(path, byPath[path]); err != nil {
+				slog.Error("Failed to write history", "history_db", path, "records", len(byPath[path]), "error", err)
+			}
+		}
+	}
+}
+
+// close writes any queued records and stops the writer
+func (w *historyWriter) close() {
+	w.once.Do(func() { go w.run() })
+	close(w.queue)
+	<-w.done
+}
+
+// appendHistory adds the entries to the database at path, creating it if
+// needed
+func appendHistory(path string, entries []historyEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	h := History{path: path}
+	return h.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.kept != "" {
+				if err := putKept(tx, entry.kept, entry.stamp); err != nil {
+					return err
+				}
+				continue
+			}
+			rec := entry.record
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			rec.ID = id
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, id)
+			if err := bucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
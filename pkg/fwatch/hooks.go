@@ -0,0 +1,134 @@
+package fwatch
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Hook is run after a rule's action: post once it has succeeded, on_error
+// once it has failed for good. It runs a command, posts the result to a
+// webhook, or both. Its command is given like an exec action's, or as a
+// command line whose words are each a template.
+type Hook struct {
+	ExecAction `yaml:",inline"`
+	Webhook    *Webhook `yaml:"webhook"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, accepting a command line or
+// a mapping
+func (h *Hook) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		words, err := splitCommandLine(value.Value)
+		if err != nil {
+			return err
+		}
+		*h = Hook{ExecAction: ExecAction{Command: words}}
+		return nil
+	}
+	type plain Hook
+	return value.Decode((*plain)(h))
+}
+
+// validate checks the hook's settings
+func (h *Hook) validate() error {
+	if h == nil {
+		return nil
+	}
+	if len(h.Command) == 0 && h.Webhook == nil {
+		return fmt.Errorf("needs a command or a webhook")
+	}
+	if h.Webhook != nil {
+		if len(h.Webhook.Events) > 0 {
+			return fmt.Errorf("webhook: events don't apply, the hook decides when it is sent")
+		}
+		if err := h.Webhook.validate(); err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+	}
+	return nil
+}
+
+// runHooks runs the rule's post hook after a success, and its on_error
+// hook after a failure that won't be retried. A failing hook is logged
+// but leaves the result as it is: the file has been handled either way.
+func (e *Engine) runHooks(rule *Rule, result Result) {
+	var hook *Hook
+	var name string
+	switch {
+	case result.Status == StatusSuccess && rule.Post != nil:
+		hook, name = rule.Post, "post"
+	case result.Status == StatusFailed && result.RetryIn == 0 && rule.OnError != nil:
+		hook, name = rule.OnError, "on_error"
+	default:
+		return
+	}
+
+	if len(hook.Command) > 0 {
+		data := newTemplateData(result.Path, rule)
+		data.Dest = cmp.Or(result.Quarantined, result.DestPath)
+		if data.Dest != "" && !isRemoteDestination(data.Dest) {
+			data.exif = sync.OnceValue(func() exifData { return readExif(data.Dest) })
+		}
+		if result.Err != nil {
+			data.Error = result.Err.Error()
+		}
+		if err := execCommand(&hook.ExecAction, data); err != nil {
+			slog.Error("Hook failed", "file", result.Path, "rule", rule.Name, "hook", name, "error", err)
+		} else {
+			slog.Debug("Hook succeeded", "file", result.Path, "rule", rule.Name, "hook", name)
+		}
+	}
+	if hook.Webhook != nil {
+		e.webhooks.send([]Webhook{*hook.Webhook}, result)
+	}
+}
+
+// splitCommandLine splits a hook's command line into words at spaces
+// outside quotes and template actions, so that a variable always expands
+// to a single argument however many spaces the file name has
+func splitCommandLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "{{"):
+			end := strings.Index(line[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated {{ in %q", line)
+			}
+			word.WriteString(line[i : i+end+2])
+			i += end + 1
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,90 @@
+package fwatch
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// idleFile is a file a rule waits for to stop changing
+type idleFile struct {
+	first   time.Time   // when the rule first waited for it
+	size    int64       // size when last looked at
+	modTime time.Time   // modification time when last looked at
+	changed time.Time   // when it was last seen to change
+	timer   *time.Timer // looks at it again
+}
+
+// validateIdle checks a rule's wait_until_idle and max_wait
+func (r *Rule) validateIdle() error {
+	switch {
+	case r.WaitUntilIdle < 0 || r.MaxWait < 0:
+		return fmt.Errorf("wait_until_idle and max_wait must not be negative")
+	case r.MaxWait > 0 && r.WaitUntilIdle == 0:
+		return fmt.Errorf("max_wait needs wait_until_idle")
+	case r.MaxWait > 0 && r.MaxWait <= r.WaitUntilIdle:
+		return fmt.Errorf("max_wait must be longer than wait_until_idle")
+	}
+	return nil
+}
+
+// waitIdle reports whether a file has to wait before the rule's action
+// runs, because it changed within the rule's wait_until_idle and max_wait
+// hasn't passed yet. The file is looked at again once it may have settled.
+func (e *Engine) waitIdle(rule *Rule, path string, info os.FileInfo) bool {
+	if rule.WaitUntilIdle <= 0 || info.IsDir() {
+		return false
+	}
+	quiet := time.Duration(rule.WaitUntilIdle)
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f := e.idle[path]
+	switch {
+	case f == nil:
+		f = &idleFile{first: now, size: info.Size(), modTime: info.ModTime(), changed: info.ModTime()}
+		e.idle[path] = f
+	case info.Size() != f.size || !info.ModTime().Equal(f.modTime):
+		// Changed since, even if a copy tool set an old modification time
+		f.size, f.modTime, f.changed = info.Size(), info.ModTime(), now
+	}
+
+	idle := now.Sub(f.changed)
+	waited := now.Sub(f.first)
+	switch {
+	case idle >= quiet:
+		e.dropIdle(path)
+		return false
+	case rule.MaxWait > 0 && waited >= time.Duration(rule.MaxWait):
+		slog.Warn("File is still changing after max_wait, processing it anyway", "file", path, "rule", rule.Name,
+			"waited", waited.Round(time.Second), "max_wait", time.Duration(rule.MaxWait))
+		e.dropIdle(path)
+		return false
+	}
+
+	delay := quiet - idle
+	if rule.MaxWait > 0 {
+		delay = min(delay, time.Duration(rule.MaxWait)-waited)
+	}
+	if f.timer == nil {
+		slog.Debug("Waiting for file to stop changing", "file", path, "rule", rule.Name, "wait_until_idle", quiet)
+		if pool := e.pool; pool != nil {
+			f.timer = time.AfterFunc(delay, func() { pool.enqueue(path) })
+		}
+	} else {
+		f.timer.Reset(delay)
+	}
+	return true
+}
+
+// dropIdle stops waiting for a file, with mu held
+func (e *Engine) dropIdle(path string) {
+	if f := e.idle[path]; f != nil {
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		delete(e.idle, path)
+	}
+}
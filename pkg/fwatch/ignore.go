@@ -0,0 +1,96 @@
+package fwatch
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultIgnorePatterns match dotfiles and the temporary files browsers,
+// download managers and sync clients write while a file is incomplete
+var defaultIgnorePatterns = []string{
+	".*",
+	"*.crdownload",
+	"*.part",
+	"*.partial",
+	"*.download",
+	"*.tmp",
+	"*.temp",
+	"*.!qB",
+	"*.swp",
+	"~$*",
+}
+
+// ignorePatterns returns the ignore patterns that apply to files in the
+// given watch, which may be nil for global patterns only
+func (c *Config) ignorePatterns(watch *Watch) []string {
+	var patterns []string
+	if c.IgnoreDefaults == nil || *c.IgnoreDefaults {
+		patterns = append(patterns, defaultIgnorePatterns...)
+	}
+	patterns = append(patterns, c.Ignore...)
+	if watch != nil {
+		patterns = append(patterns, watch.Ignore...)
+	}
+	// Claims of other instances are never files to process
+	patterns = append(patterns, claimPrefix+"*")
+	return patterns
+}
+
+// watchFor returns the watch that filePath was reported under, or nil.
+// Files in subdirectories belong to a recursive watch unless one of the
+// directories in between is excluded.
+func (c *Config) watchFor(filePath string) *Watch {
+	dir := filepath.Dir(filePath)
+	for i := range c.Watches {
+		if c.Watches[i].file && c.Watches[i].Path == filePath {
+			return &c.Watches[i]
+		}
+	}
+	for i := range c.Watches {
+		if !c.Watches[i].file && c.Watches[i].Path == dir {
+			return &c.Watches[i]
+		}
+	}
+	for i := range c.Watches {
+		watch := &c.Watches[i]
+		if (watch.Recursive || watch.DropFolders) && isWithin(dir, watch.Path) && !isExcluded(subdirs(watch.Path, filePath), c.excludePatterns(watch)) {
+			return watch
+		}
+	}
+	return nil
+}
+
+// excludePatterns returns the directory name patterns skipped by a
+// recursive watch
+func (c *Config) excludePatterns(watch *Watch) []string {
+	return append(slices.Clone(c.ExcludeDirs), watch.ExcludeDirs...)
+}
+
+// subdirs returns the names of the directories between root and the file,
+// outermost first
+func subdirs(root, filePath string) []string {
+	rel, err := filepath.Rel(root, filepath.Dir(filePath))
+	if err != nil || rel == "." {
+		return nil
+	}
+	return strings.Split(rel, string(filepath.Separator))
+}
+
+// isExcluded reports whether any of the directory names matches one of
+// the patterns
+func isExcluded(dirs, patterns []string) bool {
+	return slices.ContainsFunc(dirs, func(dir string) bool { return isIgnored(dir, patterns) })
+}
+
+// isIgnored reports whether the file name matches any of the glob patterns.
+// Patterns are validated at config load, so match errors are not possible.
+func isIgnored(filePath string, patterns []string) bool {
+	name := filepath.Base(filePath)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
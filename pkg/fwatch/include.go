@@ -0,0 +1,144 @@
+package fwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// includeFile is a file named by include: a pack of rules
+type includeFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// IncludePaths returns the include entries of a loaded config as absolute
+// paths: files, directories and glob patterns
+func (c *Config) IncludePaths() []string {
+	return slices.Clone(c.includePaths)
+}
+
+// IncludedFiles returns the files include loaded rules from, in the order
+// their rules were added
+func (c *Config) IncludedFiles() []string {
+	return slices.Clone(c.included)
+}
+
+// loadIncludes adds the rules of the files named by include after the
+// config's own rules. Relative entries are relative to dir, the directory
+// of the config file. An included file is only read once.
+func (c *Config) loadIncludes(dir string, strict bool) error {
+	c.includePaths, c.included = nil, nil
+	for _, entry := range c.Include {
+		if entry == "" {
+			continue
+		}
+		path := entry
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		path = filepath.Clean(path)
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		c.includePaths = append(c.includePaths, path)
+
+		files, err := includeFiles(path)
+		if err != nil {
+			return fmt.Errorf("include %s: %w", entry, err)
+		}
+		for _, file := range files {
+			if slices.Contains(c.included, file) {
+				continue
+			}
+			rules, err := loadIncludeFile(file, strict)
+			if err != nil {
+				return fmt.Errorf("include %s: %w", file, err)
+			}
+			c.Rules = append(c.Rules, rules...)
+			c.included = append(c.included, file)
+		}
+	}
+	return nil
+}
+
+// includeFiles returns the files an include entry names, in the order
+// their rules are added. A directory names the configuration files in it
+// and a glob pattern the files it matches, both sorted by name; a pattern
+// that matches nothing names none.
+func includeFiles(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				files = append(files, match)
+			}
+		}
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// Editors and package managers leave hidden and backup files
+		// beside the ones in use
+		if strings.HasPrefix(name, ".") || !isConfigFile(name) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(path, name)); err == nil && info.Mode().IsRegular() {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
+
+// isConfigFile reports whether name has the extension of a configuration
+// file
+func isConfigFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	}
+	return false
+}
+
+// loadIncludeFile reads the rules from an included file, naming unnamed
+// rules after the file
+func loadIncludeFile(path string, strict bool) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file includeFile
+	if err := decodeDocument(data, configFormat(path), strict, &file); err != nil {
+		return nil, err
+	}
+	if err := expandValue(reflect.ValueOf(&file).Elem(), ""); err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for i := range file.Rules {
+		if file.Rules[i].Name == "" {
+			file.Rules[i].Name = fmt.Sprintf("%s rule %d", base, i+1)
+		}
+	}
+	return file.Rules, nil
+}
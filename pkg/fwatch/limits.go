@@ -0,0 +1,111 @@
+package fwatch
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// What to do with a file larger than max_file_size
+const (
+	MaxFileSizeSkip       = "skip"
+	MaxFileSizeQuarantine = "quarantine"
+)
+
+// maxFileSizePolicies lists the valid on_max_file_size values
+var maxFileSizePolicies = []string{MaxFileSizeSkip, MaxFileSizeQuarantine}
+
+// errTooLarge is wrapped by the error a file over max_file_size is
+// quarantined with
+var errTooLarge = errors.New("file is larger than max_file_size")
+
+// validateLimits checks max_files_per_minute, max_file_size and
+// on_max_file_size, which the config and rules share
+func validateLimits(filesPerMinute int, maxFileSize ByteSize, onMaxFileSize string) error {
+	if filesPerMinute < 0 {
+		return fmt.Errorf("max_files_per_minute must not be negative")
+	}
+	if maxFileSize < 0 {
+		return fmt.Errorf("max_file_size must not be negative")
+	}
+	if onMaxFileSize != "" && !slices.Contains(maxFileSizePolicies, onMaxFileSize) {
+		return fmt.Errorf("unknown on_max_file_size policy %q", onMaxFileSize)
+	}
+	return nil
+}
+
+// maxFileSize returns the size of the largest file a rule acts on, or 0
+func (c *Config) maxFileSize(rule *Rule) ByteSize {
+	return cmp.Or(rule.MaxFileSize, c.MaxFileSize)
+}
+
+// onMaxFileSize returns what a rule does with files over its max_file_size
+func (c *Config) onMaxFileSize(rule *Rule) string {
+	return cmp.Or(rule.OnMaxFileSize, c.OnMaxFileSize, MaxFileSizeSkip)
+}
+
+// maxDepth returns how many levels of subdirectories a recursive watch
+// covers, or 0 for all of them
+func (c *Config) maxDepth(watch *Watch) int {
+	return cmp.Or(watch.MaxDepth, c.MaxDepth)
+}
+
+// tooDeep reports whether dir is more than maxDepth directories below
+// root. A maxDepth of 0 allows any depth.
+func tooDeep(root, dir string, maxDepth int) bool {
+	return maxDepth > 0 && len(subdirs(root, filepath.Join(dir, "x"))) > maxDepth
+}
+
+// fileCounts counts the files acted on in the current minute, by all rules
+// and by each, for max_files_per_minute
+type fileCounts struct {
+	mu     sync.Mutex
+	minute time.Time
+	counts map[string]int  // by rule name, "" for all rules
+	warned map[string]bool // limits reached this minute, logged once
+}
+
+// take counts a file the rule is about to act on, unless the rule or all
+// rules together have reached their max_files_per_minute. Then it returns
+// how long until the next minute, when the file may be tried again.
+func (f *fileCounts) take(config *Config, rule *Rule, now time.Time) (time.Duration, bool) {
+	if config.MaxFilesPerMinute == 0 && rule.MaxFilesPerMinute == 0 {
+		return 0, true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if minute := now.Truncate(time.Minute); !minute.Equal(f.minute) {
+		f.minute = minute
+		f.counts = make(map[string]int)
+		f.warned = make(map[string]bool)
+	}
+
+	wait := f.minute.Add(time.Minute).Sub(now)
+	for _, limit := range []struct {
+		name string
+		max  int
+	}{{"", config.MaxFilesPerMinute}, {rule.Name, rule.MaxFilesPerMinute}} {
+		if limit.max == 0 || f.counts[limit.name] < limit.max {
+			continue
+		}
+		if !f.warned[limit.name] {
+			f.warned[limit.name] = true
+			if limit.name == "" {
+				slog.Warn("Reached max_files_per_minute, holding files until the next minute", "limit", limit.max)
+			} else {
+				slog.Warn("Rule reached max_files_per_minute, holding its files until the next minute", "rule", rule.Name, "limit", limit.max)
+			}
+		}
+		return wait, false
+	}
+
+	f.counts[""]++
+	f.counts[rule.Name]++
+	return 0, true
+}
@@ -0,0 +1,51 @@
+package fwatch
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// placedFile is a file a rule put into a watched directory, remembered so
+// the events of its arrival don't process it again
+type placedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// feedsBack returns the watch that sees files arriving in a local
+// destination, or nil if none does
+func (c *Config) feedsBack(dest string) *Watch {
+	if dest == "" || isRemoteDestination(dest) {
+		return nil
+	}
+	return c.watchFor(filepath.Join(filepath.Clean(dest), "x"))
+}
+
+// rememberPlaced records a file a rule moved or copied into a watched
+// directory, as it is now
+func (e *Engine) rememberPlaced(config *Config, destPath string) {
+	if destPath == "" || isRemoteDestination(destPath) || config.watchFor(destPath) == nil {
+		return
+	}
+	info, err := os.Lstat(destPath)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.placed[destPath] = placedFile{size: info.Size(), modTime: info.ModTime()}
+}
+
+// isPlaced reports whether a file is one a rule put there and that hasn't
+// changed since. A file that has is processed like any other.
+func (e *Engine) isPlaced(path string, info os.FileInfo) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p, ok := e.placed[path]
+	if ok && p.size == info.Size() && p.modTime.Equal(info.ModTime()) {
+		return true
+	}
+	delete(e.placed, path)
+	return false
+}
@@ -0,0 +1,213 @@
+package fwatch
+
+import (
+	"cmp"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sniffLen is the number of bytes read to detect a file's content type
+const sniffLen = 512
+
+// candidate is a file being matched against rules. Expensive properties
+// such as the content type are computed on first use and then cached, so
+// evaluating many rules costs no more than evaluating one.
+type candidate struct {
+	path string
+	ext  string // lowercased, including the dot
+	info os.FileInfo
+	now  time.Time
+	dirs []string // subdirectories below the watch root, see subdirs
+
+	mimeType  string
+	mimeKnown bool
+
+	texts map[int][]byte // text read for content_matches, by limit
+}
+
+// newCandidate prepares a file in the given watch, which may be nil, for
+// rule matching
+func newCandidate(path string, info os.FileInfo, watch *Watch) *candidate {
+	c := &candidate{
+		path: path,
+		ext:  strings.ToLower(filepath.Ext(path)),
+		info: info,
+		now:  time.Now(),
+	}
+	if watch != nil {
+		c.dirs = subdirs(watch.Path, path)
+	}
+	return c
+}
+
+// contentType returns the MIME type sniffed from the file's first bytes,
+// without parameters, or "" if the file cannot be read
+func (c *candidate) contentType() string {
+	if c.mimeKnown {
+		return c.mimeType
+	}
+	c.mimeKnown = true
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		slog.Warn("Failed to read file for content sniffing", "file", c.path, "error", err)
+		return ""
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		slog.Warn("Failed to read file for content sniffing", "file", c.path, "error", err)
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	if err == nil {
+		c.mimeType = mediaType
+	}
+	return c.mimeType
+}
+
+// matchMimeType reports whether mimeType matches pattern, which is either
+// a full type ("application/pdf") or a wildcard subtype ("image/*")
+func matchMimeType(pattern, mimeType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mimeType, strings.ToLower(prefix)+"/")
+	}
+	return strings.EqualFold(pattern, mimeType)
+}
+
+// selects reports whether the file is selected by the rule's extension or
+// MIME type lists. A rule with neither selects every file its regex or
+// expr matches.
+func (r *Rule) selects(c *candidate) bool {
+	if len(r.Extensions) == 0 && len(r.MimeTypes) == 0 {
+		return r.Regex != "" || r.Expr != ""
+	}
+	if c.ext != "" && slices.ContainsFunc(r.Extensions, func(e string) bool { return strings.EqualFold(e, c.ext) }) {
+		return true
+	}
+	if len(r.MimeTypes) > 0 {
+		mimeType := c.contentType()
+		return mimeType != "" && slices.ContainsFunc(r.MimeTypes, func(p string) bool { return matchMimeType(p, mimeType) })
+	}
+	return false
+}
+
+// matches reports whether the file is selected by the rule and satisfies
+// all of its conditions
+func (r *Rule) matches(c *candidate) bool {
+	if len(r.ExcludeDirs) > 0 && isExcluded(c.dirs, r.ExcludeDirs) {
+		return false
+	}
+
+	size := ByteSize(c.info.Size())
+	if r.MinSize > 0 && size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return false
+	}
+
+	age := Duration(c.now.Sub(c.info.ModTime()))
+	if r.MinAge > 0 && age < r.MinAge {
+		return false
+	}
+	if r.MaxAge > 0 && age > r.MaxAge {
+		return false
+	}
+	if r.Regex != "" && !r.matchesName(c.path) {
+		return false
+	}
+
+	// Checked last so cheap conditions can rule the file out before its
+	// content is sniffed or searched
+	return r.selects(c) && r.matchesExpr(c) && r.matchesContent(c)
+}
+
+// oldEnoughAt returns the earliest time a rule that only min_age keeps from
+// matching the file would match it, or zero if there is no such rule
+func oldEnoughAt(rules []Rule, c *candidate) time.Time {
+	now := c.now
+	defer func() { c.now = now }()
+	var earliest time.Time
+	for _, rule := range orderedRules(rules) {
+		at := c.info.ModTime().Add(time.Duration(rule.MinAge))
+		if rule.MinAge == 0 || !at.After(now) || (!earliest.IsZero() && !at.Before(earliest)) {
+			continue
+		}
+		// Matched as it will be then, so max_age and expr see that age
+		c.now = at
+		if rule.matches(c) {
+			earliest = at
+		}
+	}
+	return earliest
+}
+
+// matchesName reports whether the name of the file at path matches the
+// rule's regex
+func (r *Rule) matchesName(path string) bool {
+	re, err := cachedRegexp(r.Regex)
+	return err == nil && re.MatchString(filepath.Base(path))
+}
+
+// nameGroups returns the text of the named groups of the rule's regex in
+// the file name, all empty if it doesn't match, or nil without a regex
+func (r *Rule) nameGroups(name string) map[string]string {
+	if r.Regex == "" {
+		return nil
+	}
+	re, err := cachedRegexp(r.Regex)
+	if err != nil {
+		return nil
+	}
+	match := re.FindStringSubmatch(name)
+	groups := make(map[string]string)
+	for i, group := range re.SubexpNames() {
+		if group == "" {
+			continue
+		}
+		groups[group] = ""
+		if match != nil {
+			groups[group] = match[i]
+		}
+	}
+	return groups
+}
+
+// orderedRules returns the rules in evaluation order: by descending
+// priority, keeping the configured order among rules of equal priority
+func orderedRules(rules []Rule) []*Rule {
+	ordered := make([]*Rule, len(rules))
+	for i := range rules {
+		ordered[i] = &rules[i]
+	}
+	slices.SortStableFunc(ordered, func(a, b *Rule) int { return cmp.Compare(b.Priority, a.Priority) })
+	return ordered
+}
+
+// matchRules returns the rules to apply to the file: the first one that
+// matches in evaluation order, followed by the next matching rule for as
+// long as the rules matched so far have continue set
+func matchRules(rules []Rule, c *candidate) []*Rule {
+	var matched []*Rule
+	for _, rule := range orderedRules(rules) {
+		if !rule.matches(c) {
+			continue
+		}
+		matched = append(matched, rule)
+		if !rule.Continue {
+			break
+		}
+	}
+	return matched
+}
@@ -0,0 +1,121 @@
+package fwatch
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOldEnoughAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "setup.exe")
+	writeFile(t, path, "data")
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime = info.ModTime()
+
+	day, week := Duration(24*time.Hour), Duration(7*24*time.Hour)
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  time.Duration // after the modification time, 0 for never
+	}{
+		{"young", []Rule{{Extensions: []string{".exe"}, MinAge: day}}, 24 * time.Hour},
+		{"earliest rule", []Rule{{Extensions: []string{".exe"}, MinAge: week}, {Extensions: []string{".exe"}, MinAge: day}}, 24 * time.Hour},
+		{"old enough", []Rule{{Extensions: []string{".exe"}, MinAge: Duration(time.Minute)}}, 0},
+		{"never matches", []Rule{{Extensions: []string{".pdf"}, MinAge: day}}, 0},
+		{"too old by then", []Rule{{Extensions: []string{".exe"}, MinAge: week, MaxAge: day}}, 0},
+		{"no min_age", []Rule{{Extensions: []string{".exe"}, MaxAge: Duration(time.Minute)}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCandidate(path, info, nil)
+			now := c.now
+			at := oldEnoughAt(tt.rules, c)
+			switch {
+			case tt.want == 0 && !at.IsZero():
+				t.Errorf("oldEnoughAt = %s, want never", at)
+			case tt.want != 0 && !at.Equal(modTime.Add(tt.want)):
+				t.Errorf("oldEnoughAt = %s, want %s", at, modTime.Add(tt.want))
+			}
+			if !c.now.Equal(now) {
+				t.Error("oldEnoughAt changed the candidate's time")
+			}
+		})
+	}
+}
+
+func TestNameGroups(t *testing.T) {
+	const invoice = `^invoice-(?P<year>\d{4})-(?P<month>\d{2})(?:-(?P<client>\w+))?\.pdf$`
+	tests := []struct {
+		name  string
+		regex string
+		file  string
+		want  map[string]string
+	}{
+		{"match", invoice, "invoice-2024-08-acme.pdf", map[string]string{"year": "2024", "month": "08", "client": "acme"}},
+		{"optional group missing", invoice, "invoice-2024-08.pdf", map[string]string{"year": "2024", "month": "08", "client": ""}},
+		{"no match", invoice, "receipt.pdf", map[string]string{"year": "", "month": "", "client": ""}},
+		{"unnamed groups", `^(\d+)-(.*)$`, "12-notes.txt", map[string]string{}},
+		{"no regex", "", "invoice-2024-08.pdf", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{Regex: tt.regex}
+			got := rule.nameGroups(tt.file)
+			if (got == nil) != (tt.want == nil) || !maps.Equal(got, tt.want) {
+				t.Errorf("nameGroups(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegexTemplate(t *testing.T) {
+	rule := &Rule{Regex: `^invoice-(?P<year>\d{4})-(?P<month>\d{2})\.pdf$`}
+	name, err := renderTemplate("{{.Match.year}}/{{.Match.month}}/{{.Name}}", newTemplateData("/watch/invoice-2024-08.pdf", rule))
+	if err != nil || name != "2024/08/invoice-2024-08.pdf" {
+		t.Errorf("rendered %q, %v", name, err)
+	}
+
+	// Loading the config catches groups the regex doesn't have
+	good := &FilenameOptions{Template: "{{.Match.year}}/{{.Name}}"}
+	if err := good.validate(rule.sampleTemplateData()); err != nil {
+		t.Errorf("validate = %v for a group of the regex", err)
+	}
+	misspelt := &FilenameOptions{Template: "{{.Match.yaer}}/{{.Name}}"}
+	if err := misspelt.validate(rule.sampleTemplateData()); err == nil {
+		t.Error("validate accepted a group the regex doesn't have")
+	}
+}
+
+func TestMatchesRegex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invoice-2024-08.pdf")
+	writeFile(t, path, "data")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		rule Rule
+		want bool
+	}{
+		{"regex alone", Rule{Regex: `^invoice-`}, true},
+		{"regex not matching", Rule{Regex: `^receipt-`}, false},
+		{"regex and extension", Rule{Regex: `^invoice-`, Extensions: []string{".pdf"}}, true},
+		{"regex and other extension", Rule{Regex: `^invoice-`, Extensions: []string{".jpg"}}, false},
+		{"regex on the name only", Rule{Regex: `^/`}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches(newCandidate(path, info, nil)); got != tt.want {
+			t.Errorf("%s: matches = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package fwatch
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// tempPrefix starts the names of the hidden temporary files that copies
+// are written to before they are renamed into place
+const tempPrefix = ".fwatch-tmp-"
+
+// moveToDestination moves a matched file into the rule's destination,
+// applying the rule's conflict policy if a file with the same name already
+// exists there. It returns the path the file was moved to, or an empty path
+// and the reason if the file was skipped. info is the file as matched: if it
+// describes a symlink, the link itself is moved.
+func moveToDestination(ctx context.Context, filePath string, rule *Rule, info os.FileInfo, limits *limiter) (destPath, skipReason string, err error) {
+	return toDestination(ctx, filePath, rule, info, limits, false)
+}
+
+// copyToDestination is moveToDestination for the copy action: the file is
+// left where it is
+func copyToDestination(ctx context.Context, filePath string, rule *Rule, info os.FileInfo, limits *limiter) (destPath, skipReason string, err error) {
+	return toDestination(ctx, filePath, rule, info, limits, true)
+}
+
+// toDestination moves or, with keepSource, copies a file into the rule's
+// destination
+func toDestination(ctx context.Context, filePath string, rule *Rule, info os.FileInfo, limits *limiter, keepSource bool) (destPath, skipReason string, err error) {
+	// Build destination path
+	name, err := rule.destName(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	if rule.Encrypt != nil {
+		name += encryptedExt
+	}
+	destPath = filepath.Join(rule.Destination, name)
+	if filepath.Dir(name) != "." {
+		// A content hash or template name can be below directories
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return "", "", fmt.Errorf("creating destination directory: %w", err)
+		}
+	}
+
+	policy := rule.conflictPolicy()
+	sidecar := rule.Filename != nil && rule.Filename.Sidecar
+	var reason string
+	if sidecar {
+		defer func() {
+			if err == nil && destPath != "" {
+				err = recordOriginalName(destPath, filePath)
+			}
+		}()
+	}
+	if rule.Checksums != "" {
+		defer func() {
+			if err == nil && destPath != "" {
+				err = recordChecksum(rule.Checksums, destPath, policy == ConflictOverwrite && reason != "")
+			}
+		}()
+	}
+
+	// Checked last, so a file that fails is in no manifest or sidecar. The
+	// source is hashed before it is gone, but only once it is to be placed.
+	var sum string
+	hashSource := rule.Verify != nil && rule.Verify.Checksum && info.Mode()&os.ModeSymlink == 0
+	if rule.Verify != nil {
+		defer func() {
+			if err == nil && destPath != "" {
+				if err = verifyPlaced(rule, filePath, destPath, info, sum, keepSource); err != nil {
+					destPath = ""
+				}
+			}
+		}()
+	}
+
+	// Apply the rule's conflict policy if the destination file exists
+	var linked bool
+	resolved, reason, err := placeResolved(filePath, destPath, policy, rule.conflictSuffix(), func(path string, replace bool) (err error) {
+		if hashSource && sum == "" {
+			if sum, err = hashFile(filePath); err != nil {
+				return err
+			}
+		}
+		linked, err = placeFile(ctx, filePath, path, rule, info, limits, keepSource, replace)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if resolved == "" {
+		// The content is stored already, under a name it now also arrived as
+		if sidecar && reason == identicalReason {
+			if err := recordOriginalName(destPath, filePath); err != nil {
+				return "", "", err
+			}
+		}
+		return "", reason, nil
+	}
+	if reason != "" {
+		slog.Info("Resolved destination conflict", "file", filePath, "rule", rule.Name,
+			"policy", policy, "reason", reason, "dest_path", resolved)
+	}
+
+	// Links share the source's attributes, which must stay as they are
+	if linked {
+		return resolved, "", nil
+	}
+	if rule.QuarantineXattr == QuarantineXattrStrip && rule.Encrypt == nil {
+		if err := removeXattr(resolved, appleQuarantineXattr); err != nil {
+			return resolved, "", fmt.Errorf("removing quarantine attribute: %w", err)
+		}
+	}
+	if err := applyPermissions(rule, resolved); err != nil {
+		return resolved, "", err
+	}
+	return resolved, "", nil
+}
+
+// placeFile moves or, with keepSource, copies a file to dest for
+// toDestination, replacing a file there only if replace is set. It
+// reports whether dest is a symlink or hard link rather than a file of
+// its own.
+func placeFile(ctx context.Context, filePath, dest string, rule *Rule, info os.FileInfo, limits *limiter, keepSource, replace bool) (bool, error) {
+	// The plaintext is read, whether the file is a link or not
+	if rule.Encrypt != nil {
+		return false, encryptFile(ctx, filePath, dest, rule.Encrypt, keepSource, replace, limits)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return true, moveLink(filePath, dest, keepSource, replace)
+	}
+
+	if keepSource && rule.Hardlink && rule.QuarantineXattr != QuarantineXattrStrip {
+		// Link the file a followed symlink points to, not the symlink
+		target, err := filepath.EvalSymlinks(filePath)
+		if err == nil {
+			if replace {
+				err = linkReplacing(target, dest)
+			} else {
+				err = os.Link(target, dest)
+			}
+		}
+		if err == nil || errors.Is(err, fs.ErrExist) {
+			return true, err
+		}
+		slog.Debug("Could not hard link file, copying instead", "file", filePath, "dest_path", dest, "error", err)
+	}
+
+	return false, moveFile(filePath, dest, moveOptions{
+		verifyChecksum:     rule.VerifyChecksum,
+		preserveAttributes: rule.PreserveAttributes,
+		keepSource:         keepSource,
+		dereference:        isSymlink(filePath),
+		fastCopy:           rule.FastCopy,
+		noReplace:          !replace,
+		limits:             limits,
+		ctx:                ctx,
+	})
+}
+
+// isSymlink reports whether path is a symbolic link
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// moveLink recreates the symlink src at dst and removes src unless
+// keepSource is set. A relative target is adjusted so the new link points
+// to the same file. With replace set, a file at dst is replaced; without,
+// moveLink fails with an error matching fs.ErrExist.
+func moveLink(src, dst string, keepSource, replace bool) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("reading symlink: %w", err)
+	}
+	if !filepath.IsAbs(target) {
+		abs := filepath.Join(filepath.Dir(src), target)
+		if target, err = filepath.Rel(filepath.Dir(dst), abs); err != nil {
+			target = abs
+		}
+	}
+
+	// Under the overwrite policy the link is created under a temporary
+	// name and renamed into place, replacing the file there; otherwise it
+	// is created at dst, which fails if that exists
+	if !replace {
+		if err := os.Symlink(target, dst); err != nil {
+			return fmt.Errorf("creating symlink: %w", err)
+		}
+	} else {
+		tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf("%s%d", tempPrefix, rand.Int64()))
+		if err := os.Symlink(target, tmp); err != nil {
+			return fmt.Errorf("creating symlink: %w", err)
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("renaming symlink into place: %w", err)
+		}
+	}
+
+	if keepSource {
+		return nil
+	}
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("removing source symlink: %w", err)
+	}
+	return nil
+}
+
+// moveOptions controls how moveFile falls back to copying
+type moveOptions struct {
+	// verifyChecksum compares SHA-256 digests of source and destination
+	// after a cross-device copy, before the source is removed
+	verifyChecksum bool
+
+	// preserveAttributes copies ownership, permissions, extended attributes
+	// and timestamps to the destination after a cross-device copy
+	preserveAttributes bool
+
+	// keepSource copies the file even on the same device and leaves the
+	// source in place
+	keepSource bool
+
+	// dereference copies the file a symlink at src points to and removes
+	// the link, rather than moving the link
+	dereference bool
+
+	// fastCopy clones the file or copies it in the kernel, unless limits
+	// throttles the bandwidth
+	fastCopy bool
+
+	// noReplace fails with an error matching fs.ErrExist rather than
+	// replace a file at the destination, see placeResolved
+	noReplace bool
+
+	// limits throttles the copy; nil copies at full speed
+	limits *limiter
+
+	// ctx carries the span the copy is traced under; nil traces nothing
+	ctx context.Context
+}
+
+// rename renames old to new, replacing a file there unless noReplace is
+// set
+func (o moveOptions) rename(old, new string) error {
+	if o.noReplace {
+		return renameNoReplace(old, new)
+	}
+	return os.Rename(old, new)
+}
+
+// moveFile moves a file from src to dst, handling cross-device moves
+func moveFile(src, dst string, opts moveOptions) error {
+	src, dst = longPath(src), longPath(dst)
+	if opts.keepSource || opts.dereference {
+		return copyAndDelete(src, dst, opts)
+	}
+
+	// Try rename first (fastest method)
+	err := opts.rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	// Check if it's a cross-device link error
+	// If so, fall back to copy + delete
+	if isCrossDevice(err) {
+		return copyAndDelete(src, dst, opts)
+	}
+
+	// For other errors, return them
+	return err
+}
+
+// copyAndDelete copies a file and then deletes the source, unless
+// opts.keepSource is set. The copy is written to a hidden temporary file
+// in the destination directory and renamed into place once complete, so
+// nothing watching the destination sees a partial file.
+func copyAndDelete(src, dst string, opts moveOptions) (err error) {
+	release := opts.limits.acquireCopy()
+	defer release()
+
+	_, span := startSpan(opts.ctx, "fwatch.copy")
+	defer func() { endSpan(span, err) }()
+
+	// Open source file
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("opening source file: %w", err)
+	}
+	defer srcFile.Close()
+
+	// Get source file info for permissions
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("getting source file info: %w", err)
+	}
+
+	// Create the temporary file next to the destination, so the final
+	// rename stays on one filesystem
+	tmpFile, err := os.CreateTemp(filepath.Dir(dst), tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("creating destination file: %w", err)
+	}
+	tmp := tmpFile.Name()
+	defer os.Remove(tmp) // fails harmlessly once renamed
+	defer tmpFile.Close()
+	if err := tmpFile.Chmod(srcInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("setting destination permissions: %w", err)
+	}
+
+	// Copy the content, hashing the source as it is read. A fast copy
+	// never passes through fwatch, so the source is hashed on its own.
+	var srcHash hash.Hash
+	var written int64
+	if opts.fastCopy && !opts.limits.throttles() {
+		written, err = fastCopy(tmpFile, srcFile)
+	} else {
+		srcHash = sha256.New()
+		written, err = io.Copy(tmpFile, opts.limits.reader(io.TeeReader(srcFile, srcHash)))
+	}
+	span.SetAttributes(attribute.Int64("fwatch.bytes", written))
+	if err != nil {
+		return fmt.Errorf("copying file content: %w", err)
+	}
+
+	// Ensure data is written to disk
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("syncing destination file: %w", err)
+	}
+
+	// Re-read the copy and make sure it matches before the source is gone
+	// for good
+	if opts.verifyChecksum {
+		var srcDigest string
+		if srcHash != nil {
+			srcDigest = fmt.Sprintf("%x", srcHash.Sum(nil))
+		} else if srcDigest, err = hashFile(src); err != nil {
+			return fmt.Errorf("hashing source file: %w", err)
+		}
+		_, verifySpan := startSpan(opts.ctx, "fwatch.verify")
+		dstDigest, err := hashFile(tmp)
+		endSpan(verifySpan, err)
+		if err != nil {
+			return fmt.Errorf("hashing destination file: %w", err)
+		}
+		if dstDigest != srcDigest {
+			return fmt.Errorf("checksum mismatch after copy: source %s, destination %s", srcDigest, dstDigest)
+		}
+		slog.Info("Verified copy checksum", "file", src, "dest_path", dst, "sha256", srcDigest)
+	}
+
+	// Close before applying timestamps so no later write can change them
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("closing destination file: %w", err)
+	}
+	if opts.preserveAttributes {
+		if err := preserveAttributes(src, tmp, srcInfo); err != nil {
+			return err
+		}
+	} else if err := copyXattr(src, tmp, appleQuarantineXattr); err != nil {
+		// A rename keeps the quarantine attribute, so a copy should too
+		return fmt.Errorf("copying quarantine attribute: %w", err)
+	}
+
+	if err := opts.rename(tmp, dst); err != nil {
+		return fmt.Errorf("renaming destination file into place: %w", err)
+	}
+
+	if opts.keepSource {
+		return nil
+	}
+
+	// Remove the source file; Windows refuses while it is still open
+	srcFile.Close()
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("removing source file: %w", err)
+	}
+
+	return nil
+}
+
+// fastCopy copies src to dst by cloning it, which shares the data until
+// either file changes, or else with copy_file_range or sendfile where the
+// OS has them, so the data isn't read into fwatch
+func fastCopy(dst, src *os.File) (int64, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err = cloneFile(dst, src); err == nil {
+		return info.Size(), nil
+	}
+	slog.Debug("Could not clone file, copying instead", "file", src.Name(), "error", err)
+	// io.Copy hands a copy between two files to the kernel
+	return io.Copy(dst, src)
+}
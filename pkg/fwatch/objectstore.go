@@ -0,0 +1,284 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+)
+
+// objectStoreSchemes are the URL schemes of object storage destinations
+var objectStoreSchemes = []string{"s3", "gs", "azblob"}
+
+const (
+	defaultUploadPartSize    = 16 << 20
+	defaultUploadConcurrency = 4
+)
+
+// UploadOptions configures how files are sent to a remote destination:
+// object storage or SFTP
+type UploadOptions struct {
+	// DeleteSource removes the local file after a successful upload
+	DeleteSource bool `yaml:"delete_source"`
+
+	// PartSize is the size of each part of a multipart upload (default 16MB)
+	PartSize ByteSize `yaml:"part_size"`
+
+	// Concurrency is the number of parts uploaded at once (default 4)
+	Concurrency int `yaml:"concurrency"`
+
+	// IdentityFile is the SSH private key for sftp destinations (default:
+	// the SSH agent and ~/.ssh/id_ed25519, id_ecdsa or id_rsa)
+	IdentityFile string `yaml:"identity_file"`
+
+	// KnownHosts lists the files SFTP host keys are verified against
+	// (default ~/.ssh/known_hosts)
+	KnownHosts []string `yaml:"known_hosts"`
+
+	// InsecureIgnoreHostKey accepts any SFTP host key. Only for testing.
+	InsecureIgnoreHostKey bool `yaml:"insecure_ignore_host_key"`
+
+	// Timeout bounds connecting to an SFTP server (default 30s)
+	Timeout Duration `yaml:"timeout"`
+}
+
+// validate checks the upload options
+func (o *UploadOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.PartSize < 0 || o.Concurrency < 0 || o.Timeout < 0 {
+		return fmt.Errorf("upload.part_size, upload.concurrency and upload.timeout must not be negative")
+	}
+	return nil
+}
+
+// isObjectStoreURL reports whether a destination is an object storage URL
+// such as "s3://bucket/prefix/"
+func isObjectStoreURL(dest string) bool {
+	scheme, _, ok := strings.Cut(dest, "://")
+	return ok && slices.Contains(objectStoreSchemes, scheme)
+}
+
+// isRemoteDestination reports whether a destination is a URL rather than
+// a local directory
+func isRemoteDestination(dest string) bool {
+	return strings.Contains(dest, "://")
+}
+
+// redactDestination hides any password in a destination URL so it can be
+// logged
+func redactDestination(dest string) string {
+	if !isRemoteDestination(dest) {
+		return dest
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return dest
+	}
+	return u.Redacted()
+}
+
+// objectStoreTarget is a destination URL split into the bucket URL that
+// gocloud opens and the key prefix within the bucket
+type objectStoreTarget struct {
+	bucketURL string
+	prefix    string
+}
+
+// parseObjectStoreURL splits "s3://bucket/some/prefix?region=eu-west-1"
+// into the bucket URL "s3://bucket?region=eu-west-1" and prefix
+// "some/prefix/"
+func parseObjectStoreURL(dest string) (objectStoreTarget, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return objectStoreTarget{}, err
+	}
+	if u.Host == "" {
+		return objectStoreTarget{}, fmt.Errorf("missing bucket name in %q", dest)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	bucket := url.URL{Scheme: u.Scheme, Host: u.Host, RawQuery: u.RawQuery}
+	return objectStoreTarget{bucketURL: bucket.String(), prefix: prefix}, nil
+}
+
+// bucketCache keeps buckets open between uploads so connections are
+// reused
+type bucketCache struct {
+	mu      sync.Mutex
+	buckets map[string]*blob.Bucket
+}
+
+// open returns the bucket for a bucket URL, opening it on first use
+func (c *bucketCache) open(ctx context.Context, bucketURL string) (*blob.Bucket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.buckets[bucketURL]; ok {
+		return b, nil
+	}
+	b, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if c.buckets == nil {
+		c.buckets = make(map[string]*blob.Bucket)
+	}
+	c.buckets[bucketURL] = b
+	return b, nil
+}
+
+// close closes every open bucket
+func (c *bucketCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for u, b := range c.buckets {
+		if err := b.Close(); err != nil {
+			slog.Warn("Failed to close bucket", "bucket", u, "error", err)
+		}
+	}
+	c.buckets = nil
+}
+
+// uploadToObjectStore uploads a matched file to the rule's object storage
+// destination, applying the rule's conflict policy to existing objects. It
+// returns the object's URL, or an empty string and the reason if the file
+// was skipped.
+func (e *Engine) uploadToObjectStore(filePath string, rule *Rule, limits *limiter) (destURL, skipReason string, err error) {
+	target, err := parseObjectStoreURL(rule.Destination)
+	if err != nil {
+		return "", "", err
+	}
+	ctx := context.Background()
+	bucket, err := e.buckets.open(ctx, target.bucketURL)
+	if err != nil {
+		return "", "", fmt.Errorf("opening bucket: %w", err)
+	}
+
+	name, err := rule.destName(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	key := target.prefix + name
+	key, skipReason, err = resolveObjectConflict(ctx, bucket, filePath, key, rule)
+	if err != nil {
+		return "", "", fmt.Errorf("resolving destination conflict: %w", err)
+	}
+	if key == "" {
+		return "", skipReason, nil
+	}
+	if skipReason != "" {
+		slog.Info("Resolved destination conflict", "file", filePath, "rule", rule.Name,
+			"policy", rule.conflictPolicy(), "reason", skipReason, "dest_path", key)
+		skipReason = ""
+	}
+
+	release := limits.acquireCopy()
+	defer release()
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("opening source file: %w", err)
+	}
+	defer src.Close()
+
+	opts := rule.Upload
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	w, err := bucket.NewWriter(ctx, key, &blob.WriterOptions{
+		ContentType:    mime.TypeByExtension(filepath.Ext(filePath)),
+		BufferSize:     cmp.Or(int(opts.PartSize), defaultUploadPartSize),
+		MaxConcurrency: cmp.Or(opts.Concurrency, defaultUploadConcurrency),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("starting upload: %w", err)
+	}
+	if _, err := io.Copy(w, limits.reader(src)); err != nil {
+		w.Close()
+		return "", "", fmt.Errorf("uploading: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", "", fmt.Errorf("finishing upload: %w", err)
+	}
+
+	destURL = objectURL(rule.Destination, key)
+	if opts.DeleteSource {
+		src.Close()
+		if err := os.Remove(filePath); err != nil {
+			return destURL, "", fmt.Errorf("removing source file: %w", err)
+		}
+	}
+	return destURL, "", nil
+}
+
+// resolveObjectConflict applies the rule's conflict policy to an object key;
+// hash-compare uses the object's MD5 where the store reports one
+func resolveObjectConflict(ctx context.Context, bucket *blob.Bucket, srcPath, key string, rule *Rule) (string, string, error) {
+	attrs, err := bucket.Attributes(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return key, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	var identical func() (bool, error)
+	if len(attrs.MD5) > 0 {
+		identical = func() (bool, error) {
+			sum, err := md5File(srcPath)
+			return string(sum) == string(attrs.MD5), err
+		}
+	}
+	return resolveRemoteConflict(key, rule.conflictPolicy(), rule.conflictSuffix(), func(k string) (bool, error) { return bucket.Exists(ctx, k) }, identical)
+}
+
+// objectURL returns the URL of key in the destination's bucket, without
+// the driver options in the query
+func objectURL(dest, key string) string {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return dest
+	}
+	return u.Scheme + "://" + u.Host + path.Join("/", key)
+}
+
+// md5File returns the MD5 digest of a file
+func md5File(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// validateObjectStoreURL checks that an object storage destination can be
+// parsed
+func validateObjectStoreURL(dest string) error {
+	if _, err := parseObjectStoreURL(dest); err != nil {
+		return fmt.Errorf("invalid destination: %w", err)
+	}
+	return nil
+}
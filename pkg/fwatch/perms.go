@@ -0,0 +1,139 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileMode is a permission mode written in YAML as an octal number, such as
+// 0640 or "2775"
+type FileMode os.FileMode
+
+// ParseFileMode parses an octal permission mode
+func ParseFileMode(s string) (FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(s), "0o"), 8, 32)
+	if err != nil || mode > 0o7777 {
+		return 0, fmt.Errorf("invalid mode %q, expected an octal number such as 0640", s)
+	}
+	return FileMode(mode), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (m *FileMode) UnmarshalYAML(value *yaml.Node) error {
+	mode, err := ParseFileMode(value.Value)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// String returns the mode in octal
+func (m FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+// osMode converts the mode to the os.FileMode bits os.Chmod understands
+func (m FileMode) osMode() os.FileMode {
+	mode := os.FileMode(m).Perm()
+	if m&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// parseOwner resolves a chown value, "user", "user:group" or ":group" with
+// names or numeric IDs, to a uid and gid, -1 for the one not given
+func parseOwner(s string) (uid, gid int, err error) {
+	name, group, _ := strings.Cut(s, ":")
+	if name == "" && group == "" {
+		return -1, -1, fmt.Errorf("invalid chown %q, expected user, user:group or :group", s)
+	}
+
+	uid, gid = -1, -1
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return -1, -1, fmt.Errorf("chown: %w", err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, fmt.Errorf("chown: %w", err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// validatePermissions checks a rule's chmod and chown
+func (r *Rule) validatePermissions() error {
+	if r.Chmod == nil && r.Chown == "" {
+		return nil
+	}
+	switch {
+	case r.Action == ActionExec || r.Action == ActionArchive || r.Action == ActionDelete:
+		return fmt.Errorf("chmod and chown are only supported for the move, copy and pipeline actions")
+	case r.Action != ActionPipeline && isRemoteDestination(r.Destination):
+		return fmt.Errorf("chmod and chown need a local destination")
+	case r.Hardlink:
+		// A hard link is the source file, so it would change too
+		return fmt.Errorf("chmod and chown can't be used with hardlink")
+	}
+	if r.Chown != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("chown is not supported on Windows")
+		}
+		if _, _, err := parseOwner(r.Chown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPermissions sets the owner and mode a rule gives the files it moves
+// or copies to path
+func applyPermissions(rule *Rule, path string) error {
+	if rule.Chown != "" {
+		uid, gid, err := parseOwner(rule.Chown)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				return fmt.Errorf("changing owner to %s: %w (giving files to another user needs root or CAP_CHOWN, and an unprivileged user can only set a group it belongs to)", rule.Chown, err)
+			}
+			return fmt.Errorf("changing owner to %s: %w", rule.Chown, err)
+		}
+	}
+
+	// The mode goes last, as chown may clear setuid and setgid bits
+	if rule.Chmod != nil {
+		if err := os.Chmod(path, rule.Chmod.osMode()); err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				return fmt.Errorf("setting mode %s: %w (only the owner of a file or root can change its mode)", rule.Chmod, err)
+			}
+			return fmt.Errorf("setting mode %s: %w", rule.Chmod, err)
+		}
+	}
+	return nil
+}
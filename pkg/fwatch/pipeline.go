@@ -0,0 +1,176 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Step is one action of a pipeline. Its settings mean the same as the rule
+// options of the same name; on_conflict and upload default to the rule's.
+type Step struct {
+	Action      string         `yaml:"action"`
+	Destination string         `yaml:"destination"`
+	OnConflict  string         `yaml:"on_conflict"`
+	Exec        *ExecAction    `yaml:"exec"`
+	Archive     *ArchiveAction `yaml:"archive"`
+	Upload      *UploadOptions `yaml:"upload"`
+}
+
+// stepRule returns the rule a pipeline step runs as: the pipeline's rule
+// with the step's action and settings
+func (r *Rule) stepRule(step *Step) *Rule {
+	rule := *r
+	rule.Action = step.Action
+	rule.Destination = step.Destination
+	rule.Exec = step.Exec
+	rule.Archive = step.Archive
+	rule.OnConflict = cmp.Or(step.OnConflict, r.OnConflict)
+	if step.Upload != nil {
+		rule.Upload = step.Upload
+	}
+	rule.Steps, rule.Continue, rule.Duplicates = nil, false, ""
+	// Only moves and copies name a file
+	if step.Action != "" && step.Action != ActionMove && step.Action != ActionCopy {
+		rule.Filename = nil
+	}
+	// and only local ones set its owner and mode or record its checksum
+	if step.Action != "" && step.Action != ActionMove && step.Action != ActionCopy || isRemoteDestination(step.Destination) {
+		rule.Chown, rule.Chmod, rule.Checksums = "", nil, ""
+	}
+	if step.Action != ActionDelete {
+		rule.DeleteMode = ""
+	}
+	return &rule
+}
+
+// actionRules returns the rules whose actions run for a matched file: the
+// rule itself or, for a pipeline, a rule per step other than checksum
+func (r *Rule) actionRules() []*Rule {
+	if r.Action != ActionPipeline {
+		return []*Rule{r}
+	}
+	var rules []*Rule
+	for i := range r.Steps {
+		if r.Steps[i].Action != ActionChecksum {
+			rules = append(rules, r.stepRule(&r.Steps[i]))
+		}
+	}
+	return rules
+}
+
+// validateSteps checks the steps of a pipeline rule
+func (r *Rule) validateSteps() error {
+	if len(r.Steps) == 0 {
+		return fmt.Errorf("the pipeline action requires steps")
+	}
+	if r.Destination != "" || r.Exec != nil || r.Archive != nil {
+		return fmt.Errorf("a pipeline takes destination, exec and archive in its steps")
+	}
+	if r.Retry != nil {
+		return fmt.Errorf("retry is not supported for pipelines, a failed pipeline is not run again")
+	}
+
+	for i := range r.Steps {
+		step := &r.Steps[i]
+		if i > 0 && removesFile(r.stepRule(&r.Steps[i-1])) {
+			return fmt.Errorf("step %d: the file is gone after step %d", i+1, i)
+		}
+		switch step.Action {
+		case "":
+			return fmt.Errorf("step %d: action is required", i+1)
+		case ActionChecksum:
+			continue
+		case ActionPipeline:
+			return fmt.Errorf("step %d: pipelines can't be nested", i+1)
+		}
+		if err := r.stepRule(step).validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// removesFile reports whether a step leaves no local file for the next
+// one. A local move hands the moved file on.
+func removesFile(rule *Rule) bool {
+	return !rule.keepsSource() && (rule.Action == ActionArchive || rule.Action == ActionDelete || isRemoteDestination(rule.Destination))
+}
+
+// runPipeline runs the steps of a pipeline rule on a file, handing each
+// step the file where the previous one left it, and stops at the first
+// step that fails or is skipped. result.DestPath is set to where the file
+// ended up and result.Step to the step that stopped the pipeline. started
+// reports whether any step other than checksum had completed.
+func (e *Engine) runPipeline(ctx context.Context, config *Config, rule *Rule, filePath string, info os.FileInfo, limits *limiter, result *Result) (started bool, err error) {
+	current := filePath
+	var checksum string
+	for i := range rule.Steps {
+		step := rule.stepRule(&rule.Steps[i])
+		start := time.Now()
+		result.Step = i + 1
+		ctx, span := startSpan(ctx, "fwatch.step", attribute.Int("fwatch.step", i+1),
+			attribute.String("fwatch.action", step.Action))
+
+		var destPath, reason string
+		switch step.Action {
+		case ActionChecksum:
+			checksum, err = hashFile(current)
+			result.Checksum = checksum
+		case ActionExec:
+			data := newTemplateData(current, step)
+			data.Checksum = checksum
+			err = execCommand(step.Exec, data)
+		default:
+			destPath, reason, _, err = e.runAction(ctx, config, step, current, info, limits)
+		}
+		endSpan(span, err)
+		if err != nil {
+			return started, fmt.Errorf("step %d (%s): %w", i+1, step.Action, err)
+		}
+		if reason != "" {
+			result.Reason = fmt.Sprintf("step %d (%s): %s", i+1, step.Action, reason)
+			return started, nil
+		}
+
+		slog.Debug("Finished pipeline step", "file", current, "rule", rule.Name, "step", i+1,
+			"action", step.Action, "dest_path", destPath, "duration", time.Since(start))
+		if step.Action != ActionChecksum {
+			started = true
+		}
+		// The file is handed on from where a move left it
+		if step.Action == ActionMove && !isRemoteDestination(step.Destination) {
+			current = destPath
+		}
+		if !step.keepsSource() {
+			result.DestPath = destPath
+		}
+	}
+	result.Step = 0
+	return started, nil
+}
+
+// failPipeline quarantines a file whose pipeline failed, or that a scan
+// rejected. Pipelines are not retried, since the steps that already ran
+// would run again, and neither are rejected files.
+func (e *Engine) failPipeline(config *Config, result *Result) {
+	result.Attempt = 1
+	e.failures.reset(result.Path)
+	if config.QuarantineDir == "" {
+		return
+	}
+
+	// A move step may have taken the file elsewhere already
+	failed := *result
+	failed.Path = cmp.Or(result.DestPath, result.Path)
+	target, err := quarantine(config, failed, 1)
+	if err != nil {
+		slog.Error("Failed to quarantine file", "file", failed.Path, "rule", result.Rule, "error", err)
+	}
+	result.Quarantined = target
+}
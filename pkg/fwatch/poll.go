@@ -0,0 +1,193 @@
+package fwatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileState is what the poll backend remembers about a file between scans
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// pollWatcher is a Watcher that periodically lists its directories and
+// diffs them against the previous scan. It works on network filesystems
+// and container volumes where OS notifications are not delivered.
+type pollWatcher struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	dirs  map[string]map[string]fileState
+	close chan struct{}
+	once  sync.Once
+
+	events chan Event
+	errors chan error
+}
+
+// newPollWatcher starts a poll backend scanning every interval
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	w := &pollWatcher{
+		interval: interval,
+		dirs:     make(map[string]map[string]fileState),
+		close:    make(chan struct{}),
+		events:   make(chan Event),
+		errors:   make(chan error),
+	}
+	go w.run()
+	return w
+}
+
+// Add starts polling path. Files already present are recorded but do not
+// produce events, matching the fsnotify backend.
+func (w *pollWatcher) Add(path string) error {
+	snapshot, err := scanDir(path)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[path] = snapshot
+	w.mu.Unlock()
+	return nil
+}
+
+// Remove stops polling path
+func (w *pollWatcher) Remove(path string) error {
+	w.mu.Lock()
+	delete(w.dirs, path)
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Events() <-chan Event { return w.events }
+func (w *pollWatcher) Errors() <-chan error { return w.errors }
+
+// Close stops polling and closes the event channels
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.close) })
+	return nil
+}
+
+// run scans all directories on every tick until closed
+func (w *pollWatcher) run() {
+	defer close(w.events)
+	defer close(w.errors)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.close:
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		dirs := make([]string, 0, len(w.dirs))
+		for dir := range w.dirs {
+			dirs = append(dirs, dir)
+		}
+		w.mu.Unlock()
+
+		for _, dir := range dirs {
+			if !w.poll(dir) {
+				return
+			}
+		}
+	}
+}
+
+// poll rescans dir and emits events for differences from the previous
+// scan. It returns false if the watcher was closed while sending.
+func (w *pollWatcher) poll(dir string) bool {
+	current, err := scanDir(dir)
+	if err != nil {
+		w.mu.Lock()
+		_, watched := w.dirs[dir]
+		w.mu.Unlock()
+		if !watched {
+			// Removed while scanning
+			return true
+		}
+		return w.send(nil, err)
+	}
+
+	w.mu.Lock()
+	previous, ok := w.dirs[dir]
+	if ok {
+		w.dirs[dir] = current
+	}
+	w.mu.Unlock()
+	if !ok {
+		// Removed while scanning
+		return true
+	}
+
+	for path, state := range current {
+		old, existed := previous[path]
+		switch {
+		case !existed:
+			if !w.send(&Event{Path: path, Op: OpCreate}, nil) {
+				return false
+			}
+		case old != state:
+			if !w.send(&Event{Path: path, Op: OpWrite}, nil) {
+				return false
+			}
+		}
+	}
+	for path := range previous {
+		if _, exists := current[path]; !exists {
+			if !w.send(&Event{Path: path, Op: OpRemove}, nil) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// send delivers an event or error, giving up if the watcher is closed
+func (w *pollWatcher) send(event *Event, err error) bool {
+	if event != nil {
+		select {
+		case w.events <- *event:
+			return true
+		case <-w.close:
+			return false
+		}
+	}
+	select {
+	case w.errors <- err:
+		return true
+	case <-w.close:
+		return false
+	}
+}
+
+// scanDir records the size and modification time of each entry in dir
+func scanDir(dir string) (map[string]fileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[string]fileState, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		snapshot[filepath.Join(dir, entry.Name())] = fileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	return snapshot, nil
+}
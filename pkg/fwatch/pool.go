@@ -0,0 +1,314 @@
+package fwatch
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the worker pool when the config does not set them
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 1000
+)
+
+// poolStatsInterval is how often queue statistics are logged at debug level
+const poolStatsInterval = time.Minute
+
+// jobState tracks a path that is queued or being processed
+type jobState int
+
+const (
+	jobQueued  jobState = iota // waiting in the queue
+	jobRunning                 // being processed by a worker
+	jobRerun                   // being processed, and another event arrived
+)
+
+// workerPool processes files concurrently on a fixed number of workers fed
+// from a bounded queue. Events first wait in a debouncer until their path
+// goes quiet. Each path is then handled by at most one worker at a time:
+// events for a path that is already queued are coalesced, and events for a
+// path being processed schedule one more pass once it finishes.
+type workerPool struct {
+	queue    chan string
+	spill    *spillQueue // overflow of queue, if queue_dir is set
+	process  func(path string, timing jobTiming)
+	debounce *debouncer
+	ctx      context.Context
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	state  map[string]jobState
+	timing map[string]jobTiming
+
+	stats poolStats
+}
+
+// jobTiming records how long a path waited before it was processed, for
+// tracing
+type jobTiming struct {
+	event  time.Time // first event, zero for retries and rescans
+	events int       // events merged while settling
+	queued time.Time // when it was queued
+}
+
+// poolStats counts queue activity for backpressure monitoring
+type poolStats struct {
+	Debounced   atomic.Int64 // events merged while their path was settling
+	Enqueued    atomic.Int64 // paths added to the queue
+	Coalesced   atomic.Int64 // events merged into an already queued path
+	Processed   atomic.Int64 // files handed to processFile
+	Spilled     atomic.Int64 // paths written to the queue_dir journal
+	Blocked     atomic.Int64 // enqueues that had to wait for a free slot
+	BlockedTime atomic.Int64 // total nanoseconds spent waiting for a slot
+}
+
+// newWorkerPool starts the workers, which call process for each queued
+// path until ctx is cancelled. Events submitted to the pool are queued
+// once their path has seen no events for debounce. With a spill queue,
+// paths that don't fit in the queue are written to it instead of blocking,
+// and those saved there by the last run are queued first.
+func newWorkerPool(ctx context.Context, workers, queueSize int, debounce time.Duration, spill *spillQueue, process func(path string, timing jobTiming)) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	p := &workerPool{
+		queue:   make(chan string, queueSize),
+		spill:   spill,
+		process: process,
+		ctx:     ctx,
+		state:   make(map[string]jobState),
+		timing:  make(map[string]jobTiming),
+	}
+	p.debounce = newDebouncer(debounce, p.enqueue)
+
+	p.wg.Add(workers)
+	for range workers {
+		go p.worker()
+	}
+	go p.logStats()
+
+	if spill != nil {
+		saved, err := spill.saved()
+		if err != nil {
+			slog.Error("Failed to read the saved queue", "queue_dir", spill.dir, "error", err)
+		}
+		for _, path := range saved {
+			p.state[path] = jobQueued
+		}
+		if len(saved) > 0 {
+			slog.Info("Resuming files queued before fwatch stopped", "queue_dir", spill.dir, "files", len(saved))
+		}
+		go p.unspill()
+	}
+
+	slog.Info("Started worker pool", "workers", workers, "queue_size", queueSize, "debounce", p.debounce.delay)
+	return p
+}
+
+// submit schedules path for processing once events for it stop arriving
+func (p *workerPool) submit(path string) {
+	p.mu.Lock()
+	timing := p.timing[path]
+	if timing.event.IsZero() {
+		timing.event = time.Now()
+	}
+	timing.events++
+	p.timing[path] = timing
+	p.mu.Unlock()
+
+	if p.debounce.add(path) {
+		p.stats.Debounced.Add(1)
+	}
+}
+
+// enqueue schedules path for processing. It blocks while the queue is full,
+// pushing back on the event source, and returns early if the pool is
+// shutting down.
+func (p *workerPool) enqueue(path string) {
+	p.mu.Lock()
+	switch state, ok := p.state[path]; {
+	case ok && state == jobQueued:
+		p.mu.Unlock()
+		p.stats.Coalesced.Add(1)
+		return
+	case ok:
+		p.state[path] = jobRerun
+		p.mu.Unlock()
+		p.stats.Coalesced.Add(1)
+		return
+	}
+	p.state[path] = jobQueued
+	timing := p.timing[path]
+	timing.queued = time.Now()
+	p.timing[path] = timing
+	p.mu.Unlock()
+
+	p.stats.Enqueued.Add(1)
+
+	// Paths go to the journal while it has any, so they stay in order
+	if p.spill != nil && p.spill.len() > 0 && p.spillPaths(path) {
+		return
+	}
+	select {
+	case p.queue <- path:
+		return
+	default:
+	}
+	if p.spill != nil && p.spillPaths(path) {
+		return
+	}
+
+	// Queue is full: wait for a slot and account for the time spent
+	start := time.Now()
+	p.stats.Blocked.Add(1)
+	slog.Warn("Processing queue full, waiting for a free slot", "file", path, "queue_size", cap(p.queue))
+	select {
+	case p.queue <- path:
+	case <-p.ctx.Done():
+		p.mu.Lock()
+		delete(p.state, path)
+		delete(p.timing, path)
+		p.mu.Unlock()
+	}
+	p.stats.BlockedTime.Add(int64(time.Since(start)))
+}
+
+// spillPaths writes paths to the journal, reporting whether it could
+func (p *workerPool) spillPaths(paths ...string) bool {
+	if p.ctx.Err() != nil {
+		return false
+	}
+	if err := p.spill.push(paths...); err != nil {
+		slog.Error("Failed to write to the queue journal", "queue_dir", p.spill.dir, "error", err)
+		return false
+	}
+	p.stats.Spilled.Add(int64(len(paths)))
+	return true
+}
+
+// unspill moves paths from the journal into the queue as it frees up,
+// until the pool is shut down
+func (p *workerPool) unspill() {
+	for {
+		path, ok := p.spill.next(p.ctx)
+		if !ok {
+			return
+		}
+		select {
+		case p.queue <- path:
+			p.spill.commit()
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// worker processes queued paths until the pool is shut down
+func (p *workerPool) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case path := <-p.queue:
+			p.mu.Lock()
+			p.state[path] = jobRunning
+			p.mu.Unlock()
+
+			p.run(path)
+		}
+	}
+}
+
+// run processes path, repeating while new events arrived during processing
+func (p *workerPool) run(path string) {
+	for {
+		p.mu.Lock()
+		timing := p.timing[path]
+		delete(p.timing, path)
+		p.mu.Unlock()
+
+		p.process(path, timing)
+		p.stats.Processed.Add(1)
+
+		p.mu.Lock()
+		if p.state[path] != jobRerun || p.ctx.Err() != nil {
+			delete(p.state, path)
+			p.mu.Unlock()
+			return
+		}
+		p.state[path] = jobRunning
+		p.mu.Unlock()
+	}
+}
+
+// wait blocks until all workers have finished their current file after
+// the pool's context is cancelled, and logs what was left in the queue.
+// With a spill queue, files still settling or queued are saved to it for
+// the next start.
+func (p *workerPool) wait() {
+	settling := p.debounce.stop()
+	p.wg.Wait()
+	if p.spill == nil {
+		if pending := len(p.queue); pending > 0 {
+			slog.Info("Worker pool stopped with files still queued", "pending", pending)
+		}
+		p.logStatsAt(slog.LevelInfo)
+		return
+	}
+
+	var queued []string
+	for len(p.queue) > 0 {
+		queued = append(queued, <-p.queue)
+	}
+	if err := p.spill.push(append(queued, settling...)...); err != nil {
+		slog.Error("Failed to save queued files", "queue_dir", p.spill.dir, "files", len(queued)+len(settling), "error", err)
+	}
+	if saved := p.spill.len(); saved > 0 {
+		slog.Info("Worker pool stopped, saved queued files for the next start", "queue_dir", p.spill.dir, "files", saved)
+	}
+	p.spill.close()
+	p.logStatsAt(slog.LevelInfo)
+}
+
+// logStats periodically logs queue statistics at debug level
+func (p *workerPool) logStats() {
+	ticker := time.NewTicker(poolStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.logStatsAt(slog.LevelDebug)
+		}
+	}
+}
+
+// spilled returns the number of paths waiting in the journal
+func (p *workerPool) spilled() int {
+	if p.spill == nil {
+		return 0
+	}
+	return p.spill.len()
+}
+
+func (p *workerPool) logStatsAt(level slog.Level) {
+	slog.Log(context.Background(), level, "Worker pool stats",
+		"queue_depth", len(p.queue),
+		"spilled", p.spilled(),
+		"settling", p.debounce.waiting(),
+		"debounced", p.stats.Debounced.Load(),
+		"enqueued", p.stats.Enqueued.Load(),
+		"coalesced", p.stats.Coalesced.Load(),
+		"processed", p.stats.Processed.Load(),
+		"blocked", p.stats.Blocked.Load(),
+		"blocked_time", time.Duration(p.stats.BlockedTime.Load()))
+}
@@ -0,0 +1,77 @@
+package fwatch
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ProfileEnv is the environment variable that selects the profiles of a
+// config file as it is loaded, overriding its profile setting
+const ProfileEnv = "FWATCH_PROFILE"
+
+// Profile is a named set of watches and rules, used in addition to the
+// top-level ones when it is selected
+type Profile struct {
+	Watches []Watch `yaml:"watches"`
+	Rules   []Rule  `yaml:"rules"`
+}
+
+// profileNames returns the selected profiles, in order
+func (c *Config) profileNames() []string {
+	var names []string
+	for name := range strings.SplitSeq(c.Profile, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// applyProfiles adds the watches and rules of the selected profiles after
+// the top-level ones, once. Unknown profiles are left to Validate.
+func (c *Config) applyProfiles() {
+	if c.profileApplied {
+		return
+	}
+	c.profileApplied = true
+	for _, name := range c.profileNames() {
+		profile, ok := c.Profiles[name]
+		if !ok {
+			continue
+		}
+		// Profiles often share a directory, which keeps the settings it
+		// was first listed with
+		for _, watch := range profile.Watches {
+			watch.Path = filepath.Clean(watch.Path)
+			if !slices.ContainsFunc(c.Watches, func(w Watch) bool { return filepath.Clean(w.Path) == watch.Path }) {
+				c.Watches = append(c.Watches, watch)
+			}
+		}
+		for i, rule := range profile.Rules {
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("%s rule %d", name, i+1)
+			}
+			c.Rules = append(c.Rules, rule)
+		}
+	}
+}
+
+// validateProfiles checks that the selected profiles exist
+func (c *Config) validateProfiles() error {
+	for name := range c.Profiles {
+		if name == "" || strings.Contains(name, ",") {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+	}
+	for _, name := range c.profileNames() {
+		if _, ok := c.Profiles[name]; !ok && len(c.Profiles) == 0 {
+			return fmt.Errorf("unknown profile %q, the config defines no profiles", name)
+		} else if !ok {
+			return fmt.Errorf("unknown profile %q (defined: %s)", name, strings.Join(slices.Sorted(maps.Keys(c.Profiles)), ", "))
+		}
+	}
+	return nil
+}
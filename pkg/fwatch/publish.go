@@ -0,0 +1,276 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message broker types
+const (
+	PublisherKafka = "kafka"
+	PublisherNATS  = "nats"
+	PublisherMQTT  = "mqtt"
+)
+
+// publisherTypes lists the valid publisher types
+var publisherTypes = []string{PublisherKafka, PublisherNATS, PublisherMQTT}
+
+// defaultPublisherEvents are published when a publisher doesn't list its
+// events: a message for every file that was routed
+var defaultPublisherEvents = []string{EventSuccess}
+
+const (
+	defaultPublisherTimeout = 10 * time.Second
+	defaultPublisherRetries = 3
+	defaultMQTTQoS          = 1
+)
+
+// Publisher sends a JSON message about processed files to a Kafka topic,
+// NATS subject or MQTT topic, so jobs downstream can be triggered by fwatch
+// instead of polling destinations. The message is the webhook payload.
+type Publisher struct {
+	Type     string       `yaml:"type"`
+	Brokers  []string     `yaml:"brokers"`
+	Topic    string       `yaml:"topic"`
+	Events   []string     `yaml:"events"`
+	Username string       `yaml:"username"`
+	Password string       `yaml:"password"`
+	TLS      bool         `yaml:"tls"`
+	QoS      *int         `yaml:"qos"`
+	Timeout  Duration     `yaml:"timeout"`
+	Retry    *RetryPolicy `yaml:"retry"`
+}
+
+// validate checks the publisher's settings
+func (p *Publisher) validate() error {
+	if !slices.Contains(publisherTypes, p.Type) {
+		return fmt.Errorf("unknown type %q (want one of %v)", p.Type, publisherTypes)
+	}
+	if len(p.Brokers) == 0 {
+		return fmt.Errorf("brokers needs at least one host:port")
+	}
+	for _, broker := range p.Brokers {
+		if broker == "" || strings.Contains(broker, "/") {
+			return fmt.Errorf("invalid broker %q, expected host or host:port", broker)
+		}
+	}
+	if p.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	if p.Type == PublisherNATS && strings.ContainsAny(p.Topic, " \t\r\n") {
+		return fmt.Errorf("a NATS subject must not contain whitespace")
+	}
+	if p.Type == PublisherMQTT && strings.ContainsAny(p.Topic, "+#") {
+		return fmt.Errorf("an MQTT topic to publish to must not contain wildcards")
+	}
+	if p.QoS != nil && (p.Type != PublisherMQTT || *p.QoS < 0 || *p.QoS > 2) {
+		return fmt.Errorf("qos must be 0, 1 or 2, and is only supported for mqtt")
+	}
+	for _, event := range p.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("unknown event %q (want one of %v)", event, webhookEvents)
+		}
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return p.Retry.validate()
+}
+
+// wants reports whether the publisher subscribes to event
+func (p *Publisher) wants(event string) bool {
+	if len(p.Events) == 0 {
+		return slices.Contains(defaultPublisherEvents, event)
+	}
+	return slices.Contains(p.Events, event)
+}
+
+// timeout returns how long connecting and publishing may take
+func (p *Publisher) timeout() time.Duration {
+	return cmp.Or(time.Duration(p.Timeout), defaultPublisherTimeout)
+}
+
+// retryPolicy returns the publisher's retry policy, defaulting to a few
+// quick attempts
+func (p *Publisher) retryPolicy() *RetryPolicy {
+	if p.Retry != nil {
+		return p.Retry
+	}
+	return &RetryPolicy{MaxAttempts: defaultPublisherRetries}
+}
+
+// brokers returns the publisher's brokers with the default port of its type
+// added where none is given
+func (p *Publisher) brokers() []string {
+	port := map[string]string{PublisherKafka: "9092", PublisherNATS: "4222", PublisherMQTT: "1883"}[p.Type]
+	if p.Type == PublisherMQTT && p.TLS {
+		port = "8883"
+	}
+	brokers := make([]string, len(p.Brokers))
+	for i, broker := range p.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			broker = net.JoinHostPort(broker, port)
+		}
+		brokers[i] = broker
+	}
+	return brokers
+}
+
+// connKey identifies the connection a publisher uses, so publishers that
+// only differ in topic or events share one
+func (p *Publisher) connKey() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%t", p.Type, strings.Join(p.Brokers, ","), p.Username, p.Password, p.TLS)
+}
+
+// brokerClient is a connection to a message broker
+type brokerClient interface {
+	// publish sends a message to the publisher's topic and returns once
+	// the broker has it
+	publish(ctx context.Context, p *Publisher, key, payload []byte) error
+	close() error
+}
+
+// dialBroker connects to the publisher's brokers
+func dialBroker(p *Publisher) (brokerClient, error) {
+	switch p.Type {
+	case PublisherKafka:
+		return dialKafka(p)
+	case PublisherNATS:
+		return dialNATS(p)
+	default:
+		return dialMQTT(p)
+	}
+}
+
+// publisherSet publishes results in the background over connections that
+// are kept open between messages
+type publisherSet struct {
+	mu      sync.Mutex
+	clients map[string]brokerClient
+	wg      sync.WaitGroup
+}
+
+// send queues a message about the result for every publisher that
+// subscribes to its event type
+func (s *publisherSet) send(publishers []Publisher, r Result) {
+	event := resultEvent(r)
+	var body []byte
+	for i := range publishers {
+		p := &publishers[i]
+		if !p.wants(event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(newWebhookPayload(event, r))
+			if err != nil {
+				slog.Error("Failed to encode publisher message", "file", r.Path, "error", err)
+				return
+			}
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.deliver(p, body, r.Path)
+		}()
+	}
+}
+
+// deliver publishes body, retrying according to the publisher's retry
+// policy. A connection that failed is dropped and dialed again.
+func (s *publisherSet) deliver(p *Publisher, body []byte, file string) {
+	policy := p.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		err := s.publish(p, body, file)
+		if err == nil {
+			slog.Debug("Published message", "type", p.Type, "topic", p.Topic, "file", file)
+			return
+		}
+		if attempt >= policy.maxAttempts() {
+			slog.Error("Failed to publish message", "type", p.Type, "topic", p.Topic, "file", file, "attempt", attempt, "error", err)
+			return
+		}
+		delay := policy.delay(attempt)
+		slog.Warn("Failed to publish message, will retry", "type", p.Type, "topic", p.Topic, "file", file,
+			"attempt", attempt, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// publish sends one message over the publisher's connection
+func (s *publisherSet) publish(p *Publisher, body []byte, file string) error {
+	client, err := s.client(p)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	if err := client.publish(ctx, p, []byte(file), body); err != nil {
+		s.drop(p, client)
+		return err
+	}
+	return nil
+}
+
+// client returns the connection for a publisher, dialing on first use
+func (s *publisherSet) client(p *Publisher) (brokerClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := p.connKey()
+	if client, ok := s.clients[key]; ok {
+		return client, nil
+	}
+	client, err := dialBroker(p)
+	if err != nil {
+		return nil, err
+	}
+	if s.clients == nil {
+		s.clients = make(map[string]brokerClient)
+	}
+	s.clients[key] = client
+	return client, nil
+}
+
+// drop closes a connection that failed, unless another delivery already
+// replaced it
+func (s *publisherSet) drop(p *Publisher, client brokerClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := p.connKey()
+	if s.clients[key] == client {
+		delete(s.clients, key)
+		client.close()
+	}
+}
+
+// shutdown waits up to timeout for pending messages and closes the
+// connections
+func (s *publisherSet) shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Abandoning pending publisher messages")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, client := range s.clients {
+		if err := client.close(); err != nil {
+			slog.Warn("Failed to close publisher connection", "error", err)
+		}
+	}
+	s.clients = nil
+}
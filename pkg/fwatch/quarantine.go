@@ -0,0 +1,125 @@
+package fwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Quarantine modes
+const (
+	QuarantineMove    = "move"
+	QuarantineSymlink = "symlink"
+)
+
+// quarantineIndexName is the file in the quarantine directory that records
+// why each file was quarantined, one JSON object per line
+const quarantineIndexName = "index.jsonl"
+
+// quarantineRecord is one line of the quarantine index
+type quarantineRecord struct {
+	Time        time.Time `json:"time"`
+	Original    string    `json:"original_path"`
+	Quarantined string    `json:"quarantined_path"`
+	Mode        string    `json:"mode"`
+	Rule        string    `json:"rule"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error"`
+}
+
+// failureTracker counts consecutive failed attempts per path
+type failureTracker struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// fail records a failed attempt for path and returns the number of
+// consecutive failures so far
+func (t *failureTracker) fail(path string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failures == nil {
+		t.failures = make(map[string]int)
+	}
+	t.failures[path]++
+	return t.failures[path]
+}
+
+// reset forgets the failures recorded for path
+func (t *failureTracker) reset(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, path)
+}
+
+// quarantine moves (or links) a file that repeatedly failed processing into
+// the quarantine directory and appends a record to the index. It returns
+// the path inside the quarantine directory.
+func quarantine(config *Config, result Result, attempts int) (string, error) {
+	dir := config.QuarantineDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("creating quarantine directory: %w", err)
+	}
+
+	mode := config.QuarantineMode
+	if mode == "" {
+		mode = QuarantineMove
+	}
+	// Files of read-only watches can only be linked
+	if config.readOnly(config.watchFor(result.Path)) {
+		mode = QuarantineSymlink
+	}
+
+	// Neither os.Symlink nor a move without replacing takes a name another
+	// file has
+	target, _, err := placeResolved(result.Path, filepath.Join(dir, filepath.Base(result.Path)), ConflictRename, defaultConflictSuffix, func(target string, _ bool) error {
+		if mode == QuarantineSymlink {
+			return os.Symlink(result.Path, target)
+		}
+		return moveFile(result.Path, target, moveOptions{noReplace: true})
+	})
+	switch {
+	case err != nil && mode == QuarantineSymlink:
+		return "", fmt.Errorf("linking into quarantine: %w", err)
+	case err != nil:
+		return "", fmt.Errorf("moving into quarantine: %w", err)
+	}
+
+	record := quarantineRecord{
+		Time:        time.Now(),
+		Original:    result.Path,
+		Quarantined: target,
+		Mode:        mode,
+		Rule:        result.Rule,
+		Attempts:    attempts,
+	}
+	if result.Err != nil {
+		record.Error = result.Err.Error()
+	}
+	if err := appendJSONLine(filepath.Join(dir, quarantineIndexName), record); err != nil {
+		return target, fmt.Errorf("writing quarantine index: %w", err)
+	}
+
+	return target, nil
+}
+
+// appendJSONLine appends v as a single line of JSON to path
+func appendJSONLine(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,124 @@
+package fwatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// copyBurst is the most a bandwidth-limited copy reads at once
+const copyBurst = 256 << 10
+
+// RateLimit caps how fast files are processed, to keep bursts of files or
+// large cross-device copies from saturating a disk or network share. Zero
+// fields are unlimited.
+type RateLimit struct {
+	// FilesPerSecond is the most files acted on per second
+	FilesPerSecond float64 `yaml:"files_per_second"`
+
+	// MaxConcurrentCopies is the most cross-device copies run at once
+	MaxConcurrentCopies int `yaml:"max_concurrent_copies"`
+
+	// CopyBandwidth is the most bytes per second copied across devices,
+	// shared by all copies
+	CopyBandwidth ByteSize `yaml:"copy_bandwidth"`
+}
+
+// validate checks the limits
+func (l *RateLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.FilesPerSecond < 0 {
+		return fmt.Errorf("rate_limit.files_per_second must not be negative")
+	}
+	if l.MaxConcurrentCopies < 0 {
+		return fmt.Errorf("rate_limit.max_concurrent_copies must not be negative")
+	}
+	if l.CopyBandwidth < 0 {
+		return fmt.Errorf("rate_limit.copy_bandwidth must not be negative")
+	}
+	return nil
+}
+
+// limiter enforces a RateLimit. A nil limiter doesn't limit anything.
+type limiter struct {
+	ctx       context.Context
+	files     *rate.Limiter
+	copies    chan struct{}
+	bandwidth *rate.Limiter
+}
+
+// newLimiter creates a limiter for l; waiting for a file slot stops when
+// ctx is done
+func newLimiter(ctx context.Context, l *RateLimit) *limiter {
+	if l == nil {
+		return nil
+	}
+	lim := &limiter{ctx: ctx}
+	if l.FilesPerSecond > 0 {
+		lim.files = rate.NewLimiter(rate.Limit(l.FilesPerSecond), max(1, int(l.FilesPerSecond)))
+	}
+	if l.MaxConcurrentCopies > 0 {
+		lim.copies = make(chan struct{}, l.MaxConcurrentCopies)
+	}
+	if l.CopyBandwidth > 0 {
+		lim.bandwidth = rate.NewLimiter(rate.Limit(l.CopyBandwidth), copyBurst)
+	}
+	return lim
+}
+
+// waitFile blocks until another file may be processed. It returns false
+// if the engine is shutting down.
+func (l *limiter) waitFile() bool {
+	if l == nil || l.files == nil {
+		return true
+	}
+	return l.files.Wait(l.ctx) == nil
+}
+
+// acquireCopy blocks until a copy slot is free and returns the function
+// releasing it
+func (l *limiter) acquireCopy() (release func()) {
+	if l == nil || l.copies == nil {
+		return func() {}
+	}
+	l.copies <- struct{}{}
+	return func() { <-l.copies }
+}
+
+// throttles reports whether copies are limited in bandwidth
+func (l *limiter) throttles() bool {
+	return l != nil && l.bandwidth != nil
+}
+
+// reader wraps r so that reads respect the bandwidth limit. Copies already
+// under way are finished at shutdown, so this wait isn't cancelled.
+func (l *limiter) reader(r io.Reader) io.Reader {
+	if l == nil || l.bandwidth == nil {
+		return r
+	}
+	return &throttledReader{r: r, limit: l.bandwidth}
+}
+
+// throttledReader is an io.Reader limited by a shared rate limiter
+type throttledReader struct {
+	r     io.Reader
+	limit *rate.Limiter
+}
+
+// Read implements io.Reader
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > copyBurst {
+		p = p[:copyBurst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		// Reserve rather than Wait so the delay can't be cut short
+		time.Sleep(t.limit.ReserveN(time.Now(), n).Delay())
+	}
+	return n, err
+}
@@ -0,0 +1,116 @@
+package fwatch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit *RateLimit
+		valid bool
+	}{
+		{"none", nil, true},
+		{"all", &RateLimit{FilesPerSecond: 0.5, MaxConcurrentCopies: 2, CopyBandwidth: 10 << 20}, true},
+		{"negative files", &RateLimit{FilesPerSecond: -1}, false},
+		{"negative copies", &RateLimit{MaxConcurrentCopies: -1}, false},
+		{"negative bandwidth", &RateLimit{CopyBandwidth: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.limit.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: validate = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	for _, l := range []*limiter{newLimiter(context.Background(), nil), newLimiter(context.Background(), &RateLimit{})} {
+		if !l.waitFile() {
+			t.Error("waitFile = false without a limit")
+		}
+		l.acquireCopy()()
+		if l.throttles() {
+			t.Error("throttles without a bandwidth limit")
+		}
+		r := strings.NewReader("data")
+		if got := l.reader(r); got != r {
+			t.Error("reader wrapped without a bandwidth limit")
+		}
+	}
+}
+
+func TestLimiterFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := newLimiter(ctx, &RateLimit{FilesPerSecond: 0.1})
+	if !l.waitFile() {
+		t.Fatal("first file waited")
+	}
+
+	// The next slot is ten seconds away; shutting down ends the wait
+	done := make(chan bool)
+	go func() { done <- l.waitFile() }()
+	cancel()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("waitFile = true after shutdown")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitFile still waiting after shutdown")
+	}
+}
+
+func TestLimiterCopies(t *testing.T) {
+	l := newLimiter(context.Background(), &RateLimit{MaxConcurrentCopies: 1})
+	release := l.acquireCopy()
+
+	acquired := make(chan func())
+	go func() { acquired <- l.acquireCopy() }()
+	select {
+	case <-acquired:
+		t.Fatal("second copy started while the first ran")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("second copy didn't start once the first was done")
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	l := newLimiter(context.Background(), &RateLimit{CopyBandwidth: 4 * copyBurst})
+	if !l.throttles() {
+		t.Fatal("no bandwidth limit")
+	}
+	data := bytes.Repeat([]byte("x"), 3*copyBurst)
+	r := l.reader(bytes.NewReader(data))
+
+	// Reads are cut to the burst, so no read asks for more than there is
+	buf := make([]byte, 2*copyBurst)
+	n, err := r.Read(buf)
+	if err != nil || n != copyBurst {
+		t.Fatalf("Read = %d, %v; want %d bytes", n, err, copyBurst)
+	}
+
+	// The first burst is free, the other two take half a second at four
+	// bursts per second
+	start := time.Now()
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("copied %d bytes in %s, faster than the limit", len(rest), elapsed)
+	}
+	if !bytes.Equal(append(buf[:n], rest...), data) {
+		t.Error("throttled copy changed the data")
+	}
+}
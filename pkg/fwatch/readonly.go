@@ -0,0 +1,157 @@
+package fwatch
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keptBucket maps the files of read-only watches that were processed to
+// their size and modification time, so they aren't processed again
+const keptBucket = "kept"
+
+// readOnly reports whether fwatch must leave the files of watch where they
+// are
+func (c *Config) readOnly(watch *Watch) bool {
+	return watch != nil && (c.ReadOnlySources || watch.ReadOnlySources)
+}
+
+// keepingSource returns the rule as it runs on a file of a read-only watch:
+// moves become copies, and archives, uploads and pipelines keep the file.
+// Pipelines leave out their delete steps.
+func (r *Rule) keepingSource() *Rule {
+	rule := *r
+	if rule.Action == "" || rule.Action == ActionMove {
+		rule.Action = ActionCopy
+		rule.Duplicates = ""
+	}
+	if rule.Archive != nil && rule.Archive.RemoveSource {
+		archive := *rule.Archive
+		archive.RemoveSource = false
+		rule.Archive = &archive
+	}
+	if rule.Upload != nil && rule.Upload.DeleteSource {
+		upload := *rule.Upload
+		upload.DeleteSource = false
+		rule.Upload = &upload
+	}
+
+	var steps []Step
+	for _, step := range rule.Steps {
+		switch step.Action {
+		case ActionDelete:
+			continue
+		case "", ActionMove:
+			step.Action = ActionCopy
+		}
+		if step.Archive != nil && step.Archive.RemoveSource {
+			archive := *step.Archive
+			archive.RemoveSource = false
+			step.Archive = &archive
+		}
+		if step.Upload != nil && step.Upload.DeleteSource {
+			upload := *step.Upload
+			upload.DeleteSource = false
+			step.Upload = &upload
+		}
+		steps = append(steps, step)
+	}
+	rule.Steps = steps
+	return &rule
+}
+
+// keptSources remembers the files of read-only watches that were processed.
+// With a history database they are recorded there too, and loaded from it
+// the first time one is looked up.
+type keptSources struct {
+	mu     sync.Mutex
+	db     string // the database files were loaded from
+	loaded bool
+	files  map[string]fileStamp
+}
+
+// has reports whether the file at path was processed and hasn't changed
+// since
+func (k *keptSources) has(db, path string, info os.FileInfo) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.load(db)
+	f, ok := k.files[path]
+	return ok && f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+}
+
+// add records that the file at path has been processed
+func (k *keptSources) add(db string, history *historyWriter, path string, info os.FileInfo) {
+	stamp := fileStamp{Size: info.Size(), ModTime: info.ModTime()}
+	k.mu.Lock()
+	k.load(db)
+	k.files[path] = stamp
+	k.mu.Unlock()
+	history.keep(db, path, stamp)
+}
+
+// load reads the kept files from db, unless they were read from it
+// already. Callers must hold k.mu.
+func (k *keptSources) load(db string) {
+	if k.loaded && k.db == db {
+		return
+	}
+	k.db, k.loaded, k.files = db, true, make(map[string]fileStamp)
+	if db == "" {
+		return
+	}
+	if _, err := os.Stat(db); err != nil {
+		return
+	}
+	h := History{path: db}
+	h.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(keptBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var f fileStamp
+			if json.Unmarshal(value, &f) == nil {
+				k.files[string(key)] = f
+			}
+			return nil
+		})
+	})
+}
+
+// putKept records a processed file of a read-only watch
+func putKept(tx *bolt.Tx, path string, stamp fileStamp) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(keptBucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(stamp)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(path), data)
+}
+
+// forget drops a file that is gone
+func (k *keptSources) forget(path string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.files, path)
+}
+
+// unkeep forgets that the file at path was processed, so it is processed
+// again
+func (k *keptSources) unkeep(db, path string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.load(db)
+	delete(k.files, path)
+}
+
+// keepsSources reports whether any watch is read-only
+func (c *Config) keepsSources() bool {
+	return c.ReadOnlySources || slices.ContainsFunc(c.Watches, func(w Watch) bool { return w.ReadOnlySources })
+}
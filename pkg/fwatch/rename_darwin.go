@@ -0,0 +1,22 @@
+package fwatch
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameNoReplace renames old to new, failing with an error matching
+// fs.ErrExist instead of replacing a file at new
+func renameNoReplace(old, new string) error {
+	err := unix.RenamexNp(old, new, unix.RENAME_EXCL)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL) {
+		// Only APFS and HFS+ support RENAME_EXCL
+		return renameByLinking(old, new)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+	return nil
+}
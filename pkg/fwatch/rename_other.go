@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package fwatch
+
+// renameNoReplace renames old to new, failing with an error matching
+// fs.ErrExist instead of replacing a file at new
+func renameNoReplace(old, new string) error {
+	return renameByLinking(old, new)
+}
@@ -0,0 +1,25 @@
+package fwatch
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// renameNoReplace renames old to new, failing with an error matching
+// fs.ErrExist instead of replacing a file at new. Without
+// MOVEFILE_REPLACE_EXISTING, MoveFileEx never replaces anything.
+func renameNoReplace(old, new string) error {
+	from, err := windows.UTF16PtrFromString(old)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+	to, err := windows.UTF16PtrFromString(new)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+	if err := windows.MoveFileEx(from, to, 0); err != nil {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package fwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// ReplayRecords returns the latest record of each file in the history
+// database whose latest record matches filter, oldest first. A file that
+// failed and then succeeded isn't selected by Failed, and its Rule is the
+// one that handled it last.
+func (h *History) ReplayRecords(filter HistoryFilter) ([]HistoryRecord, error) {
+	records, err := h.Query(HistoryFilter{Since: filter.Since})
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int)
+	for i, rec := range records {
+		latest[rec.Source] = i
+	}
+	var selected []HistoryRecord
+	for i, rec := range records {
+		if latest[rec.Source] == i && filter.matches(&rec) {
+			selected = append(selected, rec)
+		}
+	}
+	return selected, nil
+}
+
+// Locate returns where the file recorded in rec is now, for Replay: its
+// source path if it is still there, or else the local destination it was
+// moved to or the quarantine it was moved into. Files that were deleted,
+// encrypted, copied and then removed or put back by undo can't be
+// replayed.
+func (rec *HistoryRecord) Locate() (string, error) {
+	if rec.Undone != nil {
+		return "", errors.New("put back by undo")
+	}
+	if _, err := os.Lstat(rec.Source); err == nil {
+		return rec.Source, nil
+	}
+	return rec.locateMoved()
+}
+
+// locateMoved is Locate for a file that isn't at its source path
+func (rec *HistoryRecord) locateMoved() (string, error) {
+	switch {
+	case rec.Quarantined != "":
+		info, err := os.Lstat(rec.Quarantined)
+		if err != nil {
+			return "", fmt.Errorf("quarantined file is gone: %w", err)
+		}
+		// A link into quarantine points at the source, which is gone
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("source is gone")
+		}
+		return rec.Quarantined, nil
+	case rec.Action == ActionDelete:
+		return "", errors.New("deleted")
+	case rec.Action != ActionMove || rec.Destination == "" || rec.Destination == rec.Duplicate:
+		return "", errors.New("source is gone")
+	case isRemoteDestination(rec.Destination):
+		return "", errors.New("stored remotely")
+	case rec.Encrypted:
+		return "", errors.New("encrypted")
+	}
+	if _, err := os.Lstat(rec.Destination); err != nil {
+		return "", fmt.Errorf("moved file is gone: %w", err)
+	}
+	return rec.Destination, nil
+}
+
+// Replay routes the files of history records through the rules again, as
+// if they had just arrived, for after a rule was fixed or a destination
+// came back. Files that were moved are first moved back to their source
+// paths, and files of read-only watches are processed even though they
+// were already. It returns the number of files routed; those that can't
+// be found are logged and left out. Like RunOnce, it runs without
+// watching and may only be called once.
+func (e *Engine) Replay(ctx context.Context, records []HistoryRecord) (int, error) {
+	e.mu.Lock()
+	if e.running {
+		e.mu.Unlock()
+		return 0, errors.New("engine is already running")
+	}
+	e.running = true
+	e.mu.Unlock()
+
+	config := e.config.Load()
+	createDestinations(config)
+
+	var files []string
+	replayed := make(map[string]bool)
+	for i := range records {
+		rec := &records[i]
+		// A file already at the source path is another record's
+		path, err := restoreForReplay(rec, replayed[rec.Source])
+		switch {
+		case errors.Is(err, fs.ErrExist):
+			slog.Warn("Not replaying file, another file is at its source path", "file", rec.Source, "from", path)
+			continue
+		case err != nil:
+			slog.Warn("Can't replay file", "file", rec.Source, "error", err)
+			continue
+		}
+		replayed[path] = true
+		e.kept.unkeep(config.HistoryDB, path)
+		files = append(files, path)
+	}
+	return len(files), e.runFiles(ctx, config, files)
+}
+
+// restoreForReplay moves the file recorded in rec back to its source path
+// if it is elsewhere, and returns the source path. With taken set, the
+// file at the source path isn't the one recorded. An error matching
+// fs.ErrExist comes with the path the file was left at.
+func restoreForReplay(rec *HistoryRecord, taken bool) (string, error) {
+	locate := rec.Locate
+	if taken {
+		locate = rec.locateMoved
+	}
+	path, err := locate()
+	if err != nil || path == rec.Source {
+		return path, err
+	}
+	if err := os.MkdirAll(filepath.Dir(rec.Source), 0o755); err != nil {
+		return "", err
+	}
+	// The modification time is kept for min_age and max_age, and a file
+	// that arrived at the source path since is never replaced
+	opts := moveOptions{verifyChecksum: true, preserveAttributes: true, noReplace: true}
+	if err := moveFile(path, rec.Source, opts); errors.Is(err, fs.ErrExist) {
+		return path, err
+	} else if err != nil {
+		return "", fmt.Errorf("moving back from %s: %w", path, err)
+	}
+	slog.Info("Moved file back for replay", "file", rec.Source, "from", path)
+	return rec.Source, nil
+}
@@ -0,0 +1,82 @@
+package fwatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// movedRecord returns a record of a file with contents data that was moved
+// from src into a new directory
+func movedRecord(t *testing.T, src, data string) HistoryRecord {
+	t.Helper()
+	dest := filepath.Join(t.TempDir(), filepath.Base(src))
+	writeFile(t, dest, data)
+	return HistoryRecord{Source: src, Destination: dest, Action: ActionMove, Status: StatusSuccess}
+}
+
+func TestReplay(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	rec := movedRecord(t, filepath.Join(dir, "report.pdf"), "data")
+	e, err := New(Config{Watches: []Watch{{Path: dir}}, Rules: []Rule{{Regex: ".", Destination: out}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := e.Replay(context.Background(), []HistoryRecord{rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("replayed %d files, want 1", n)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "report.pdf")); string(data) != "data" {
+		t.Errorf("replayed file holds %q", data)
+	}
+}
+
+func TestReplaySameSource(t *testing.T) {
+	// Two downloads with the same name, moved away one after the other
+	dir, out := t.TempDir(), t.TempDir()
+	src := filepath.Join(dir, "report.pdf")
+	first, second := movedRecord(t, src, "first"), movedRecord(t, src, "second")
+	e, err := New(Config{Watches: []Watch{{Path: dir}}, Rules: []Rule{{Regex: ".", Destination: out}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := e.Replay(context.Background(), []HistoryRecord{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("replayed %d files, want 1", n)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "report.pdf")); string(data) != "first" {
+		t.Errorf("replayed file holds %q, want the first", data)
+	}
+	// The second is skipped rather than replacing the first at the source
+	// or replaying it twice
+	if data, _ := os.ReadFile(second.Destination); string(data) != "second" {
+		t.Errorf("second file holds %q where it was left", data)
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 1 {
+		t.Errorf("%d files routed, want 1", len(entries))
+	}
+}
+
+func TestRestoreForReplayKeepsNewFile(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "report.pdf")
+	rec := movedRecord(t, src, "data")
+	writeFile(t, src, "new download")
+
+	// The new file isn't the recorded one, so it must be left alone
+	path, err := restoreForReplay(&rec, true)
+	if err == nil || path != rec.Destination {
+		t.Errorf("restoreForReplay = %q, %v; want the file left at %s", path, err, rec.Destination)
+	}
+	if data, _ := os.ReadFile(src); string(data) != "new download" {
+		t.Errorf("source replaced with %q", data)
+	}
+}
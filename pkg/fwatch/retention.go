@@ -0,0 +1,212 @@
+package fwatch
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Retention actions
+const (
+	RetentionDelete  = "delete"
+	RetentionArchive = "archive"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+
+	// retentionTick is how often retention rules are checked for being due
+	retentionTick = time.Minute
+)
+
+// RetentionRule removes or archives old files from directories on a
+// schedule, so folders don't grow forever
+type RetentionRule struct {
+	// Name is used in logs. Defaults to "retention N".
+	Name string `yaml:"name"`
+
+	// Paths are the directories to clean up
+	Paths []string `yaml:"paths"`
+
+	// Match lists file name glob patterns; empty matches every file
+	Match []string `yaml:"match"`
+
+	// OlderThan is the modification age after which a file expires
+	OlderThan Duration `yaml:"older_than"`
+
+	// Action is "delete" or "archive" (move to Destination)
+	Action string `yaml:"action"`
+
+	// Destination receives archived files
+	Destination string `yaml:"destination"`
+
+	// Recursive includes files in subdirectories
+	Recursive bool `yaml:"recursive"`
+
+	// Interval is how often the rule runs (default 1h)
+	Interval Duration `yaml:"interval"`
+
+	// DeleteMode is "permanent" (default) or "trash", for the delete action
+	DeleteMode string `yaml:"delete_mode"`
+
+	// DryRun only logs the files that would expire
+	DryRun bool `yaml:"dry_run"`
+}
+
+// validate checks the retention rule's settings
+func (r *RetentionRule) validate() error {
+	if len(r.Paths) == 0 {
+		return fmt.Errorf("paths is required")
+	}
+	if r.OlderThan <= 0 {
+		return fmt.Errorf("older_than is required")
+	}
+	switch r.Action {
+	case RetentionDelete:
+	case RetentionArchive:
+		if r.Destination == "" {
+			return fmt.Errorf("destination is required for the archive action")
+		}
+	case "":
+		return fmt.Errorf("action is required (delete or archive)")
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	for _, pattern := range r.Match {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid match pattern %q: %w", pattern, err)
+		}
+	}
+	if err := validDeleteMode(r.DeleteMode); err != nil {
+		return err
+	}
+	if r.DeleteMode != "" && r.Action != RetentionDelete {
+		return fmt.Errorf("delete_mode only applies to the delete action")
+	}
+	if r.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	return nil
+}
+
+// expired reports whether the file described by info is covered by the
+// rule and old enough to go
+func (r *RetentionRule) expired(info fs.FileInfo, now time.Time) bool {
+	if now.Sub(info.ModTime()) < time.Duration(r.OlderThan) {
+		return false
+	}
+	if len(r.Match) == 0 {
+		return true
+	}
+	return isIgnored(info.Name(), r.Match)
+}
+
+// runRetention applies retention rules as they become due, and empties
+// expired trash, until ctx is done. The current config is read on every
+// tick, so reloads apply.
+func (e *Engine) runRetention(ctx context.Context) {
+	lastRun := make(map[string]time.Time)
+	var lastExpiry time.Time
+	ticker := time.NewTicker(retentionTick)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		config := e.config.Load()
+		for i := range config.Retention {
+			rule := &config.Retention[i]
+			interval := defaultRetentionInterval
+			if rule.Interval > 0 {
+				interval = time.Duration(rule.Interval)
+			}
+			if last, ok := lastRun[rule.Name]; ok && now.Sub(last) < interval {
+				continue
+			}
+			lastRun[rule.Name] = now
+			sweep(ctx, rule, config.Trash, now)
+		}
+		if now.Sub(lastExpiry) >= trashExpiryInterval {
+			lastExpiry = now
+			expireTrash(config.Trash, now)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep deletes or archives the expired files in the rule's paths
+func sweep(ctx context.Context, rule *RetentionRule, trash *TrashOptions, now time.Time) {
+	expired, failed := 0, 0
+	for _, root := range rule.Paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				slog.Warn("Failed to read directory for retention", "retention", rule.Name, "path", path, "error", err)
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if d.IsDir() {
+				if path != root && !rule.Recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || !rule.expired(info, now) {
+				return nil
+			}
+
+			expired++
+			age := now.Sub(info.ModTime()).Round(time.Second)
+			if rule.DryRun {
+				slog.Info("File would expire", "retention", rule.Name, "file", path, "action", rule.Action, "age", age)
+				return nil
+			}
+			if err := expire(rule, trash, root, path); err != nil {
+				failed++
+				slog.Error("Failed to expire file", "retention", rule.Name, "file", path, "action", rule.Action, "error", err)
+				return nil
+			}
+			slog.Info("Expired file", "retention", rule.Name, "file", path, "action", rule.Action, "age", age)
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("Retention sweep stopped", "retention", rule.Name, "path", root, "error", err)
+		}
+	}
+	slog.Debug("Retention sweep finished", "retention", rule.Name, "expired", expired, "failed", failed)
+}
+
+// expire deletes the file or moves it below the archive destination,
+// keeping its path relative to root
+func expire(rule *RetentionRule, trash *TrashOptions, root, path string) error {
+	if rule.Action == RetentionDelete {
+		_, err := deleteFile(trash, path, rule.DeleteMode)
+		return err
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(rule.Destination, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	_, _, err = placeResolved(path, dest, ConflictRename, defaultConflictSuffix, func(resolved string, _ bool) error {
+		return moveFile(path, resolved, moveOptions{preserveAttributes: true, noReplace: true})
+	})
+	return err
+}
@@ -0,0 +1,86 @@
+package fwatch
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Retry defaults applied to unset RetryPolicy fields
+const (
+	defaultRetryInitialDelay = time.Second
+	defaultRetryMaxDelay     = 5 * time.Minute
+	defaultRetryMultiplier   = 2.0
+	defaultRetryJitter       = 0.2
+)
+
+// RetryPolicy controls how failed files are retried. The delay before
+// retry n (starting at 1) is InitialDelay * Multiplier^(n-1), capped at
+// MaxDelay and randomized by ±Jitter (a fraction of the delay).
+type RetryPolicy struct {
+	MaxAttempts  int      `yaml:"max_attempts"`
+	InitialDelay Duration `yaml:"initial_delay"`
+	MaxDelay     Duration `yaml:"max_delay"`
+	Multiplier   float64  `yaml:"multiplier"`
+	Jitter       *float64 `yaml:"jitter"`
+}
+
+// validate checks the policy's settings
+func (p *RetryPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry.max_attempts must not be negative")
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return fmt.Errorf("retry.multiplier must be at least 1")
+	}
+	if p.Jitter != nil && (*p.Jitter < 0 || *p.Jitter > 1) {
+		return fmt.Errorf("retry.jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// maxAttempts returns the total number of attempts allowed, at least 1
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil {
+		return 1
+	}
+	return max(p.MaxAttempts, 1)
+}
+
+// delay returns how long to wait before the given retry (1 for the first)
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	initial := defaultRetryInitialDelay
+	maxDelay := defaultRetryMaxDelay
+	multiplier := defaultRetryMultiplier
+	jitter := defaultRetryJitter
+	if p.InitialDelay > 0 {
+		initial = time.Duration(p.InitialDelay)
+	}
+	if p.MaxDelay > 0 {
+		maxDelay = time.Duration(p.MaxDelay)
+	}
+	if p.Multiplier > 0 {
+		multiplier = p.Multiplier
+	}
+	if p.Jitter != nil {
+		jitter = *p.Jitter
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	d = min(d, float64(maxDelay))
+	d += d * jitter * (2*rand.Float64() - 1)
+	return time.Duration(d)
+}
+
+// retryPolicy returns the policy that applies to rule: its own if set,
+// otherwise the global one, which may be nil
+func (c *Config) retryPolicy(rule *Rule) *RetryPolicy {
+	if rule != nil && rule.Retry != nil {
+		return rule.Retry
+	}
+	return c.Retry
+}
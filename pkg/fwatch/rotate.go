@@ -0,0 +1,98 @@
+package fwatch
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.WriteCloser that appends to a file, such as a log
+// file, and rotates it to path.1, path.2, ... once it grows past maxSize
+// bytes
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens path for appending. A maxSize of zero disables
+// rotation.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("getting file info: %w", err)
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts existing backups up by one, dropping the oldest, and
+// starts a fresh file. If the rename fails, writing continues in the
+// current file.
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+
+	var err error
+	if rf.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		err = os.Rename(rf.path, rf.path+".1")
+	} else {
+		err = os.Truncate(rf.path, 0)
+	}
+
+	if openErr := rf.open(); openErr != nil {
+		rf.file = nil
+		return openErr
+	}
+	return err
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file != nil && rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "fwatch: rotating %s: %v\n", rf.path, err)
+		}
+	}
+
+	// Fall back to stderr rather than losing records if the file could
+	// not be reopened
+	if rf.file == nil {
+		return os.Stderr.Write(p)
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	return rf.file.Close()
+}
@@ -0,0 +1,128 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RunOnce processes the files already in the given watch directories, or
+// in all of them, and returns once they are done, for running fwatch from
+// cron or Task Scheduler instead of as a daemon. Nothing is watched: files
+// that fail are not retried within the run, and files that are locked, wait
+// for a schedule or are still being written are left for the next run. It
+// returns the number of files and drop folders found. Like Run, it may only
+// be called once.
+func (e *Engine) RunOnce(ctx context.Context, paths ...string) (int, error) {
+	e.mu.Lock()
+	if e.running {
+		e.mu.Unlock()
+		return 0, errors.New("engine is already running")
+	}
+	e.running = true
+	e.mu.Unlock()
+
+	paths, err := e.resolveWatches(paths)
+	if err != nil {
+		return 0, err
+	}
+	config := e.config.Load()
+	createDestinations(config)
+
+	var files []string
+	for _, path := range paths {
+		found, err := config.watchedFiles(path)
+		if err != nil {
+			return 0, err
+		}
+		slog.Debug("Scanned watch directory", "watch_dir", path, "files", len(found))
+		files = append(files, found...)
+	}
+	return len(files), e.runFiles(ctx, config, files)
+}
+
+// runFiles processes files with the config's workers and returns once
+// they are done or ctx is canceled
+func (e *Engine) runFiles(ctx context.Context, config *Config, files []string) error {
+	defer e.closeOutputs()
+	provider, shutdownTracing, err := newTracerProvider(ctx, config.Tracing)
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Failed to export remaining traces", "error", err)
+		}
+	}()
+
+	e.mu.Lock()
+	e.tracer = provider.Tracer(tracerName)
+	e.limits = newLimiter(ctx, config.RateLimit)
+	e.started = time.Now()
+	e.mu.Unlock()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range cmp.Or(config.Workers, defaultWorkers) {
+		wg.Go(func() {
+			for path := range jobs {
+				e.processOnce(ctx, config, path)
+			}
+		})
+	}
+feed:
+	for _, path := range files {
+		select {
+		case jobs <- path:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return ctx.Err()
+}
+
+// processOnce processes a file found by RunOnce. A drop folder is handled
+// as if it had just settled, unless it changed within its settle time.
+func (e *Engine) processOnce(ctx context.Context, config *Config, path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		e.processFile(path, jobTiming{})
+		return
+	}
+
+	watch, _ := config.isDropFolder(path)
+	state, err := scanTree(path)
+	switch {
+	case err != nil:
+		slog.Warn("Failed to scan drop folder", "dir", path, "error", err)
+		return
+	case state.files == 0:
+		return
+	case time.Since(state.modTime) < watch.dropSettle():
+		slog.Info("Leaving drop folder that is still being written to", "dir", path, "settle", watch.dropSettle())
+		return
+	case matchDirRule(config.Rules, path) != nil:
+		e.processDropFolder(ctx, config, path, info)
+		return
+	}
+
+	slog.Info("Processing drop folder", "dir", path, "files", state.files)
+	filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && ctx.Err() == nil {
+			e.processFile(file, jobTiming{})
+		}
+		return nil
+	})
+	removeEmptyDirs(path)
+}
@@ -0,0 +1,184 @@
+package fwatch
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// SandboxEnv is set in the environment of an fwatch that Sandbox
+// re-executed, so it knows it is sandboxed already
+const SandboxEnv = "FWATCH_SANDBOXED"
+
+// SandboxPaths are what a sandboxed fwatch may access; everything else on
+// the filesystem is out of reach
+type SandboxPaths struct {
+	// ReadWrite lists the directories files are moved, written and deleted
+	// in: watches, local destinations and the directories fwatch keeps
+	// its state in
+	ReadWrite []string
+
+	// ReadOnly lists what is only read, such as included configs and /etc
+	ReadOnly []string
+
+	// Execute lists the directories of the programs that may be run, by
+	// exec actions and notifications and to re-execute fwatch. None may
+	// overlap ReadWrite, or a downloaded file could be run.
+	Execute []string
+
+	// Inherit are open files the sandboxed fwatch keeps, under the same
+	// descriptor numbers, such as a listening socket it couldn't create
+	Inherit []*os.File
+}
+
+// systemReadOnly are read by the Go runtime and standard library: DNS, TLS
+// roots, time zones and user names
+var systemReadOnly = []string{"/etc", "/usr/share/zoneinfo", "/usr/share/ca-certificates", "/proc/self"}
+
+// systemExecute hold the programs commands are usually found in, and the
+// libraries they load
+var systemExecute = []string{"/bin", "/sbin", "/usr", "/lib", "/lib64", "/lib32", "/opt"}
+
+// SandboxPaths returns what fwatch needs to access to run config. Local
+// paths named by exec commands outside the usual directories are added
+// to Execute.
+func (c *Config) SandboxPaths() SandboxPaths {
+	var paths SandboxPaths
+	add := func(list *[]string, path string) {
+		if path == "" || isRemoteDestination(path) {
+			return
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if !slices.Contains(*list, path) {
+			*list = append(*list, path)
+		}
+	}
+	command := func(action *ExecAction) {
+		if action == nil || len(action.Command) == 0 || strings.Contains(action.Command[0], "{{") {
+			return
+		}
+		if path, err := exec.LookPath(action.Command[0]); err == nil {
+			add(&paths.Execute, filepath.Dir(path))
+		}
+	}
+
+	for _, watch := range c.Watches {
+		if c.readOnly(&watch) {
+			add(&paths.ReadOnly, watch.Path)
+			continue
+		}
+		add(&paths.ReadWrite, watch.Path)
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		add(&paths.ReadWrite, rule.Destination)
+		if rule.Encrypt != nil {
+			add(&paths.ReadOnly, rule.Encrypt.RecipientsFile)
+		}
+		command(rule.Exec)
+		for _, hook := range []*Hook{rule.Post, rule.OnError} {
+			if hook != nil {
+				command(&hook.ExecAction)
+			}
+		}
+		if rule.Scan != nil {
+			command(rule.Scan.Exec)
+		}
+		if rule.Verify != nil {
+			command(rule.Verify.Exec)
+		}
+		for _, step := range rule.Steps {
+			add(&paths.ReadWrite, step.Destination)
+			command(step.Exec)
+		}
+	}
+	if c.Scan != nil {
+		command(c.Scan.Exec)
+	}
+	for _, r := range c.Retention {
+		for _, path := range r.Paths {
+			add(&paths.ReadWrite, path)
+		}
+		add(&paths.ReadWrite, r.Destination)
+	}
+
+	add(&paths.ReadWrite, c.QuarantineDir)
+	add(&paths.ReadWrite, c.QueueDir)
+	if c.Trash != nil {
+		add(&paths.ReadWrite, c.Trash.Dir)
+	}
+	if c.usesSystemTrash() {
+		dataHome := os.Getenv("XDG_DATA_HOME")
+		if home, err := os.UserHomeDir(); dataHome == "" && err == nil {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+		if dataHome != "" {
+			add(&paths.ReadWrite, filepath.Join(dataHome, "Trash"))
+		}
+	}
+	// Databases keep journals beside them
+	if c.HistoryDB != "" {
+		add(&paths.ReadWrite, filepath.Dir(c.HistoryDB))
+	}
+	if c.HashIndex != "" {
+		add(&paths.ReadWrite, filepath.Dir(c.HashIndex))
+	}
+	// Rotation renames the audit log beside itself
+	if c.Audit != nil {
+		add(&paths.ReadWrite, filepath.Dir(c.Audit.Path))
+	}
+	add(&paths.ReadWrite, os.DevNull)
+
+	// Editors save by replacing files, so their directories are allowed
+	for _, path := range c.included {
+		add(&paths.ReadOnly, filepath.Dir(path))
+	}
+	for _, path := range c.includePaths {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			add(&paths.ReadOnly, path)
+		}
+	}
+	for _, path := range systemReadOnly {
+		add(&paths.ReadOnly, path)
+	}
+
+	for _, path := range systemExecute {
+		add(&paths.Execute, path)
+	}
+	if self, err := os.Executable(); err == nil {
+		add(&paths.Execute, self)
+	}
+	return paths
+}
+
+// overlap returns a ReadWrite and an Execute path of paths that are the
+// same or one below the other
+func (p SandboxPaths) overlap() (string, string, bool) {
+	for _, run := range p.Execute {
+		for _, rw := range p.ReadWrite {
+			if run == rw || isWithin(run, rw) || isWithin(rw, run) {
+				return rw, run, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// usesSystemTrash reports whether any rule deletes files to the trash
+func (c *Config) usesSystemTrash() bool {
+	for _, rule := range c.Rules {
+		if rule.DeleteMode == DeleteModeTrash {
+			return true
+		}
+	}
+	for _, r := range c.Retention {
+		if r.DeleteMode == DeleteModeTrash {
+			return true
+		}
+	}
+	return false
+}
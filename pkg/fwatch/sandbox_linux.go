@@ -0,0 +1,240 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Landlock access rights, by what they are granted for
+const (
+	landlockRead    = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockExecute = landlockRead | unix.LANDLOCK_ACCESS_FS_EXECUTE
+
+	// landlockFile are the rights that apply to files rather than
+	// directories
+	landlockFile = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+	// landlockNoWrite are never granted: running downloaded files, and
+	// device nodes
+	landlockNoWrite = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+)
+
+// deniedSyscalls are refused with EPERM in the sandbox. fwatch never needs
+// them, and they are what an exploit would use to break out or attack the
+// rest of the system.
+var deniedSyscalls = []uintptr{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_FSOPEN, unix.SYS_FSMOUNT, unix.SYS_FSPICK, unix.SYS_FSCONFIG,
+	unix.SYS_MOVE_MOUNT, unix.SYS_OPEN_TREE, unix.SYS_MOUNT_SETATTR,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_ACCT, unix.SYS_QUOTACTL, unix.SYS_SYSLOG,
+	unix.SYS_SETHOSTNAME, unix.SYS_SETDOMAINNAME, unix.SYS_CLOCK_SETTIME,
+}
+
+// Sandbox restricts fwatch to paths with Landlock and refuses the system
+// calls it has no use for with seccomp, then re-executes it with SandboxEnv
+// set, so that every thread of the new process and the commands it runs
+// are confined. It only returns on failure, after which the calling thread
+// may be restricted and the process should exit.
+//
+// Landlock needs Linux 5.13 or later; before 5.19 files can't be renamed
+// across directories and are copied instead.
+func Sandbox(paths SandboxPaths) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding executable: %w", err)
+	}
+	if rw, exec, ok := paths.overlap(); ok {
+		return fmt.Errorf("files could be run from %s, which overlaps the writable %s", exec, rw)
+	}
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("landlock is not available: %w", errno)
+	}
+
+	handled := landlockRights(int(abi))
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr.Access_fs), 0)
+	if errno != 0 {
+		return fmt.Errorf("creating landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	for _, path := range paths.ReadWrite {
+		// A directory that isn't there yet, such as a watch on a drive
+		// that isn't mounted, is allowed through the nearest one that is
+		dir := path
+		for {
+			if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		if dir != path {
+			slog.Warn("Sandbox path doesn't exist, allowing the directory above it", "path", path, "allowed", dir)
+		}
+		if err := landlockAllow(ruleset, dir, handled&^landlockNoWrite); err != nil {
+			return err
+		}
+	}
+	for _, path := range paths.ReadOnly {
+		if err := landlockAllow(ruleset, path, landlockRead); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for _, path := range paths.Execute {
+		if err := landlockAllow(ruleset, path, landlockExecute); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, file := range paths.Inherit {
+		if _, err := unix.FcntlInt(file.Fd(), unix.F_SETFD, 0); err != nil {
+			return fmt.Errorf("keeping %s open: %w", file.Name(), err)
+		}
+	}
+
+	// Both restrictions apply to this thread and what it executes; the
+	// other threads of this process end with the exec
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %w", err)
+	}
+	if err := installSeccomp(); err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("enforcing landlock ruleset: %w", errno)
+	}
+	env := append(os.Environ(), SandboxEnv+"=1")
+	err = syscall.Exec(self, os.Args, env)
+	runtime.KeepAlive(paths.Inherit)
+	return fmt.Errorf("re-executing in the sandbox: %w", err)
+}
+
+// landlockRights returns the filesystem rights a Landlock ABI version can
+// restrict
+func landlockRights(abi int) uint64 {
+	rights := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		rights |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		rights |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		rights |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return rights
+}
+
+// landlockAllow adds a rule granting access to path and everything below
+// it. Files only take the rights that apply to files.
+func landlockAllow(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &fs.PathError{Op: "sandbox", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return &fs.PathError{Op: "sandbox", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFile
+	}
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+		return &fs.PathError{Op: "sandbox", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// auditArch returns the seccomp architecture of this build, or 0 if the
+// syscall filter doesn't know it
+func auditArch() uint32 {
+	switch runtime.GOARCH {
+	case "amd64":
+		return unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		return unix.AUDIT_ARCH_AARCH64
+	case "386":
+		return unix.AUDIT_ARCH_I386
+	case "arm":
+		return unix.AUDIT_ARCH_ARM
+	case "riscv64":
+		return unix.AUDIT_ARCH_RISCV64
+	case "ppc64le":
+		return unix.AUDIT_ARCH_PPC64LE
+	case "s390x":
+		return unix.AUDIT_ARCH_S390X
+	case "loong64":
+		return unix.AUDIT_ARCH_LOONGARCH64
+	}
+	return 0
+}
+
+// installSeccomp installs a filter on this thread refusing deniedSyscalls,
+// and any call made with another architecture's numbers
+func installSeccomp() error {
+	arch := auditArch()
+	if arch == 0 {
+		slog.Warn("System call filtering is not supported on this architecture", "arch", runtime.GOARCH)
+		return nil
+	}
+
+	const (
+		load  = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		equal = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		above = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ret   = unix.BPF_RET | unix.BPF_K
+		deny  = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	)
+	filter := []unix.SockFilter{
+		{Code: load, K: 4}, // seccomp_data.arch
+		{Code: equal, Jt: 1, K: arch},
+		{Code: ret, K: deny},
+		{Code: load, K: 0}, // seccomp_data.nr
+	}
+	// The x32 ABI shares the x86-64 architecture, with numbers above this
+	checks := len(deniedSyscalls)
+	if runtime.GOARCH == "amd64" {
+		checks++
+	}
+	jump := func(i int) uint8 { return uint8(checks - i) }
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter, unix.SockFilter{Code: above, Jt: jump(0), K: 0x40000000})
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, unix.SockFilter{Code: equal, Jt: jump(len(filter) - 4), K: uint32(nr)})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: ret, K: deny},
+	)
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, 0, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("installing system call filter: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fwatch
+
+import "errors"
+
+// Sandbox is only supported on Linux
+func Sandbox(paths SandboxPaths) error {
+	return errors.New("sandboxing is only supported on Linux")
+}
@@ -0,0 +1,266 @@
+package fwatch
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultScanTimeout bounds a clamd scan when the config does not set one
+const defaultScanTimeout = 2 * time.Minute
+
+// clamdChunk is the size of the chunks a file is streamed to clamd in
+const clamdChunk = 64 << 10
+
+// errRejected marks a file that a scan found to be infected, or that the
+// scan command rejected
+var errRejected = errors.New("rejected by scan")
+
+// errScanFailed marks a file that couldn't be scanned, because clamd is
+// unreachable or the scan command didn't run. The file waits for the
+// scanner rather than counting as failed.
+var errScanFailed = errors.New("scan failed")
+
+// scanRecheckDelay is how long a file that couldn't be scanned waits
+// before it is scanned again
+const scanRecheckDelay = time.Minute
+
+// defaultScanRetries is how many times a file that couldn't be scanned is
+// scanned again, about an hour, before it is quarantined
+const defaultScanRetries = 60
+
+// errClamdSizeLimit is clamd refusing a stream longer than its
+// StreamMaxLength
+var errClamdSizeLimit = errors.New("INSTREAM size limit exceeded")
+
+// What to do with a file clamd won't scan because it is too large
+const (
+	ScanSizeLimitReject = "reject"
+	ScanSizeLimitAllow  = "allow"
+)
+
+// ScanOptions checks matched files before their rule's action, with a
+// ClamAV daemon or a command. A rejected file goes to quarantine_dir
+// instead of its destination.
+type ScanOptions struct {
+	// Clamd is the clamd socket, "unix:///run/clamav/clamd.ctl" or
+	// "tcp://host:3310"; files are streamed to it, so it may run elsewhere
+	Clamd   string   `yaml:"clamd"`
+	Timeout Duration `yaml:"timeout"`
+
+	// OnSizeLimit is what happens to a file longer than clamd's
+	// StreamMaxLength: "reject" (the default) quarantines it, "allow" lets
+	// it pass unscanned
+	OnSizeLimit string `yaml:"on_size_limit"`
+
+	// MaxRetries is how many times a file that couldn't be scanned is
+	// scanned again before it is quarantined (default 60, a minute apart)
+	MaxRetries int `yaml:"max_retries"`
+
+	// Exec is a command that exits with 0 for files that may pass and with
+	// any other status to reject them
+	Exec *ExecAction `yaml:"exec"`
+}
+
+// validate checks the scan settings
+func (s *ScanOptions) validate() error {
+	if s == nil {
+		return nil
+	}
+	switch {
+	case (s.Clamd == "") == (s.Exec == nil):
+		return fmt.Errorf("scan needs one of clamd or exec")
+	case s.Exec != nil && len(s.Exec.Command) == 0:
+		return fmt.Errorf("scan.exec requires command")
+	case s.Timeout < 0:
+		return fmt.Errorf("scan.timeout must not be negative")
+	case s.MaxRetries < 0:
+		return fmt.Errorf("scan.max_retries must not be negative")
+	case s.OnSizeLimit != "" && s.OnSizeLimit != ScanSizeLimitReject && s.OnSizeLimit != ScanSizeLimitAllow:
+		return fmt.Errorf("unknown scan.on_size_limit %q", s.OnSizeLimit)
+	case s.OnSizeLimit != "" && s.Clamd == "":
+		return fmt.Errorf("scan.on_size_limit needs clamd")
+	}
+	if s.Clamd != "" {
+		if _, _, err := clamdAddress(s.Clamd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxRetries returns how many times a file that couldn't be scanned is
+// scanned again
+func (s *ScanOptions) maxRetries() int {
+	return cmp.Or(s.MaxRetries, defaultScanRetries)
+}
+
+// scanFor returns the scan that applies to rule: its own if set, otherwise
+// the global one. Deletes are never scanned.
+func (c *Config) scanFor(rule *Rule) *ScanOptions {
+	if rule.Action == ActionDelete {
+		return nil
+	}
+	if rule.Scan != nil {
+		return rule.Scan
+	}
+	return c.Scan
+}
+
+// scanFile scans a file, or every file in a directory, and returns an
+// error wrapping errRejected if one of them must not pass
+func scanFile(ctx context.Context, scan *ScanOptions, rule *Rule, path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return scanOne(ctx, scan, rule, path)
+	}
+	return filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := scanOne(ctx, scan, rule, file); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		return nil
+	})
+}
+
+// scanOne scans a single file
+func scanOne(ctx context.Context, scan *ScanOptions, rule *Rule, path string) error {
+	if scan.Exec != nil {
+		err := execCommand(scan.Exec, newTemplateData(path, rule))
+		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+			return fmt.Errorf("%w command %s: %s", errRejected, scan.Exec.Command[0], exitErr)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errScanFailed, err)
+		}
+		return nil
+	}
+
+	timeout := time.Duration(scan.Timeout)
+	if timeout == 0 {
+		timeout = defaultScanTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	threat, err := clamdScan(ctx, scan.Clamd, path)
+	if errors.Is(err, errClamdSizeLimit) {
+		if scan.OnSizeLimit == ScanSizeLimitAllow {
+			slog.Warn("File too large for clamd, passing it unscanned", "file", path, "rule", rule.Name)
+			return nil
+		}
+		return fmt.Errorf("%w, clamd: %w", errRejected, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w, clamd: %w", errScanFailed, err)
+	}
+	if threat != "" {
+		return fmt.Errorf("%w, clamd found %s", errRejected, threat)
+	}
+	return nil
+}
+
+// clamdAddress splits a clamd address into a network and address for
+// net.Dial. Bare paths are unix sockets, anything else a TCP address.
+func clamdAddress(address string) (network, addr string, err error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		addr = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	default:
+		addr = address
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid clamd address %q: %w", address, err)
+	}
+	return "tcp", addr, nil
+}
+
+// clamdScan streams a file to clamd with the INSTREAM command and returns
+// the name of the threat it found, or "" if the file is clean
+func clamdScan(ctx context.Context, address, path string) (string, error) {
+	network, addr, err := clamdAddress(address)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// clamd answers as soon as it rejects the stream, for instance when
+	// it exceeds StreamMaxLength, so a failed write still has a reply
+	writeErr := streamToClamd(conn, f)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	if reply == "" {
+		return "", cmp.Or(writeErr, err, errors.New("no reply"))
+	}
+
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.HasPrefix(reply, errClamdSizeLimit.Error()):
+		return "", errClamdSizeLimit
+	default:
+		return "", errors.New(reply)
+	}
+}
+
+// streamToClamd sends the INSTREAM command and the file in chunks, each
+// preceded by its length, ending with an empty chunk
+func streamToClamd(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunk)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,257 @@
+package fwatch
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeClamd serves the INSTREAM command on a unix socket. reply gets the
+// stream received so far after each chunk and returns the reply once it
+// has one; clamd stops reading there, as it does for a stream that is too
+// long. It returns the socket's address.
+func fakeClamd(t *testing.T, reply func(stream []byte, done bool) string) string {
+	t.Helper()
+	// Unix socket paths are short, too short for t.TempDir on some systems
+	dir, err := os.MkdirTemp("", "clamd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "clamd.ctl")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(t, conn, reply)
+		}
+	}()
+	return "unix://" + socket
+}
+
+func serveClamd(t *testing.T, conn net.Conn, reply func(stream []byte, done bool) string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+		t.Errorf("command = %q, %v; want zINSTREAM", command, err)
+		return
+	}
+	var stream []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			t.Errorf("reading chunk size: %v", err)
+			return
+		}
+		if size > clamdChunk {
+			t.Errorf("chunk of %d bytes, want at most %d", size, clamdChunk)
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			t.Errorf("reading chunk: %v", err)
+			return
+		}
+		stream = append(stream, chunk...)
+		if answer := reply(stream, size == 0); answer != "" {
+			io.WriteString(conn, answer+"\x00")
+			return
+		}
+		if size == 0 {
+			return
+		}
+	}
+}
+
+// scanned writes a file of size bytes for clamdScan
+func scanned(t *testing.T, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "download.zip")
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClamdScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		threat  string
+		wantErr error
+	}{
+		{"clean", "stream: OK", "", nil},
+		{"infected", "stream: Eicar-Signature FOUND", "Eicar-Signature", nil},
+		{"size limit", "INSTREAM size limit exceeded. ERROR", "", errClamdSizeLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const size = 3*clamdChunk + 100
+			var received int
+			address := fakeClamd(t, func(stream []byte, done bool) string {
+				received = len(stream)
+				if done {
+					return tt.reply
+				}
+				return ""
+			})
+			threat, err := clamdScan(context.Background(), address, scanned(t, size))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if threat != tt.threat {
+				t.Errorf("threat = %q, want %q", threat, tt.threat)
+			}
+			if received != size {
+				t.Errorf("clamd received %d bytes, want %d", received, size)
+			}
+		})
+	}
+}
+
+func TestClamdScanSizeLimitMidStream(t *testing.T) {
+	// clamd answers and hangs up as soon as the stream is too long
+	address := fakeClamd(t, func(stream []byte, done bool) string {
+		if len(stream) >= clamdChunk {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		return ""
+	})
+	if _, err := clamdScan(context.Background(), address, scanned(t, 64*clamdChunk)); !errors.Is(err, errClamdSizeLimit) {
+		t.Errorf("err = %v, want the size limit", err)
+	}
+}
+
+func TestClamdScanErrors(t *testing.T) {
+	address := fakeClamd(t, func(stream []byte, done bool) string {
+		if done {
+			return "stream: Can't allocate memory ERROR"
+		}
+		return ""
+	})
+	if _, err := clamdScan(context.Background(), address, scanned(t, 10)); err == nil || errors.Is(err, errClamdSizeLimit) {
+		t.Errorf("err = %v, want clamd's error", err)
+	}
+
+	silent := fakeClamd(t, func([]byte, bool) string { return "" })
+	if _, err := clamdScan(context.Background(), silent, scanned(t, 10)); err == nil {
+		t.Error("clamdScan succeeded without a reply")
+	}
+}
+
+func TestScanOneSizeLimit(t *testing.T) {
+	address := fakeClamd(t, func(stream []byte, done bool) string {
+		return "INSTREAM size limit exceeded. ERROR"
+	})
+	rule := &Rule{Name: "downloads"}
+	path := scanned(t, 10)
+
+	err := scanOne(context.Background(), &ScanOptions{Clamd: address}, rule, path)
+	if !errors.Is(err, errRejected) {
+		t.Errorf("err = %v by default, want the file rejected", err)
+	}
+	err = scanOne(context.Background(), &ScanOptions{Clamd: address, OnSizeLimit: ScanSizeLimitReject}, rule, path)
+	if !errors.Is(err, errRejected) {
+		t.Errorf("err = %v with reject, want the file rejected", err)
+	}
+	if err := scanOne(context.Background(), &ScanOptions{Clamd: address, OnSizeLimit: ScanSizeLimitAllow}, rule, path); err != nil {
+		t.Errorf("err = %v with allow, want the file passed", err)
+	}
+}
+
+func TestScanOneUnreachable(t *testing.T) {
+	scan := &ScanOptions{Clamd: "unix://" + filepath.Join(t.TempDir(), "missing.ctl")}
+	if err := scanOne(context.Background(), scan, &Rule{}, scanned(t, 10)); !errors.Is(err, errScanFailed) {
+		t.Errorf("err = %v, want a failed scan", err)
+	}
+}
+
+func TestScanRetriesThenQuarantines(t *testing.T) {
+	dir, dest, quarantineDir := t.TempDir(), t.TempDir(), t.TempDir()
+	path := filepath.Join(dir, "download.zip")
+	writeFile(t, path, "data")
+	e, err := New(Config{
+		Watches:       []Watch{{Path: dir}},
+		Rules:         []Rule{{Regex: ".", Destination: dest}},
+		QuarantineDir: quarantineDir,
+		Scan:          &ScanOptions{Clamd: "unix://" + filepath.Join(t.TempDir(), "missing.ctl"), MaxRetries: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.tracer = noop.NewTracerProvider().Tracer(tracerName)
+
+	// The first scan and the first retry leave the file waiting, the last
+	// retry quarantines it
+	for range 2 {
+		e.processFile(path, jobTiming{})
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("file gone before the retries ran out: %v", err)
+		}
+	}
+	e.processFile(path, jobTiming{})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still in the watch after the retries ran out: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(quarantineDir, "download.zip")); err != nil {
+		t.Errorf("file not quarantined: %v", err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Errorf("unscanned file reached the destination")
+	}
+}
+
+func TestClamdAddress(t *testing.T) {
+	tests := []struct {
+		address, network, addr string
+		valid                  bool
+	}{
+		{"unix:///run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl", true},
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl", true},
+		{"tcp://scanner:3310", "tcp", "scanner:3310", true},
+		{"scanner:3310", "tcp", "scanner:3310", true},
+		{"tcp://scanner", "", "", false},
+	}
+	for _, tt := range tests {
+		network, addr, err := clamdAddress(tt.address)
+		if (err == nil) != tt.valid || network != tt.network || addr != tt.addr {
+			t.Errorf("clamdAddress(%q) = %q, %q, %v", tt.address, network, addr, err)
+		}
+	}
+}
+
+func TestScanOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		scan  ScanOptions
+		valid bool
+	}{
+		{"clamd", ScanOptions{Clamd: "/run/clamav/clamd.ctl", OnSizeLimit: ScanSizeLimitAllow, MaxRetries: 5}, true},
+		{"neither", ScanOptions{}, false},
+		{"unknown size limit", ScanOptions{Clamd: "/run/clamav/clamd.ctl", OnSizeLimit: "skip"}, false},
+		{"size limit without clamd", ScanOptions{Exec: &ExecAction{Command: []string{"check"}}, OnSizeLimit: ScanSizeLimitAllow}, false},
+		{"negative retries", ScanOptions{Clamd: "/run/clamav/clamd.ctl", MaxRetries: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.scan.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: validate = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
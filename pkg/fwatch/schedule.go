@@ -0,0 +1,147 @@
+package fwatch
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Schedule restricts when a rule's action runs. It is a set of daily time
+// windows such as "22:00-06:00" and standard five-field cron expressions,
+// each of which is open during every minute it matches; the schedule is
+// open when any of them is.
+type Schedule struct {
+	specs   []string
+	windows []timeWindow
+	crons   []cron.Schedule
+}
+
+// timeWindow is a daily window in minutes since midnight. An end before
+// the start wraps past midnight.
+type timeWindow struct {
+	start, end int
+}
+
+// ParseSchedule parses schedule specs, each a time window or a cron
+// expression
+func ParseSchedule(specs ...string) (*Schedule, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	s := &Schedule{specs: specs}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if window, ok, err := parseTimeWindow(spec); ok {
+			if err != nil {
+				return nil, err
+			}
+			s.windows = append(s.windows, window)
+			continue
+		}
+		sched, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		s.crons = append(s.crons, sched)
+	}
+	return s, nil
+}
+
+// parseTimeWindow parses "HH:MM-HH:MM". ok is false if spec doesn't have
+// that shape, so it can be tried as a cron expression instead.
+func parseTimeWindow(spec string) (w timeWindow, ok bool, err error) {
+	from, to, found := strings.Cut(spec, "-")
+	if !found || !strings.Contains(from, ":") || !strings.Contains(to, ":") {
+		return w, false, nil
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return w, true, fmt.Errorf("invalid schedule window %q: %w", spec, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return w, true, fmt.Errorf("invalid schedule window %q: %w", spec, err)
+	}
+	w = timeWindow{start: start.Hour()*60 + start.Minute(), end: end.Hour()*60 + end.Minute()}
+	if w.start == w.end {
+		return w, true, fmt.Errorf("invalid schedule window %q: start and end are equal", spec)
+	}
+	return w, true, nil
+}
+
+// contains reports whether the window is open at t
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// next returns the next time the window opens after t
+func (w timeWindow) next(t time.Time) time.Time {
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+// Open reports whether the schedule allows running at t
+func (s *Schedule) Open(t time.Time) bool {
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	minute := t.Truncate(time.Minute)
+	for _, c := range s.crons {
+		if c.Next(minute.Add(-time.Nanosecond)).Equal(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next time after t at which the schedule opens
+func (s *Schedule) Next(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range s.windows {
+		if n := w.next(t); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	for _, c := range s.crons {
+		if n := c.Next(t); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+// String returns the schedule's specs
+func (s *Schedule) String() string {
+	return strings.Join(s.specs, ", ")
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, accepting a single spec or a
+// list of specs
+func (s *Schedule) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if value.Kind == yaml.SequenceNode {
+		if err := value.Decode(&specs); err != nil {
+			return err
+		}
+	} else {
+		specs = []string{value.Value}
+	}
+	parsed, err := ParseSchedule(specs...)
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
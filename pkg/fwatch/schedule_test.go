@@ -0,0 +1,90 @@
+package fwatch
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns hour:minute on a fixed Tuesday, in UTC
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 5, 14, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		at    time.Time
+		want  bool
+	}{
+		{"inside a window", []string{"09:00-17:00"}, at(12, 0), true},
+		{"window start", []string{"09:00-17:00"}, at(9, 0), true},
+		{"window end", []string{"09:00-17:00"}, at(17, 0), false},
+		{"last minute of a window", []string{"09:00-17:00"}, at(16, 59), true},
+		{"before a window", []string{"09:00-17:00"}, at(8, 59), false},
+		{"crossing midnight, late", []string{"22:00-06:00"}, at(23, 30), true},
+		{"crossing midnight, early", []string{"22:00-06:00"}, at(5, 59), true},
+		{"crossing midnight, end", []string{"22:00-06:00"}, at(6, 0), false},
+		{"crossing midnight, daytime", []string{"22:00-06:00"}, at(12, 0), false},
+		{"cron minute", []string{"30 2 * * *"}, at(2, 30).Add(45 * time.Second), true},
+		{"cron next minute", []string{"30 2 * * *"}, at(2, 31), false},
+		{"cron weekday", []string{"* * * * 2"}, at(10, 0), true}, // a Tuesday
+		{"cron other weekday", []string{"* * * * 1"}, at(10, 0), false},
+		{"any spec", []string{"09:00-10:00", "0 12 * * *"}, at(12, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.specs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Open(tt.at); got != tt.want {
+				t.Errorf("Open(%s) = %t, want %t", tt.at.Format("15:04:05"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		at    time.Time
+		want  time.Time
+	}{
+		{"later today", []string{"22:00-06:00"}, at(12, 0), at(22, 0)},
+		{"at the start", []string{"22:00-06:00"}, at(22, 0), at(22, 0).AddDate(0, 0, 1)},
+		{"after midnight", []string{"22:00-06:00"}, at(23, 0), at(22, 0).AddDate(0, 0, 1)},
+		{"cron", []string{"30 2 * * *"}, at(12, 0), at(2, 30).AddDate(0, 0, 1)},
+		{"earliest spec", []string{"22:00-06:00", "0 18 * * *"}, at(12, 0), at(18, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.specs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(tt.at); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+	}{
+		{"empty", nil},
+		{"equal start and end", []string{"08:00-08:00"}},
+		{"bad hour", []string{"25:00-06:00"}},
+		{"bad cron", []string{"* * *"}},
+		{"one bad spec", []string{"22:00-06:00", "every night"}},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSchedule(tt.specs...); err == nil {
+			t.Errorf("%s: ParseSchedule(%q) succeeded", tt.name, tt.specs)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package fwatch
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSFTPPort    = "22"
+	defaultSSHTimeout  = 30 * time.Second
+	sftpIdleClients    = 4
+	sftpTempFilePrefix = ".fwatch-upload-"
+)
+
+// sftpTarget is a parsed sftp:// destination
+type sftpTarget struct {
+	user, password string
+	addr           string // host:port
+	dir            string
+}
+
+// isSFTPURL reports whether a destination is an sftp:// URL
+func isSFTPURL(dest string) bool {
+	u, err := url.Parse(dest)
+	return err == nil && u.Scheme == "sftp"
+}
+
+// parseSFTPURL parses "sftp://user@host:port/path". A path starting with
+// "/~/" is relative to the user's home directory.
+func parseSFTPURL(dest string) (sftpTarget, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return sftpTarget{}, err
+	}
+	if u.Hostname() == "" {
+		return sftpTarget{}, fmt.Errorf("missing host in %q", dest)
+	}
+	t := sftpTarget{
+		addr: net.JoinHostPort(u.Hostname(), cmp.Or(u.Port(), defaultSFTPPort)),
+		dir:  u.Path,
+	}
+	if u.User != nil {
+		t.user = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+	if t.user == "" {
+		t.user = os.Getenv("USER")
+	}
+	if rest, ok := strings.CutPrefix(t.dir, "/~/"); ok {
+		t.dir = rest
+	} else if t.dir == "" || t.dir == "/~" {
+		t.dir = "."
+	}
+	return t, nil
+}
+
+// sftpPool keeps SSH connections open between uploads, one per user and
+// host, with a few idle SFTP sessions on each
+type sftpPool struct {
+	mu    sync.Mutex
+	conns map[string]*sftpConn
+}
+
+// sftpConn is a pooled SSH connection
+type sftpConn struct {
+	ssh  *ssh.Client
+	idle []*sftp.Client
+}
+
+// get returns an SFTP session for the target, dialing if needed. reused is
+// true if the session was idle in the pool, so it may have gone stale.
+func (p *sftpPool) get(t sftpTarget, opts *UploadOptions) (client *sftp.Client, reused bool, err error) {
+	key := t.user + "@" + t.addr
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn := p.conns[key]
+	if conn != nil && len(conn.idle) > 0 {
+		client = conn.idle[len(conn.idle)-1]
+		conn.idle = conn.idle[:len(conn.idle)-1]
+		return client, true, nil
+	}
+	if conn == nil {
+		sshClient, err := dialSSH(t, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		conn = &sftpConn{ssh: sshClient}
+		if p.conns == nil {
+			p.conns = make(map[string]*sftpConn)
+		}
+		p.conns[key] = conn
+		reused = false
+	} else {
+		reused = true
+	}
+
+	client, err = sftp.NewClient(conn.ssh)
+	if err != nil {
+		// The connection is unusable; drop it so the next call redials
+		conn.ssh.Close()
+		delete(p.conns, key)
+		return nil, false, fmt.Errorf("starting sftp session: %w", err)
+	}
+	return client, reused, nil
+}
+
+// put returns a session to the pool, or closes it (and its connection, if
+// that is broken) after a failure
+func (p *sftpPool) put(t sftpTarget, client *sftp.Client, failed bool) {
+	key := t.user + "@" + t.addr
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn := p.conns[key]
+	if conn == nil {
+		client.Close()
+		return
+	}
+	if failed {
+		client.Close()
+		if _, _, err := conn.ssh.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			p.dropLocked(key)
+		}
+		return
+	}
+	if len(conn.idle) >= sftpIdleClients {
+		client.Close()
+		return
+	}
+	conn.idle = append(conn.idle, client)
+}
+
+// drop closes the connection for a target
+func (p *sftpPool) drop(t sftpTarget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropLocked(t.user + "@" + t.addr)
+}
+
+// dropLocked closes a connection; p.mu must be held
+func (p *sftpPool) dropLocked(key string) {
+	conn := p.conns[key]
+	if conn == nil {
+		return
+	}
+	for _, c := range conn.idle {
+		c.Close()
+	}
+	conn.ssh.Close()
+	delete(p.conns, key)
+}
+
+// close closes every pooled connection
+func (p *sftpPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.conns {
+		p.dropLocked(key)
+	}
+}
+
+// dialSSH connects and authenticates to the target's server
+func dialSSH(t sftpTarget, opts *UploadOptions) (*ssh.Client, error) {
+	hostKeys, err := hostKeyCallback(opts)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := sshAuthMethods(t, opts)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            t.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         cmp.Or(time.Duration(opts.Timeout), defaultSSHTimeout),
+	}
+	client, err := ssh.Dial("tcp", t.addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", t.addr, err)
+	}
+	return client, nil
+}
+
+// hostKeyCallback verifies server host keys against known_hosts files,
+// unless verification is explicitly disabled
+func hostKeyCallback(opts *UploadOptions) (ssh.HostKeyCallback, error) {
+	if opts.InsecureIgnoreHostKey {
+		slog.Warn("SFTP host key verification is disabled")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	files := opts.KnownHosts
+	if len(files) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("locating known_hosts: %w", err)
+		}
+		files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("loading known_hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// sshAuthMethods returns the ways to authenticate: the URL's password, the
+// SSH agent, and the configured or default identity files
+func sshAuthMethods(t sftpTarget, opts *UploadOptions) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if t.password != "" {
+		methods = append(methods, ssh.Password(t.password))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	files := []string{opts.IdentityFile}
+	if opts.IdentityFile == "" {
+		files = nil
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				files = append(files, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if opts.IdentityFile != "" {
+				return nil, fmt.Errorf("reading identity file: %w", err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			if opts.IdentityFile != "" {
+				return nil, fmt.Errorf("parsing identity file %s: %w", file, err)
+			}
+			slog.Debug("Skipping unusable SSH key", "file", file, "error", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH credentials: set upload.identity_file, run an SSH agent or put a password in the URL")
+	}
+	return methods, nil
+}
+
+// uploadToSFTP uploads a matched file to the rule's sftp:// destination.
+// The file is written under a temporary name and renamed into place, so
+// the server never shows a partial file under its final name. A stale
+// pooled connection is retried once on a fresh one.
+func (e *Engine) uploadToSFTP(filePath string, rule *Rule, limits *limiter) (destURL, skipReason string, err error) {
+	t, err := parseSFTPURL(rule.Destination)
+	if err != nil {
+		return "", "", err
+	}
+	opts := rule.Upload
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+
+	release := limits.acquireCopy()
+	defer release()
+
+	for attempt := 1; ; attempt++ {
+		client, reused, err := e.sftp.get(t, opts)
+		if err != nil {
+			return "", "", err
+		}
+		remotePath, skipReason, err := sftpPut(client, t, filePath, rule, limits)
+		e.sftp.put(t, client, err != nil)
+		if err != nil && reused && attempt == 1 && isConnectionError(err) {
+			slog.Debug("Retrying SFTP upload on a new connection", "file", filePath, "error", err)
+			e.sftp.drop(t)
+			continue
+		}
+		if err != nil || remotePath == "" {
+			return "", skipReason, err
+		}
+		if skipReason != "" {
+			slog.Info("Resolved destination conflict", "file", filePath, "rule", rule.Name,
+				"policy", rule.conflictPolicy(), "reason", skipReason, "dest_path", remotePath)
+		}
+
+		destURL = "sftp://" + t.user + "@" + t.addr + path.Join("/", remotePath)
+		if opts.DeleteSource {
+			if err := os.Remove(filePath); err != nil {
+				return destURL, "", fmt.Errorf("removing source file: %w", err)
+			}
+		}
+		return destURL, "", nil
+	}
+}
+
+// sftpPut uploads one file over a session and returns its remote path, or
+// an empty path and the reason if it was skipped. If the path differs from
+// the preferred one, the reason says why.
+func sftpPut(client *sftp.Client, t sftpTarget, filePath string, rule *Rule, limits *limiter) (string, string, error) {
+	if err := client.MkdirAll(t.dir); err != nil {
+		return "", "", fmt.Errorf("creating remote directory: %w", err)
+	}
+
+	name, err := rule.destName(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	remotePath := path.Join(t.dir, name)
+	if dir := path.Dir(remotePath); dir != t.dir {
+		// The filename template put the file in subdirectories
+		if err := client.MkdirAll(dir); err != nil {
+			return "", "", fmt.Errorf("creating remote directory: %w", err)
+		}
+	}
+	exists := func(p string) (bool, error) {
+		_, err := client.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	wanted := remotePath
+	resolve := func() (string, string, error) {
+		taken, err := exists(wanted)
+		if err != nil {
+			return "", "", fmt.Errorf("checking destination: %w", err)
+		}
+		if !taken {
+			return wanted, "", nil
+		}
+		remotePath, reason, err := resolveRemoteConflict(wanted, rule.conflictPolicy(), rule.conflictSuffix(), exists, nil)
+		if err != nil {
+			return "", "", fmt.Errorf("resolving destination conflict: %w", err)
+		}
+		return remotePath, reason, nil
+	}
+	remotePath, reason, err := resolve()
+	if err != nil || remotePath == "" {
+		return "", reason, err
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("opening source file: %w", err)
+	}
+	defer src.Close()
+
+	// A name of its own, so uploads racing for the same name can't write
+	// into each other's file
+	tmpPath := path.Join(path.Dir(remotePath), fmt.Sprintf("%s%d-%s", sftpTempFilePrefix, rand.Int64(), path.Base(remotePath)))
+	dst, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return "", "", fmt.Errorf("creating remote file: %w", err)
+	}
+	if _, err := io.Copy(dst, limits.reader(src)); err != nil {
+		dst.Close()
+		client.Remove(tmpPath)
+		return "", "", fmt.Errorf("uploading: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		client.Remove(tmpPath)
+		return "", "", fmt.Errorf("finishing upload: %w", err)
+	}
+
+	replace := rule.conflictPolicy() == ConflictOverwrite
+	for attempt := 1; ; attempt++ {
+		err := sftpPlace(client, tmpPath, remotePath, replace)
+		if err == nil {
+			return remotePath, reason, nil
+		}
+		// Plain rename fails on a name another upload took since it was
+		// resolved; resolve it again
+		if taken, _ := exists(remotePath); !taken || replace || attempt == maxPlaceAttempts {
+			client.Remove(tmpPath)
+			return "", "", fmt.Errorf("renaming uploaded file: %w", err)
+		}
+		slog.Debug("Destination was taken while placing file, resolving again", "file", filePath, "dest_path", remotePath)
+		if remotePath, reason, err = resolve(); err != nil || remotePath == "" {
+			client.Remove(tmpPath)
+			return "", reason, err
+		}
+	}
+}
+
+// sftpPlace renames an uploaded file into place. Only with replace is a
+// file already there replaced, with posix-rename, which does so
+// atomically, or plain rename on servers without the extension; plain
+// rename fails on an existing file.
+func sftpPlace(client *sftp.Client, tmpPath, remotePath string, replace bool) error {
+	if replace {
+		if err := client.PosixRename(tmpPath, remotePath); err == nil {
+			return nil
+		}
+	}
+	return client.Rename(tmpPath, remotePath)
+}
+
+// isConnectionError reports whether err means the SSH connection itself
+// failed rather than an operation on it
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+// validateSFTPURL checks that an sftp:// destination can be parsed
+func validateSFTPURL(dest string) error {
+	if _, err := parseSFTPURL(dest); err != nil {
+		return fmt.Errorf("invalid destination: %w", err)
+	}
+	return nil
+}
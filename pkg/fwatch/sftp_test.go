@@ -0,0 +1,129 @@
+package fwatch
+
+import (
+	"io"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// memorySFTP returns a client of an in-memory SFTP server
+func memorySFTP(t *testing.T) *sftp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+// remoteFile returns the contents of a file on the server
+func remoteFile(t *testing.T, client *sftp.Client, p string) string {
+	t.Helper()
+	f, err := client.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSFTPPutConcurrent(t *testing.T) {
+	client := memorySFTP(t)
+	target := sftpTarget{dir: "/incoming"}
+	rule := &Rule{OnConflict: ConflictNumbered}
+
+	// Uploads racing for the same name each end up under one of their own
+	const uploads = 10
+	paths := make([]string, uploads)
+	var wg sync.WaitGroup
+	for i := range uploads {
+		file := filepath.Join(t.TempDir(), "report.pdf")
+		writeFile(t, file, strconv.Itoa(i))
+		wg.Go(func() {
+			remotePath, _, err := sftpPut(client, target, file, rule, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = remotePath
+		})
+	}
+	wg.Wait()
+
+	for i, p := range paths {
+		if p == "" {
+			continue
+		}
+		if data := remoteFile(t, client, p); data != strconv.Itoa(i) {
+			t.Errorf("%s holds upload %s, want upload %d", p, data, i)
+		}
+	}
+	entries, err := client.ReadDir(target.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != uploads {
+		for _, entry := range entries {
+			t.Log(entry.Name())
+		}
+		t.Errorf("%d files on the server, want %d and no temporary files", len(entries), uploads)
+	}
+}
+
+func TestSFTPPutPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string // what the existing name holds afterwards
+		path   string // where the upload went, "" if skipped
+	}{
+		{ConflictOverwrite, "new", "/incoming/report.pdf"},
+		{ConflictSkip, "old", ""},
+		{ConflictNumbered, "old", "/incoming/report (1).pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			client := memorySFTP(t)
+			client.MkdirAll("/incoming")
+			f, err := client.Create("/incoming/report.pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(f, "old")
+			f.Close()
+
+			file := filepath.Join(t.TempDir(), "report.pdf")
+			writeFile(t, file, "new")
+			remotePath, _, err := sftpPut(client, sftpTarget{dir: "/incoming"}, file, &Rule{OnConflict: tt.policy}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remotePath != tt.path {
+				t.Errorf("uploaded to %q, want %q", remotePath, tt.path)
+			}
+			if data := remoteFile(t, client, "/incoming/report.pdf"); data != tt.want {
+				t.Errorf("existing name holds %q, want %q", data, tt.want)
+			}
+			if remotePath != "" && path.Base(remotePath) != "report.pdf" {
+				if data := remoteFile(t, client, remotePath); data != "new" {
+					t.Errorf("upload holds %q", data)
+				}
+			}
+		})
+	}
+}
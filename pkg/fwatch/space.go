@@ -0,0 +1,82 @@
+package fwatch
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// What to do with a file when its destination is low on space
+const (
+	LowSpaceWait = "wait"
+	LowSpaceSkip = "skip"
+	LowSpaceFail = "fail"
+)
+
+// lowSpacePolicies lists the valid on_low_space values
+var lowSpacePolicies = []string{LowSpaceWait, LowSpaceSkip, LowSpaceFail}
+
+// lowSpaceRecheckDelay is how long a file waits for space to be freed at
+// its destination before it is looked at again
+const lowSpaceRecheckDelay = time.Minute
+
+// errLowSpace is wrapped by the error returned when a destination has less
+// free space than the rule requires
+var errLowSpace = errors.New("not enough free space at destination")
+
+// validLowSpace checks an on_low_space value
+func validLowSpace(policy string) error {
+	if policy != "" && !slices.Contains(lowSpacePolicies, policy) {
+		return fmt.Errorf("unknown on_low_space policy %q", policy)
+	}
+	return nil
+}
+
+// minFreeSpace returns the free space a rule must leave at its destination
+func (c *Config) minFreeSpace(rule *Rule) ByteSize {
+	return cmp.Or(rule.MinFreeSpace, c.MinFreeSpace)
+}
+
+// onLowSpace returns what a rule does with files while its destination is
+// low on space
+func (c *Config) onLowSpace(rule *Rule) string {
+	return cmp.Or(rule.OnLowSpace, c.OnLowSpace, LowSpaceWait)
+}
+
+// checkFreeSpace returns an error wrapping errLowSpace if writing size
+// bytes from filePath to dir would leave less than the configured minimum
+// free on its filesystem. A move within a filesystem takes no space and is
+// always allowed.
+func checkFreeSpace(config *Config, rule *Rule, filePath, dir string, size int64) error {
+	minimum := config.minFreeSpace(rule)
+	if minimum <= 0 || isRemoteDestination(dir) {
+		return nil
+	}
+	// The destination may not have been created yet
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	if rule.Action != ActionCopy && rule.Action != ActionArchive && sameFilesystem(filePath, dir) {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		return fmt.Errorf("checking free space: %w", err)
+	}
+	if free-size < int64(minimum) {
+		return fmt.Errorf("%w: %s free on %s, %s needed for the file and %s to keep free",
+			errLowSpace, ByteSize(free), dir, ByteSize(size), minimum)
+	}
+	return nil
+}
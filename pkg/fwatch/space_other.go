@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package fwatch
+
+import "errors"
+
+// freeSpace is not supported on this platform, so min_free_space is not
+// checked
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// sameFilesystem is not known on this platform
+func sameFilesystem(a, b string) bool {
+	return false
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package fwatch
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem dir is on
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// sameFilesystem reports whether a and b are on the same filesystem, so a
+// rename between them takes no space
+func sameFilesystem(a, b string) bool {
+	devA, errA := deviceOf(a)
+	devB, errB := deviceOf(b)
+	return errA == nil && errB == nil && devA == devB
+}
@@ -0,0 +1,29 @@
+package fwatch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// freeSpace returns the bytes available to the user on the volume dir is
+// on, taking quotas into account
+func freeSpace(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(longPath(dir))
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return 0, &os.PathError{Op: "GetDiskFreeSpaceEx", Path: dir, Err: err}
+	}
+	return int64(available), nil
+}
+
+// sameFilesystem reports whether a and b are on the same volume, so a
+// rename between them takes no space
+func sameFilesystem(a, b string) bool {
+	return strings.EqualFold(filepath.VolumeName(a), filepath.VolumeName(b))
+}
@@ -0,0 +1,207 @@
+package fwatch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// spillJournal is the file in queue_dir listing the paths the queue
+	// overflowed with, one quoted path per line in the order queued
+	spillJournal = "queue"
+
+	// spillOffset is the file in queue_dir holding how far the journal has
+	// been read back
+	spillOffset = "queue.offset"
+)
+
+// spillQueue is a journal on disk that the worker pool's queue overflows
+// into, read back in order as workers free up. Paths still in it when
+// fwatch stops are processed after the next start.
+type spillQueue struct {
+	dir string
+
+	mu      sync.Mutex
+	journal *os.File
+	offsets *os.File
+	offset  int64         // start of the first path not handed to the queue
+	pending int           // paths from offset on
+	wake    chan struct{} // signalled when a path is added
+
+	// Only used by the goroutine that reads paths back
+	reader  *bufio.Reader
+	readPos int64
+}
+
+// openSpillQueue opens the journal in dir, creating it if needed. It
+// returns nil if dir is empty.
+func openSpillQueue(dir string) (*spillQueue, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(filepath.Join(dir, spillJournal), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := os.OpenFile(filepath.Join(dir, spillOffset), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	s := &spillQueue{dir: dir, journal: journal, offsets: offsets, wake: make(chan struct{}, 1)}
+
+	data, err := io.ReadAll(offsets)
+	if err == nil && len(data) > 0 {
+		s.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	info, statErr := journal.Stat()
+	if err != nil || statErr != nil || s.offset > info.Size() {
+		slog.Warn("Queue offset is unreadable, processing the saved queue from the start", "queue_dir", dir)
+		s.offset = 0
+	}
+	s.readPos = s.offset
+	s.reader = bufio.NewReader(io.NewSectionReader(journal, s.offset, 1<<62))
+	return s, nil
+}
+
+// saved returns the paths left in the journal from the last run and counts
+// them as pending. A line cut short by a crash is dropped.
+func (s *spillQueue) saved() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := bufio.NewReader(io.NewSectionReader(s.journal, s.offset, 1<<62))
+	var paths []string
+	lines := 0
+	end := s.offset
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end += int64(len(line))
+		lines++
+		if path, err := strconv.Unquote(strings.TrimSuffix(line, "\n")); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	// Appends go after the last complete line
+	if lines == 0 {
+		s.offset, s.readPos, end = 0, 0, 0
+		s.reader.Reset(io.NewSectionReader(s.journal, 0, 1<<62))
+	}
+	if err := s.journal.Truncate(end); err != nil {
+		return nil, err
+	}
+	s.pending = lines
+	return paths, nil
+}
+
+// len returns the number of paths waiting in the journal
+func (s *spillQueue) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// push appends paths to the journal
+func (s *spillQueue) push(paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, path := range paths {
+		b.WriteString(strconv.Quote(path))
+		b.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := s.journal.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.WriteAt([]byte(b.String()), info.Size()); err != nil {
+		return fmt.Errorf("writing %s: %w", s.journal.Name(), err)
+	}
+	s.pending += len(paths)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next returns the oldest path in the journal without removing it, waiting
+// for one to be added. It returns false once ctx is cancelled.
+func (s *spillQueue) next(ctx context.Context) (string, bool) {
+	for {
+		s.mu.Lock()
+		pending := s.pending
+		s.mu.Unlock()
+		if pending > 0 {
+			line, err := s.reader.ReadString('\n')
+			if err == nil {
+				s.readPos += int64(len(line))
+				path, err := strconv.Unquote(strings.TrimSuffix(line, "\n"))
+				if err == nil {
+					return path, true
+				}
+				slog.Warn("Dropping unreadable entry from the saved queue", "queue_dir", s.dir, "entry", line)
+				s.commit()
+				continue
+			}
+			// The line was being written as it was read; read it again
+			s.reader.Reset(io.NewSectionReader(s.journal, s.readPos, 1<<62))
+			if line != "" {
+				continue
+			}
+		}
+		select {
+		case <-s.wake:
+		case <-ctx.Done():
+			return "", false
+		}
+	}
+}
+
+// commit removes the path last returned by next, once it is in the queue.
+// An emptied journal is truncated, so it only grows during a burst.
+func (s *spillQueue) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = s.readPos
+	s.pending--
+	if s.pending == 0 {
+		if err := s.journal.Truncate(0); err == nil {
+			s.offset, s.readPos = 0, 0
+			s.reader.Reset(io.NewSectionReader(s.journal, 0, 1<<62))
+		}
+	}
+	if _, err := s.offsets.WriteAt([]byte(fmt.Sprintf("%020d\n", s.offset)), 0); err != nil {
+		slog.Warn("Failed to save queue offset", "queue_dir", s.dir, "error", err)
+	}
+}
+
+// close flushes the journal to disk and closes it
+func (s *spillQueue) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal.Sync()
+	s.offsets.Sync()
+	s.journal.Close()
+	s.offsets.Close()
+}
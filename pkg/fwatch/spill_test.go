@@ -0,0 +1,164 @@
+package fwatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// drain reads n paths back from the journal, committing each
+func drain(t *testing.T, s *spillQueue, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var paths []string
+	for range n {
+		path, ok := s.next(ctx)
+		if !ok {
+			t.Fatalf("got %d of %d paths", len(paths), n)
+		}
+		s.commit()
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestSpillQueueOrder(t *testing.T) {
+	s, err := openSpillQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	paths := []string{"/watch/a.pdf", "/watch/with space.txt", "/watch/new\nline", `/watch/quote".txt`}
+	if err := s.push(paths[:2]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.push(paths[2:]...); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.len(); n != len(paths) {
+		t.Errorf("len = %d, want %d", n, len(paths))
+	}
+	if got := drain(t, s, len(paths)); !slices.Equal(got, paths) {
+		t.Errorf("read back %q, want %q", got, paths)
+	}
+	if n := s.len(); n != 0 {
+		t.Errorf("len = %d once drained, want 0", n)
+	}
+
+	// An emptied journal is truncated
+	info, err := os.Stat(filepath.Join(s.dir, spillJournal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("journal is %d bytes once drained, want 0", info.Size())
+	}
+}
+
+func TestSpillQueueNextWaits(t *testing.T) {
+	s, err := openSpillQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.push("/watch/late.pdf")
+	}()
+	if got := drain(t, s, 1); got[0] != "/watch/late.pdf" {
+		t.Errorf("next = %q, want the path pushed later", got[0])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := s.next(ctx); ok {
+		t.Error("next returned a path from an empty journal after cancel")
+	}
+}
+
+func TestSpillQueueResumes(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpillQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.push("/watch/1", "/watch/2", "/watch/3")
+	drain(t, s, 1)
+	s.close()
+
+	s, err = openSpillQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	saved, err := s.saved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/watch/2", "/watch/3"}; !slices.Equal(saved, want) {
+		t.Errorf("saved = %q, want %q", saved, want)
+	}
+	if n := s.len(); n != 2 {
+		t.Errorf("len = %d, want 2", n)
+	}
+	if got := drain(t, s, 2); !slices.Equal(got, saved) {
+		t.Errorf("read back %q, want %q", got, saved)
+	}
+}
+
+func TestSpillQueueDropsTornLine(t *testing.T) {
+	dir := t.TempDir()
+	journal := `"/watch/1"` + "\n" + `"/watch/2"` + "\n" + `"/watch/cut sho`
+	if err := os.WriteFile(filepath.Join(dir, spillJournal), []byte(journal), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpillQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	saved, err := s.saved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/watch/1", "/watch/2"}; !slices.Equal(saved, want) {
+		t.Errorf("saved = %q, want %q", saved, want)
+	}
+
+	// New paths go after the last complete line
+	s.push("/watch/3")
+	if got := drain(t, s, 3); !slices.Equal(got, []string{"/watch/1", "/watch/2", "/watch/3"}) {
+		t.Errorf("read back %q", got)
+	}
+}
+
+func TestSpillQueueBadOffset(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, spillJournal), []byte(`"/watch/1"`+"\n"), 0o600)
+	os.WriteFile(filepath.Join(dir, spillOffset), []byte("99999\n"), 0o600)
+	s, err := openSpillQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	saved, err := s.saved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(saved, []string{"/watch/1"}) {
+		t.Errorf("saved = %q, want the journal from the start", saved)
+	}
+}
+
+func TestOpenSpillQueueDisabled(t *testing.T) {
+	s, err := openSpillQueue("")
+	if s != nil || err != nil {
+		t.Errorf("openSpillQueue(\"\") = %v, %v; want nil, nil", s, err)
+	}
+}
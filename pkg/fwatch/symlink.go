@@ -0,0 +1,54 @@
+package fwatch
+
+import (
+	"cmp"
+	"os"
+)
+
+// Symlink policies for symbolic links found in watch directories
+const (
+	// SymlinksMoveAsLink treats a link as a file of its own: it is matched
+	// by its own size and age, and moved or copied as a link whose target
+	// is adjusted to keep pointing to the same file
+	SymlinksMoveAsLink = "move-as-link"
+
+	// SymlinksFollow treats a link as the file it points to: a move
+	// copies that file to the destination and removes the link, leaving
+	// the original in place
+	SymlinksFollow = "follow"
+
+	// SymlinksIgnore leaves links alone
+	SymlinksIgnore = "ignore"
+)
+
+// symlinkPolicies lists the valid symlinks values
+var symlinkPolicies = []string{SymlinksMoveAsLink, SymlinksFollow, SymlinksIgnore}
+
+// symlinkPolicy returns the symlink policy for files in a watch, which may
+// be nil
+func (c *Config) symlinkPolicy(watch *Watch) string {
+	if watch != nil && watch.Symlinks != "" {
+		return watch.Symlinks
+	}
+	return cmp.Or(c.Symlinks, SymlinksMoveAsLink)
+}
+
+// statFile returns the file info that rules are matched against: that of
+// the link itself or of the file it points to, depending on the symlink
+// policy. ignored is set for links the policy ignores. A dangling link is
+// reported as not existing when it is followed.
+func (c *Config) statFile(watch *Watch, filePath string) (info os.FileInfo, ignored bool, err error) {
+	info, err = os.Lstat(filePath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return info, false, err
+	}
+	switch c.symlinkPolicy(watch) {
+	case SymlinksIgnore:
+		return info, true, nil
+	case SymlinksFollow:
+		info, err = os.Stat(filePath)
+		return info, false, err
+	default:
+		return info, false, nil
+	}
+}
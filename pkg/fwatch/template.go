@@ -0,0 +1,80 @@
+package fwatch
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// templateData holds the variables available to templates in rule
+// configuration, such as exec arguments
+type templateData struct {
+	Path        string            // Full path of the matched file
+	Name        string            // File name including extension
+	Stem        string            // File name without extension
+	Ext         string            // Lowercased extension including the dot
+	Dir         string            // Directory containing the file
+	Destination string            // The rule's destination, if any
+	Checksum    string            // SHA-256 of the file, after a pipeline checksum step
+	Match       map[string]string // Named groups of the rule's regex in the file name
+	Dest        string            // Where the file went, in post and on_error hooks
+	Error       string            // Why the action failed, in on_error hooks
+	Date        string            // Current local date as YYYY-MM-DD
+	Now         time.Time         // Current local time, for custom formats
+
+	exif func() exifData // reads the file's metadata on first use
+}
+
+// Exif returns the photo or video metadata of the file, read when a
+// template first refers to it
+func (d templateData) Exif() exifData {
+	if d.exif == nil {
+		return exifData{}
+	}
+	return d.exif()
+}
+
+// newTemplateData builds the template variables for a matched file
+func newTemplateData(filePath string, rule *Rule) templateData {
+	name := filepath.Base(filePath)
+	ext := filepath.Ext(name)
+	now := time.Now()
+	return templateData{
+		Path:        filePath,
+		Name:        name,
+		Stem:        strings.TrimSuffix(name, ext),
+		Ext:         strings.ToLower(ext),
+		Dir:         filepath.Dir(filePath),
+		Destination: rule.Destination,
+		Match:       rule.nameGroups(name),
+		Date:        now.Format(time.DateOnly),
+		Now:         now,
+		exif:        sync.OnceValue(func() exifData { return readExif(filePath) }),
+	}
+}
+
+// sampleTemplateData returns empty template variables for checking the
+// rule's templates when the config is loaded, with the groups of its regex
+// defined so that a misspelt one is reported
+func (r *Rule) sampleTemplateData() templateData {
+	return templateData{Match: r.nameGroups("")}
+}
+
+// renderTemplate expands a Go text/template string with the given data.
+// Missing keys are reported as errors rather than rendered as "<no value>".
+func renderTemplate(text string, data any) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing template %q: %w", text, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("executing template %q: %w", text, err)
+	}
+	return buf.String(), nil
+}
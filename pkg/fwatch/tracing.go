@@ -0,0 +1,125 @@
+package fwatch
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of fwatch's spans
+const tracerName = "github.com/polarn/fwatch"
+
+const defaultTracingService = "fwatch"
+
+// TracingOptions configures OpenTelemetry tracing of file processing. Spans
+// are exported over OTLP/HTTP to Endpoint, or where the standard
+// OTEL_EXPORTER_OTLP_* environment variables point when it is empty.
+type TracingOptions struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio *float64          `yaml:"sample_ratio"`
+}
+
+// validate checks the tracing settings
+func (o *TracingOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Endpoint != "" {
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q, expected an http or https URL such as http://localhost:4318", o.Endpoint)
+		}
+	}
+	if o.SampleRatio != nil && (*o.SampleRatio < 0 || *o.SampleRatio > 1) {
+		return fmt.Errorf("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// newTracerProvider sets up a tracer provider exporting spans as configured.
+// Without options the global provider is used, which is a no-op unless a
+// program embedding the engine installed one.
+func newTracerProvider(ctx context.Context, opts *TracingOptions) (trace.TracerProvider, func(context.Context) error, error) {
+	if opts == nil {
+		return otel.GetTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	var exporterOpts []otlptracehttp.Option
+	if opts.Endpoint != "" {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	}
+	if len(opts.Headers) > 0 {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithHeaders(opts.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cmp.Or(opts.ServiceName, defaultTracingService)),
+		attribute.String("host.name", host),
+	))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating tracing resource: %w", err)
+	}
+
+	ratio := 1.0
+	if opts.SampleRatio != nil {
+		ratio = *opts.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+// startSpan starts a child of the span in ctx. Without one, the span is a
+// no-op, so code outside file processing pays nothing for tracing.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceWaits records the time a file spent settling and queued as children
+// of the span in ctx, after the fact
+func traceWaits(ctx context.Context, timing jobTiming, start time.Time) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	if !timing.event.IsZero() && !timing.queued.IsZero() {
+		_, span := tracer.Start(ctx, "fwatch.settle", trace.WithTimestamp(timing.event),
+			trace.WithAttributes(attribute.Int("fwatch.events", timing.events)))
+		span.End(trace.WithTimestamp(timing.queued))
+	}
+	if !timing.queued.IsZero() {
+		_, span := tracer.Start(ctx, "fwatch.queue", trace.WithTimestamp(timing.queued))
+		span.End(trace.WithTimestamp(start))
+	}
+}
@@ -0,0 +1,123 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Delete modes, for the delete action, duplicates: delete and retention
+const (
+	DeleteModePermanent = "permanent"
+	DeleteModeTrash     = "trash"
+)
+
+// trashExpiryInterval is how often expired files are purged from the
+// trash directory
+const trashExpiryInterval = time.Hour
+
+// errNoSystemTrash is returned when the platform has no trash a file can
+// be moved to
+var errNoSystemTrash = errors.New("no system trash available")
+
+// TrashOptions configures deleting to the trash
+type TrashOptions struct {
+	// Dir receives trashed files the system trash can't take, such as
+	// files on network shares, in a subdirectory per day
+	Dir string `yaml:"dir"`
+
+	// Expire removes files from Dir once they have been there this long;
+	// zero keeps them until removed by hand
+	Expire Duration `yaml:"expire"`
+}
+
+// validate checks the trash settings
+func (t *TrashOptions) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.Expire < 0 {
+		return fmt.Errorf("trash.expire must not be negative")
+	}
+	if t.Expire > 0 && t.Dir == "" {
+		return fmt.Errorf("trash.expire needs trash.dir")
+	}
+	return nil
+}
+
+// validDeleteMode checks a delete_mode value
+func validDeleteMode(mode string) error {
+	if mode != "" && mode != DeleteModePermanent && mode != DeleteModeTrash {
+		return fmt.Errorf("unknown delete_mode %q (want %s or %s)", mode, DeleteModePermanent, DeleteModeTrash)
+	}
+	return nil
+}
+
+// deleteFile removes a file or, in trash mode, moves it to the trash. It
+// returns where the file went, which is empty if it was removed or the
+// trash doesn't say.
+func deleteFile(trash *TrashOptions, path, mode string) (string, error) {
+	if mode != DeleteModeTrash {
+		return "", os.Remove(path)
+	}
+
+	dest, err := systemTrash(path)
+	if err == nil {
+		return dest, nil
+	}
+	if trash == nil || trash.Dir == "" {
+		return "", fmt.Errorf("moving to trash: %w", err)
+	}
+	slog.Debug("System trash unavailable, using trash directory", "file", path, "trash_dir", trash.Dir, "error", err)
+	return trashToDir(trash.Dir, path)
+}
+
+// trashToDir moves a file into today's subdirectory of dir
+func trashToDir(dir, path string) (string, error) {
+	day := filepath.Join(dir, time.Now().Format(time.DateOnly))
+	if err := os.MkdirAll(day, 0o700); err != nil {
+		return "", fmt.Errorf("creating trash directory: %w", err)
+	}
+	target := filepath.Join(day, filepath.Base(path))
+	dest, _, err := placeResolved(path, target, ConflictNumbered, defaultConflictSuffix, func(dest string, _ bool) error {
+		return moveFile(path, dest, moveOptions{preserveAttributes: true, noReplace: true})
+	})
+	if err != nil {
+		return "", fmt.Errorf("moving to trash directory: %w", err)
+	}
+	return dest, nil
+}
+
+// expireTrash removes the day directories of the trash directory that are
+// older than its expiry
+func expireTrash(trash *TrashOptions, now time.Time) {
+	if trash == nil || trash.Dir == "" || trash.Expire <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(trash.Dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to read trash directory", "trash_dir", trash.Dir, "error", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		day, err := time.ParseInLocation(time.DateOnly, entry.Name(), time.Local)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// A day's files were trashed by its end at the latest
+		if now.Sub(day.AddDate(0, 0, 1)) < time.Duration(trash.Expire) {
+			continue
+		}
+		path := filepath.Join(trash.Dir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Failed to empty expired trash", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Emptied expired trash", "path", path)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build darwin
+
+package fwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// systemTrash moves a file to the macOS trash: ~/.Trash for files on the
+// same volume as the home directory, otherwise the volume's own
+// .Trashes/<uid>, which Finder shows in the same Trash. It returns the path
+// of the trashed file.
+func systemTrash(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+
+	var trash string
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errNoSystemTrash
+	}
+	if homeDev, err := deviceOf(home); err == nil && homeDev == dev {
+		trash = filepath.Join(home, ".Trash")
+	} else {
+		top, err := mountRoot(path)
+		if err != nil {
+			return "", err
+		}
+		// .Trashes is set up by the system on volumes that support it
+		if info, err := os.Lstat(filepath.Join(top, ".Trashes")); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("%w: %s has no .Trashes", errNoSystemTrash, top)
+		}
+		trash = filepath.Join(top, ".Trashes", strconv.Itoa(os.Getuid()))
+	}
+	if err := os.MkdirAll(trash, 0o700); err != nil {
+		return "", fmt.Errorf("%w: %v", errNoSystemTrash, err)
+	}
+
+	// Finder names a second file of the same name with the time it was
+	// deleted
+	dest := filepath.Join(trash, filepath.Base(path))
+	if _, err := os.Lstat(dest); err == nil {
+		stem, ext := splitExt(filepath.Base(path))
+		dest = filepath.Join(trash, fmt.Sprintf("%s %s%s", stem, time.Now().Format("15.04.05.000"), ext))
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// forgetTrashed does nothing; the macOS trash keeps no records of its own
+// that a restored file would leave behind
+func forgetTrashed(path string) {}
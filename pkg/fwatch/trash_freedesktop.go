@@ -0,0 +1,144 @@
+//go:build unix && !darwin
+
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// systemTrash moves a file to the trash as described by the freedesktop.org
+// Trash specification: the home trash for files on the same filesystem as
+// it, otherwise the trash at the top of the file's filesystem. It returns
+// the path of the trashed file.
+func systemTrash(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errNoSystemTrash
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	homeTrash := filepath.Join(dataHome, "Trash")
+	if err := os.MkdirAll(homeTrash, 0o700); err != nil {
+		return "", fmt.Errorf("creating home trash: %w", err)
+	}
+	if homeDev, err := deviceOf(homeTrash); err == nil && homeDev == dev {
+		return trashInto(homeTrash, path, path)
+	}
+
+	// Files elsewhere go to their filesystem's trash, which records paths
+	// relative to its top directory
+	top, err := mountRoot(path)
+	if err != nil {
+		return "", err
+	}
+	trash, err := topdirTrash(top)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(top, path)
+	if err != nil {
+		return "", err
+	}
+	return trashInto(trash, path, rel)
+}
+
+// topdirTrash returns the trash directory for the current user at the top
+// of a filesystem: $topdir/.Trash/$uid if the administrator set up a
+// shared .Trash, otherwise $topdir/.Trash-$uid
+func topdirTrash(top string) (string, error) {
+	uid := strconv.Itoa(os.Getuid())
+
+	// The shared directory must be a real, sticky directory
+	if info, err := os.Lstat(filepath.Join(top, ".Trash")); err == nil &&
+		info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		dir := filepath.Join(top, ".Trash", uid)
+		if err := os.MkdirAll(dir, 0o700); err == nil {
+			return dir, nil
+		}
+	}
+
+	dir := filepath.Join(top, ".Trash-"+uid)
+	if err := os.Mkdir(dir, 0o700); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("%w: %v", errNoSystemTrash, err)
+	}
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%w: %s is not a directory", errNoSystemTrash, dir)
+	}
+	return dir, nil
+}
+
+// trashInto moves a file into a trash directory, recording origPath, the
+// path it is restored to, in its .trashinfo file
+func trashInto(trash, path, origPath string) (string, error) {
+	files, info := filepath.Join(trash, "files"), filepath.Join(trash, "info")
+	for _, dir := range []string{files, info} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", err
+		}
+	}
+
+	contents := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: origPath}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+
+	// Creating the info file exclusively reserves the name in the trash
+	stem, ext := splitExt(filepath.Base(path))
+	for n := 1; ; n++ {
+		name := filepath.Base(path)
+		if n > 1 {
+			name = fmt.Sprintf("%s.%d%s", stem, n, ext)
+		}
+		infoPath := filepath.Join(info, name+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.WriteString(contents)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		dest := filepath.Join(files, name)
+		if _, statErr := os.Lstat(dest); statErr == nil {
+			// Left behind without its info file
+			os.Remove(infoPath)
+			continue
+		}
+		if err == nil {
+			err = os.Rename(path, dest)
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return "", err
+		}
+		return dest, nil
+	}
+}
+
+// forgetTrashed removes the .trashinfo file of a file restored from a
+// freedesktop.org trash
+func forgetTrashed(path string) {
+	files := filepath.Dir(path)
+	if filepath.Base(files) != "files" {
+		return
+	}
+	os.Remove(filepath.Join(filepath.Dir(files), "info", filepath.Base(path)+".trashinfo"))
+}
@@ -0,0 +1,12 @@
+//go:build !unix && !(windows && (amd64 || arm64))
+
+package fwatch
+
+// systemTrash is not supported on this platform; trashed files go to the
+// trash directory if one is configured
+func systemTrash(path string) (string, error) {
+	return "", errNoSystemTrash
+}
+
+// forgetTrashed does nothing on this platform
+func forgetTrashed(path string) {}
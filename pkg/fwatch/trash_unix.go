@@ -0,0 +1,46 @@
+//go:build unix
+
+package fwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// deviceOf returns the device a file is on, without following symlinks
+func deviceOf(path string) (uint64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no device number for %s", path)
+	}
+	return uint64(st.Dev), nil
+}
+
+// mountRoot returns the top directory of the filesystem path is on
+func mountRoot(path string) (string, error) {
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(path)
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, nil
+		}
+		parentDev, err := deviceOf(parent)
+		if err != nil {
+			return "", err
+		}
+		if parentDev != dev {
+			return dir, nil
+		}
+		dir = parent
+	}
+}
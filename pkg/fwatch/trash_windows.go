@@ -0,0 +1,84 @@
+//go:build windows && (amd64 || arm64)
+
+package fwatch
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// SHFileOperationW operation and flags, from shellapi.h
+const (
+	foDelete           = 0x0003
+	fofSilent          = 0x0004
+	fofNoConfirmation  = 0x0010
+	fofAllowUndo       = 0x0040
+	fofNoErrorUI       = 0x0400
+	fofNoConfirmMkdir  = 0x0200
+	fofNoRecursiveHook = 0x1000
+)
+
+var procSHFileOperationW = windows.NewLazySystemDLL("shell32.dll").NewProc("SHFileOperationW")
+
+// shFileOpStruct is SHFILEOPSTRUCTW. It is packed on 32-bit Windows, which
+// is why this file is limited to 64-bit platforms, where the layout matches
+// Go's.
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom                 *uint16
+	pTo                   *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+// systemTrash moves a file to the Recycle Bin. Only fixed drives are
+// used: the shell deletes files on network shares and removable drives
+// for good instead. The Recycle Bin's location of the file isn't known, so
+// the returned path is empty.
+func systemTrash(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	p16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	root := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p16, &root[0], uint32(len(root))); err != nil {
+		return "", fmt.Errorf("%w: %v", errNoSystemTrash, err)
+	}
+	if windows.GetDriveType(&root[0]) != windows.DRIVE_FIXED {
+		return "", fmt.Errorf("%w: %s is not on a fixed drive", errNoSystemTrash, path)
+	}
+
+	// pFrom is a list of paths ended by an empty one
+	from, err := windows.UTF16FromString(path)
+	if err != nil {
+		return "", err
+	}
+	from = append(from, 0)
+	op := shFileOpStruct{
+		wFunc:  foDelete,
+		pFrom:  &from[0],
+		fFlags: fofAllowUndo | fofNoConfirmation | fofSilent | fofNoErrorUI | fofNoConfirmMkdir | fofNoRecursiveHook,
+	}
+	ret, _, _ := procSHFileOperationW.Call(uintptr(unsafe.Pointer(&op)))
+	if ret != 0 {
+		return "", fmt.Errorf("moving %s to the Recycle Bin failed with code %#x", path, ret)
+	}
+	if op.fAnyOperationsAborted != 0 {
+		return "", fmt.Errorf("moving %s to the Recycle Bin was aborted", path)
+	}
+	return "", nil
+}
+
+// forgetTrashed does nothing; files in the Recycle Bin are never restored
+// by undo, since their path isn't recorded
+func forgetTrashed(path string) {}
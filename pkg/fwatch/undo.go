@@ -0,0 +1,172 @@
+package fwatch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fileStamp identifies a version of a file, such as the one undo restored
+// at a path
+type fileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Undoable reports whether rec describes a local move, or a file moved to
+// the trash, that Undo can reverse. A deleted duplicate can't be restored,
+// as its destination is the file it duplicated, and neither can a file
+// that was encrypted, which fwatch can't decrypt.
+func (rec *HistoryRecord) Undoable() bool {
+	return rec.Status == StatusSuccess && (rec.Action == ActionMove || rec.Action == ActionDelete) && rec.Destination != "" &&
+		!isRemoteDestination(rec.Destination) && rec.Destination != rec.Duplicate && !rec.Encrypted && rec.Undone == nil
+}
+
+// Undo moves the file recorded in rec back to its source path and marks
+// the record as undone. It refuses if the file has changed since it was
+// moved, unless force is set, and never overwrites a file at the source
+// path.
+func (h *History) Undo(rec *HistoryRecord, force bool) error {
+	if !rec.Undoable() {
+		return errors.New("not a move that can be undone")
+	}
+
+	info, err := os.Stat(rec.Destination)
+	if err != nil {
+		return fmt.Errorf("moved file is gone: %w", err)
+	}
+	if !force && rec.Checksum != "" {
+		sum, err := hashFile(rec.Destination)
+		if err != nil {
+			return err
+		}
+		if sum != rec.Checksum {
+			return fmt.Errorf("%s has changed since it was moved (use -force to restore it anyway)", rec.Destination)
+		}
+	}
+	// Only a quick answer; the move itself refuses to replace a file that
+	// arrives in the meantime
+	if _, err := os.Lstat(rec.Source); err == nil {
+		return fmt.Errorf("%s already exists", rec.Source)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Record the restored file before moving it so that a running fwatch
+	// doesn't route it straight back
+	undone := fileStamp{Size: info.Size(), ModTime: info.ModTime()}
+	if err := h.setUndone(rec.Source, &undone); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rec.Source), 0o755); err != nil {
+		h.setUndone(rec.Source, nil)
+		return err
+	}
+	// Preserving attributes keeps the modification time recorded above
+	opts := moveOptions{verifyChecksum: true, preserveAttributes: true, noReplace: true}
+	if err := moveFile(rec.Destination, rec.Source, opts); err != nil {
+		h.setUndone(rec.Source, nil)
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s already exists", rec.Source)
+		}
+		return err
+	}
+	if rec.Action == ActionDelete {
+		forgetTrashed(rec.Destination)
+	}
+
+	now := time.Now()
+	rec.Undone = &now
+	return h.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBucket))
+		if bucket == nil {
+			return errors.New("history bucket missing")
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, rec.ID)
+		return bucket.Put(key, data)
+	})
+}
+
+// setUndone records the file restored to path, or clears the entry if f
+// is nil
+func (h *History) setUndone(path string, f *fileStamp) error {
+	return h.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(undoneBucket))
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return bucket.Delete([]byte(path))
+		}
+		data, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(path), data)
+	})
+}
+
+// undoneFiles holds the files undo put back, read from the history
+// database again whenever it has changed, as undo runs in another process
+type undoneFiles struct {
+	mu      sync.Mutex
+	db      string    // the database files were loaded from
+	modTime time.Time // its modification time then
+	files   map[string]fileStamp
+}
+
+// has reports whether the file at path is one that undo put back,
+// unchanged since. Errors reading the database count as no.
+func (u *undoneFiles) has(db, path string, info os.FileInfo) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.load(db)
+	f, ok := u.files[path]
+	return ok && f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+}
+
+// load reads the undone files from db, unless they were read from it
+// since it last changed. Callers must hold u.mu.
+func (u *undoneFiles) load(db string) {
+	dbInfo, err := os.Stat(db)
+	if err != nil {
+		u.db, u.modTime, u.files = db, time.Time{}, nil
+		return
+	}
+	if u.files != nil && u.db == db && u.modTime.Equal(dbInfo.ModTime()) {
+		return
+	}
+	u.db, u.modTime, u.files = db, dbInfo.ModTime(), make(map[string]fileStamp)
+	h := History{path: db}
+	err = h.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(undoneBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var f fileStamp
+			if json.Unmarshal(value, &f) == nil {
+				u.files[string(key)] = f
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		// Read again next time rather than miss files until it changes
+		u.files = nil
+	}
+}
@@ -0,0 +1,117 @@
+package fwatch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestUndoneFiles(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "history.db")
+	path := filepath.Join(dir, "report.pdf")
+	writeFile(t, path, "data")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var undone undoneFiles
+	if undone.has(db, path, info) {
+		t.Error("file undone without a database")
+	}
+
+	h := History{path: db}
+	if err := h.setUndone(path, &fileStamp{Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		t.Fatal(err)
+	}
+	if !undone.has(db, path, info) {
+		t.Error("file undo put back not found")
+	}
+
+	// A change to the file makes it one to process again
+	later := info.ModTime().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	changed, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undone.has(db, path, changed) {
+		t.Error("file changed since undo still counted as undone")
+	}
+
+	// Another process clearing the entry is seen once the database changes
+	if err := h.setUndone(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	dbLater := time.Now().Add(time.Second)
+	os.Chtimes(db, dbLater, dbLater)
+	if undone.has(db, path, info) {
+		t.Error("cleared entry still cached")
+	}
+}
+
+// undoRecord stores a record of a file moved from src to dest in a new
+// history database
+func undoRecord(t *testing.T, src, dest string) (*History, *HistoryRecord) {
+	t.Helper()
+	h := &History{path: filepath.Join(t.TempDir(), "history.db")}
+	err := h.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, &HistoryRecord{ID: 1, Source: src, Destination: dest, Action: ActionMove, Status: StatusSuccess}
+}
+
+func TestUndo(t *testing.T) {
+	src, dest := filepath.Join(t.TempDir(), "report.pdf"), filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, dest, "data")
+	h, rec := undoRecord(t, src, dest)
+
+	if err := h.Undo(rec, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(src); string(data) != "data" {
+		t.Errorf("source holds %q after undo", data)
+	}
+	if rec.Undone == nil {
+		t.Error("record not marked undone")
+	}
+}
+
+func TestUndoKeepsExistingSource(t *testing.T) {
+	src, dest := filepath.Join(t.TempDir(), "report.pdf"), filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, dest, "data")
+	writeFile(t, src, "new download")
+	h, rec := undoRecord(t, src, dest)
+
+	if err := h.Undo(rec, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Undo = %v, want the source reported as existing", err)
+	}
+	if data, _ := os.ReadFile(src); string(data) != "new download" {
+		t.Errorf("source replaced with %q", data)
+	}
+
+	// A file arriving after the check is kept by the move itself, with the
+	// options Undo uses
+	err := moveFile(dest, src, moveOptions{verifyChecksum: true, preserveAttributes: true, noReplace: true})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("moveFile over a file = %v, want fs.ErrExist", err)
+	}
+	if data, _ := os.ReadFile(src); string(data) != "new download" {
+		t.Errorf("source replaced with %q", data)
+	}
+	var undone undoneFiles
+	if info, err := os.Stat(src); err != nil || undone.has(h.path, src, info) {
+		t.Errorf("existing source recorded as undone: %v", err)
+	}
+}
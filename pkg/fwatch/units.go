@@ -0,0 +1,126 @@
+package fwatch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a size in bytes that can be written in YAML as a plain number
+// or with a unit suffix such as "10MB" or "1.5GiB"
+type ByteSize int64
+
+// sizeUnits maps unit suffixes to their multiplier. Both decimal-looking
+// (KB, MB) and binary (KiB, MiB) suffixes are treated as powers of 1024.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1 << 40,
+	"tib": 1 << 40,
+}
+
+// ParseByteSize parses a human-readable size like "100MB" into bytes
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	// Split into numeric part and unit suffix
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q in %q", unit, s)
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return ByteSize(value * float64(multiplier)), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// String formats the size with the largest unit that fits, such as "1.5GB"
+func (b ByteSize) String() string {
+	for _, unit := range []string{"TB", "GB", "MB", "KB"} {
+		multiplier := sizeUnits[strings.ToLower(unit)]
+		if int64(b) >= multiplier {
+			value := strconv.FormatFloat(float64(b)/float64(multiplier), 'f', 1, 64)
+			return strings.TrimSuffix(value, ".0") + unit
+		}
+	}
+	return fmt.Sprintf("%dB", int64(b))
+}
+
+// Duration is a time.Duration that can be written in YAML as a Go duration
+// string ("48h", "90m") or with a day/week suffix ("7d", "2w")
+type Duration time.Duration
+
+// ParseDuration parses a duration string, extending time.ParseDuration with
+// "d" (days) and "w" (weeks) suffixes
+func ParseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			value, err := strconv.ParseFloat(number, 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return Duration(value * float64(unit)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return Duration(d), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := ParseDuration(value.Value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
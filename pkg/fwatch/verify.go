@@ -0,0 +1,99 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// errVerifyFailed is wrapped by the error of a file that didn't pass its
+// rule's verify checks at the destination
+var errVerifyFailed = errors.New("verification failed")
+
+// VerifyOptions checks each moved or copied file at its destination. The
+// file must exist there with the size it had when it matched; a file that
+// fails a check is put back where it came from and counts as a failed
+// attempt.
+type VerifyOptions struct {
+	// Checksum compares the SHA-256 digests of the file before it was
+	// moved and of the stored copy
+	Checksum bool `yaml:"checksum"`
+
+	// Exec is a command that exits with 0 for a stored file that is fine,
+	// with FWATCH_DEST and {{.Dest}} set to where it is
+	Exec *ExecAction `yaml:"exec"`
+}
+
+// validate checks the verify settings
+func (v *VerifyOptions) validate() error {
+	if v != nil && v.Exec != nil && len(v.Exec.Command) == 0 {
+		return fmt.Errorf("verify.exec requires command")
+	}
+	return nil
+}
+
+// verifyPlaced checks the file stored at dest as the rule's verify asks,
+// and if it fails, restores it to src, or only removes it when the source
+// was kept. sum is the digest of the source, if verify.checksum is set.
+func verifyPlaced(rule *Rule, src, dest string, info os.FileInfo, sum string, keepSource bool) error {
+	err := checkPlaced(rule, src, dest, info, sum)
+	if err == nil {
+		return nil
+	}
+	if restoreErr := rollBack(src, dest, info, keepSource); restoreErr != nil {
+		return fmt.Errorf("%w, and restoring the file failed, leaving it at %s: %v", err, dest, restoreErr)
+	}
+	slog.Warn("Stored file failed verification, restored it", "file", src, "rule", rule.Name, "dest_path", dest, "error", err)
+	return err
+}
+
+// checkPlaced runs the rule's verify checks on the file stored at dest.
+// A symlink is only checked to exist.
+func checkPlaced(rule *Rule, src, dest string, info os.FileInfo, sum string) error {
+	stored, err := os.Lstat(dest)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errVerifyFailed, err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		if stored.Size() != info.Size() {
+			return fmt.Errorf("%w: %s has %d bytes, expected %d", errVerifyFailed, dest, stored.Size(), info.Size())
+		}
+		if sum != "" {
+			got, err := hashFile(dest)
+			if err != nil {
+				return fmt.Errorf("%w: %w", errVerifyFailed, err)
+			}
+			if got != sum {
+				return fmt.Errorf("%w: checksum of %s doesn't match the source", errVerifyFailed, dest)
+			}
+		}
+	}
+	if exec := rule.Verify.Exec; exec != nil {
+		data := newTemplateData(src, rule)
+		data.Dest = dest
+		if err := execCommand(exec, data); err != nil {
+			return fmt.Errorf("%w: %w", errVerifyFailed, err)
+		}
+	}
+	return nil
+}
+
+// rollBack undoes storing a file at dest: a kept source makes the stored
+// file redundant, otherwise it is moved back to src
+func rollBack(src, dest string, info os.FileInfo, keepSource bool) error {
+	if keepSource {
+		return os.Remove(dest)
+	}
+	if _, err := os.Lstat(src); err == nil {
+		return fmt.Errorf("%s already exists", src)
+	}
+	if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return moveLink(dest, src, false, true)
+	}
+	return moveFile(dest, src, moveOptions{preserveAttributes: true})
+}
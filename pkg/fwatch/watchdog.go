@@ -0,0 +1,241 @@
+package fwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Watch health states, as reported in WatchStatus
+const (
+	HealthOK   = "ok"
+	HealthDown = "down"
+)
+
+const (
+	// defaultWatchdogInterval is how often watch directories are checked
+	// when the config does not set watchdog_interval
+	defaultWatchdogInterval = 30 * time.Second
+
+	// watchdogTick is how often the watchdog looks for checks and retries
+	// that are due
+	watchdogTick = time.Second
+
+	// watchdogStatTimeout bounds a check of a watch directory, since a
+	// stat on a network mount that went away can hang
+	watchdogStatTimeout = 10 * time.Second
+
+	// Re-establishing a lost watch is retried with a delay doubling from
+	// watchdogRetryMin up to watchdogRetryMax
+	watchdogRetryMin = 5 * time.Second
+	watchdogRetryMax = 5 * time.Minute
+)
+
+// watchHealth is what the watchdog knows about a watch directory
+type watchHealth struct {
+	dir      os.FileInfo // the directory as watched, to notice it being replaced
+	checking bool        // a check is running
+	checked  time.Time   // when it was last checked
+
+	// Set while the watch is down
+	err     error
+	since   time.Time
+	retries int
+	next    time.Time
+}
+
+// down reports whether the watch is waiting to be re-established
+func (h *watchHealth) down() bool { return h.err != nil }
+
+// watchdogInterval returns how often watch directories are checked
+func (c *Config) watchdogInterval() time.Duration {
+	if c.WatchdogInterval > 0 {
+		return time.Duration(c.WatchdogInterval)
+	}
+	return defaultWatchdogInterval
+}
+
+// watchEstablished records that a watch directory is now being watched;
+// dir describes it, if known. Callers must hold e.mu.
+func (e *Engine) watchEstablished(path string, dir os.FileInfo) {
+	e.health[path] = &watchHealth{dir: dir, checked: time.Now()}
+}
+
+// watchLost takes down a watch whose directory has gone, so the watchdog
+// re-establishes it once the directory is back. It does nothing if the
+// watch is already down.
+func (e *Engine) watchLost(path string, cause error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := e.health[path]
+	if h == nil || h.down() || e.watcher == nil {
+		return
+	}
+
+	now := time.Now()
+	h.err, h.since, h.retries, h.next = cause, now, 0, now.Add(watchdogRetryMin)
+	// The OS may keep a watch on a directory that was replaced
+	e.watcher.Remove(path)
+	slog.Error("Lost watch directory, will re-establish it", "watch_dir", path, "error", cause, "retry_in", watchdogRetryMin)
+}
+
+// lostWatch returns the watch directory an event or watcher error says is
+// gone, if any. Events for a watch directory itself are only reported when
+// it was removed, renamed or unmounted.
+func lostWatch(config *Config, event *Event, err error) (string, error) {
+	if event != nil {
+		if (event.Op.Has(OpRemove) || event.Op.Has(OpRename)) && config.isWatchPath(event.Path) {
+			return event.Path, errors.New("directory was removed, renamed or unmounted")
+		}
+		return "", nil
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && config.isWatchPath(pathErr.Path) {
+		return pathErr.Path, err
+	}
+	return "", nil
+}
+
+// isWatchPath reports whether path is one of the configured watch
+// directories. A watched file is saved by replacing it, which doesn't
+// lose its watch.
+func (c *Config) isWatchPath(path string) bool {
+	watch := c.watchAt(path)
+	return watch != nil && !watch.file
+}
+
+// watchAt returns the watch configured for path, or nil
+func (c *Config) watchAt(path string) *Watch {
+	for i := range c.Watches {
+		if c.Watches[i].Path == path {
+			return &c.Watches[i]
+		}
+	}
+	return nil
+}
+
+// runWatchdog checks watch directories every watchdog interval and
+// re-establishes lost watches with backoff until ctx is done. Event
+// backends stop reporting anything when the device or network mount a
+// directory is on goes away, so a check is the only way to notice.
+func (e *Engine) runWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(watchdogTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		config := e.config.Load()
+		interval := config.watchdogInterval()
+
+		// Checks run on their own, so a hanging mount holds up nothing else
+		e.mu.Lock()
+		watcher := e.watcher
+		for i := range config.Watches {
+			watch := &config.Watches[i]
+			h := e.health[watch.Path]
+			switch {
+			case h == nil || h.checking || watcher == nil:
+			case h.down() && !now.Before(h.next):
+				h.checking = true
+				go e.reestablish(config, watcher, watch)
+			case !h.down() && now.Sub(h.checked) >= interval:
+				h.checking, h.checked = true, now
+				go e.checkWatch(watch, h.dir)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// checkWatch checks that a watch directory is still there and is still the
+// directory that was watched, and takes the watch down if not
+func (e *Engine) checkWatch(watch *Watch, watched os.FileInfo) {
+	_, err := checkDir(watch.dir(), watched)
+
+	e.mu.Lock()
+	if h := e.health[watch.Path]; h != nil {
+		h.checking = false
+	}
+	e.mu.Unlock()
+	if err != nil {
+		e.watchLost(watch.Path, err)
+	}
+}
+
+// reestablish tries to watch a lost directory again, scheduling the next
+// attempt if it fails, and rescans it if it succeeds
+func (e *Engine) reestablish(config *Config, watcher *multiWatcher, watch *Watch) {
+	dir, err := checkDir(watch.dir(), nil)
+	if err == nil {
+		err = addWatch(watcher, config, watch)
+	}
+
+	e.mu.Lock()
+	h := e.health[watch.Path]
+	if h == nil || !h.down() {
+		// Removed from the config meanwhile
+		if h == nil && err == nil {
+			watcher.Remove(watch.Path)
+		}
+		e.mu.Unlock()
+		return
+	}
+	h.checking = false
+	if err != nil {
+		h.retries++
+		attempts := h.retries
+		delay := min(watchdogRetryMin<<min(h.retries, 16), watchdogRetryMax)
+		h.err, h.next = err, time.Now().Add(delay)
+		e.mu.Unlock()
+		slog.Debug("Failed to re-establish watch directory", "watch_dir", watch.Path, "attempt", attempts, "retry_in", delay, "error", err)
+		return
+	}
+	down, attempts := time.Since(h.since).Round(time.Second), h.retries+1
+	e.watchEstablished(watch.Path, dir)
+	e.mu.Unlock()
+	slog.Info("Re-established watch directory", "watch_dir", watch.Path, "down_for", down, "attempts", attempts)
+
+	// Files may have arrived while the watch was down
+	if _, err := e.Rescan(watch.Path); err != nil {
+		slog.Warn("Failed to rescan re-established watch directory", "watch_dir", watch.Path, "error", err)
+	}
+}
+
+// checkDir checks that path is a directory and, if watched is set, the
+// same directory as watched. It gives up on directories that don't answer
+// within watchdogStatTimeout.
+func checkDir(path string, watched os.FileInfo) (os.FileInfo, error) {
+	type result struct {
+		info os.FileInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+		case !info.IsDir():
+			err = fmt.Errorf("%s is not a directory", path)
+		case watched != nil && !os.SameFile(info, watched):
+			// A remounted or recreated directory is a different one
+			err = fmt.Errorf("%s was replaced by another directory", path)
+		}
+		done <- result{info, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.info, r.err
+	case <-time.After(watchdogStatTimeout):
+		return nil, fmt.Errorf("%s is not responding", path)
+	}
+}
@@ -0,0 +1,517 @@
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch backends
+const (
+	BackendFsnotify = "fsnotify"
+	BackendPoll     = "poll"
+	BackendFSEvents = "fsevents"
+)
+
+// defaultPollInterval is how often the poll backend rescans directories
+const defaultPollInterval = 5 * time.Second
+
+// Op describes what happened to a file in an Event
+type Op uint32
+
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+	OpChmod
+)
+
+// Has reports whether o includes all of the bits in other
+func (o Op) Has(other Op) bool { return o&other == other }
+
+func (o Op) String() string {
+	var names []string
+	for _, op := range []struct {
+		op   Op
+		name string
+	}{{OpCreate, "CREATE"}, {OpWrite, "WRITE"}, {OpRemove, "REMOVE"}, {OpRename, "RENAME"}, {OpChmod, "CHMOD"}} {
+		if o.Has(op.op) {
+			names = append(names, op.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return fmt.Sprint(names)
+}
+
+// Event is a change to a file in a watched directory
+type Event struct {
+	Path string
+	Op   Op
+}
+
+// Watcher is a backend that reports file events for a set of directories.
+// The routing pipeline only consumes Events and Errors, so it does not
+// care which backend produced them.
+type Watcher interface {
+	Add(path string) error
+	Remove(path string) error
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+// fsnotifyWatcher adapts fsnotify to the Watcher interface
+type fsnotifyWatcher struct {
+	watcher *fsnotify.Watcher
+	events  chan Event
+}
+
+// newFsnotifyWatcher creates a watcher backed by the OS notification API
+func newFsnotifyWatcher() (*fsnotifyWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &fsnotifyWatcher{watcher: watcher, events: make(chan Event)}
+	go func() {
+		defer close(w.events)
+		for event := range watcher.Events {
+			w.events <- Event{Path: event.Name, Op: fromFsnotifyOp(event.Op)}
+		}
+	}()
+	return w, nil
+}
+
+// fromFsnotifyOp converts fsnotify's operation bits to ours
+func fromFsnotifyOp(op fsnotify.Op) Op {
+	var o Op
+	for _, m := range []struct {
+		from fsnotify.Op
+		to   Op
+	}{{fsnotify.Create, OpCreate}, {fsnotify.Write, OpWrite}, {fsnotify.Remove, OpRemove}, {fsnotify.Rename, OpRename}, {fsnotify.Chmod, OpChmod}} {
+		if op.Has(m.from) {
+			o |= m.to
+		}
+	}
+	return o
+}
+
+func (w *fsnotifyWatcher) Add(path string) error    { return w.watcher.Add(path) }
+func (w *fsnotifyWatcher) Remove(path string) error { return w.watcher.Remove(path) }
+func (w *fsnotifyWatcher) Events() <-chan Event     { return w.events }
+func (w *fsnotifyWatcher) Errors() <-chan error     { return w.watcher.Errors }
+func (w *fsnotifyWatcher) Close() error             { return w.watcher.Close() }
+
+// multiWatcher routes each watched directory to the backend configured for
+// it and merges all backend events into a single stream. Recursive watches
+// register every subdirectory with the same backend and follow
+// directories as they are created and removed.
+type multiWatcher struct {
+	pollInterval time.Duration
+
+	mu       sync.Mutex
+	backends map[string]Watcher
+	paths    map[string]string     // watched path → backend name
+	trees    map[string]*watchTree // recursive watch root → its subdirectories
+	files    map[string]string     // watched file → the directory registered for it
+
+	events chan Event
+	errors chan error
+}
+
+// watchTree tracks the subdirectories registered for a recursive watch
+type watchTree struct {
+	root    string
+	backend string
+	exclude []string          // glob patterns for directory names to skip
+	depth   int               // levels of subdirectories watched, 0 for all
+	onLimit string            // what to do when the backend runs out of watches
+	dirs    map[string]string // registered subdirectories, not including root → backend
+
+	limitReported bool // the watch limit was reached and logged
+}
+
+// skips reports whether the subdirectory dir is left out of the tree
+func (t *watchTree) skips(dir string) bool {
+	return isIgnored(dir, t.exclude) || tooDeep(t.root, dir, t.depth)
+}
+
+// newMultiWatcher creates an empty multiWatcher. Backends are started on
+// first use.
+func newMultiWatcher(pollInterval time.Duration) *multiWatcher {
+	return &multiWatcher{
+		pollInterval: pollInterval,
+		backends:     make(map[string]Watcher),
+		paths:        make(map[string]string),
+		trees:        make(map[string]*watchTree),
+		files:        make(map[string]string),
+		events:       make(chan Event),
+		errors:       make(chan error),
+	}
+}
+
+// backend returns the named backend, starting it if needed. Callers must
+// hold m.mu.
+func (m *multiWatcher) backend(name string) (Watcher, error) {
+	if w, ok := m.backends[name]; ok {
+		return w, nil
+	}
+
+	var w Watcher
+	switch name {
+	case "", BackendFsnotify:
+		fw, err := newFsnotifyWatcher()
+		if err != nil {
+			return nil, fmt.Errorf("creating fsnotify watcher: %w", err)
+		}
+		w = fw
+	case BackendPoll:
+		w = newPollWatcher(m.pollInterval)
+	case BackendFSEvents:
+		fw, err := newFSEventsWatcher()
+		if err != nil {
+			return nil, fmt.Errorf("creating fsevents watcher: %w", err)
+		}
+		w = fw
+	default:
+		return nil, fmt.Errorf("unknown watch backend %q", name)
+	}
+
+	// Fan backend events into the merged channels
+	go func() {
+		for event := range w.Events() {
+			for _, e := range m.follow(event) {
+				m.events <- e
+			}
+		}
+	}()
+	go func() {
+		for err := range w.Errors() {
+			if !m.vanished(err) {
+				m.errors <- err
+			}
+		}
+	}()
+
+	m.backends[name] = w
+	return w, nil
+}
+
+// Add watches path with the named backend, moving it from another backend
+// if it was already watched with a different one. With recursive set, all
+// subdirectories except those whose name matches an exclude pattern are
+// watched too, down to maxDepth levels unless it is 0. onLimit says what happens to directories the backend
+// refuses because a system limit on watches is reached: with
+// WatchLimitPoll they are polled instead, otherwise they are skipped.
+func (m *multiWatcher) Add(path, backend string, recursive bool, exclude []string, maxDepth int, onLimit string) error {
+	if backend == "" {
+		backend = BackendFsnotify
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, watched := m.paths[path]
+	tree := m.trees[path]
+	sameTree := (tree == nil && !recursive) || (tree != nil && recursive && slices.Equal(tree.exclude, exclude) && tree.depth == maxDepth && tree.onLimit == onLimit)
+	if watched && (current == backend || tree != nil && tree.backend == backend) && sameTree {
+		return nil
+	}
+
+	w, err := m.backend(backend)
+	if err != nil {
+		return err
+	}
+	registered := backend
+	if current != backend {
+		err := w.Add(path)
+		if isWatchLimit(err) && onLimit == WatchLimitPoll && backend != BackendPoll {
+			slog.Warn("Reached the watch limit, polling watch directory", "watch_dir", path, "backend", backend, "error", err)
+			registered = BackendPoll
+			var poll Watcher
+			if poll, err = m.backend(BackendPoll); err == nil {
+				err = poll.Add(path)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if watched && current != registered {
+			m.backends[current].Remove(path)
+		}
+	}
+	if tree != nil {
+		m.removeDirs(tree, path)
+		delete(m.trees, path)
+	}
+	m.paths[path] = registered
+
+	if recursive {
+		tree = &watchTree{root: path, backend: backend, exclude: slices.Clone(exclude), depth: maxDepth, onLimit: onLimit, dirs: make(map[string]string)}
+		m.trees[path] = tree
+		m.addDirs(tree, registered, path)
+	}
+	return nil
+}
+
+// AddFile watches a single file with the named backend. Its directory is
+// what is registered, since many programs save a file by writing a new one
+// and renaming it over the old, and only events for the file are
+// delivered.
+func (m *multiWatcher) AddFile(path, backend string) error {
+	if backend == "" {
+		backend = BackendFsnotify
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, watched := m.paths[path]
+	if watched && current == backend {
+		return nil
+	}
+	w, err := m.backend(backend)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := w.Add(dir); err != nil {
+		return err
+	}
+	if watched {
+		m.releaseDir(path, current)
+	}
+	m.paths[path], m.files[path] = backend, dir
+	return nil
+}
+
+// releaseDir stops watching the directory of a watched file with backend,
+// unless another watched file in it still needs it. Callers must hold m.mu.
+func (m *multiWatcher) releaseDir(path, backend string) {
+	dir := m.files[path]
+	delete(m.files, path)
+	for other, otherDir := range m.files {
+		if otherDir == dir && m.paths[other] == backend {
+			return
+		}
+	}
+	m.backends[backend].Remove(dir)
+}
+
+// fileDir reports whether dir is only watched for the files in it. Callers
+// must hold m.mu.
+func (m *multiWatcher) fileDir(dir string) bool {
+	for _, fileDir := range m.files {
+		if fileDir == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// addDirs registers the subdirectories of dir with the named backend and
+// returns the files found in them. If the backend runs out of watches, the
+// rest are polled or skipped, depending on the tree's watch limit policy.
+// Callers must hold m.mu.
+func (m *multiWatcher) addDirs(tree *watchTree, backend, dir string) []string {
+	var files []string
+	refused := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Warn("Failed to scan directory", "dir", path, "error", err)
+			return nil
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+			return nil
+		}
+		if path == tree.root {
+			return nil
+		}
+		if tree.skips(path) {
+			return filepath.SkipDir
+		}
+		err = m.backends[backend].Add(path)
+		if isWatchLimit(err) {
+			refused++
+			if tree.onLimit != WatchLimitPoll {
+				slog.Debug("Reached the watch limit, skipping subdirectory", "dir", path, "error", err)
+				return filepath.SkipDir
+			}
+			// This directory and the rest of the walk are polled instead
+			backend = BackendPoll
+			var poll Watcher
+			if poll, err = m.backend(BackendPoll); err == nil {
+				err = poll.Add(path)
+			}
+		}
+		if err != nil {
+			slog.Warn("Failed to watch subdirectory", "dir", path, "error", err)
+			return filepath.SkipDir
+		}
+		tree.dirs[path] = backend
+		return nil
+	})
+	if refused > 0 {
+		m.reportWatchLimit(tree, refused)
+	}
+	return files
+}
+
+// removeDirs stops watching dir and everything below it, if they belong to
+// tree. Callers must hold m.mu.
+func (m *multiWatcher) removeDirs(tree *watchTree, dir string) {
+	for path, backend := range tree.dirs {
+		if path == dir || isWithin(path, dir) {
+			// The OS drops watches of deleted directories by itself
+			m.backends[backend].Remove(path)
+			delete(tree.dirs, path)
+		}
+	}
+}
+
+// polled returns the number of directories of a recursive watch that are
+// polled because its backend ran out of watches
+func (m *multiWatcher) polled(root string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tree := m.trees[root]
+	if tree == nil || tree.backend == BackendPoll {
+		return 0
+	}
+	n := 0
+	if m.paths[root] == BackendPoll {
+		n++
+	}
+	for _, backend := range tree.dirs {
+		if backend == BackendPoll {
+			n++
+		}
+	}
+	return n
+}
+
+// follow keeps recursive watches in step with the directories inside them
+// and returns the events to deliver for a backend event. A directory
+// created in a recursive watch is watched at once, and the files already
+// inside it are reported as created, since they may have been written
+// before the watch was in place.
+func (m *multiWatcher) follow(event Event) []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parent := filepath.Dir(event.Path)
+	if _, ok := m.files[event.Path]; !ok && m.fileDir(parent) {
+		return nil
+	}
+	var tree *watchTree
+	var backend string
+	for _, t := range m.trees {
+		if parent == t.root {
+			tree, backend = t, m.paths[t.root]
+			break
+		}
+		if b, ok := t.dirs[parent]; ok {
+			tree, backend = t, b
+			break
+		}
+	}
+	if tree == nil {
+		return []Event{event}
+	}
+
+	events := []Event{event}
+	_, registered := tree.dirs[event.Path]
+	switch {
+	case event.Op.Has(OpCreate):
+		info, err := os.Lstat(event.Path)
+		if err != nil || !info.IsDir() || registered || tree.skips(event.Path) {
+			break
+		}
+		// New directories are watched like their parent
+		for _, file := range m.addDirs(tree, backend, event.Path) {
+			events = append(events, Event{Path: file, Op: OpCreate})
+		}
+	case event.Op.Has(OpRemove) || event.Op.Has(OpRename):
+		if registered {
+			m.removeDirs(tree, event.Path)
+		}
+	}
+	return events
+}
+
+// vanished reports whether err says that a subdirectory of a recursive
+// watch no longer exists, in which case it is dropped. The poll backend can
+// notice this before the scan of the parent directory reports the removal.
+func (m *multiWatcher) vanished(err error) bool {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tree := range m.trees {
+		// The directory may already have been dropped along with a parent
+		if isWithin(pathErr.Path, tree.root) {
+			m.removeDirs(tree, pathErr.Path)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove stops watching path, and its subdirectories if it is a recursive
+// watch
+func (m *multiWatcher) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	backend, ok := m.paths[path]
+	if !ok {
+		return nil
+	}
+	if _, ok := m.files[path]; ok {
+		delete(m.paths, path)
+		m.releaseDir(path, backend)
+		return nil
+	}
+	if tree := m.trees[path]; tree != nil {
+		m.removeDirs(tree, path)
+		delete(m.trees, path)
+	}
+	delete(m.paths, path)
+	return m.backends[backend].Remove(path)
+}
+
+// Events returns the merged event stream of all backends
+func (m *multiWatcher) Events() <-chan Event { return m.events }
+
+// Errors returns the merged error stream of all backends
+func (m *multiWatcher) Errors() <-chan error { return m.errors }
+
+// Close stops all backends
+func (m *multiWatcher) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var firstErr error
+	for _, w := range m.backends {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
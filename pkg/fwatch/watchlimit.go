@@ -0,0 +1,90 @@
+package fwatch
+
+import (
+	"cmp"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+)
+
+// What to do with directories of a recursive watch that the backend can't
+// watch because a system limit is reached
+const (
+	WatchLimitSkip = "skip"
+	WatchLimitPoll = "poll"
+)
+
+// watchLimitPolicies lists the valid on_watch_limit values
+var watchLimitPolicies = []string{WatchLimitSkip, WatchLimitPoll}
+
+// onWatchLimit returns the watch limit policy for a watch directory
+func (c *Config) onWatchLimit(watch *Watch) string {
+	if watch != nil && watch.OnWatchLimit != "" {
+		return watch.OnWatchLimit
+	}
+	return cmp.Or(c.OnWatchLimit, WatchLimitSkip)
+}
+
+// countDirs returns the number of directories in the tree, including its
+// root, that a recursive watch registers
+func countDirs(tree *watchTree) int {
+	n := 0
+	filepath.WalkDir(tree.root, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil || !d.IsDir():
+		case path != tree.root && tree.skips(path):
+			return filepath.SkipDir
+		default:
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// reportWatchLimit logs, once per recursive watch, that the backend ran out
+// of watches for it, with how many are needed and how to raise the limit.
+// Callers must hold m.mu.
+func (m *multiWatcher) reportWatchLimit(tree *watchTree, refused int) {
+	if tree.limitReported {
+		return
+	}
+	tree.limitReported = true
+
+	// Every directory registered with the backend uses one watch
+	inUse := 0
+	for _, backend := range m.paths {
+		if backend == tree.backend {
+			inUse++
+		}
+	}
+	for _, t := range m.trees {
+		for _, backend := range t.dirs {
+			if backend == tree.backend {
+				inUse++
+			}
+		}
+	}
+	required := inUse + countDirs(tree) - countRegistered(tree)
+	limit, advice := watchLimitAdvice(required)
+
+	attrs := []any{"watch_dir", tree.root, "backend", tree.backend, "limit", limit,
+		"in_use", inUse, "required", required, "advice", advice}
+	if tree.onLimit == WatchLimitPoll {
+		slog.Warn("Reached the watch limit, polling the remaining subdirectories", attrs...)
+	} else {
+		slog.Error("Reached the watch limit, skipping the remaining subdirectories", append(attrs, "refused", refused)...)
+	}
+}
+
+// countRegistered returns the number of directories of a tree registered
+// with its own backend, including the root
+func countRegistered(tree *watchTree) int {
+	n := 1
+	for _, backend := range tree.dirs {
+		if backend == tree.backend {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,27 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// isWatchLimit reports whether err is kqueue failing to watch a directory
+// because fwatch is out of file descriptors, of which it needs one per
+// watched directory and file
+func isWatchLimit(err error) bool {
+	return errors.Is(err, unix.EMFILE) || errors.Is(err, unix.ENFILE)
+}
+
+// watchLimitAdvice returns the open file limit and how to raise it to fit
+// required watches
+func watchLimitAdvice(required int) (int, string) {
+	var rlimit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, "raise the open file limit"
+	}
+	return int(rlimit.Cur), fmt.Sprintf("raise the open file limit above %d files in total, for example with \"ulimit -n\", or use the poll or fsevents backend", required)
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package fwatch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxUserWatchesPath holds the per-user inotify watch limit
+const maxUserWatchesPath = "/proc/sys/fs/inotify/max_user_watches"
+
+// isWatchLimit reports whether err is inotify refusing a watch because the
+// user has used up fs.inotify.max_user_watches
+func isWatchLimit(err error) bool {
+	return errors.Is(err, unix.ENOSPC)
+}
+
+// watchLimitAdvice returns the current inotify watch limit and how to
+// raise it to fit required watches
+func watchLimitAdvice(required int) (int, string) {
+	limit := 0
+	if data, err := os.ReadFile(maxUserWatchesPath); err == nil {
+		limit, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	// Other programs use watches too, so leave room for them
+	suggested := max(limit+required, 2*required)
+	suggested = (suggested + 65535) / 65536 * 65536
+	return limit, fmt.Sprintf("run \"sudo sysctl fs.inotify.max_user_watches=%d\" and add the setting to a file in /etc/sysctl.d to keep it", suggested)
+}
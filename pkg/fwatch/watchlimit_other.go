@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package fwatch
+
+// isWatchLimit reports whether err means a watch limit was reached. This
+// platform's notification API has no limit fwatch knows of.
+func isWatchLimit(err error) bool {
+	return false
+}
+
+// watchLimitAdvice is not used on this platform
+func watchLimitAdvice(required int) (int, string) {
+	return 0, ""
+}
@@ -0,0 +1,283 @@
+package fwatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	EventSuccess     = "success"
+	EventSkipped     = "skipped"
+	EventFailed      = "failed"
+	EventRetry       = "retry"
+	EventQuarantined = "quarantined"
+)
+
+// webhookEvents lists the valid webhook event types
+var webhookEvents = []string{EventSuccess, EventSkipped, EventFailed, EventRetry, EventQuarantined}
+
+// defaultWebhookEvents are sent when a webhook doesn't list its events
+var defaultWebhookEvents = []string{EventSuccess, EventFailed, EventQuarantined}
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	defaultWebhookRetries = 3
+
+	// webhookShutdownTimeout bounds how long shutdown waits for pending
+	// deliveries
+	webhookShutdownTimeout = 5 * time.Second
+)
+
+// Webhook is an HTTP endpoint that is POSTed a JSON payload for selected
+// events
+type Webhook struct {
+	URL     string            `yaml:"url"`
+	Events  []string          `yaml:"events"`
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout Duration          `yaml:"timeout"`
+	Retry   *RetryPolicy      `yaml:"retry"`
+}
+
+// validate checks the webhook's settings
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("unknown event %q (want one of %v)", event, webhookEvents)
+		}
+	}
+	if w.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return w.Retry.validate()
+}
+
+// wants reports whether the webhook subscribes to event
+func (w *Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return slices.Contains(defaultWebhookEvents, event)
+	}
+	return slices.Contains(w.Events, event)
+}
+
+// retryPolicy returns the webhook's retry policy, defaulting to a few
+// quick attempts
+func (w *Webhook) retryPolicy() *RetryPolicy {
+	if w.Retry != nil {
+		return w.Retry
+	}
+	return &RetryPolicy{MaxAttempts: defaultWebhookRetries}
+}
+
+// resultEvent returns the webhook event type for a result
+func resultEvent(r Result) string {
+	switch {
+	case r.Quarantined != "":
+		return EventQuarantined
+	case r.Status == StatusFailed && r.RetryIn > 0:
+		return EventRetry
+	case r.Status == StatusFailed:
+		return EventFailed
+	case r.Status == StatusSkipped:
+		return EventSkipped
+	default:
+		return EventSuccess
+	}
+}
+
+// webhookPayload is the JSON body sent to webhooks
+type webhookPayload struct {
+	Event       string    `json:"event"`
+	Timestamp   time.Time `json:"timestamp"`
+	File        string    `json:"file"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Rule        string    `json:"rule"`
+	Action      string    `json:"action"`
+	Destination string    `json:"destination,omitempty"`
+	DestPath    string    `json:"dest_path,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"`
+	Quarantined string    `json:"quarantined,omitempty"`
+	Status      Status    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// newWebhookPayload builds the payload describing a result
+func newWebhookPayload(event string, r Result) webhookPayload {
+	p := webhookPayload{
+		Event:       event,
+		Timestamp:   r.Time.UTC(),
+		File:        r.Path,
+		Name:        filepath.Base(r.Path),
+		Size:        r.Size,
+		Rule:        r.Rule,
+		Action:      r.Action,
+		Destination: r.Destination,
+		DestPath:    r.DestPath,
+		Checksum:    r.Checksum,
+		Quarantined: r.Quarantined,
+		Status:      r.Status,
+		Reason:      r.Reason,
+		Attempt:     r.Attempt,
+		DurationMS:  r.Duration.Milliseconds(),
+	}
+	if r.Err != nil {
+		p.Error = r.Err.Error()
+	}
+	return p
+}
+
+// webhookSender delivers webhook payloads in the background
+type webhookSender struct {
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newWebhookSender creates a sender with its own lifetime, so deliveries
+// can complete after the engine has stopped accepting files
+func newWebhookSender() *webhookSender {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookSender{client: &http.Client{}, ctx: ctx, cancel: cancel}
+}
+
+// send queues a delivery of the result to every webhook that subscribes
+// to its event type
+func (s *webhookSender) send(hooks []Webhook, r Result) {
+	event := resultEvent(r)
+	var body []byte
+	for i := range hooks {
+		hook := &hooks[i]
+		if !hook.wants(event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(newWebhookPayload(event, r))
+			if err != nil {
+				slog.Error("Failed to encode webhook payload", "file", r.Path, "error", err)
+				return
+			}
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.deliver(hook, event, body, r.Path)
+		}()
+	}
+}
+
+// deliver POSTs body to the webhook, retrying network errors and server
+// errors according to its retry policy
+func (s *webhookSender) deliver(hook *Webhook, event string, body []byte, file string) {
+	policy := hook.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		retryable, err := s.post(hook, event, body)
+		if err == nil {
+			slog.Debug("Delivered webhook", "file", file, "url", hook.URL, "event", event, "attempt", attempt)
+			return
+		}
+		if !retryable || attempt >= policy.maxAttempts() {
+			slog.Error("Failed to deliver webhook", "file", file, "url", hook.URL, "event", event, "attempt", attempt, "error", err)
+			return
+		}
+
+		delay := policy.delay(attempt)
+		slog.Warn("Failed to deliver webhook, will retry", "file", file, "url", hook.URL, "event", event, "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			slog.Error("Failed to deliver webhook before shutdown", "file", file, "url", hook.URL, "event", event, "error", err)
+			return
+		}
+	}
+}
+
+// post makes a single delivery attempt and reports whether a failure is
+// worth retrying
+func (s *webhookSender) post(hook *Webhook, event string, body []byte) (retryable bool, err error) {
+	timeout := defaultWebhookTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fwatch")
+	req.Header.Set("X-Fwatch-Event", event)
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+	if hook.Secret != "" {
+		req.Header.Set("X-Fwatch-Signature", "sha256="+signPayload(hook.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retryable, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// shutdown waits up to timeout for pending deliveries, then abandons the
+// rest
+func (s *webhookSender) shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Abandoning pending webhook deliveries")
+		s.cancel()
+		<-done
+	}
+	s.cancel()
+}
+
+// signPayload returns the hex HMAC-SHA256 of body keyed with secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// reloadDebounce is how long to wait after a config file change before
+// reloading, so editors that write in several steps trigger a single reload
+const reloadDebounce = 250 * time.Millisecond
+
+// watchConfig returns a channel that receives a value whenever the config
+// file or a file it includes changes on disk or the process receives
+// SIGHUP. Bursts of changes are coalesced into a single notification. The
+// returned function sets the include paths to watch, and is called again
+// after each reload.
+func watchConfig(configPath string) (<-chan struct{}, func([]string)) {
+	reloads := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+			// A reload is already pending
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Watch the parent directory rather than the file itself, since many
+	// editors save by writing a new file and renaming it over the old one
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		slog.Warn("Cannot resolve config path, only SIGHUP will reload", "config", configPath, "error", err)
+	}
+
+	var fileEvents <-chan fsnotify.Event
+	var watcher *fsnotify.Watcher
+	if err == nil {
+		watcher, err = fsnotify.NewWatcher()
+		if err == nil {
+			err = watcher.Add(filepath.Dir(configPath))
+		}
+		if err != nil {
+			slog.Warn("Cannot watch config file, only SIGHUP will reload", "config", configPath, "error", err)
+			watcher = nil
+		} else {
+			fileEvents = watcher.Events
+		}
+	}
+
+	// Included directories are watched themselves, files and patterns
+	// through the directory they are in
+	var mu sync.Mutex
+	var includes []string
+	watchIncludes := func(paths []string) {
+		mu.Lock()
+		previous := includes
+		includes = paths
+		mu.Unlock()
+		if watcher == nil {
+			return
+		}
+		// Directories that didn't exist are tried again, but only
+		// warned about once
+		for _, path := range paths {
+			dir := path
+			if info, err := os.Stat(path); err != nil || !info.IsDir() {
+				dir = filepath.Dir(path)
+			}
+			if err := watcher.Add(dir); err != nil && !slices.Contains(previous, path) {
+				slog.Warn("Cannot watch included config, only SIGHUP will reload it", "include", path, "error", err)
+			}
+		}
+	}
+	changed := func(name string) bool {
+		if name == configPath {
+			return true
+		}
+		if strings.HasPrefix(filepath.Base(name), ".") {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, path := range includes {
+			if match, _ := filepath.Match(path, name); match || filepath.Dir(name) == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-hup:
+				slog.Info("Received SIGHUP, reloading config")
+				notify()
+
+			case event, ok := <-fileEvents:
+				if !ok {
+					fileEvents = nil
+					continue
+				}
+				if !changed(filepath.Clean(event.Name)) {
+					continue
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+					debounce = time.After(reloadDebounce)
+				}
+
+			case <-debounce:
+				debounce = nil
+				// The file may be briefly missing mid-save; the next event
+				// will trigger another attempt
+				if _, err := os.Stat(configPath); err == nil {
+					slog.Info("Config file changed, reloading", "config", configPath)
+					notify()
+				}
+			}
+		}
+	}()
+
+	return reloads, watchIncludes
+}
+
+// reloadOnChange calls reload whenever watchConfig reports a change, until
+// ctx is cancelled
+func reloadOnChange(ctx context.Context, reloads <-chan struct{}, reload func() error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloads:
+		}
+
+		reload()
+	}
+}
+
+// reloadConfig loads the config file into engine. A config that fails to
+// load or validate is logged and returned, and the current one is kept.
+func reloadConfig(configPath string, engine *fwatch.Engine) error {
+	config, err := fwatch.LoadConfig(configPath)
+	if err == nil {
+		warnOutsideSandbox(config)
+		err = engine.SetConfig(*config)
+	}
+	if err != nil {
+		slog.Error("Config reload failed, keeping current config", "config", configPath, "error", err)
+		return err
+	}
+	rememberConfig(configPath, config)
+	notifySystemd("READY=1")
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runReplay implements "fwatch replay": it routes files from the history
+// database through the rules again and returns the exit code, like
+// run-once
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	profile := profileFlag(fs)
+	since := fs.String("since", "24h", "Replay files processed within this duration (e.g. 24h, 7d)")
+	rule := fs.String("rule", "", "Only replay files last handled by this rule")
+	failedOnly := fs.Bool("failed-only", false, "Only replay files whose last attempt failed")
+	dryRun := fs.Bool("dry-run", false, "Show what would be replayed without processing anything")
+	logFormat := fs.String("log-format", "text", "Log format: text or json")
+	logLevel := fs.String("log-level", "warn", "Log level: debug, info, warn or error")
+	asJSON := fs.Bool("json", false, "Print the summary as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch replay [-since duration] [flags]\n\nRoute files from the history database through the current rules again,\nmoving those that were moved back to where they came from first.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	selectProfile(*profile)
+
+	d, err := fwatch.ParseDuration(*since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -since: %v\n", err)
+		return 2
+	}
+	filter := fwatch.HistoryFilter{Since: time.Now().Add(-time.Duration(d)), Rule: *rule, Failed: *failedOnly}
+
+	logCloser, err := setupLogging(*logFormat, *logLevel, "", 0, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		return 2
+	}
+	defer logCloser.Close()
+
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 2
+	}
+	if config.HistoryDB == "" {
+		fmt.Fprintf(os.Stderr, "%s: history is not enabled (set history_db)\n", *configPath)
+		return 2
+	}
+	history, err := fwatch.OpenHistory(config.HistoryDB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.HistoryDB, err)
+		return 2
+	}
+	records, err := history.ReplayRecords(filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.HistoryDB, err)
+		return 2
+	}
+	if len(records) == 0 {
+		fmt.Println("Nothing to replay")
+		return 0
+	}
+
+	if *dryRun {
+		for _, rec := range records {
+			switch path, err := rec.Locate(); {
+			case err != nil:
+				fmt.Printf("can't replay %s: %v\n", rec.Source, err)
+			case path != rec.Source:
+				fmt.Printf("would replay %s from %s\n", rec.Source, path)
+			default:
+				fmt.Printf("would replay %s\n", rec.Source)
+			}
+		}
+		return 0
+	}
+
+	engine, err := fwatch.New(*config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 2
+	}
+
+	// A file counts once, by its last result, whatever rules it went through
+	var mu sync.Mutex
+	outcomes := make(map[string]fwatch.Status)
+	engine.OnResult(func(r fwatch.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		outcomes[r.Path] = r.Status
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	started := time.Now()
+	files, err := engine.Replay(ctx, records)
+	interrupted := errors.Is(err, context.Canceled)
+	if err != nil && !interrupted {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		return 2
+	}
+
+	summary := summarize(engine, files, time.Since(started), outcomes)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(summary)
+	} else {
+		printRunOnce(&summary)
+	}
+
+	switch {
+	case interrupted:
+		fmt.Fprintln(os.Stderr, "fwatch: interrupted before all files were replayed")
+		return 1
+	case summary.Failed > 0 || files < len(records):
+		return 1
+	}
+	return 0
+}
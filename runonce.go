@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runOnceSummary is what "fwatch run-once" reports when it is done
+type runOnceSummary struct {
+	Files     int                  `json:"files"`     // files and drop folders found
+	Succeeded int                  `json:"succeeded"` // files a rule handled
+	Skipped   int                  `json:"skipped"`   // files a rule skipped
+	Failed    int                  `json:"failed"`    // files a rule failed on
+	Untouched int                  `json:"untouched"` // files no rule matched or left for the next run
+	Duration  time.Duration        `json:"duration_ns"`
+	Rules     []fwatch.RuleStats   `json:"rules"`
+	Errors    []fwatch.ErrorStatus `json:"errors"`
+}
+
+// runRunOnce implements "fwatch run-once": it processes the files already
+// in the watch directories and exits, for running fwatch from cron or Task
+// Scheduler. It returns 0 if every file was handled or left alone, 1 if any
+// failed and 2 if fwatch couldn't run at all.
+func runRunOnce(args []string) int {
+	fs := flag.NewFlagSet("run-once", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	profile := profileFlag(fs)
+	overrides := addConfigFlags(fs)
+	logFormat := fs.String("log-format", "text", "Log format: text or json")
+	logLevel := fs.String("log-level", "warn", "Log level: debug, info, warn or error")
+	asJSON := fs.Bool("json", false, "Print the summary as JSON")
+	sandboxed := fs.Bool("sandbox", false, "Confine fwatch to the paths in its config with Landlock and seccomp (Linux only)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch run-once [flags] [dir...]\n\nProcess the files already in the watch directories, or in the given\ndirectories, against the rules and exit. Directories that aren't watches\nin the config are processed recursively with its default settings.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	selectProfile(*profile)
+	if err := overrides.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		return 2
+	}
+
+	logCloser, err := setupLogging(*logFormat, *logLevel, "", 0, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		return 2
+	}
+	defer logCloser.Close()
+
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 2
+	}
+	if fs.NArg() > 0 {
+		config.Watches = selectWatches(config.Watches, fs.Args())
+		config.WatchDir = ""
+	}
+	if *sandboxed {
+		if err := sandbox(*configPath, config, sandboxFiles{}); err != nil {
+			fmt.Fprintf(os.Stderr, "fwatch: entering sandbox: %v\n", err)
+			return 2
+		}
+	}
+
+	engine, err := fwatch.New(*config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 2
+	}
+
+	// A file counts once, by its last result, whatever rules it went through
+	var mu sync.Mutex
+	outcomes := make(map[string]fwatch.Status)
+	engine.OnResult(func(r fwatch.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		outcomes[r.Path] = r.Status
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	started := time.Now()
+	files, err := engine.RunOnce(ctx)
+	interrupted := errors.Is(err, context.Canceled)
+	if err != nil && !interrupted {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		return 2
+	}
+
+	summary := summarize(engine, files, time.Since(started), outcomes)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(summary)
+	} else {
+		printRunOnce(&summary)
+	}
+
+	switch {
+	case interrupted:
+		fmt.Fprintln(os.Stderr, "fwatch: interrupted before all files were processed")
+		return 1
+	case summary.Failed > 0:
+		return 1
+	}
+	return 0
+}
+
+// summarize counts what a run did to files, by the last result of each
+func summarize(engine *fwatch.Engine, files int, took time.Duration, outcomes map[string]fwatch.Status) runOnceSummary {
+	stats := engine.Stats()
+	summary := runOnceSummary{Files: files, Duration: took, Rules: stats.Rules, Errors: stats.Errors}
+	for _, status := range outcomes {
+		switch status {
+		case fwatch.StatusSuccess:
+			summary.Succeeded++
+		case fwatch.StatusSkipped:
+			summary.Skipped++
+		case fwatch.StatusFailed:
+			summary.Failed++
+		}
+	}
+	summary.Untouched = max(files-len(outcomes), 0)
+	return summary
+}
+
+// selectWatches returns the watches to process for the given directories:
+// the configured watch for each, or a recursive one with default settings
+func selectWatches(watches []fwatch.Watch, dirs []string) []fwatch.Watch {
+	var selected []fwatch.Watch
+	for _, dir := range dirs {
+		watch := fwatch.Watch{Path: filepath.Clean(dir)}
+		if info, err := os.Stat(dir); err != nil || info.IsDir() {
+			watch.Recursive = true
+		}
+		for _, w := range watches {
+			if samePath(w.Path, watch.Path) {
+				watch = w
+				break
+			}
+		}
+		selected = append(selected, watch)
+	}
+	return selected
+}
+
+// samePath reports whether two paths name the same directory, relative or
+// not
+func samePath(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// printRunOnce prints what a run did, with a row per rule that handled
+// anything
+func printRunOnce(summary *runOnceSummary) {
+	fmt.Printf("Found %d file(s) in %s: %d succeeded, %d skipped, %d failed, %d left alone\n",
+		summary.Files, summary.Duration.Round(time.Millisecond), summary.Succeeded, summary.Skipped, summary.Failed, summary.Untouched)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := false
+	for _, rule := range summary.Rules {
+		if rule.Succeeded+rule.Skipped+rule.Failed == 0 {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "\nRULE\tSUCCEEDED\tSKIPPED\tFAILED")
+			header = true
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", rule.Name, rule.Succeeded, rule.Skipped, rule.Failed)
+	}
+	w.Flush()
+
+	if len(summary.Errors) > 0 {
+		fmt.Println("\nErrors:")
+		for _, e := range summary.Errors {
+			fmt.Printf("  %s (rule %s): %s\n", e.File, e.Rule, e.Error)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// sandboxControlEnv names the descriptor of the control socket listener a
+// sandboxed fwatch inherits, since it can't create the socket itself
+const sandboxControlEnv = "FWATCH_CONTROL_FD"
+
+// sandboxPaths is what the sandbox allows, once fwatch runs in it
+var sandboxPaths *fwatch.SandboxPaths
+
+// sandboxControl is the inherited control socket listener, if any
+var sandboxControl net.Listener
+
+// sandboxFiles are what fwatch writes besides the paths in its config.
+// Only the files themselves are allowed, not the directories they are in.
+type sandboxFiles struct {
+	logFile string
+	// logBackups is set when rotation renames the log file, which needs
+	// its directory
+	logBackups    bool
+	pidFile       string
+	controlSocket string
+}
+
+// sandbox confines fwatch to what config needs, plus the config file and
+// files, by re-executing it in the sandbox. In the re-executed fwatch it
+// records what is allowed and returns.
+func sandbox(configPath string, config *fwatch.Config, files sandboxFiles) error {
+	// The sandboxed fwatch reads its config again, and stdin is used up
+	if configPath == fwatch.StdinConfig {
+		return fmt.Errorf("-sandbox needs a config file or %s and %s, not -config -", fwatch.WatchDirEnv, fwatch.RulesEnv)
+	}
+	paths := config.SandboxPaths()
+	if abs, err := filepath.Abs(configPath); err == nil {
+		paths.ReadOnly = append(paths.ReadOnly, filepath.Dir(abs))
+	}
+
+	if os.Getenv(fwatch.SandboxEnv) != "" {
+		sandboxPaths = &paths
+		if fd, err := strconv.Atoi(os.Getenv(sandboxControlEnv)); err == nil {
+			listener, err := net.FileListener(os.NewFile(uintptr(fd), files.controlSocket))
+			if err != nil {
+				return fmt.Errorf("inheriting control socket: %w", err)
+			}
+			sandboxControl = listener
+		}
+		slog.Info("Running in sandbox", "read_write", paths.ReadWrite)
+		return nil
+	}
+
+	for _, path := range []string{files.logFile, files.pidFile} {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		// A file can only be allowed once it exists
+		file, err := os.OpenFile(abs, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		paths.ReadWrite = append(paths.ReadWrite, abs)
+	}
+	if files.logFile != "" && files.logBackups {
+		dir, err := filepath.Abs(filepath.Dir(files.logFile))
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(dir); err == nil && info.Mode().Perm()&0002 != 0 {
+			return fmt.Errorf("log backups need the log file in a directory of its own, not %s", dir)
+		}
+		paths.ReadWrite = append(paths.ReadWrite, dir)
+	}
+
+	if files.controlSocket != "" {
+		if listener, err := listenControl(files.controlSocket); err != nil {
+			slog.Warn("Control socket disabled", "socket", files.controlSocket, "error", err)
+		} else {
+			file, err := listener.(*net.UnixListener).File()
+			if err != nil {
+				return fmt.Errorf("passing control socket: %w", err)
+			}
+			paths.Inherit = append(paths.Inherit, file)
+			os.Setenv(sandboxControlEnv, strconv.Itoa(int(file.Fd())))
+		}
+	}
+	return fwatch.Sandbox(paths)
+}
+
+// controlListener returns the listener for the control socket at path: the
+// one a sandboxed fwatch inherited, which is nil if the socket couldn't be
+// created, or a new one
+func controlListener(path string) (net.Listener, error) {
+	if sandboxPaths != nil {
+		return sandboxControl, nil
+	}
+	return listenControl(path)
+}
+
+// removePIDFile removes the PID file when fwatch stops. The sandbox can't
+// remove files beside it, so there it is emptied instead.
+func removePIDFile(path string) error {
+	if sandboxPaths != nil {
+		return os.Truncate(path, 0)
+	}
+	return os.Remove(path)
+}
+
+// warnOutsideSandbox logs the paths a reloaded config needs that the
+// sandbox doesn't allow, since it can't be widened while fwatch runs
+func warnOutsideSandbox(config *fwatch.Config) {
+	if sandboxPaths == nil {
+		return
+	}
+	for _, path := range config.SandboxPaths().ReadWrite {
+		if !withinAny(path, sandboxPaths.ReadWrite) {
+			slog.Warn("Path is outside the sandbox and can't be accessed until fwatch restarts", "path", path)
+		}
+	}
+}
+
+// withinAny reports whether path is one of dirs or below one
+func withinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// pauseOnSignal pauses all watches on SIGUSR1 and resumes them on SIGUSR2
+// until ctx is cancelled
+func pauseOnSignal(ctx context.Context, engine *fwatch.Engine) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			var err error
+			if sig == syscall.SIGUSR1 {
+				slog.Info("Received SIGUSR1, pausing all watches")
+				err = engine.Pause()
+			} else {
+				slog.Info("Received SIGUSR2, resuming all watches")
+				err = engine.Resume()
+			}
+			if err != nil {
+				slog.Error("Failed to handle signal", "signal", sig, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"context"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// pauseOnSignal does nothing on Windows, which has no SIGUSR1 or SIGUSR2;
+// use "fwatch ctl pause" and "fwatch ctl resume" instead
+func pauseOnSignal(ctx context.Context, engine *fwatch.Engine) {}
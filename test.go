@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runTest implements "fwatch test": it shows which rule matches each given
+// file and what would happen to it, without touching anything, and
+// returns the exit code
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	profile := profileFlag(fs)
+	overrides := addConfigFlags(fs)
+	all := fs.Bool("all", false, "Arguments are directories; test every file in them")
+	asJSON := fs.Bool("json", false, "Print one JSON record per file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch test [flags] <file...>\n       fwatch test [flags] -all <dir...>\n\nShow which rule matches each file, where it would go and how a conflict\nwould be resolved, without performing any action.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	selectProfile(*profile)
+	if err := overrides.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	paths := fs.Args()
+	if *all {
+		paths = nil
+		for _, dir := range fs.Args() {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", dir, err)
+				return 1
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					paths = append(paths, filepath.Join(dir, entry.Name()))
+				}
+			}
+		}
+	}
+
+	status := 0
+	enc := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !*asJSON {
+		fmt.Fprintln(w, "FILE\tRULE\tRESULT")
+	}
+	for _, path := range paths {
+		x, err := config.Explain(path)
+		if err != nil {
+			// Print the table so far so the error shows up after it
+			w.Flush()
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		if *asJSON {
+			enc.Encode(x)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", path, cmp.Or(x.Rule, "-"), describeExplanation(x))
+		printSteps(w, x)
+		// Rules reached through continue get a row each, under the file
+		for next := x.Next; next != nil; next = next.Next {
+			fmt.Fprintf(w, "\t%s\t%s\n", next.Rule, describeExplanation(next))
+			printSteps(w, next)
+		}
+	}
+	w.Flush()
+	return status
+}
+
+// describeExplanation summarizes what would happen to a file
+func describeExplanation(x *fwatch.Explanation) string {
+	var parts []string
+	switch {
+	case x.Ignored:
+		return "ignored"
+	case x.Rule == "":
+		return "no rule matches"
+	case x.Action == fwatch.ActionPipeline:
+		parts = append(parts, "pipeline")
+	case x.Action == fwatch.ActionChecksum:
+		parts = append(parts, "checksum")
+	case x.Command != nil:
+		parts = append(parts, "exec: "+strings.Join(x.Command, " "))
+	case x.Action == fwatch.ActionDelete && x.Trash:
+		parts = append(parts, "delete to trash")
+	case x.Action == fwatch.ActionDelete:
+		parts = append(parts, "delete")
+	case x.Skipped:
+		parts = append(parts, fmt.Sprintf("%s: skipped, %s", x.Action, x.Conflict))
+	default:
+		parts = append(parts, fmt.Sprintf("%s → %s", x.Action, x.DestPath))
+		if x.Conflict != "" {
+			parts = append(parts, x.Conflict)
+		}
+	}
+	if !x.OpensAt.IsZero() {
+		parts = append(parts, "deferred until "+x.OpensAt.Local().Format(time.DateTime))
+	}
+	if x.Watch == "" {
+		parts = append(parts, "not in a watch directory")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// printSteps prints a row for each step of a pipeline
+func printSteps(w io.Writer, x *fwatch.Explanation) {
+	for i, step := range x.Steps {
+		fmt.Fprintf(w, "\t\t%d. %s\n", i+1, describeExplanation(step))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// uiPage is the dashboard, which polls GET /status and posts to the
+// control endpoints
+//
+//go:embed ui.html
+var uiPage []byte
+
+// uiTokenCookie carries the dashboard token for the browser once the page
+// was opened with it
+const uiTokenCookie = "fwatch_token"
+
+// serveUI serves the web dashboard and the control API on addr until ctx
+// is cancelled. Actions are refused to requests from other origins, so
+// that a web page can't pause fwatch through the browser of someone who
+// can reach the dashboard, and requests for other host names, so that a
+// site rebinding its name to the dashboard's address can't either. With a
+// token, every request must carry it.
+func serveUI(ctx context.Context, addr, token string, control http.Handler) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Warn("Dashboard disabled", "addr", addr, "error", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", control)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+		w.Write(uiPage)
+	})
+
+	host, _, _ := net.SplitHostPort(addr)
+	guard := &uiGuard{host: host, token: token, next: mux}
+	slog.Info("Serving dashboard", "url", "http://"+listener.Addr().String()+"/", "token", token != "")
+	if err := serveHTTP(ctx, listener, http.NewCrossOriginProtection().Handler(guard)); err != nil {
+		slog.Error("Dashboard failed", "addr", addr, "error", err)
+	}
+}
+
+// uiGuard checks the host name and token of dashboard requests before
+// passing them on
+type uiGuard struct {
+	host  string // the host of the listen address
+	token string // "" for none
+	next  http.Handler
+}
+
+func (g *uiGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.allowedHost(r.Host) {
+		http.Error(w, "unknown host "+r.Host, http.StatusForbidden)
+		return
+	}
+	if g.token == "" {
+		g.next.ServeHTTP(w, r)
+		return
+	}
+
+	// Opening the page with ?token= keeps the token in a cookie, so the
+	// page's own requests carry it
+	if token := r.URL.Query().Get("token"); token != "" && r.Method == http.MethodGet && r.URL.Path == "/" {
+		if !g.validToken(token) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: uiTokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if cookie, err := r.Cookie(uiTokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if !g.validToken(token) {
+		http.Error(w, "token required: open the dashboard with ?token=, or send Authorization: Bearer", http.StatusUnauthorized)
+		return
+	}
+	g.next.ServeHTTP(w, r)
+}
+
+// validToken compares token with the dashboard's in constant time
+func (g *uiGuard) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) == 1
+}
+
+// allowedHost reports whether a request's Host header names the dashboard.
+// IP addresses and loopback names can't be rebound by another site; other
+// names only if the dashboard listens on that very name.
+func (g *uiGuard) allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	switch {
+	case host == "":
+		return false
+	case net.ParseIP(host) != nil, isLoopbackName(host):
+		return true
+	}
+	return g.host != "" && strings.EqualFold(host, strings.TrimSuffix(g.host, "."))
+}
+
+// isLoopbackName reports whether host is localhost or a name below it
+func isLoopbackName(host string) bool {
+	host = strings.ToLower(host)
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// uiToken returns the token the dashboard on addr requires, read from
+// tokenFile. A dashboard reachable from other machines must have one.
+func uiToken(addr, tokenFile string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid -ui-addr: %w", err)
+	}
+	if tokenFile == "" {
+		if ip := net.ParseIP(host); isLoopbackName(host) || ip != nil && ip.IsLoopback() {
+			return "", nil
+		}
+		return "", fmt.Errorf("-ui-addr %s is reachable from other machines and needs -ui-token-file", addr)
+	}
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading -ui-token-file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("-ui-token-file is empty")
+	}
+	return token, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUIGuardHosts(t *testing.T) {
+	guard := &uiGuard{host: "nas.home", next: http.NotFoundHandler()}
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"192.168.1.5:8080", true},
+		{"localhost:8080", true},
+		{"app.localhost:8080", true},
+		{"nas.home:8080", true},
+		{"NAS.home.:8080", true},
+		{"attacker.example:8080", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		guard.ServeHTTP(w, r)
+		if allowed := w.Code != http.StatusForbidden; allowed != tt.allowed {
+			t.Errorf("Host %q: status %d, want allowed %t", tt.host, w.Code, tt.allowed)
+		}
+	}
+}
+
+func TestUIGuardToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	guard := &uiGuard{token: "secret", next: ok}
+	request := func(target string, header http.Header, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Host = "127.0.0.1:8080"
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		guard.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("/status", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status %d, want 401", w.Code)
+	}
+	if w := request("/status", http.Header{"Authorization": {"Bearer wrong"}}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want 401", w.Code)
+	}
+	if w := request("/status", http.Header{"Authorization": {"Bearer secret"}}, nil); w.Code != http.StatusOK {
+		t.Errorf("bearer token: status %d, want 200", w.Code)
+	}
+	if w := request("/?token=wrong", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("page with wrong token: status %d, want 401", w.Code)
+	}
+
+	// Opening the page with the token sets the cookie the page then sends
+	w := request("/?token=secret", nil, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("page with token: status %d, want a redirect", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != uiTokenCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v, want the token cookie", cookies)
+	}
+	if w := request("/status", nil, cookies[0]); w.Code != http.StatusOK {
+		t.Errorf("token cookie: status %d, want 200", w.Code)
+	}
+}
+
+func TestUIToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("secret\n"), 0o600)
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(emptyFile, nil, 0o600)
+
+	tests := []struct {
+		addr, file string
+		token      string
+		valid      bool
+	}{
+		{"", "", "", true},
+		{"127.0.0.1:8080", "", "", true},
+		{"[::1]:8080", "", "", true},
+		{"localhost:8080", "", "", true},
+		{":8080", "", "", false},
+		{"0.0.0.0:8080", "", "", false},
+		{"192.168.1.5:8080", "", "", false},
+		{"nas.home:8080", "", "", false},
+		{":8080", tokenFile, "secret", true},
+		{"127.0.0.1:8080", tokenFile, "secret", true},
+		{":8080", emptyFile, "", false},
+		{":8080", filepath.Join(t.TempDir(), "missing"), "", false},
+	}
+	for _, tt := range tests {
+		token, err := uiToken(tt.addr, tt.file)
+		if (err == nil) != tt.valid || token != tt.token {
+			t.Errorf("uiToken(%q, %q) = %q, %v", tt.addr, tt.file, token, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runUndo implements "fwatch undo": it moves recently routed files back to
+// where they came from, newest first, and returns the exit code
+func runUndo(args []string) int {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	last := fs.Int("last", 0, "Undo the last N moves (default 1 unless -since is given)")
+	since := fs.String("since", "", "Undo moves made within this duration (e.g. 1h)")
+	rule := fs.String("rule", "", "Only undo moves made by this rule")
+	force := fs.Bool("force", false, "Restore files even if they changed since they were moved")
+	dryRun := fs.Bool("dry-run", false, "Show what would be restored without moving anything")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch undo [-last N | -since duration] [flags]\n\nMove files back to the paths they were moved from, using the history database.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := fwatch.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	if config.HistoryDB == "" {
+		fmt.Fprintf(os.Stderr, "%s: history is not enabled (set history_db)\n", *configPath)
+		return 1
+	}
+
+	filter := fwatch.HistoryFilter{Rule: *rule}
+	if *since != "" {
+		d, err := fwatch.ParseDuration(*since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -since: %v\n", err)
+			return 2
+		}
+		filter.Since = time.Now().Add(-time.Duration(d))
+	} else if *last == 0 {
+		*last = 1
+	}
+
+	history, err := fwatch.OpenHistory(config.HistoryDB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.HistoryDB, err)
+		return 1
+	}
+	records, err := history.Query(filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.HistoryDB, err)
+		return 1
+	}
+
+	// Newest first, so a file moved more than once is walked back in order
+	records = slices.DeleteFunc(records, func(rec fwatch.HistoryRecord) bool { return !rec.Undoable() })
+	slices.Reverse(records)
+	if *last > 0 && len(records) > *last {
+		records = records[:*last]
+	}
+	if len(records) == 0 {
+		fmt.Println("Nothing to undo")
+		return 0
+	}
+
+	failed := 0
+	for _, rec := range records {
+		if *dryRun {
+			fmt.Printf("would restore %s → %s\n", rec.Destination, rec.Source)
+			continue
+		}
+		if err := history.Undo(&rec, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rec.Destination, err)
+			failed++
+			continue
+		}
+		fmt.Printf("restored %s → %s\n", rec.Destination, rec.Source)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d file(s) not restored\n", failed, len(records))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/polarn/fwatch/pkg/fwatch"
+)
+
+// runValidate implements "fwatch validate": it checks the configuration
+// thoroughly, prints every problem found and returns the exit code
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", getDefaultConfigPath(), "Path to configuration file")
+	profile := profileFlag(fs)
+	overrides := addConfigFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fwatch validate [-config path] [-profile names]\n\nCheck a configuration file without starting fwatch.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	selectProfile(*profile)
+	if err := overrides.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "fwatch: %v\n", err)
+		return 1
+	}
+
+	config, err := fwatch.LoadConfigStrict(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	problems := config.Check()
+	errors := 0
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", *configPath, problem)
+		if problem.Severity == fwatch.SeverityError {
+			errors++
+		}
+	}
+
+	if errors > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", *configPath, errors, len(problems)-errors)
+		return 1
+	}
+	if config.Profile != "" {
+		fmt.Printf("%s: OK (%d rule(s) with profile %s, %d warning(s))\n", *configPath, len(config.Rules), config.Profile, len(problems))
+		return 0
+	}
+	fmt.Printf("%s: OK (%d rule(s), %d warning(s))\n", *configPath, len(config.Rules), len(problems))
+	return 0
+}